@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// hints suggest what to do about each error code the server sends.
+var hints = map[string]string{
+	"not_found":             "check the file ID or path; the file must be yours or shared with you",
+	"forbidden":             "you may not do this; ask the file's owner",
+	"conflict":              "the path is taken or the upload is out of step; choose another path or start the upload again",
+	"invalid_argument":      "check the command's arguments",
+	"rate_limited":          "too many requests; wait a moment and try again",
+	"expired":               "the link has expired; ask for a new one",
+	"range_not_satisfiable": "the link's range lies past the end of the file",
+	"too_large":             "the file exceeds the server's upload limit",
+	"quota_exceeded":        "your storage quota is used up; delete files or old versions, or ask the operator for more",
+	"key_unavailable":       "the server cannot reach its key service; try again later",
+	"integrity_failure":     "the stored file failed its integrity check; report the request ID to the operator",
+	"internal":              "the server failed; report the request ID to the operator",
+}
+
+// apiError is a failed response: the server's JSON error body, or the raw
+// body from anything that does not send one.
+type apiError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId"`
+}
+
+func readAPIError(resp *http.Response) *apiError {
+	body, _ := io.ReadAll(resp.Body)
+	e := &apiError{Status: resp.StatusCode}
+	if json.Unmarshal(body, e) != nil || e.Code == "" {
+		e.Code, e.Message = "", strings.TrimSpace(string(body))
+	}
+	return e
+}
+
+// Error describes the failure with a hint on what to do about it.
+func (e *apiError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("(%d) %s", e.Status, e.Message)
+	}
+	msg := e.Message
+	if hint, ok := hints[e.Code]; ok {
+		msg += "\n  " + hint
+	}
+	if e.RequestID != "" {
+		msg += "\n  request ID: " + e.RequestID
+	}
+	return msg
+}
+
+// fail reports a failed HTTP response for op and exits.
+func fail(op string, resp *http.Response) {
+	fmt.Fprintf(os.Stderr, "%s failed: %v\n", op, readAPIError(resp))
+	os.Exit(1)
+}
+
+// grpcCodes names the HTTP error code matching each gRPC status.
+var grpcCodes = map[codes.Code]string{
+	codes.NotFound:           "not_found",
+	codes.PermissionDenied:   "forbidden",
+	codes.AlreadyExists:      "conflict",
+	codes.FailedPrecondition: "conflict",
+	codes.InvalidArgument:    "invalid_argument",
+	codes.ResourceExhausted:  "rate_limited",
+	codes.DataLoss:           "integrity_failure",
+	codes.Internal:           "internal",
+}
+
+// mustRPC reports a failed gRPC call for op and exits.
+func mustRPC(op string, err error) {
+	if err == nil {
+		return
+	}
+	st, ok := status.FromError(err)
+	if !ok {
+		must(err)
+	}
+	fmt.Fprintf(os.Stderr, "%s failed: %s\n", op, st.Message())
+	code := grpcCodes[st.Code()]
+	if st.Code() == codes.ResourceExhausted && strings.Contains(st.Message(), "quota exceeded") {
+		code = "quota_exceeded"
+	}
+	if hint, ok := hints[code]; ok {
+		fmt.Fprintf(os.Stderr, "  %s\n", hint)
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi/dsdepb"
+)
+
+// uploadChunk is the size of each streamed upload message.
+const uploadChunk = 64 << 10
+
+// grpcClient connects to the gRPC API and returns a context acting as user.
+func grpcClient(user string) (dsdepb.DSDEClient, context.Context) {
+	creds := insecure.NewCredentials()
+	if clientTLS != nil {
+		creds = credentials.NewTLS(clientTLS)
+	}
+	conn, err := grpc.NewClient(*grpcAddr, grpc.WithTransportCredentials(creds))
+	must(err)
+	ctx := context.Background()
+	if user != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, grpcapi.OwnerKey, user)
+	}
+	return dsdepb.NewDSDEClient(conn), ctx
+}
+
+func grpcUpload(user, filename string, r io.Reader) map[string]string {
+	c, ctx := grpcClient(user)
+	stream, err := c.Upload(ctx)
+	must(err)
+	hdr := &dsdepb.UploadHeader{Path: filename, StorageMode: *storeMode, Codec: *codecName}
+	must(stream.Send(&dsdepb.UploadRequest{Msg: &dsdepb.UploadRequest_Header{Header: hdr}}))
+
+	buf := make([]byte, uploadChunk)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			must(stream.Send(&dsdepb.UploadRequest{Msg: &dsdepb.UploadRequest_Data{Data: buf[:n]}}))
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		must(err)
+	}
+	resp, err := stream.CloseAndRecv()
+	mustRPC("upload", err)
+	return map[string]string{
+		"fileID":    resp.FileId,
+		"feaHash":   fmt.Sprintf("%x", resp.FeaHash),
+		"dekShared": fmt.Sprintf("%x", resp.DekShared),
+		"dekUser":   fmt.Sprintf("%x", resp.DekUser),
+	}
+}
+
+// grpcDownload writes a file, by ID or by path and version, to outpath.
+func grpcDownload(user, fileID, path string, version int, outpath string) {
+	c, ctx := grpcClient(user)
+	req := &dsdepb.DownloadRequest{Version: int32(version)}
+	if fileID != "" {
+		req.Target = &dsdepb.DownloadRequest_FileId{FileId: fileID}
+	} else {
+		req.Target = &dsdepb.DownloadRequest_Path{Path: path}
+	}
+	stream, err := c.Download(ctx, req)
+	mustRPC("download", err)
+
+	// the first message carries any error, before outpath is created
+	msg, err := stream.Recv()
+	if err != io.EOF {
+		mustRPC("download", err)
+	}
+	outF, err := os.Create(outpath)
+	must(err)
+	defer outF.Close()
+	for msg != nil {
+		_, err = outF.Write(msg.Data)
+		must(err)
+		if msg, err = stream.Recv(); err == io.EOF {
+			break
+		}
+		mustRPC("download", err)
+	}
+}
+
+func grpcList(user, path string) []treeEntry {
+	c, ctx := grpcClient(user)
+	resp, err := c.List(ctx, &dsdepb.ListRequest{Path: path, Recursive: true})
+	mustRPC("tree", err)
+	entries := make([]treeEntry, len(resp.Entries))
+	for i, e := range resp.Entries {
+		entries[i] = treeEntry{Path: e.Path, Folder: e.Folder, Version: int(e.Version)}
+	}
+	return entries
+}
+
+func grpcRemove(user, path string) {
+	c, ctx := grpcClient(user)
+	_, err := c.Delete(ctx, &dsdepb.DeleteRequest{Path: path})
+	mustRPC("rm", err)
+}
+
+func grpcStats() map[string]int64 {
+	c, ctx := grpcClient("")
+	if token := os.Getenv("DSDE_ADMIN_TOKEN"); token != "" {
+		ctx = metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+	}
+	resp, err := c.Stats(ctx, &dsdepb.StatsRequest{})
+	mustRPC("stats", err)
+	return map[string]int64{
+		"files":        resp.Files,
+		"owners":       resp.Owners,
+		"features":     resp.Features,
+		"chunks":       resp.Chunks,
+		"commonChunks": resp.CommonChunks,
+	}
+}
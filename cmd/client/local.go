@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+)
+
+// localUpload runs FG, PG and both encryption layers on this machine and sends
+// the server only ciphertext: d when the server does not already hold it (a
+// proof of ownership over d otherwise) and the sBlob.
+func localUpload(user, filename string, data []byte) map[string]string {
+	body, err := json.Marshal(map[string]string{
+		"feaHash": fmt.Sprintf("%x", dedupTag(user, data)),
+	})
+	must(err)
+	req, err := http.NewRequest("POST", *serverAddr+"/cs/uploads", bytes.NewReader(body))
+	must(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Owner-ID", user)
+	req.Header.Set("X-Filename", filename)
+	var keys dsde.ClientKeys
+	if code, err := doJSON(req, &keys); code != 200 {
+		must(fmt.Errorf("begin upload failed: %w", err))
+	}
+
+	// The feature above covers the raw content; what is sealed is compressed.
+	want := keys.Codec
+	if *codecName != "" {
+		c, err := codec.Parse(*codecName)
+		must(err)
+		want = c
+	}
+	stored, used, err := codec.Choose(want, data)
+	must(err)
+
+	base := "/cs/uploads/" + keys.FileID
+	var out map[string]string
+	if keys.Private {
+		// Not yet popular: the whole file goes up under the user DEK, no d.
+		blob, err := dsde.SealPrivate(keys.Params, keys.UserKey, keys.FileID, stored)
+		must(err)
+		commit := map[string]any{"pkg2Len": 0, "codec": used, "size": len(data), "sBlob": blob}
+		if code, err := postJSON(user, base+"/commit", commit, &out); code != 200 {
+			must(fmt.Errorf("commit failed: %w", err))
+		}
+		return out
+	}
+
+	d, sBlob, pkg2Len, err := dsde.Seal(keys.Params, keys.SharedKey, keys.UserKey, keys.FeaHash, keys.FileID, stored)
+	must(err)
+
+	var dec dsde.DDecision
+	if code, err := postJSON(user, base+"/check", map[string]string{"dHash": fmt.Sprintf("%x", sha256.Sum256(d))}, &dec); code != 200 {
+		must(fmt.Errorf("dedup check failed: %w", err))
+	}
+
+	var proofs []pow.Proof
+	if dec.NeedD {
+		req, err := http.NewRequest("PUT", *serverAddr+base+"/d", bytes.NewReader(d))
+		must(err)
+		req.Header.Set("X-Owner-ID", user)
+		resp, err := http.DefaultClient.Do(req)
+		must(err)
+		if resp.StatusCode != http.StatusNoContent {
+			fail("d upload", resp)
+		}
+		resp.Body.Close()
+	} else if dec.Challenge != nil {
+		tree := pow.Build(d)
+		for _, i := range dec.Challenge.Indices {
+			p, err := tree.Prove(d, i)
+			must(err)
+			proofs = append(proofs, p)
+		}
+	}
+
+	commit := map[string]any{"pkg2Len": pkg2Len, "codec": used, "size": len(data), "sBlob": sBlob, "proofs": proofs}
+	if code, err := postJSON(user, base+"/commit", commit, &out); code != 200 {
+		must(fmt.Errorf("commit failed: %w", err))
+	}
+	return out
+}
+
+// localDownload fetches a file's keys and ciphertext and opens it locally.
+func localDownload(user, fileID string) []byte {
+	var keys dsde.ClientKeys
+	if code, err := getJSON(user, "/cs/files/"+fileID, &keys); code != 200 {
+		must(fmt.Errorf("fetch keys failed: %w", err))
+	}
+
+	if keys.Private {
+		rc := getBlob(user, fileID, 0)
+		defer rc.Close()
+		data, err := dsde.OpenPrivate(keys.Params, keys.UserKey, fileID, rc)
+		must(err)
+		data, err = codec.Decompress(keys.Codec, data, keys.Size)
+		must(err)
+		return data
+	}
+
+	dRc := getBlob(user, fileID, 0)
+	d, err := io.ReadAll(dRc)
+	dRc.Close()
+	must(err)
+
+	sRc := getBlob(user, fileID, 1)
+	defer sRc.Close()
+	data, err := dsde.Open(keys.Params, keys.SharedKey, keys.UserKey, keys.FeaHash, fileID, keys.Pkg2Len, d, sRc)
+	must(err)
+	data, err = codec.Decompress(keys.Codec, data, keys.Size)
+	must(err)
+	return data
+}
+
+func getJSON(user, path string, out any) (int, error) {
+	req, err := http.NewRequest("GET", *serverAddr+path, nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	return doJSON(req, out)
+}
+
+// getBlob streams the raw ciphertext of chunk seq of fileID.
+func getBlob(user, fileID string, seq int) io.ReadCloser {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/cs/files/%s/blobs/%d", *serverAddr, fileID, seq), nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	if resp.StatusCode != 200 {
+		fail(fmt.Sprintf("fetch blob %d", seq), resp)
+	}
+	return resp.Body
+}
@@ -1,17 +1,34 @@
 package main
 
 import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"flag"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/split"
 )
 
 var (
 	serverAddr = flag.String("addr", "http://localhost:8080", "DSDE server address")
+	tryPoW     = flag.Bool("pow", false, "try proof-of-ownership dedup before uploading the file")
+	localMode  = flag.Bool("local", false, "seal and open files on this machine so the server never sees plaintext")
+	storeMode  = flag.String("mode", "", "storage mode for uploads: dsde or chunks (default: the server's)")
+	codecName  = flag.String("codec", "", "compression for uploads: none, gzip or zstd (default: the server's)")
+	transport  = flag.String("transport", "http", "API for upload, download, get, tree, rm and stats: http or grpc")
+	grpcAddr   = flag.String("grpc-addr", "localhost:9090", "DSDE gRPC server address")
 )
 
 func must(err error) {
@@ -22,32 +39,176 @@ func must(err error) {
 }
 
 func upload(user, path string) {
+	if *localMode {
+		data, err := os.ReadFile(path)
+		must(err)
+		printJSON(localUpload(user, filepath.Base(path), data))
+		return
+	}
+	if *tryPoW {
+		data, err := os.ReadFile(path)
+		must(err)
+		if out, ok := dedupUpload(user, filepath.Base(path), data); ok {
+			printJSON(out)
+			return
+		}
+	}
+
 	f, err := os.Open(path)
 	must(err)
 	defer f.Close()
 
+	if *transport == "grpc" {
+		printJSON(grpcUpload(user, filepath.Base(path), f))
+		return
+	}
+
 	req, err := http.NewRequest("POST", *serverAddr+"/files", f)
 	must(err)
 	req.Header.Set("X-Owner-ID", user)
 	req.Header.Set("X-Filename", filepath.Base(path))
+	if *storeMode != "" {
+		req.Header.Set("X-Storage-Mode", *storeMode)
+	}
+	if *codecName != "" {
+		req.Header.Set("X-Codec", *codecName)
+	}
 
 	resp, err := http.DefaultClient.Do(req)
 	must(err)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Fprintf(os.Stderr, "upload failed (%d): %s\n", resp.StatusCode, body)
-		os.Exit(1)
+		fail("upload", resp)
 	}
 
 	var out map[string]string
 	must(json.NewDecoder(resp.Body).Decode(&out))
-	pretty, _ := json.MarshalIndent(out, "", "  ")
+	printJSON(out)
+}
+
+func printJSON(v any) {
+	pretty, _ := json.MarshalIndent(v, "", "  ")
 	fmt.Println(string(pretty))
 }
 
+// dedupTag computes the content's dedup tag: the raw feature, or its key-server
+// evaluation when the server runs one.
+func dedupTag(user string, data []byte) []byte {
+	fea, err := split.NewDefaultFG().Feature(bytes.NewReader(data))
+	must(err)
+
+	resp, err := http.Get(*serverAddr + "/keyserver/public-key")
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return fea
+	}
+	if resp.StatusCode != 200 {
+		fail("key server", resp)
+	}
+	raw, err := io.ReadAll(resp.Body)
+	must(err)
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		must(fmt.Errorf("key server returned no PEM key"))
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	must(err)
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		must(fmt.Errorf("key server key is not RSA"))
+	}
+
+	blinded, st, err := keyserver.Blind(pub, fea)
+	must(err)
+	var evalResp struct {
+		Evaluated []byte `json:"evaluated"`
+	}
+	if code, err := postJSON(user, "/keyserver/evaluate", map[string][]byte{"blinded": blinded}, &evalResp); code != 200 {
+		must(fmt.Errorf("key server evaluate failed: %w", err))
+	}
+	tag, err := keyserver.Finalize(pub, st, evalResp.Evaluated)
+	must(err)
+	return tag
+}
+
+// postJSON sends body as JSON and decodes a 200 response into out. For any
+// other response it returns the status code, and for an error status the
+// server's explanation.
+func postJSON(user, path string, body, out any) (int, error) {
+	buf, err := json.Marshal(body)
+	must(err)
+	req, err := http.NewRequest("POST", *serverAddr+path, bytes.NewReader(buf))
+	must(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Owner-ID", user)
+	return doJSON(req, out)
+}
+
+func doJSON(req *http.Request, out any) (int, error) {
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, readAPIError(resp)
+	}
+	if resp.StatusCode != 200 || out == nil {
+		return resp.StatusCode, nil
+	}
+	must(json.NewDecoder(resp.Body).Decode(out))
+	return resp.StatusCode, nil
+}
+
+// dedupUpload claims content the server already stores by answering a
+// proof-of-ownership challenge. It reports false when a full upload is needed.
+func dedupUpload(user, filename string, data []byte) (map[string]string, bool) {
+	body := map[string]any{
+		"feaHash": fmt.Sprintf("%x", dedupTag(user, data)),
+		"size":    len(data),
+	}
+	buf, err := json.Marshal(body)
+	must(err)
+	req, err := http.NewRequest("POST", *serverAddr+"/files/dedup", bytes.NewReader(buf))
+	must(err)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Owner-ID", user)
+	req.Header.Set("X-Filename", filename)
+
+	var ch struct {
+		ID      string `json:"challengeID"`
+		Indices []int  `json:"indices"`
+	}
+	if code, _ := doJSON(req, &ch); code != 200 {
+		return nil, false
+	}
+
+	tree := pow.Build(data)
+	proofs := make([]pow.Proof, 0, len(ch.Indices))
+	for _, i := range ch.Indices {
+		p, err := tree.Prove(data, i)
+		must(err)
+		proofs = append(proofs, p)
+	}
+	var out map[string]string
+	if code, err := postJSON(user, "/files/dedup/"+ch.ID, map[string]any{"proofs": proofs}, &out); code != 200 {
+		fmt.Fprintf(os.Stderr, "proof of ownership failed: %v\nuploading in full\n", err)
+		return nil, false
+	}
+	return out, true
+}
+
 func download(user, fileID, outpath string) {
+	if *localMode {
+		must(os.WriteFile(outpath, localDownload(user, fileID), 0o644))
+		fmt.Println("wrote", outpath)
+		return
+	}
+	if *transport == "grpc" {
+		grpcDownload(user, fileID, "", 0, outpath)
+		fmt.Println("wrote", outpath)
+		return
+	}
 	req, err := http.NewRequest("GET", *serverAddr+"/files/"+fileID, nil)
 	must(err)
 	req.Header.Set("X-Owner-ID", user)
@@ -57,9 +218,7 @@ func download(user, fileID, outpath string) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Fprintf(os.Stderr, "download failed (%d): %s\n", resp.StatusCode, body)
-		os.Exit(1)
+		fail("download", resp)
 	}
 
 	outF, err := os.Create(outpath)
@@ -71,15 +230,235 @@ func download(user, fileID, outpath string) {
 	fmt.Println("wrote", outpath)
 }
 
+// getPath downloads version of user's path (0: the newest) to outpath.
+func getPath(user, path, version, outpath string) {
+	if *transport == "grpc" {
+		n := 0
+		if version != "" {
+			var err error
+			n, err = strconv.Atoi(version)
+			must(err)
+		}
+		grpcDownload(user, "", path, n, outpath)
+		fmt.Println("wrote", outpath)
+		return
+	}
+	u := *serverAddr + "/files/path/" + path
+	if version != "" {
+		u += "?version=" + version
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		fail("get", resp)
+	}
+	outF, err := os.Create(outpath)
+	must(err)
+	defer outF.Close()
+	_, err = io.Copy(outF, resp.Body)
+	must(err)
+	fmt.Println("wrote", outpath, "from file", resp.Header.Get("X-File-ID"))
+}
+
+// versions lists the versions of user's path.
+func versions(user, path string) {
+	req, err := http.NewRequest("GET", *serverAddr+"/files/versions/"+path, nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	var out []map[string]any
+	if code, err := doJSON(req, &out); code != 200 {
+		must(fmt.Errorf("versions failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// restore makes an old version of user's path the newest one.
+func restore(user, path, version string) {
+	n, err := strconv.Atoi(version)
+	must(err)
+	var out map[string]string
+	if code, err := postJSON(user, "/files/restore/"+path, map[string]int{"version": n}, &out); code != 200 {
+		must(fmt.Errorf("restore failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// fsOp runs a namespace operation on user's path.
+func fsOp(user, path string, query url.Values) {
+	req, err := http.NewRequest("POST", *serverAddr+"/fs/"+path+"?"+query.Encode(), nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail(fmt.Sprintf("%s", query.Get("op")), resp)
+	}
+}
+
+// treeEntry is a file or folder in a listing.
+type treeEntry struct {
+	Path    string `json:"path"`
+	Folder  bool   `json:"folder"`
+	Version int    `json:"version"`
+}
+
+// tree prints everything beneath user's folder path, indented by depth.
+func tree(user, path string) {
+	var entries []treeEntry
+	if *transport == "grpc" {
+		entries = grpcList(user, path)
+	} else {
+		req, err := http.NewRequest("GET", *serverAddr+"/fs/"+path+"?recursive=true", nil)
+		must(err)
+		req.Header.Set("X-Owner-ID", user)
+		if code, err := doJSON(req, &entries); code != 200 {
+			must(fmt.Errorf("tree failed: %w", err))
+		}
+	}
+	base := strings.Count(strings.Trim(path, "/"), "/") + 1
+	if strings.Trim(path, "/") == "" {
+		base = 0
+	}
+	for _, e := range entries {
+		depth := strings.Count(e.Path, "/") - base
+		name := e.Path[strings.LastIndex(e.Path, "/")+1:]
+		if e.Folder {
+			fmt.Printf("%s%s/\n", strings.Repeat("  ", depth), name)
+		} else {
+			fmt.Printf("%s%s (v%d)\n", strings.Repeat("  ", depth), name, e.Version)
+		}
+	}
+}
+
+// rm deletes user's file at path with all its versions, or an empty folder.
+func rm(user, path string) {
+	if *transport == "grpc" {
+		grpcRemove(user, path)
+		return
+	}
+	req, err := http.NewRequest("DELETE", *serverAddr+"/fs/"+path, nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail("rm", resp)
+	}
+}
+
+// stats prints the server's deduplication counters; it is an operator call,
+// authorised by $DSDE_ADMIN_TOKEN.
+func stats() {
+	if *transport == "grpc" {
+		printJSON(grpcStats())
+		return
+	}
+	req, err := http.NewRequest("GET", *serverAddr+"/stats", nil)
+	must(err)
+	if token := os.Getenv("DSDE_ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	var out map[string]int64
+	if code, err := doJSON(req, &out); code != 200 {
+		must(fmt.Errorf("stats failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// usage prints user's quota and how much of it they use.
+func usage(user string) {
+	req, err := http.NewRequest("GET", *serverAddr+"/usage", nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	var out map[string]any
+	if code, err := doJSON(req, &out); code != 200 {
+		must(fmt.Errorf("usage failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// copyFile asks the server to copy one of user's files, or one shared with
+// them, into user's namespace, optionally under a new name, without uploading
+// it again.
+func copyFile(user, fileID, filename string) {
+	var out map[string]string
+	body := map[string]string{"filename": filename}
+	if code, err := postJSON(user, "/files/"+fileID+"/copy", body, &out); code != 200 {
+		must(fmt.Errorf("copy failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// share grants grantee read access to one of user's files, for ttl (a Go
+// duration) or indefinitely if ttl is empty.
+func share(user, fileID, grantee, ttl string) {
+	body := map[string]string{"grantee": grantee, "expiresIn": ttl}
+	if code, err := postJSON(user, "/files/"+fileID+"/grants", body, nil); code != http.StatusNoContent {
+		must(fmt.Errorf("share failed: %w", err))
+	}
+	fmt.Println("shared", fileID, "with", grantee)
+}
+
+// unshare revokes grantee's access to one of user's files.
+func unshare(user, fileID, grantee string) {
+	req, err := http.NewRequest("DELETE", *serverAddr+"/files/"+fileID+"/grants/"+grantee, nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	resp, err := http.DefaultClient.Do(req)
+	must(err)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		fail("unshare", resp)
+	}
+	fmt.Println("unshared", fileID, "from", grantee)
+}
+
+// sharedWithMe lists the files other users share with user.
+func sharedWithMe(user string) {
+	req, err := http.NewRequest("GET", *serverAddr+"/shared", nil)
+	must(err)
+	req.Header.Set("X-Owner-ID", user)
+	var out []map[string]any
+	if code, err := doJSON(req, &out); code != 200 {
+		must(fmt.Errorf("shared-with-me failed: %w", err))
+	}
+	printJSON(out)
+}
+
+// link asks the server for a signed download URL to fileID, valid for ttl or
+// the server's maximum if ttl is empty.
+func link(user, fileID, ttl string) {
+	var out struct {
+		URL       string `json:"url"`
+		ExpiresAt string `json:"expiresAt"`
+	}
+	if code, err := postJSON(user, "/files/"+fileID+"/links", map[string]string{"expiresIn": ttl}, &out); code != 200 {
+		must(fmt.Errorf("link failed: %w", err))
+	}
+	fmt.Println(*serverAddr + out.URL)
+	fmt.Println("expires", out.ExpiresAt)
+}
+
+// s3List lists the bucket's keys. It is an admin call: it sends the token in
+// DSDE_ADMIN_TOKEN, or relies on the client certificate of an operator.
 func s3List() {
-	resp, err := http.Get(*serverAddr + "/admin/s3-list")
+	req, err := http.NewRequest("GET", *serverAddr+"/admin/s3-list", nil)
+	must(err)
+	if token := os.Getenv("DSDE_ADMIN_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
 	must(err)
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		body, _ := io.ReadAll(resp.Body)
-		fmt.Fprintf(os.Stderr, "s3-list failed (%d): %s\n", resp.StatusCode, body)
-		os.Exit(1)
+		fail("s3-list", resp)
 	}
 
 	var keys []string
@@ -91,8 +470,9 @@ func s3List() {
 
 func main() {
 	flag.Parse()
+	setupTLS()
 	if flag.NArg() < 1 {
-		fmt.Fprintf(os.Stderr, "usage: client <upload|download|s3-list> [args]\n")
+		fmt.Fprintf(os.Stderr, "usage: client <upload|download|get|versions|restore|mkdir|mv|tree|rm|stats|usage|copy|share|unshare|shared-with-me|link|s3-list> [args]\n")
 		os.Exit(1)
 	}
 
@@ -112,6 +492,100 @@ func main() {
 		}
 		download(flag.Arg(1), flag.Arg(2), flag.Arg(3))
 
+	case "get":
+		if flag.NArg() < 4 || flag.NArg() > 5 {
+			fmt.Fprintf(os.Stderr, "usage: client get <user> <path> <outpath> [version]\n")
+			os.Exit(1)
+		}
+		getPath(flag.Arg(1), flag.Arg(2), flag.Arg(4), flag.Arg(3))
+
+	case "versions":
+		if flag.NArg() != 3 {
+			fmt.Fprintf(os.Stderr, "usage: client versions <user> <path>\n")
+			os.Exit(1)
+		}
+		versions(flag.Arg(1), flag.Arg(2))
+
+	case "restore":
+		if flag.NArg() != 4 {
+			fmt.Fprintf(os.Stderr, "usage: client restore <user> <path> <version>\n")
+			os.Exit(1)
+		}
+		restore(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+
+	case "mkdir":
+		if flag.NArg() != 3 {
+			fmt.Fprintf(os.Stderr, "usage: client mkdir <user> <path>\n")
+			os.Exit(1)
+		}
+		fsOp(flag.Arg(1), flag.Arg(2), url.Values{"op": {"mkdir"}})
+
+	case "mv":
+		if flag.NArg() != 4 {
+			fmt.Fprintf(os.Stderr, "usage: client mv <user> <from> <to>\n")
+			os.Exit(1)
+		}
+		fsOp(flag.Arg(1), flag.Arg(2), url.Values{"op": {"move"}, "to": {flag.Arg(3)}})
+
+	case "tree":
+		if flag.NArg() < 2 || flag.NArg() > 3 {
+			fmt.Fprintf(os.Stderr, "usage: client tree <user> [path]\n")
+			os.Exit(1)
+		}
+		tree(flag.Arg(1), flag.Arg(2))
+
+	case "rm":
+		if flag.NArg() != 3 {
+			fmt.Fprintf(os.Stderr, "usage: client rm <user> <path>\n")
+			os.Exit(1)
+		}
+		rm(flag.Arg(1), flag.Arg(2))
+
+	case "stats":
+		stats()
+
+	case "usage":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "usage: client usage <user>\n")
+			os.Exit(1)
+		}
+		usage(flag.Arg(1))
+
+	case "copy":
+		if flag.NArg() < 3 || flag.NArg() > 4 {
+			fmt.Fprintf(os.Stderr, "usage: client copy <user> <fileID> [filename]\n")
+			os.Exit(1)
+		}
+		copyFile(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+
+	case "share":
+		if flag.NArg() < 4 || flag.NArg() > 5 {
+			fmt.Fprintf(os.Stderr, "usage: client share <user> <fileID> <grantee> [ttl]\n")
+			os.Exit(1)
+		}
+		share(flag.Arg(1), flag.Arg(2), flag.Arg(3), flag.Arg(4))
+
+	case "unshare":
+		if flag.NArg() != 4 {
+			fmt.Fprintf(os.Stderr, "usage: client unshare <user> <fileID> <grantee>\n")
+			os.Exit(1)
+		}
+		unshare(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+
+	case "shared-with-me":
+		if flag.NArg() != 2 {
+			fmt.Fprintf(os.Stderr, "usage: client shared-with-me <user>\n")
+			os.Exit(1)
+		}
+		sharedWithMe(flag.Arg(1))
+
+	case "link":
+		if flag.NArg() < 3 || flag.NArg() > 4 {
+			fmt.Fprintf(os.Stderr, "usage: client link <user> <fileID> [ttl]\n")
+			os.Exit(1)
+		}
+		link(flag.Arg(1), flag.Arg(2), flag.Arg(3))
+
 	case "s3-list":
 		s3List()
 
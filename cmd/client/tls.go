@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+var (
+	caCert     = flag.String("cacert", "", "PEM CA certificates to trust for the server (default: the system's)")
+	clientCert = flag.String("cert", "", "PEM client certificate for servers that require one")
+	clientKey  = flag.String("key", "", "PEM private key for -cert")
+	grpcTLS    = flag.Bool("grpc-tls", false, "use TLS for the gRPC transport; implied by -cacert and -cert")
+)
+
+// clientTLS is the TLS configuration built from the flags, or nil if none
+// was given.
+var clientTLS *tls.Config
+
+// setupTLS applies the TLS flags to HTTP requests and the gRPC transport.
+func setupTLS() {
+	if *caCert == "" && *clientCert == "" && !*grpcTLS {
+		return
+	}
+	clientTLS = &tls.Config{MinVersion: tls.VersionTLS12}
+	if *caCert != "" {
+		pem, err := os.ReadFile(*caCert)
+		must(err)
+		clientTLS.RootCAs = x509.NewCertPool()
+		if !clientTLS.RootCAs.AppendCertsFromPEM(pem) {
+			must(fmt.Errorf("no certificates in %s", *caCert))
+		}
+	}
+	if *clientCert != "" {
+		if *clientKey == "" {
+			must(fmt.Errorf("-cert needs -key"))
+		}
+		cert, err := tls.LoadX509KeyPair(*clientCert, *clientKey)
+		must(err)
+		clientTLS.Certificates = []tls.Certificate{cert}
+	}
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = clientTLS
+	http.DefaultClient.Transport = t
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"net/http"
+	"strings"
+
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/tlsconf"
+)
+
+// operators admits callers of the operator endpoints: those carrying the
+// admin token as a bearer credential, or a verified client certificate whose
+// owner is listed in admins (comma separated). Everyone else is refused, so
+// the endpoints stay closed until one of the two is configured. X-Owner-ID is
+// not trusted here: without a certificate it is whatever the client says.
+type operators struct {
+	token   string
+	allowed map[string]bool
+	owners  *tlsconf.Owners
+}
+
+func newOperators(token, admins string, owners *tlsconf.Owners) *operators {
+	o := &operators{token: token, allowed: make(map[string]bool), owners: owners}
+	for _, a := range strings.Split(admins, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			o.allowed[a] = true
+		}
+	}
+	return o
+}
+
+// admits reports whether a caller with the given Authorization value and TLS
+// state is an operator.
+func (o *operators) admits(authorization string, cs *tls.ConnectionState) bool {
+	if o.token != "" {
+		got, ok := strings.CutPrefix(authorization, "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(got), []byte(o.token)) == 1 {
+			return true
+		}
+	}
+	if o.owners != nil {
+		if owner, ok := o.owners.Owner(cs); ok && o.allowed[owner] {
+			return true
+		}
+	}
+	return false
+}
+
+// handler refuses requests from anyone but an operator with 403.
+func (o *operators) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !o.admits(r.Header.Get("Authorization"), r.TLS) {
+			writeStatus(w, r, http.StatusForbidden, codeForbidden, "admin endpoints need the admin token or an operator's client certificate")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// call reports whether a gRPC call comes from an operator, by its
+// authorization metadata or its peer's client certificate.
+func (o *operators) call(ctx context.Context) bool {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var authorization string
+	if v := md.Get("authorization"); len(v) == 1 {
+		authorization = v[0]
+	}
+	var cs *tls.ConnectionState
+	if p, ok := peer.FromContext(ctx); ok {
+		if info, ok := p.AuthInfo.(credentials.TLSInfo); ok {
+			cs = &info.State
+		}
+	}
+	return o.admits(authorization, cs)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/signedurl"
+)
+
+// Error codes sent in the JSON body of every failed request; cmd/client
+// switches on them.
+const (
+	codeNotFound         = "not_found"
+	codeForbidden        = "forbidden"
+	codeConflict         = "conflict"
+	codeInvalidArgument  = "invalid_argument"
+	codeRateLimited      = "rate_limited"
+	codeExpired          = "expired"
+	codeRangeInvalid     = "range_not_satisfiable"
+	codeTooLarge         = "too_large"
+	codeQuotaExceeded    = "quota_exceeded"
+	codeKeyUnavailable   = "key_unavailable"
+	codeIntegrityFailure = "integrity_failure"
+	codeInternal         = "internal"
+)
+
+// apiError is the JSON body of a failed request.
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+// writeStatus sends an error body with an explicit status and code.
+func writeStatus(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(apiError{Code: code, Message: msg, RequestID: middleware.GetReqID(r.Context())})
+}
+
+// badRequest rejects a malformed request.
+func badRequest(w http.ResponseWriter, r *http.Request, msg string) {
+	writeStatus(w, r, http.StatusBadRequest, codeInvalidArgument, msg)
+}
+
+// writeError maps err onto a status and code. Errors of a known kind carry
+// their own text; anything else is logged with the request ID and answered
+// with a generic message, so storage keys and KMS details stay server-side.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var status int
+	var code string
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		status, code = http.StatusRequestEntityTooLarge, codeTooLarge
+	case errors.Is(err, dsde.ErrNotFound):
+		status, code = http.StatusNotFound, codeNotFound
+	case errors.Is(err, dsde.ErrForbidden), errors.Is(err, signedurl.ErrInvalidToken):
+		status, code = http.StatusForbidden, codeForbidden
+	case errors.Is(err, dsde.ErrConflict):
+		status, code = http.StatusConflict, codeConflict
+	case errors.Is(err, dsde.ErrInvalidArgument), errors.Is(err, keyserver.ErrInvalidElement):
+		status, code = http.StatusBadRequest, codeInvalidArgument
+	case errors.Is(err, dsde.ErrQuotaExceeded):
+		status, code = http.StatusInsufficientStorage, codeQuotaExceeded
+	case errors.Is(err, keyserver.ErrRateLimited), errors.Is(err, ratelimit.ErrLimited):
+		setRetryAfter(w, err)
+		status, code = http.StatusTooManyRequests, codeRateLimited
+	case errors.Is(err, signedurl.ErrExpired):
+		status, code = http.StatusGone, codeExpired
+	case errors.Is(err, dsde.ErrKeyUnavailable):
+		logError(r, err)
+		writeStatus(w, r, http.StatusBadGateway, codeKeyUnavailable, "the key service could not provide the file's keys")
+		return
+	case errors.Is(err, dsde.ErrIntegrityFailure):
+		logError(r, err)
+		writeStatus(w, r, http.StatusInternalServerError, codeIntegrityFailure, "stored data failed its integrity check")
+		return
+	default:
+		logError(r, err)
+		writeStatus(w, r, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	writeStatus(w, r, status, code, err.Error())
+}
+
+func logError(r *http.Request, err error) {
+	zap.L().Named("http").Error("request failed",
+		zap.Error(err),
+		zap.String("method", r.Method),
+		zap.String("path", r.URL.Path),
+		zap.String("requestID", middleware.GetReqID(r.Context())),
+	)
+}
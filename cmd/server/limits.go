@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+// limitKey is who a request is charged to: its X-Owner-ID, or its client's
+// address when it names no owner (signed links, admin calls).
+func limitKey(r *http.Request) string {
+	if owner := r.Header.Get("X-Owner-ID"); owner != "" {
+		return owner
+	}
+	return "addr:" + clientAddr(r)
+}
+
+// clientAddr is the host a request came from.
+func clientAddr(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// keySource records the client's address for the key server, which limits
+// the evaluations made for uploads by address as well as by claimed owner.
+func keySource(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(keyserver.WithSource(r.Context(), clientAddr(r))))
+	})
+}
+
+// rateLimit refuses requests over l's request rates with 429 and slows
+// their bodies, both ways, to its byte rates. Paths under the exempt
+// prefixes pass through untouched.
+func rateLimit(l *ratelimit.Limiter, exempt ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if slices.ContainsFunc(exempt, func(p string) bool { return strings.HasPrefix(r.URL.Path, p) }) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			key := limitKey(r)
+			if err := l.Allow(key); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			r.Body = readCloser{l.Reader(r.Context(), key, r.Body), r.Body}
+			next.ServeHTTP(l.ResponseWriter(r.Context(), key, w), r)
+		})
+	}
+}
+
+// uploadSlot holds one of the owner's concurrent upload slots for the
+// length of the request, refusing it with 429 when all are taken. Only the
+// methods listed count; none means all.
+func uploadSlot(l *ratelimit.Limiter, methods ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			release, err := l.StartUpload(limitKey(r))
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			defer release()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// readCloser pairs a throttled reader with the body it reads.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// setRetryAfter tells the client when a limited request may be retried.
+func setRetryAfter(w http.ResponseWriter, err error) {
+	if after := ratelimit.RetryAfter(err); after != "" {
+		w.Header().Set("Retry-After", after)
+	}
+}
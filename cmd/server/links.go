@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/signedurl"
+)
+
+// writeLink serves the part of a downloaded file a signed link grants. The
+// window is [c.Offset, c.Offset+c.Length), or to the end when Length is 0.
+// A Range request is honoured when it falls inside the window and refused
+// with 416 when it does not. Byte positions in Range and Content-Range are
+// those of the whole file, so a link to part of it answers 206 even when no
+// Range was asked for.
+func writeLink(w http.ResponseWriter, r *http.Request, rc io.ReadSeeker, c signedurl.Claims) {
+	size, err := rc.Seek(0, io.SeekEnd)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	unsatisfiable := func(msg string) {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", size))
+		writeStatus(w, r, http.StatusRequestedRangeNotSatisfiable, codeRangeInvalid, msg)
+	}
+
+	start, end := c.Offset, size
+	if c.Length > 0 && c.Offset+c.Length < size {
+		end = c.Offset + c.Length
+	}
+	if start > size || (start == size && start > 0) {
+		unsatisfiable("range starts past the end of the file")
+		return
+	}
+	partial := start > 0 || end < size
+	if from, to, ok := parseRange(r.Header.Get("Range"), size); ok {
+		if from < start || to > end || from >= to {
+			unsatisfiable("range falls outside the link's range")
+			return
+		}
+		start, end, partial = from, to, true
+	}
+	if _, err := rc.Seek(start, io.SeekStart); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	maxAge := int(time.Until(c.Expires).Seconds())
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", maxAge))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start, 10))
+	status := http.StatusOK
+	if partial {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, size))
+		status = http.StatusPartialContent
+	}
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.CopyN(w, rc, end-start); err != nil {
+		zap.L().Warn("signed link copy", zap.String("fileID", c.FileID), zap.Error(err))
+	}
+}
+
+// parseRange parses a single byte range of a file of the given size into
+// [from, to). It reports false when the header is absent, malformed or asks
+// for several ranges; the caller then ignores it and serves the whole
+// window, as RFC 9110 allows.
+func parseRange(h string, size int64) (from, to int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// suffix range: the last n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return max(size-n, 0), size, true
+	}
+	from, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || from < 0 {
+		return 0, 0, false
+	}
+	to = size
+	if last != "" {
+		l, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || l < from {
+			return 0, 0, false
+		}
+		to = min(l+1, size)
+	}
+	return from, to, true
+}
@@ -2,12 +2,23 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,13 +32,27 @@ import (
 	awsConfig "github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/config"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/davfs"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/extractor"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/health"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/logger"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/s3gw"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/signedurl"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/split"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/storage"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/tlsconf"
 )
 
 func loadAWSConfig(region string) (cfg aws.Config, err error) {
@@ -50,6 +75,125 @@ func (l *zapLoggerAdapter) Print(v ...interface{}) {
 	l.logger.Sugar().Info(v...)
 }
 
+// writeGrants sends grants as JSON, with expiresAt omitted for grants that
+// never expire.
+func writeGrants(w http.ResponseWriter, grants []db.Grant) {
+	type grant struct {
+		db.Grant
+		ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+	}
+	out := make([]grant, 0, len(grants))
+	for _, g := range grants {
+		o := grant{Grant: g}
+		if g.ExpiresAt.Valid {
+			o.ExpiresAt = &g.ExpiresAt.Time
+		}
+		out = append(out, o)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(out)
+}
+
+// writeUploadResult sends the JSON body returned for a stored file.
+func writeUploadResult(w http.ResponseWriter, fileID string, feaHash, dekShared, dekUser []byte) {
+	resp := map[string]string{
+		"fileID":    fileID,
+		"feaHash":   fmt.Sprintf("%x", feaHash),
+		"dekShared": fmt.Sprintf("%x", dekShared),
+		"dekUser":   fmt.Sprintf("%x", dekUser),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// writeFile sends a downloaded file, answering Range requests by seeking
+// when the reader allows it.
+func writeFile(w http.ResponseWriter, r *http.Request, rc io.ReadCloser) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, rs)
+		return
+	}
+	io.Copy(w, rc)
+}
+
+// newHTTPServer returns a server for h on addr with the configured timeouts,
+// serving TLS if tlsCfg is set.
+func newHTTPServer(cfg *config.Config, addr string, h http.Handler, tlsCfg *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		TLSConfig:         tlsCfg,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serveHTTP runs srv until it is shut down, over TLS if it has a config.
+func serveHTTP(srv *http.Server) error {
+	var err error
+	if srv.TLSConfig != nil {
+		err = srv.ListenAndServeTLS("", "") // the config supplies the certificate
+	} else {
+		err = srv.ListenAndServe()
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
+
+// shutdownHTTP stops srv accepting connections and waits up to timeout for
+// in-flight requests, then closes whatever is left.
+func shutdownHTTP(srv *http.Server, timeout time.Duration) {
+	sctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		zap.L().Warn("shutdown timed out, closing open connections", zap.String("addr", srv.Addr), zap.Error(err))
+		srv.Close()
+	}
+}
+
+// certOwner makes the owner named by a verified client certificate the
+// request's X-Owner-ID, refusing requests that claim someone else.
+func certOwner(owners *tlsconf.Owners) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+			owner, ok := owners.Owner(r.TLS)
+			if !ok {
+				writeStatus(w, r, http.StatusForbidden, codeForbidden, "client certificate maps to no owner")
+				return
+			}
+			if claimed := r.Header.Get("X-Owner-ID"); claimed != "" && claimed != owner {
+				writeStatus(w, r, http.StatusForbidden, codeForbidden, "client certificate belongs to another owner")
+				return
+			}
+			r.Header.Set("X-Owner-ID", owner)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// limitBody rejects request bodies over max bytes with 413.
+func limitBody(max int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > max {
+				writeError(w, r, &http.MaxBytesError{Limit: max})
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, max)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
 func main() {
 	// parse our --stats flag
 	stats := flag.Bool("stats", false, "print per-upload dedupe statistics")
@@ -91,69 +235,1062 @@ func main() {
 		zap.L().Fatal("DB init", zap.Error(err))
 	}
 
+	// stop on SIGINT/SIGTERM, letting background work save its state
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// chunk extractor, whose Bloom filter survives restarts
+	ext := extractor.New(cfg.BloomCapacity, cfg.BloomFPRate, cfg.ChunkSize)
+	if err := ext.Load(ctx, storeClient); storage.IsNotFound(err) {
+		zap.L().Info("no saved bloom filter, starting empty")
+	} else if err != nil {
+		zap.L().Fatal("load bloom filter", zap.Error(err))
+	}
+	extDone := make(chan struct{})
+	go func() {
+		ext.Persist(ctx, storeClient, cfg.BloomSaveInterval)
+		close(extDone)
+	}()
+
 	// our DSDE service
-	fg := split.NewFG([]uint64{1, 3, 5}, []uint64{0, 0, 0})
-	svc := dsde.NewService(fg, 3, kmsClient, cfg.KMSKeyID, dbClient, storeClient, *stats)
+	sharedSuite, err := encryption.ParseSuite(cfg.SharedSuite)
+	if err != nil {
+		zap.L().Fatal("shared suite", zap.Error(err))
+	}
+	userSuite, err := encryption.ParseSuite(cfg.UserSuite)
+	if err != nil {
+		zap.L().Fatal("user suite", zap.Error(err))
+	}
+	defaultCodec, err := codec.Parse(cfg.Codec)
+	if err != nil {
+		zap.L().Fatal("codec", zap.Error(err))
+	}
+	opts := []dsde.Option{dsde.WithSuites(sharedSuite, userSuite), dsde.WithChunkMode(ext), dsde.WithCodec(defaultCodec), dsde.WithMaxFileSize(cfg.MaxUploadBytes)}
+	switch cfg.StorageMode {
+	case "dsde", "chunks":
+	default:
+		zap.L().Fatal("storage mode", zap.String("mode", cfg.StorageMode))
+	}
 
-	// router w/ pretty request logs
+	var keySrv *keyserver.Server
+	if cfg.KeyServerKeyFile != "" {
+		priv, err := keyserver.LoadKey(cfg.KeyServerKeyFile)
+		if err != nil {
+			zap.L().Fatal("key server key", zap.Error(err))
+		}
+		var ksOpts []keyserver.Option
+		if cfg.KeyServerGlobalRate > 0 {
+			ksOpts = append(ksOpts, keyserver.WithGlobalLimit(cfg.KeyServerGlobalRate, cfg.KeyServerGlobalBurst))
+		}
+		keySrv = keyserver.New(priv, cfg.KeyServerRate, cfg.KeyServerBurst, ksOpts...)
+		opts = append(opts, dsde.WithKeyServer(keySrv))
+	}
+	if cfg.DedupThresholdMax > 0 {
+		opts = append(opts, dsde.WithRandomizedThreshold(cfg.DedupThresholdMax, cfg.DedupMinLatency))
+	}
+	if cfg.PopularityThreshold > 1 {
+		opts = append(opts, dsde.WithPopularityThreshold(cfg.PopularityThreshold))
+	}
+	if cfg.RetainVersions > 0 || cfg.RetainFor > 0 {
+		opts = append(opts, dsde.WithRetention(cfg.RetainVersions, cfg.RetainFor))
+	}
+	if cfg.QuotaLogicalBytes > 0 || cfg.QuotaPhysicalBytes > 0 {
+		opts = append(opts, dsde.WithDefaultQuota(cfg.QuotaLogicalBytes, cfg.QuotaPhysicalBytes))
+	}
+	if cfg.KeyCacheSize > 0 {
+		opts = append(opts, dsde.WithKeyCache(cfg.KeyCacheSize, cfg.KeyCacheTTL))
+	}
+	if cfg.UserKeyPoolSize > 0 {
+		opts = append(opts, dsde.WithUserKeyPool(cfg.UserKeyPoolSize))
+	}
+
+	var links *signedurl.Signer
+	if cfg.LinkKeys != "" {
+		keys, err := signedurl.ParseKeys(cfg.LinkKeys)
+		if err != nil {
+			zap.L().Fatal("link keys", zap.Error(err))
+		}
+		if links, err = signedurl.New(keys); err != nil {
+			zap.L().Fatal("link keys", zap.Error(err))
+		}
+	}
+
+	// TLS, with client certificates naming owners when a client CA is set;
+	// the S3 gateway authenticates by signature and never asks for one
+	var (
+		tlsCfg, gwTLS *tls.Config
+		certOwners    *tlsconf.Owners
+	)
+	if cfg.TLSCertFile != "" {
+		certs, err := tlsconf.NewReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			zap.L().Fatal("tls certificate", zap.Error(err))
+		}
+		go certs.Watch(ctx, cfg.TLSReloadInterval)
+		var clientCAs *x509.CertPool
+		clientAuth := tls.NoClientCert
+		if cfg.TLSClientCAFile != "" {
+			if clientCAs, err = tlsconf.LoadCertPool(cfg.TLSClientCAFile); err != nil {
+				zap.L().Fatal("tls client CA", zap.Error(err))
+			}
+			if clientAuth, err = tlsconf.ParseClientAuth(cfg.TLSClientAuth); err != nil {
+				zap.L().Fatal("tls client auth", zap.Error(err))
+			}
+			if certOwners, err = tlsconf.ParseOwners(cfg.TLSClientOwners); err != nil {
+				zap.L().Fatal("tls client owners", zap.Error(err))
+			}
+		}
+		tlsCfg = tlsconf.ServerConfig(certs, clientCAs, clientAuth)
+		gwTLS = tlsconf.ServerConfig(certs, nil, tls.NoClientCert)
+	}
+
+	fg := split.NewDefaultFG()
+	svc := dsde.NewService(fg, 3, kmsClient, cfg.KMSKeyID, dbClient, storeClient, *stats, opts...)
+
+	// finish promotions of newly popular content that a restart interrupted
+	svc.Go(func(ctx context.Context) {
+		n, err := svc.PromotePending(ctx)
+		if err != nil && ctx.Err() == nil {
+			zap.L().Warn("PromotePending", zap.Error(err))
+		}
+		if n > 0 {
+			zap.L().Info("promoted private files", zap.Int("count", n))
+		}
+	})
+
+	// apply the version retention policy until the service closes
+	svc.Go(func(ctx context.Context) {
+		t := time.NewTicker(cfg.PruneInterval)
+		defer t.Stop()
+		for {
+			if _, err := svc.PruneVersions(ctx); err != nil && ctx.Err() == nil {
+				zap.L().Warn("PruneVersions", zap.Error(err))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
+		}
+	})
+
+	// router w/ pretty request logs; chi must know WebDAV's methods up front
+	for _, m := range []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK"} {
+		chi.RegisterMethod(m)
+	}
 	r := chi.NewRouter()
 	r.Use(middleware.RequestID)
 
 	zapAdapter := &zapLoggerAdapter{logger: zap.L()}
 	r.Use(middleware.RequestLogger(&middleware.DefaultLogFormatter{Logger: zapAdapter, NoColor: false}))
 	r.Use(middleware.Recoverer)
+	if cfg.MaxUploadBytes > 0 {
+		r.Use(limitBody(cfg.MaxUploadBytes))
+	}
+	if certOwners != nil {
+		r.Use(certOwner(certOwners))
+	}
+	// shared by every listener, so the global limits cover them all
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{
+		OwnerRequests:  cfg.OwnerRequestRate,
+		OwnerBurst:     cfg.OwnerRequestBurst,
+		GlobalRequests: cfg.GlobalRequestRate,
+		GlobalBurst:    cfg.GlobalRequestBurst,
+		OwnerBytes:     cfg.OwnerByteRate,
+		GlobalBytes:    cfg.GlobalByteRate,
+		OwnerUploads:   cfg.MaxConcurrentUploads,
+	})
+	// health probes are never limited; WebDAV is limited once it knows the
+	// owner, who may have authenticated with a password
+	r.Use(rateLimit(limiter, "/health", "/dav"))
+	r.Use(keySource)
+	uploads := uploadSlot(limiter)
+
+	// liveness says the process serves; readiness checks every backend a
+	// request touches, and fails from the moment shutdown begins
+	probes := health.New()
+	probes.Add("postgres", dbClient.Ping)
+	probes.Add("s3", storeClient.Ping)
+	probes.Add("kms", func(ctx context.Context) error {
+		_, err := kmsClient.DescribeKey(ctx, &kms.DescribeKeyInput{KeyId: &cfg.KMSKeyID})
+		return err
+	})
+	r.Get("/health", probes.Live)
+	r.Get("/health/live", probes.Live)
+	r.Get("/health/ready", probes.Ready)
+
+	// upload stores the request body as filename, in the storage mode and
+	// with the codec the headers ask for
+	upload := func(w http.ResponseWriter, r *http.Request, owner, filename string) {
+		var (
+			fileID                      string
+			feaHash, dekShared, dekUser []byte
+			err                         error
+		)
+		c := defaultCodec
+		if name := r.Header.Get("X-Codec"); name != "" {
+			if c, err = codec.Parse(name); err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+		}
+		mode := r.Header.Get("X-Storage-Mode")
+		if mode == "" {
+			mode = cfg.StorageMode
+		}
+		switch mode {
+		case "dsde":
+			fileID, feaHash, dekShared, dekUser, err = svc.UploadWithCodec(r.Context(), owner, filename, c, r.Body)
+		case "chunks":
+			fileID, feaHash, dekShared, dekUser, err = svc.UploadChunks(r.Context(), owner, filename, r.Body)
+		default:
+			badRequest(w, r, "unknown storage mode "+mode)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUploadResult(w, fileID, feaHash, dekShared, dekUser)
+	}
 
-	r.Get("/health", func(w http.ResponseWriter, _ *http.Request) {
-		w.Write([]byte(`{"status":"ok"}`))
+	r.With(uploads).Post("/files", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		filename := r.Header.Get("X-Filename")
+		if owner == "" || filename == "" {
+			badRequest(w, r, "missing owner or filename headers")
+			return
+		}
+		p, err := svc.FilePath(r.Context(), owner, filename)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		upload(w, r, owner, p)
 	})
 
-	r.Post("/files", func(w http.ResponseWriter, r *http.Request) {
+	// proof-of-ownership dedup: claim content by feature, then prove it
+	r.Post("/files/dedup", func(w http.ResponseWriter, r *http.Request) {
 		owner := r.Header.Get("X-Owner-ID")
 		filename := r.Header.Get("X-Filename")
 		if owner == "" || filename == "" {
-			http.Error(w, "missing owner or filename headers", http.StatusBadRequest)
+			badRequest(w, r, "missing owner or filename headers")
+			return
+		}
+		var req struct {
+			FeaHash string `json:"feaHash"`
+			Size    int64  `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
 			return
 		}
-		fileID, feaHash, dekShared, dekUser, err := svc.Upload(r.Context(), owner, filename, r.Body)
+		feaHash, err := hex.DecodeString(req.FeaHash)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			badRequest(w, r, "feaHash must be hex")
 			return
 		}
-		resp := map[string]string{
-			"fileID":    fileID,
-			"feaHash":   fmt.Sprintf("%x", feaHash),
-			"dekShared": fmt.Sprintf("%x", dekShared),
-			"dekUser":   fmt.Sprintf("%x", dekUser),
+		ch, err := svc.BeginDedup(r.Context(), owner, filename, feaHash, req.Size)
+		if err != nil {
+			writeError(w, r, err)
+			return
 		}
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(resp)
+		json.NewEncoder(w).Encode(ch)
+	})
+
+	r.Post("/files/dedup/{challengeID}", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			Proofs []pow.Proof `json:"proofs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		fileID, feaHash, dekShared, dekUser, err := svc.CompleteDedup(r.Context(), owner, chi.URLParam(r, "challengeID"), req.Proofs)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUploadResult(w, fileID, feaHash, dekShared, dekUser)
 	})
 
 	r.Get("/files/{fileID}", func(w http.ResponseWriter, r *http.Request) {
 		owner := r.Header.Get("X-Owner-ID")
 		if owner == "" {
-			http.Error(w, "missing owner header", http.StatusBadRequest)
+			badRequest(w, r, "missing owner header")
 			return
 		}
 		rc, err := svc.Download(r.Context(), owner, chi.URLParam(r, "fileID"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
 		defer rc.Close()
-		w.Header().Set("Content-Type", "application/octet-stream")
-		io.Copy(w, rc)
+		writeFile(w, r, rc)
+	})
+
+	// server-side copy: a new file for the caller, of one of their files or one
+	// shared with them, with no re-upload
+	r.Post("/files/{fileID}/copy", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			Owner    string `json:"owner"`    // must be the caller if set
+			Filename string `json:"filename"` // defaults to the source's name
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			badRequest(w, r, err.Error())
+			return
+		}
+		if req.Owner != "" && req.Owner != owner {
+			writeStatus(w, r, http.StatusForbidden, codeForbidden, "files can only be copied to the caller; share the file for its recipient to copy")
+			return
+		}
+		fileID, feaHash, dekShared, dekUser, err := svc.CopyFile(r.Context(), owner, chi.URLParam(r, "fileID"), req.Filename)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUploadResult(w, fileID, feaHash, dekShared, dekUser)
+	})
+
+	// namespace: files and folders by path
+	r.Get("/fs/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		p := chi.URLParam(r, "*")
+		file, folder, err := svc.Stat(r.Context(), owner, p)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		switch {
+		case file:
+			fileID, err := svc.ResolvePath(r.Context(), owner, p, 0)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			rc, err := svc.Download(r.Context(), owner, fileID)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			defer rc.Close()
+			w.Header().Set("X-File-ID", fileID)
+			writeFile(w, r, rc)
+		case folder:
+			entries, err := svc.List(r.Context(), owner, p, r.URL.Query().Get("recursive") == "true")
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			if entries == nil {
+				entries = []db.TreeEntry{}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(entries)
+		default:
+			writeError(w, r, dsde.ErrFileNotFound)
+		}
+	})
+
+	r.With(uploads).Put("/fs/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		p, err := svc.FilePath(r.Context(), owner, chi.URLParam(r, "*"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		upload(w, r, owner, p)
+	})
+
+	// ?op=mkdir creates a folder; ?op=move&to=<path> moves or renames
+	r.Post("/fs/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		p := chi.URLParam(r, "*")
+		var err error
+		switch op := r.URL.Query().Get("op"); op {
+		case "mkdir":
+			err = svc.Mkdir(r.Context(), owner, p)
+		case "move":
+			err = svc.Move(r.Context(), owner, p, r.URL.Query().Get("to"))
+		default:
+			badRequest(w, r, "unknown op "+op)
+			return
+		}
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Delete("/fs/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		if err := svc.Remove(r.Context(), owner, chi.URLParam(r, "*")); err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	// the caller's quota and how much of it they use
+	r.Get("/usage", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		q, err := svc.OwnUsage(r.Context(), owner)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(q)
+	})
+
+	// versions: an owner's filename is a path, each upload of it a version
+	r.Get("/files/path/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		version := 0
+		if v := r.URL.Query().Get("version"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				badRequest(w, r, "version must be a positive integer")
+				return
+			}
+			version = n
+		}
+		fileID, err := svc.ResolvePath(r.Context(), owner, chi.URLParam(r, "*"), version)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		rc, err := svc.Download(r.Context(), owner, fileID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("X-File-ID", fileID)
+		writeFile(w, r, rc)
+	})
+
+	r.Get("/files/versions/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		versions, err := svc.Versions(r.Context(), owner, chi.URLParam(r, "*"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(versions)
+	})
+
+	// restore: copy an old version to a new, newest one
+	r.Post("/files/restore/*", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			Version int `json:"version"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Version < 1 {
+			badRequest(w, r, "body must name a version to restore")
+			return
+		}
+		fileID, feaHash, dekShared, dekUser, err := svc.Restore(r.Context(), owner, chi.URLParam(r, "*"), req.Version)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUploadResult(w, fileID, feaHash, dekShared, dekUser)
+	})
+
+	// sharing: read grants from a file's owner to other users
+	r.Post("/files/{fileID}/grants", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			Grantee   string    `json:"grantee"`
+			ExpiresIn string    `json:"expiresIn"` // a Go duration, e.g. "72h"
+			ExpiresAt time.Time `json:"expiresAt"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		if req.ExpiresIn != "" {
+			d, err := time.ParseDuration(req.ExpiresIn)
+			if err != nil {
+				badRequest(w, r, "invalid expiresIn: "+err.Error())
+				return
+			}
+			req.ExpiresAt = time.Now().Add(d)
+		}
+		err := svc.ShareFile(r.Context(), owner, chi.URLParam(r, "fileID"), req.Grantee, req.ExpiresAt)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/files/{fileID}/grants", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		grants, err := svc.Grants(r.Context(), owner, chi.URLParam(r, "fileID"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeGrants(w, grants)
+	})
+
+	r.Delete("/files/{fileID}/grants/{grantee}", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		err := svc.Unshare(r.Context(), owner, chi.URLParam(r, "fileID"), chi.URLParam(r, "grantee"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.Get("/shared", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		grants, err := svc.SharedWith(r.Context(), owner)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeGrants(w, grants)
+	})
+
+	// client-side mode: the client seals and opens files itself
+	r.Post("/cs/uploads", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		filename := r.Header.Get("X-Filename")
+		if owner == "" || filename == "" {
+			badRequest(w, r, "missing owner or filename headers")
+			return
+		}
+		var req struct {
+			FeaHash string `json:"feaHash"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		feaHash, err := hex.DecodeString(req.FeaHash)
+		if err != nil {
+			badRequest(w, r, "feaHash must be hex")
+			return
+		}
+		keys, err := svc.BeginClientUpload(r.Context(), owner, filename, feaHash)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+	})
+
+	r.Post("/cs/uploads/{fileID}/check", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			DHash string `json:"dHash"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		dec, err := svc.CheckClientD(r.Context(), owner, chi.URLParam(r, "fileID"), req.DHash)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(dec)
+	})
+
+	r.With(uploads).Put("/cs/uploads/{fileID}/d", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		err := svc.PutClientD(r.Context(), owner, chi.URLParam(r, "fileID"), r.Body)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	r.With(uploads).Post("/cs/uploads/{fileID}/commit", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		var req struct {
+			Pkg2Len int         `json:"pkg2Len"`
+			Codec   string      `json:"codec"`
+			Size    *int64      `json:"size"` // of the plaintext, before compression
+			SBlob   []byte      `json:"sBlob"`
+			Proofs  []pow.Proof `json:"proofs"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		if req.Size == nil {
+			badRequest(w, r, "missing size")
+			return
+		}
+		c, err := codec.Parse(req.Codec)
+		if err != nil {
+			badRequest(w, r, err.Error())
+			return
+		}
+		fileID := chi.URLParam(r, "fileID")
+		feaHash, dekShared, dekUser, err := svc.CommitClientUpload(r.Context(), owner, fileID, req.Pkg2Len, c, *req.Size, req.SBlob, req.Proofs)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		writeUploadResult(w, fileID, feaHash, dekShared, dekUser)
 	})
 
-	r.Get("/admin/s3-list", func(w http.ResponseWriter, r *http.Request) {
-		keys, err := storeClient.ListKeys(r.Context())
+	r.Get("/cs/files/{fileID}", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		keys, err := svc.ClientFile(r.Context(), owner, chi.URLParam(r, "fileID"))
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, r, err)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(keys)
 	})
 
-	zap.L().Info("starting server", zap.String("addr", cfg.ServerAddr))
-	http.ListenAndServe(cfg.ServerAddr, r)
+	r.Get("/cs/files/{fileID}/blobs/{seq}", func(w http.ResponseWriter, r *http.Request) {
+		owner := r.Header.Get("X-Owner-ID")
+		if owner == "" {
+			badRequest(w, r, "missing owner header")
+			return
+		}
+		seq, err := strconv.Atoi(chi.URLParam(r, "seq"))
+		if err != nil {
+			badRequest(w, r, "seq must be an integer")
+			return
+		}
+		rc, err := svc.ClientBlob(r.Context(), owner, chi.URLParam(r, "fileID"), seq)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		defer rc.Close()
+		w.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(w, rc)
+	})
+
+	if keySrv != nil {
+		r.Get("/keyserver/public-key", func(w http.ResponseWriter, r *http.Request) {
+			der, err := x509.MarshalPKIXPublicKey(keySrv.PublicKey())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/x-pem-file")
+			pem.Encode(w, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+		})
+
+		r.Post("/keyserver/evaluate", func(w http.ResponseWriter, r *http.Request) {
+			owner := r.Header.Get("X-Owner-ID")
+			if owner == "" {
+				badRequest(w, r, "missing owner header")
+				return
+			}
+			var req struct {
+				Blinded []byte `json:"blinded"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			evaluated, err := keySrv.Evaluate(owner, clientAddr(r), req.Blinded)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string][]byte{"evaluated": evaluated})
+		})
+	}
+
+	if links != nil {
+		// mint a signed link to a file the caller can read
+		r.Post("/files/{fileID}/links", func(w http.ResponseWriter, r *http.Request) {
+			owner := r.Header.Get("X-Owner-ID")
+			if owner == "" {
+				badRequest(w, r, "missing owner header")
+				return
+			}
+			var req struct {
+				ExpiresIn string `json:"expiresIn"` // a Go duration; defaults to the maximum
+				Offset    int64  `json:"offset"`
+				Length    int64  `json:"length"` // 0 serves to the end
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+				badRequest(w, r, err.Error())
+				return
+			}
+			ttl := cfg.LinkMaxTTL
+			if req.ExpiresIn != "" {
+				d, err := time.ParseDuration(req.ExpiresIn)
+				if err != nil || d <= 0 || d > cfg.LinkMaxTTL {
+					badRequest(w, r, fmt.Sprintf("expiresIn must be a duration in (0, %s]", cfg.LinkMaxTTL))
+					return
+				}
+				ttl = d
+			}
+			fileID := chi.URLParam(r, "fileID")
+			err := svc.CanRead(r.Context(), owner, fileID)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			expires := time.Now().Add(ttl)
+			token, err := links.Sign(signedurl.Claims{
+				FileID:  fileID,
+				OwnerID: owner,
+				Expires: expires,
+				Offset:  req.Offset,
+				Length:  req.Length,
+			})
+			if err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]any{"url": "/d/" + token, "expiresAt": expires.UTC().Truncate(time.Second)})
+		})
+
+		// redeem a signed link; access is re-checked, so revoked grants end it
+		r.Get("/d/{token}", func(w http.ResponseWriter, r *http.Request) {
+			c, err := links.Verify(chi.URLParam(r, "token"), time.Now())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			rc, err := svc.Download(r.Context(), c.OwnerID, c.FileID)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			defer rc.Close()
+			rs, ok := rc.(io.ReadSeeker)
+			if !ok {
+				writeError(w, r, fmt.Errorf("download of %s is not seekable", c.FileID))
+				return
+			}
+			writeLink(w, r, rs, c)
+		})
+	}
+
+	// WebDAV view of each owner's namespace, for file managers
+	var davUsers map[string]string
+	if cfg.DAVUsers != "" {
+		if davUsers, err = davfs.ParseUsers(cfg.DAVUsers); err != nil {
+			zap.L().Fatal("dav users", zap.Error(err))
+		}
+	}
+	davOpts := []davfs.Option{davfs.WithCodec(defaultCodec)}
+	if davUsers != nil {
+		davOpts = append(davOpts, davfs.WithUsers(davUsers))
+	}
+	if cfg.StorageMode == "chunks" {
+		davOpts = append(davOpts, davfs.WithChunkMode())
+	}
+	davOpts = append(davOpts, davfs.WithOwnerMiddleware(func(next http.Handler) http.Handler {
+		return rateLimit(limiter)(uploadSlot(limiter, http.MethodPut)(next))
+	}))
+	dav := davfs.New(svc, dbClient, "/dav", davOpts...)
+	r.Handle("/dav", dav)
+	r.Handle("/dav/*", dav)
+
+	// operator endpoints: the admin token or an operator's certificate
+	ops := newOperators(cfg.AdminToken, cfg.AdminOwners, certOwners)
+	r.Group(func(r chi.Router) {
+		r.Use(ops.handler)
+
+		// service-wide counters; how many features and common chunks there
+		// are tells whether an upload deduplicated, so they are not public
+		r.Get("/stats", func(w http.ResponseWriter, r *http.Request) {
+			st, err := svc.Stats(r.Context())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(st)
+		})
+
+		r.Get("/admin/s3-list", func(w http.ResponseWriter, r *http.Request) {
+			keys, err := storeClient.ListKeys(r.Context())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			json.NewEncoder(w).Encode(keys)
+		})
+
+		r.Post("/admin/reseal", func(w http.ResponseWriter, r *http.Request) {
+			n, err := svc.ResealAll(r.Context())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"resealed": n})
+		})
+
+		r.Post("/admin/prune", func(w http.ResponseWriter, r *http.Request) {
+			n, err := svc.PruneVersions(r.Context())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]int{"pruned": n})
+		})
+
+		// per-owner quotas: limits in bytes, 0 unlimited; owners without their
+		// own fall back to the configured default
+		r.Get("/admin/quotas", func(w http.ResponseWriter, r *http.Request) {
+			qs, err := svc.Quotas(r.Context())
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(qs)
+		})
+
+		r.Get("/admin/quotas/{owner}", func(w http.ResponseWriter, r *http.Request) {
+			q, err := svc.Quota(r.Context(), chi.URLParam(r, "owner"))
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(q)
+		})
+
+		r.Put("/admin/quotas/{owner}", func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				LogicalBytes  int64 `json:"logicalBytes"`
+				PhysicalBytes int64 `json:"physicalBytes"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				badRequest(w, r, err.Error())
+				return
+			}
+			owner := chi.URLParam(r, "owner")
+			if err := svc.SetQuota(r.Context(), owner, req.LogicalBytes, req.PhysicalBytes); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			q, err := svc.Quota(r.Context(), owner)
+			if err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(q)
+		})
+
+		r.Delete("/admin/quotas/{owner}", func(w http.ResponseWriter, r *http.Request) {
+			if err := svc.RemoveQuota(r.Context(), chi.URLParam(r, "owner")); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		r.Get("/admin/bloom", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(ext.Stats())
+		})
+
+		r.Post("/admin/bloom/save", func(w http.ResponseWriter, r *http.Request) {
+			if err := ext.Save(r.Context(), storeClient); err != nil {
+				writeError(w, r, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		// hit rates of the shared DEK cache and the user DEK pool
+		r.Get("/admin/keys", func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(svc.KeyStats())
+		})
+	})
+
+	// on SIGTERM every listener drains its in-flight requests, up to
+	// ShutdownTimeout, before the clients behind them are closed
+	var drained sync.WaitGroup
+	srv := newHTTPServer(cfg, cfg.ServerAddr, r, tlsCfg)
+	drained.Add(1)
+	go func() {
+		defer drained.Done()
+		<-ctx.Done()
+		probes.Drain()
+		shutdownHTTP(srv, cfg.ShutdownTimeout)
+	}()
+
+	// S3-compatible front end on its own listener
+	if cfg.S3GatewayAddr != "" {
+		creds, err := s3gw.ParseCredentials(cfg.S3GatewayCredentials)
+		if err != nil {
+			zap.L().Fatal("s3 gateway credentials", zap.Error(err))
+		}
+		gwOpts := []s3gw.Option{s3gw.WithCodec(defaultCodec), s3gw.WithLimiter(limiter)}
+		if cfg.StorageMode == "chunks" {
+			gwOpts = append(gwOpts, s3gw.WithChunkMode())
+		}
+		if cfg.MaxUploadBytes > 0 {
+			gwOpts = append(gwOpts, s3gw.WithMaxObjectSize(cfg.MaxUploadBytes))
+		}
+		gw := s3gw.New(svc, dbClient, storeClient, creds, gwOpts...)
+		gwSrv := newHTTPServer(cfg, cfg.S3GatewayAddr, keySource(gw), gwTLS)
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			<-ctx.Done()
+			shutdownHTTP(gwSrv, cfg.ShutdownTimeout)
+		}()
+		go func() {
+			zap.L().Info("starting s3 gateway", zap.String("addr", cfg.S3GatewayAddr), zap.Int("credentials", len(creds)))
+			if err := serveHTTP(gwSrv); err != nil {
+				zap.L().Error("s3 gateway", zap.Error(err))
+				stop()
+			}
+		}()
+	}
+
+	// gRPC API on its own listener
+	if cfg.GRPCAddr != "" {
+		lis, err := net.Listen("tcp", cfg.GRPCAddr)
+		if err != nil {
+			zap.L().Fatal("grpc listen", zap.Error(err))
+		}
+		var gsOpts []grpc.ServerOption
+		if tlsCfg != nil {
+			gsOpts = append(gsOpts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+		}
+		apiOpts := []grpcapi.Option{grpcapi.WithCodec(defaultCodec), grpcapi.WithStorageMode(cfg.StorageMode), grpcapi.WithLimiter(limiter), grpcapi.WithOperator(ops.call), grpcapi.WithMaxUploadSize(cfg.MaxUploadBytes)}
+		if certOwners != nil {
+			apiOpts = append(apiOpts, grpcapi.WithPeerOwners(certOwners.Owner))
+		}
+		gs := grpc.NewServer(gsOpts...)
+		grpcapi.New(svc, apiOpts...).Register(gs)
+		drained.Add(1)
+		go func() {
+			defer drained.Done()
+			<-ctx.Done()
+			stopped := make(chan struct{})
+			go func() {
+				gs.GracefulStop()
+				close(stopped)
+			}()
+			select {
+			case <-stopped:
+			case <-time.After(cfg.ShutdownTimeout):
+				zap.L().Warn("grpc shutdown timed out, closing open streams")
+				gs.Stop()
+			}
+		}()
+		go func() {
+			zap.L().Info("starting grpc server", zap.String("addr", cfg.GRPCAddr))
+			if err := gs.Serve(lis); err != nil {
+				zap.L().Error("grpc server", zap.Error(err))
+				stop()
+			}
+		}()
+	}
+
+	zap.L().Info("starting server", zap.String("addr", cfg.ServerAddr), zap.Bool("tls", tlsCfg != nil))
+	if err := serveHTTP(srv); err != nil {
+		zap.L().Error("server", zap.Error(err))
+		stop()
+	}
+	drained.Wait()
+	<-extDone
+	// background promotions and pruning finish before the DB and KMS clients go
+	svc.Close()
+	if err := dbClient.Close(); err != nil {
+		zap.L().Warn("close db", zap.Error(err))
+	}
+	zap.L().Info("server stopped")
 }
@@ -0,0 +1,169 @@
+// Package codec compresses file contents before they are split and sealed.
+// Compression must be deterministic: two uploads of the same content with the
+// same codec have to produce identical bytes or their d blobs stop matching.
+// Both codecs run with fixed settings and no timestamps or names in their
+// headers. Their output can still change between library versions, which, like
+// a suite change, only costs dedup against content stored before the upgrade.
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec names a compression format, as recorded in files.codec.
+type Codec string
+
+const (
+	None Codec = "none"
+	Gzip Codec = "gzip"
+	Zstd Codec = "zstd"
+)
+
+// Parse maps a codec name (empty meaning none) to its Codec.
+func Parse(name string) (Codec, error) {
+	switch c := Codec(name); c {
+	case "", None:
+		return None, nil
+	case Gzip, Zstd:
+		return c, nil
+	default:
+		return "", fmt.Errorf("unknown codec %q", name)
+	}
+}
+
+// MaxEntropy is the Shannon entropy, in bits per byte, above which data is
+// treated as already compressed or encrypted and stored as is.
+const MaxEntropy = 7.5
+
+// entropySample bounds how much of a file Entropy looks at.
+const entropySample = 1 << 20
+
+// Entropy returns the Shannon entropy of (a prefix of) data in bits per byte.
+func Entropy(data []byte) float64 {
+	if len(data) > entropySample {
+		data = data[:entropySample]
+	}
+	if len(data) == 0 {
+		return 0
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	h := 0.0
+	n := float64(len(data))
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / n
+			h -= p * math.Log2(p)
+		}
+	}
+	return h
+}
+
+// Choose compresses data with c unless it looks incompressible or compression
+// does not make it smaller. It returns the bytes to store and the codec they
+// are in.
+func Choose(c Codec, data []byte) ([]byte, Codec, error) {
+	if c == None || len(data) == 0 || Entropy(data) > MaxEntropy {
+		return data, None, nil
+	}
+	out, err := Compress(c, data)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(out) >= len(data) {
+		return data, None, nil
+	}
+	return out, c, nil
+}
+
+var zstdEnc, _ = zstd.NewWriter(nil,
+	zstd.WithEncoderLevel(zstd.SpeedDefault),
+	zstd.WithEncoderConcurrency(1),
+	zstd.WithEncoderCRC(true),
+)
+
+// Compress encodes data with c.
+func Compress(c Codec, data []byte) ([]byte, error) {
+	switch c {
+	case None:
+		return data, nil
+	case Gzip:
+		var buf bytes.Buffer
+		w, err := gzip.NewWriterLevel(&buf, gzip.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case Zstd:
+		return zstdEnc.EncodeAll(data, nil), nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", c)
+	}
+}
+
+// ErrTooLarge is returned by Decompress for data that expands past its limit.
+var ErrTooLarge = errors.New("codec: decompressed data larger than expected")
+
+// Decompress reverses Compress. It stops after max bytes of output and
+// returns ErrTooLarge if there is more, so a small blob that expands without
+// bound cannot exhaust memory; max <= 0 is no limit.
+func Decompress(c Codec, data []byte, max int64) ([]byte, error) {
+	switch c {
+	case None, "":
+		return data, nil
+	case Gzip:
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		defer r.Close()
+		out, err := readAll(r, max)
+		if err != nil {
+			return nil, fmt.Errorf("gzip: %w", err)
+		}
+		return out, nil
+	case Zstd:
+		r, err := zstd.NewReader(bytes.NewReader(data), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		defer r.Close()
+		out, err := readAll(r, max)
+		if err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", c)
+	}
+}
+
+// readAll reads r to the end, or returns ErrTooLarge past max bytes.
+func readAll(r io.Reader, max int64) ([]byte, error) {
+	if max <= 0 {
+		return io.ReadAll(r)
+	}
+	out, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(out)) > max {
+		return nil, ErrTooLarge
+	}
+	return out, nil
+}
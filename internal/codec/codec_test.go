@@ -0,0 +1,91 @@
+package codec_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+)
+
+func TestCompress_RoundTripAndDeterministic(t *testing.T) {
+	data, err := os.ReadFile("../../test_files/OpenSSH_2k.log")
+	if err != nil {
+		t.Fatalf("read sample: %v", err)
+	}
+	for _, c := range []codec.Codec{codec.Gzip, codec.Zstd} {
+		a, err := codec.Compress(c, data)
+		if err != nil {
+			t.Fatalf("%s: Compress: %v", c, err)
+		}
+		b, _ := codec.Compress(c, data)
+		if !bytes.Equal(a, b) {
+			t.Errorf("%s: compression is not deterministic", c)
+		}
+		if len(a)*5 > len(data) {
+			t.Errorf("%s: log compressed only to %d of %d bytes", c, len(a), len(data))
+		}
+		out, err := codec.Decompress(c, a, int64(len(data)))
+		if err != nil {
+			t.Fatalf("%s: Decompress: %v", c, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("%s: round trip mismatch", c)
+		}
+	}
+}
+
+func TestDecompress_RefusesOutputPastLimit(t *testing.T) {
+	bomb := make([]byte, 8<<20)
+	for _, c := range []codec.Codec{codec.Gzip, codec.Zstd} {
+		small, err := codec.Compress(c, bomb)
+		if err != nil {
+			t.Fatalf("%s: Compress: %v", c, err)
+		}
+		if _, err := codec.Decompress(c, small, 1<<20); !errors.Is(err, codec.ErrTooLarge) {
+			t.Errorf("%s: expected ErrTooLarge for %d bytes expanding to %d, got %v", c, len(small), len(bomb), err)
+		}
+		if out, err := codec.Decompress(c, small, int64(len(bomb))); err != nil || len(out) != len(bomb) {
+			t.Errorf("%s: expected data at the limit to decompress, got %d bytes, %v", c, len(out), err)
+		}
+	}
+}
+
+func TestChoose_SkipsIncompressible(t *testing.T) {
+	random := make([]byte, 64<<10)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	if e := codec.Entropy(random); e <= codec.MaxEntropy {
+		t.Fatalf("random data has entropy %.2f, expected above %.1f", e, codec.MaxEntropy)
+	}
+	out, c, err := codec.Choose(codec.Zstd, random)
+	if err != nil {
+		t.Fatalf("Choose: %v", err)
+	}
+	if c != codec.None || !bytes.Equal(out, random) {
+		t.Errorf("expected random data stored as is, got codec %s", c)
+	}
+
+	text := bytes.Repeat([]byte("sshd[1234]: Failed password for root\n"), 200)
+	out, c, err = codec.Choose(codec.Gzip, text)
+	if err != nil {
+		t.Fatalf("Choose: %v", err)
+	}
+	if c != codec.Gzip || len(out) >= len(text) {
+		t.Errorf("expected gzip to shrink repetitive text, got codec %s and %d bytes", c, len(out))
+	}
+}
+
+func TestParse(t *testing.T) {
+	for name, want := range map[string]codec.Codec{"": codec.None, "none": codec.None, "gzip": codec.Gzip, "zstd": codec.Zstd} {
+		if got, err := codec.Parse(name); err != nil || got != want {
+			t.Errorf("Parse(%q) = %q, %v", name, got, err)
+		}
+	}
+	if _, err := codec.Parse("lz4"); err == nil {
+		t.Error("expected an error for an unknown codec")
+	}
+}
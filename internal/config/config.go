@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/spf13/viper"
 )
 
@@ -8,10 +10,78 @@ type Config struct {
 	ServerAddr string
 	LogLevel   string
 
+	ReadHeaderTimeout time.Duration // time to read a request's headers
+	ReadTimeout       time.Duration // time to read a whole request, body included; 0 is unlimited
+	WriteTimeout      time.Duration // time to write a response; 0 is unlimited
+	IdleTimeout       time.Duration // how long an idle keep-alive connection stays open
+	ShutdownTimeout   time.Duration // how long in-flight requests may finish after SIGTERM
+	MaxUploadBytes    int64         // largest request body or gRPC and S3 upload accepted; 0 is unlimited
+
+	// Request limits; a zero rate or cap leaves that limit off
+	OwnerRequestRate     float64 // requests per second per owner
+	OwnerRequestBurst    int
+	GlobalRequestRate    float64 // requests per second over all owners
+	GlobalRequestBurst   int
+	OwnerByteRate        float64 // body bytes per second per owner, each way
+	GlobalByteRate       float64 // body bytes per second over all owners, each way
+	MaxConcurrentUploads int     // uploads in flight per owner
+
+	TLSCertFile       string        // PEM certificate chain; empty serves plaintext
+	TLSKeyFile        string        // PEM private key for TLSCertFile
+	TLSReloadInterval time.Duration // how often the pair is checked for changes
+	TLSClientCAFile   string        // PEM CAs for client certificates; empty disables mTLS
+	TLSClientAuth     string        // with a client CA: "optional" or "require"
+	TLSClientOwners   string        // certificate common names as cn:owner,...; empty uses the name itself
+
+	AdminToken  string // bearer token for /admin/*; empty accepts none
+	AdminOwners string // client certificate owners allowed /admin/*, comma separated
+
 	AWSRegion   string
 	KMSKeyID    string
 	S3Bucket    string
 	PostgresDSN string
+
+	KeyCacheSize    int           // decrypted shared DEKs kept in memory; 0 disables the cache
+	KeyCacheTTL     time.Duration // how long a cached DEK is used before KMS is asked again
+	UserKeyPoolSize int           // user DEKs generated ahead of uploads; 0 disables the pool
+
+	SharedSuite string // AEAD suite for the shared (pkg1) layer
+	UserSuite   string // AEAD suite for the user (sBlob) layer
+
+	KeyServerKeyFile     string  // RSA key PEM; empty disables the key server
+	KeyServerRate        float64 // evaluations per second per owner, and per client address
+	KeyServerBurst       int
+	KeyServerGlobalRate  float64 // evaluations per second over all clients; 0 is unlimited
+	KeyServerGlobalBurst int
+
+	DedupThresholdMax int           // upper bound of per-feature dedup thresholds; 0 disables them
+	DedupMinLatency   time.Duration // pad dedup-revealing responses to at least this
+
+	PopularityThreshold int // distinct owners before content is shared; 0 or 1 shares at once
+
+	StorageMode       string        // default for uploads: "dsde" or "chunks"
+	Codec             string        // default compression for uploads: "none", "gzip" or "zstd"
+	ChunkSize         int           // block size of the chunk extractor
+	BloomCapacity     uint          // items in the first layer of the extractor's Bloom filter
+	BloomFPRate       float64       // overall false-positive bound of that filter
+	BloomSaveInterval time.Duration // how often the filter is persisted
+
+	LinkKeys   string        // signed-link keys as id:hexsecret,...; the first signs, empty disables links
+	LinkMaxTTL time.Duration // longest lifetime of a signed link
+
+	RetainVersions int           // versions kept per path; 0 keeps all
+	RetainFor      time.Duration // prune older versions past this age; 0 keeps them
+	PruneInterval  time.Duration // how often the retention policy runs
+
+	QuotaLogicalBytes  int64 // default limit on an owner's file sizes; 0 is unlimited
+	QuotaPhysicalBytes int64 // default limit on the stored bytes charged to an owner; 0 is unlimited
+
+	S3GatewayAddr        string // listen address of the S3-compatible gateway; empty disables it
+	S3GatewayCredentials string // gateway access keys as accesskey:secret:owner,...
+
+	DAVUsers string // WebDAV logins as user:password,...; empty trusts X-Owner-ID
+
+	GRPCAddr string // listen address of the gRPC API; empty disables it
 }
 
 func Load() (*Config, error) {
@@ -20,15 +90,121 @@ func Load() (*Config, error) {
 
 	viper.SetDefault("SERVER_ADDR", ":8080")
 	viper.SetDefault("LOG_LEVEL", "info")
+	viper.SetDefault("READ_HEADER_TIMEOUT", "10s")
+	viper.SetDefault("READ_TIMEOUT", "10m")
+	viper.SetDefault("WRITE_TIMEOUT", "10m")
+	viper.SetDefault("IDLE_TIMEOUT", "2m")
+	viper.SetDefault("SHUTDOWN_TIMEOUT", "30s")
+	viper.SetDefault("MAX_UPLOAD_BYTES", 1<<30)
+	viper.SetDefault("OWNER_REQUEST_RATE", 0)
+	viper.SetDefault("OWNER_REQUEST_BURST", 20)
+	viper.SetDefault("GLOBAL_REQUEST_RATE", 0)
+	viper.SetDefault("GLOBAL_REQUEST_BURST", 200)
+	viper.SetDefault("OWNER_BYTE_RATE", 0)
+	viper.SetDefault("GLOBAL_BYTE_RATE", 0)
+	viper.SetDefault("MAX_CONCURRENT_UPLOADS", 0)
+	viper.SetDefault("TLS_RELOAD_INTERVAL", "1m")
+	viper.SetDefault("TLS_CLIENT_AUTH", "require")
+	viper.SetDefault("KEY_CACHE_SIZE", 1024)
+	viper.SetDefault("KEY_CACHE_TTL", "5m")
+	viper.SetDefault("USER_KEY_POOL_SIZE", 0)
+	viper.SetDefault("SHARED_SUITE", "aes-gcm-siv")
+	viper.SetDefault("USER_SUITE", "xchacha20-poly1305")
+	viper.SetDefault("KEYSERVER_RATE", 1.0)
+	viper.SetDefault("KEYSERVER_BURST", 20)
+	viper.SetDefault("KEYSERVER_GLOBAL_RATE", 100.0)
+	viper.SetDefault("KEYSERVER_GLOBAL_BURST", 1000)
+	viper.SetDefault("DEDUP_THRESHOLD_MAX", 0)
+	viper.SetDefault("DEDUP_MIN_LATENCY", "0s")
+	viper.SetDefault("POPULARITY_THRESHOLD", 0)
+	viper.SetDefault("STORAGE_MODE", "dsde")
+	viper.SetDefault("CODEC", "none")
+	viper.SetDefault("CHUNK_SIZE", 4096)
+	viper.SetDefault("BLOOM_CAPACITY", 1000000)
+	viper.SetDefault("BLOOM_FP_RATE", 0.01)
+	viper.SetDefault("BLOOM_SAVE_INTERVAL", "5m")
+	viper.SetDefault("LINK_MAX_TTL", "24h")
+	viper.SetDefault("RETAIN_VERSIONS", 0)
+	viper.SetDefault("RETAIN_FOR", "0s")
+	viper.SetDefault("PRUNE_INTERVAL", "1h")
+	viper.SetDefault("QUOTA_LOGICAL_BYTES", 0)
+	viper.SetDefault("QUOTA_PHYSICAL_BYTES", 0)
 
 	cfg := &Config{
 		ServerAddr: viper.GetString("SERVER_ADDR"),
 		LogLevel:   viper.GetString("LOG_LEVEL"),
 
+		ReadHeaderTimeout: viper.GetDuration("READ_HEADER_TIMEOUT"),
+		ReadTimeout:       viper.GetDuration("READ_TIMEOUT"),
+		WriteTimeout:      viper.GetDuration("WRITE_TIMEOUT"),
+		IdleTimeout:       viper.GetDuration("IDLE_TIMEOUT"),
+		ShutdownTimeout:   viper.GetDuration("SHUTDOWN_TIMEOUT"),
+		MaxUploadBytes:    viper.GetInt64("MAX_UPLOAD_BYTES"),
+
+		OwnerRequestRate:     viper.GetFloat64("OWNER_REQUEST_RATE"),
+		OwnerRequestBurst:    viper.GetInt("OWNER_REQUEST_BURST"),
+		GlobalRequestRate:    viper.GetFloat64("GLOBAL_REQUEST_RATE"),
+		GlobalRequestBurst:   viper.GetInt("GLOBAL_REQUEST_BURST"),
+		OwnerByteRate:        viper.GetFloat64("OWNER_BYTE_RATE"),
+		GlobalByteRate:       viper.GetFloat64("GLOBAL_BYTE_RATE"),
+		MaxConcurrentUploads: viper.GetInt("MAX_CONCURRENT_UPLOADS"),
+
+		TLSCertFile:       viper.GetString("TLS_CERT_FILE"),
+		TLSKeyFile:        viper.GetString("TLS_KEY_FILE"),
+		TLSReloadInterval: viper.GetDuration("TLS_RELOAD_INTERVAL"),
+		TLSClientCAFile:   viper.GetString("TLS_CLIENT_CA_FILE"),
+		TLSClientAuth:     viper.GetString("TLS_CLIENT_AUTH"),
+		TLSClientOwners:   viper.GetString("TLS_CLIENT_OWNERS"),
+
+		AdminToken:  viper.GetString("ADMIN_TOKEN"),
+		AdminOwners: viper.GetString("ADMIN_OWNERS"),
+
 		AWSRegion:   viper.GetString("AWS_REGION"),
 		KMSKeyID:    viper.GetString("KMS_KEY_ID"),
 		S3Bucket:    viper.GetString("S3_BUCKET"),
 		PostgresDSN: viper.GetString("POSTGRES_DSN"),
+
+		KeyCacheSize:    viper.GetInt("KEY_CACHE_SIZE"),
+		KeyCacheTTL:     viper.GetDuration("KEY_CACHE_TTL"),
+		UserKeyPoolSize: viper.GetInt("USER_KEY_POOL_SIZE"),
+
+		SharedSuite: viper.GetString("SHARED_SUITE"),
+		UserSuite:   viper.GetString("USER_SUITE"),
+
+		KeyServerKeyFile:     viper.GetString("KEYSERVER_KEY_FILE"),
+		KeyServerRate:        viper.GetFloat64("KEYSERVER_RATE"),
+		KeyServerBurst:       viper.GetInt("KEYSERVER_BURST"),
+		KeyServerGlobalRate:  viper.GetFloat64("KEYSERVER_GLOBAL_RATE"),
+		KeyServerGlobalBurst: viper.GetInt("KEYSERVER_GLOBAL_BURST"),
+
+		DedupThresholdMax: viper.GetInt("DEDUP_THRESHOLD_MAX"),
+		DedupMinLatency:   viper.GetDuration("DEDUP_MIN_LATENCY"),
+
+		PopularityThreshold: viper.GetInt("POPULARITY_THRESHOLD"),
+
+		StorageMode:       viper.GetString("STORAGE_MODE"),
+		Codec:             viper.GetString("CODEC"),
+		ChunkSize:         viper.GetInt("CHUNK_SIZE"),
+		BloomCapacity:     viper.GetUint("BLOOM_CAPACITY"),
+		BloomFPRate:       viper.GetFloat64("BLOOM_FP_RATE"),
+		BloomSaveInterval: viper.GetDuration("BLOOM_SAVE_INTERVAL"),
+
+		LinkKeys:   viper.GetString("LINK_KEYS"),
+		LinkMaxTTL: viper.GetDuration("LINK_MAX_TTL"),
+
+		RetainVersions: viper.GetInt("RETAIN_VERSIONS"),
+		RetainFor:      viper.GetDuration("RETAIN_FOR"),
+		PruneInterval:  viper.GetDuration("PRUNE_INTERVAL"),
+
+		QuotaLogicalBytes:  viper.GetInt64("QUOTA_LOGICAL_BYTES"),
+		QuotaPhysicalBytes: viper.GetInt64("QUOTA_PHYSICAL_BYTES"),
+
+		S3GatewayAddr:        viper.GetString("S3_GATEWAY_ADDR"),
+		S3GatewayCredentials: viper.GetString("S3_GATEWAY_CREDENTIALS"),
+
+		DAVUsers: viper.GetString("DAV_USERS"),
+
+		GRPCAddr: viper.GetString("GRPC_ADDR"),
 	}
 	return cfg, nil
 }
@@ -3,6 +3,7 @@ package config_test
 import (
 	"os"
 	"testing"
+	"time"
 
 	"github.com/Anish-Chanda/double-layer-dedup/internal/config"
 )
@@ -22,6 +23,79 @@ func TestLoad_Defaults(t *testing.T) {
 	if cfg.LogLevel != "info" {
 		t.Errorf("expected LogLevel 'info', got '%s'", cfg.LogLevel)
 	}
+	if cfg.ReadHeaderTimeout != 10*time.Second || cfg.ReadTimeout != 10*time.Minute || cfg.WriteTimeout != 10*time.Minute || cfg.IdleTimeout != 2*time.Minute {
+		t.Errorf("unexpected server timeouts: header %s, read %s, write %s, idle %s", cfg.ReadHeaderTimeout, cfg.ReadTimeout, cfg.WriteTimeout, cfg.IdleTimeout)
+	}
+	if cfg.ShutdownTimeout != 30*time.Second || cfg.MaxUploadBytes != 1<<30 {
+		t.Errorf("expected a 30s shutdown and 1 GiB uploads, got %s, %d bytes", cfg.ShutdownTimeout, cfg.MaxUploadBytes)
+	}
+	if cfg.OwnerRequestRate != 0 || cfg.GlobalRequestRate != 0 || cfg.OwnerByteRate != 0 || cfg.GlobalByteRate != 0 || cfg.MaxConcurrentUploads != 0 {
+		t.Errorf("expected no request limits, got %v/%v req/s, %v/%v B/s, %d uploads",
+			cfg.OwnerRequestRate, cfg.GlobalRequestRate, cfg.OwnerByteRate, cfg.GlobalByteRate, cfg.MaxConcurrentUploads)
+	}
+	if cfg.OwnerRequestBurst != 20 || cfg.GlobalRequestBurst != 200 {
+		t.Errorf("expected request bursts 20 per owner and 200 overall, got %d and %d", cfg.OwnerRequestBurst, cfg.GlobalRequestBurst)
+	}
+	if cfg.TLSCertFile != "" || cfg.TLSClientCAFile != "" {
+		t.Errorf("expected plaintext without client certificates, got cert %q, client CA %q", cfg.TLSCertFile, cfg.TLSClientCAFile)
+	}
+	if cfg.TLSReloadInterval != time.Minute || cfg.TLSClientAuth != "require" {
+		t.Errorf("unexpected TLS defaults: reload every %s, client auth %q", cfg.TLSReloadInterval, cfg.TLSClientAuth)
+	}
+	if cfg.AdminToken != "" || cfg.AdminOwners != "" {
+		t.Errorf("expected no admin credentials by default, got owners %q", cfg.AdminOwners)
+	}
+	if cfg.SharedSuite != "aes-gcm-siv" {
+		t.Errorf("expected SharedSuite 'aes-gcm-siv', got '%s'", cfg.SharedSuite)
+	}
+	if cfg.UserSuite != "xchacha20-poly1305" {
+		t.Errorf("expected UserSuite 'xchacha20-poly1305', got '%s'", cfg.UserSuite)
+	}
+	if cfg.KeyServerKeyFile != "" {
+		t.Errorf("expected key server disabled by default, got key file '%s'", cfg.KeyServerKeyFile)
+	}
+	if cfg.KeyServerGlobalRate != 100 || cfg.KeyServerGlobalBurst != 1000 {
+		t.Errorf("expected a global key server budget of 100/s up to 1000, got %v up to %d", cfg.KeyServerGlobalRate, cfg.KeyServerGlobalBurst)
+	}
+	if cfg.DedupThresholdMax != 0 || cfg.DedupMinLatency != 0 {
+		t.Errorf("expected dedup thresholds disabled by default, got max %d, min latency %s", cfg.DedupThresholdMax, cfg.DedupMinLatency)
+	}
+	if cfg.PopularityThreshold != 0 {
+		t.Errorf("expected popularity threshold disabled by default, got %d", cfg.PopularityThreshold)
+	}
+	if cfg.StorageMode != "dsde" {
+		t.Errorf("expected StorageMode 'dsde', got '%s'", cfg.StorageMode)
+	}
+	if cfg.Codec != "none" {
+		t.Errorf("expected Codec 'none', got '%s'", cfg.Codec)
+	}
+	if cfg.ChunkSize != 4096 || cfg.BloomCapacity != 1000000 || cfg.BloomFPRate != 0.01 {
+		t.Errorf("unexpected extractor defaults: chunk %d, capacity %d, fp %v", cfg.ChunkSize, cfg.BloomCapacity, cfg.BloomFPRate)
+	}
+	if cfg.BloomSaveInterval != 5*time.Minute {
+		t.Errorf("expected BloomSaveInterval 5m, got %s", cfg.BloomSaveInterval)
+	}
+	if cfg.LinkKeys != "" || cfg.LinkMaxTTL != 24*time.Hour {
+		t.Errorf("expected signed links disabled with a 24h max TTL, got keys %q, TTL %s", cfg.LinkKeys, cfg.LinkMaxTTL)
+	}
+	if cfg.RetainVersions != 0 || cfg.RetainFor != 0 || cfg.PruneInterval != time.Hour {
+		t.Errorf("expected all versions retained, pruning hourly, got keep %d, for %s, every %s", cfg.RetainVersions, cfg.RetainFor, cfg.PruneInterval)
+	}
+	if cfg.KeyCacheSize != 1024 || cfg.KeyCacheTTL != 5*time.Minute || cfg.UserKeyPoolSize != 0 {
+		t.Errorf("expected a 1024-key cache with a 5m TTL and no user key pool, got %d, %s, pool %d", cfg.KeyCacheSize, cfg.KeyCacheTTL, cfg.UserKeyPoolSize)
+	}
+	if cfg.QuotaLogicalBytes != 0 || cfg.QuotaPhysicalBytes != 0 {
+		t.Errorf("expected no default quota, got logical %d, physical %d", cfg.QuotaLogicalBytes, cfg.QuotaPhysicalBytes)
+	}
+	if cfg.S3GatewayAddr != "" || cfg.S3GatewayCredentials != "" {
+		t.Errorf("expected the S3 gateway disabled, got addr %q", cfg.S3GatewayAddr)
+	}
+	if cfg.DAVUsers != "" {
+		t.Errorf("expected no WebDAV users, got %q", cfg.DAVUsers)
+	}
+	if cfg.GRPCAddr != "" {
+		t.Errorf("expected the gRPC API disabled, got %q", cfg.GRPCAddr)
+	}
 }
 
 func TestLoad_WithEnvOverrides(t *testing.T) {
@@ -0,0 +1,472 @@
+package davfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+)
+
+// fileSystem is one owner's namespace as a webdav.FileSystem. Names are
+// slash-separated and rooted; the root is the owner's top-level folder.
+type fileSystem struct {
+	h     *Handler
+	owner string
+}
+
+// pathError maps the file service's errors onto the os errors the webdav
+// package turns into status codes.
+func pathError(op, name string, err error) error {
+	switch {
+	case errors.Is(err, dsde.ErrFileNotFound):
+		err = fs.ErrNotExist
+	case errors.Is(err, dsde.ErrExists):
+		err = fs.ErrExist
+	case errors.Is(err, dsde.ErrInvalidPath):
+		err = fs.ErrInvalid
+	default:
+		return err
+	}
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+func clean(name string) (string, error) {
+	p, err := dsde.CleanPath(name)
+	if err != nil {
+		return "", pathError("open", name, err)
+	}
+	return p, nil
+}
+
+// isDir reports whether p is the root or a folder.
+func (f *fileSystem) isDir(ctx context.Context, p string) (bool, error) {
+	if p == "" {
+		return true, nil
+	}
+	_, folder, err := f.h.files.Stat(ctx, f.owner, p)
+	return folder, err
+}
+
+func (f *fileSystem) Mkdir(ctx context.Context, name string, _ os.FileMode) error {
+	p, err := clean(name)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return pathError("mkdir", name, dsde.ErrExists)
+	}
+	file, folder, err := f.h.files.Stat(ctx, f.owner, p)
+	if err != nil {
+		return err
+	}
+	if file || folder {
+		return pathError("mkdir", name, dsde.ErrExists)
+	}
+	// unlike the /fs API, WebDAV wants the parent to exist already
+	if parent, err := f.isDir(ctx, parentOf(p)); err != nil {
+		return err
+	} else if !parent {
+		return pathError("mkdir", name, dsde.ErrFileNotFound)
+	}
+	return pathError("mkdir", name, f.h.files.Mkdir(ctx, f.owner, p))
+}
+
+func parentOf(p string) string {
+	if dir := path.Dir(p); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+func (f *fileSystem) OpenFile(ctx context.Context, name string, flag int, _ os.FileMode) (webdav.File, error) {
+	p, err := clean(name)
+	if err != nil {
+		return nil, err
+	}
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		return f.create(ctx, name, p, flag)
+	}
+	fi, err := f.stat(ctx, p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	if fi.dir {
+		return &dirFile{fs: f, ctx: ctx, p: p, info: fi}, nil
+	}
+	return &readFile{fs: f, ctx: ctx, info: fi}, nil
+}
+
+// create opens a new version of p for writing. Only whole-file writes are
+// supported, as versions are immutable.
+func (f *fileSystem) create(ctx context.Context, name, p string, flag int) (webdav.File, error) {
+	if flag&os.O_CREATE == 0 || flag&(os.O_TRUNC|os.O_EXCL) == 0 {
+		return nil, pathError("open", name, dsde.ErrInvalidPath)
+	}
+	if flag&os.O_EXCL != 0 {
+		if file, folder, err := f.h.files.Stat(ctx, f.owner, p); err != nil {
+			return nil, err
+		} else if file || folder {
+			return nil, pathError("open", name, dsde.ErrExists)
+		}
+	}
+	if parent, err := f.isDir(ctx, parentOf(p)); err != nil {
+		return nil, err
+	} else if !parent {
+		return nil, pathError("open", name, dsde.ErrFileNotFound)
+	}
+	p, err := f.h.files.FilePath(ctx, f.owner, p)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &writeFile{fs: f, ctx: ctx, p: p}, nil
+}
+
+// RemoveAll deletes a file with all its versions, or a folder and
+// everything beneath it.
+func (f *fileSystem) RemoveAll(ctx context.Context, name string) error {
+	p, err := clean(name)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return pathError("remove", name, dsde.ErrInvalidPath)
+	}
+	file, folder, err := f.h.files.Stat(ctx, f.owner, p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case file:
+		return pathError("remove", name, f.h.files.DeletePath(ctx, f.owner, p))
+	case !folder:
+		return pathError("remove", name, dsde.ErrFileNotFound)
+	}
+
+	entries, err := f.h.files.List(ctx, f.owner, p, true)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	var folders []string
+	for _, e := range entries {
+		if e.Folder {
+			folders = append(folders, e.Path)
+		} else if err := f.h.files.DeletePath(ctx, f.owner, e.Path); err != nil && !errors.Is(err, dsde.ErrFileNotFound) {
+			return err
+		}
+	}
+	// children before their parents; implied folders are already gone
+	sort.Sort(sort.Reverse(sort.StringSlice(folders)))
+	for _, dir := range append(folders, p) {
+		if err := f.h.files.Rmdir(ctx, f.owner, dir); err != nil && !errors.Is(err, dsde.ErrFileNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Rename moves a file, with its versions, or a folder. The webdav package
+// has already removed an existing destination it may overwrite.
+func (f *fileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	to, err := clean(newName)
+	if err != nil {
+		return err
+	}
+	if parent, err := f.isDir(ctx, parentOf(to)); err != nil {
+		return err
+	} else if !parent {
+		return pathError("rename", newName, dsde.ErrFileNotFound)
+	}
+	return pathError("rename", oldName, f.h.files.Move(ctx, f.owner, oldName, to))
+}
+
+func (f *fileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	p, err := clean(name)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.stat(ctx, p)
+	if err != nil {
+		return nil, pathError("stat", name, err)
+	}
+	return fi, nil
+}
+
+func (f *fileSystem) stat(ctx context.Context, p string) (*fileInfo, error) {
+	if p == "" {
+		return &fileInfo{name: "/", dir: true}, nil
+	}
+	file, folder, err := f.h.files.Stat(ctx, f.owner, p)
+	if err != nil {
+		return nil, err
+	}
+	if folder {
+		return &fileInfo{name: path.Base(p), dir: true}, nil
+	}
+	if !file {
+		return nil, dsde.ErrFileNotFound
+	}
+	versions, err := f.h.files.Versions(ctx, f.owner, p)
+	if err != nil {
+		return nil, err
+	}
+	infos, err := f.fileInfos(ctx, []db.TreeEntry{{Path: p, FileID: versions[0].FileID, CreatedAt: versions[0].CreatedAt}})
+	if err != nil {
+		return nil, err
+	}
+	return infos[0], nil
+}
+
+// fileInfos describes files, filling in the size and ETag of any stored by
+// another API and never measured.
+func (f *fileSystem) fileInfos(ctx context.Context, entries []db.TreeEntry) ([]*fileInfo, error) {
+	ids := make([]string, len(entries))
+	for i, e := range entries {
+		ids[i] = e.FileID
+	}
+	metas, err := f.h.meta.ObjectMetas(ids)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*fileInfo, len(entries))
+	for i, e := range entries {
+		m, ok := metas[e.FileID]
+		if !ok {
+			if m, err = f.measure(ctx, e.FileID); err != nil {
+				return nil, err
+			}
+		}
+		infos[i] = &fileInfo{name: path.Base(e.Path), fileID: e.FileID, size: m.Size, modTime: e.CreatedAt, etag: m.ETag, contentType: m.ContentType}
+	}
+	return infos, nil
+}
+
+func (f *fileSystem) measure(ctx context.Context, fileID string) (db.ObjectMeta, error) {
+	rc, err := f.h.files.Download(ctx, f.owner, fileID)
+	if err != nil {
+		return db.ObjectMeta{}, err
+	}
+	defer rc.Close()
+	h := md5.New()
+	n, err := io.Copy(h, rc)
+	if err != nil {
+		return db.ObjectMeta{}, err
+	}
+	m := db.ObjectMeta{FileID: fileID, Size: n, ETag: hex.EncodeToString(h.Sum(nil))}
+	return m, f.h.meta.PutObjectMeta(m)
+}
+
+// fileInfo describes a file or folder. It supplies the ETag and content
+// type itself so listings never have to read file contents.
+type fileInfo struct {
+	name        string
+	dir         bool
+	fileID      string
+	size        int64
+	modTime     time.Time
+	etag        string // hex MD5 of the contents
+	contentType string
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() os.FileMode {
+	if fi.dir {
+		return os.ModeDir | 0o755
+	}
+	return 0o644
+}
+
+func (fi *fileInfo) ETag(context.Context) (string, error) {
+	if fi.dir || fi.etag == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.etag + `"`, nil
+}
+
+func (fi *fileInfo) ContentType(context.Context) (string, error) {
+	if fi.contentType != "" {
+		return fi.contentType, nil
+	}
+	if t := mime.TypeByExtension(path.Ext(fi.name)); t != "" {
+		return t, nil
+	}
+	return "application/octet-stream", nil
+}
+
+// dirFile is an open folder; it can only be listed.
+type dirFile struct {
+	fs   *fileSystem
+	ctx  context.Context
+	p    string
+	info *fileInfo
+	read bool
+}
+
+func (d *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if d.read {
+		if count > 0 {
+			return nil, io.EOF
+		}
+		return nil, nil
+	}
+	d.read = true
+	entries, err := d.fs.h.files.List(d.ctx, d.fs.owner, d.p, false)
+	if err != nil {
+		return nil, err
+	}
+	var out []fs.FileInfo
+	var files []db.TreeEntry
+	for _, e := range entries {
+		if e.Folder {
+			out = append(out, &fileInfo{name: path.Base(e.Path), dir: true, modTime: e.CreatedAt})
+		} else {
+			files = append(files, e)
+		}
+	}
+	if len(files) > 0 {
+		infos, err := d.fs.fileInfos(d.ctx, files)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range infos {
+			out = append(out, fi)
+		}
+	}
+	return out, nil
+}
+
+func (d *dirFile) Stat() (fs.FileInfo, error)     { return d.info, nil }
+func (d *dirFile) Close() error                   { return nil }
+func (d *dirFile) Read([]byte) (int, error)       { return 0, fs.ErrInvalid }
+func (d *dirFile) Seek(int64, int) (int64, error) { return 0, fs.ErrInvalid }
+func (d *dirFile) Write([]byte) (int, error)      { return 0, fs.ErrInvalid }
+
+// readFile is the newest version of a file, open for reading. Its contents
+// are only fetched once read, so HEAD and PROPFIND never download.
+type readFile struct {
+	fs   *fileSystem
+	ctx  context.Context
+	info *fileInfo
+	r    io.ReadSeeker
+	rc   io.Closer
+}
+
+// load opens the file's contents, reading them into memory only if the
+// download cannot seek.
+func (f *readFile) load() error {
+	if f.r != nil {
+		return nil
+	}
+	rc, err := f.fs.h.files.Download(f.ctx, f.fs.owner, f.info.fileID)
+	if err != nil {
+		return err
+	}
+	if rs, ok := rc.(io.ReadSeeker); ok {
+		f.r, f.rc = rs, rc
+		return nil
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return err
+	}
+	f.r = bytes.NewReader(data)
+	return nil
+}
+
+func (f *readFile) Read(p []byte) (int, error) {
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.r.Read(p)
+}
+
+func (f *readFile) Seek(offset int64, whence int) (int64, error) {
+	// finding the size needs no download
+	if f.r == nil && whence == io.SeekEnd && offset == 0 {
+		return f.info.size, nil
+	}
+	if f.r == nil && whence == io.SeekStart && offset == 0 {
+		return 0, nil
+	}
+	if err := f.load(); err != nil {
+		return 0, err
+	}
+	return f.r.Seek(offset, whence)
+}
+
+func (f *readFile) Readdir(int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
+func (f *readFile) Stat() (fs.FileInfo, error)         { return f.info, nil }
+func (f *readFile) Write([]byte) (int, error)          { return 0, fs.ErrPermission }
+
+func (f *readFile) Close() error {
+	if f.rc != nil {
+		return f.rc.Close()
+	}
+	return nil
+}
+
+// writeFile buffers a new version of a file and stores it on Close.
+type writeFile struct {
+	fs   *fileSystem
+	ctx  context.Context
+	p    string
+	buf  bytes.Buffer
+	done bool
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	if int64(f.buf.Len()+len(p)) > f.fs.h.maxSize {
+		return 0, errors.New("davfs: file too large")
+	}
+	return f.buf.Write(p)
+}
+
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	sum := md5.Sum(f.buf.Bytes())
+	return &fileInfo{name: path.Base(f.p), size: int64(f.buf.Len()), modTime: time.Now(), etag: hex.EncodeToString(sum[:])}, nil
+}
+
+func (f *writeFile) Close() error {
+	if f.done {
+		return nil
+	}
+	f.done = true
+	var (
+		fileID string
+		err    error
+	)
+	data := f.buf.Bytes()
+	if f.fs.h.chunks {
+		fileID, _, _, _, err = f.fs.h.files.UploadChunks(f.ctx, f.fs.owner, f.p, bytes.NewReader(data))
+	} else {
+		fileID, _, _, _, err = f.fs.h.files.UploadWithCodec(f.ctx, f.fs.owner, f.p, f.fs.h.codec, bytes.NewReader(data))
+	}
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	contentType := mime.TypeByExtension(path.Ext(f.p))
+	return f.fs.h.meta.PutObjectMeta(db.ObjectMeta{FileID: fileID, Size: int64(len(data)), ETag: hex.EncodeToString(sum[:]), ContentType: contentType})
+}
+
+func (f *writeFile) Read([]byte) (int, error)           { return 0, fs.ErrPermission }
+func (f *writeFile) Seek(int64, int) (int64, error)     { return 0, fs.ErrInvalid }
+func (f *writeFile) Readdir(int) ([]fs.FileInfo, error) { return nil, fs.ErrInvalid }
@@ -0,0 +1,211 @@
+// Package davfs serves an owner's namespace over WebDAV, so the files they
+// store can be browsed, opened and saved from a file manager. Folders and
+// paths are those of the /fs API; writes go through the DSDE file service
+// and so are deduplicated and double-layer encrypted like any upload.
+//
+// Each owner gets a file system and lock table of their own. With users
+// configured, requests authenticate with HTTP Basic and the user name is
+// the owner; otherwise the owner comes from X-Owner-ID, as on the rest of
+// the API.
+package davfs
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+)
+
+// Files is the namespace and file service behind the file system;
+// *dsde.Service implements it.
+type Files interface {
+	FilePath(ctx context.Context, ownerID, p string) (string, error)
+	UploadWithCodec(ctx context.Context, ownerID, filename string, c codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error)
+	UploadChunks(ctx context.Context, ownerID, filename string, r io.Reader) (string, []byte, []byte, []byte, error)
+	Versions(ctx context.Context, ownerID, path string) ([]db.FileVersion, error)
+	Download(ctx context.Context, ownerID, fileID string) (io.ReadCloser, error)
+	Stat(ctx context.Context, ownerID, p string) (file, folder bool, err error)
+	List(ctx context.Context, ownerID, p string, recursive bool) ([]db.TreeEntry, error)
+	Mkdir(ctx context.Context, ownerID, p string) error
+	Rmdir(ctx context.Context, ownerID, p string) error
+	Move(ctx context.Context, ownerID, from, to string) error
+	DeletePath(ctx context.Context, ownerID, path string) error
+}
+
+// Meta records file sizes and ETags by file ID; *db.Client implements it.
+type Meta interface {
+	PutObjectMeta(m db.ObjectMeta) error
+	ObjectMetas(fileIDs []string) (map[string]db.ObjectMeta, error)
+}
+
+// Handler is the WebDAV front end, mounted under a URL prefix.
+type Handler struct {
+	files  Files
+	meta   Meta
+	prefix string
+	users  map[string]string // password by user name; nil trusts X-Owner-ID
+
+	codec   codec.Codec
+	chunks  bool  // store files in chunk mode instead of DSDE
+	maxSize int64 // largest file accepted, in bytes
+
+	wrap func(http.Handler) http.Handler // around each request once its owner is known
+
+	mu      sync.Mutex
+	byOwner map[string]*webdav.Handler
+}
+
+// Option configures a Handler.
+type Option func(*Handler)
+
+// WithUsers requires HTTP Basic authentication against users, password by
+// user name.
+func WithUsers(users map[string]string) Option {
+	return func(h *Handler) {
+		h.users = users
+	}
+}
+
+// WithCodec compresses files with c before they are sealed.
+func WithCodec(c codec.Codec) Option {
+	return func(h *Handler) {
+		h.codec = c
+	}
+}
+
+// WithChunkMode stores files in chunk mode instead of DSDE.
+func WithChunkMode() Option {
+	return func(h *Handler) {
+		h.chunks = true
+	}
+}
+
+// WithMaxFileSize caps the size of a file written over WebDAV.
+func WithMaxFileSize(n int64) Option {
+	return func(h *Handler) {
+		h.maxSize = n
+	}
+}
+
+// WithOwnerMiddleware runs mw around every request once its owner has been
+// resolved, with X-Owner-ID set to that owner, so per-owner limits apply to
+// users who authenticate with a password too. Requests that fail to
+// authenticate pass through mw without X-Owner-ID.
+func WithOwnerMiddleware(mw func(http.Handler) http.Handler) Option {
+	return func(h *Handler) {
+		h.wrap = mw
+	}
+}
+
+// New returns a Handler serving files under prefix, e.g. "/dav".
+func New(files Files, meta Meta, prefix string, opts ...Option) *Handler {
+	h := &Handler{
+		files:   files,
+		meta:    meta,
+		prefix:  strings.TrimSuffix(prefix, "/"),
+		codec:   codec.None,
+		maxSize: 1 << 30,
+		byOwner: make(map[string]*webdav.Handler),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	return h
+}
+
+// ParseUsers parses a comma-separated list of user:password pairs.
+func ParseUsers(spec string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		user, pass, ok := strings.Cut(part, ":")
+		if !ok || user == "" || pass == "" {
+			return nil, fmt.Errorf("davfs: user %q is not user:password", part)
+		}
+		if _, dup := users[user]; dup {
+			return nil, fmt.Errorf("davfs: duplicate user %q", user)
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// ServeHTTP resolves the owner and hands the request to their WebDAV
+// handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	owner, ok := h.owner(r)
+	var next http.Handler
+	if ok {
+		next = h.ownerHandler(owner)
+		r.Header.Set("X-Owner-ID", owner)
+	} else {
+		next = http.HandlerFunc(h.refuse)
+		r.Header.Del("X-Owner-ID")
+	}
+	if h.wrap != nil {
+		next = h.wrap(next)
+	}
+	next.ServeHTTP(w, r)
+}
+
+// refuse answers a request whose owner could not be resolved.
+func (h *Handler) refuse(w http.ResponseWriter, _ *http.Request) {
+	if h.users != nil {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dsde", charset="UTF-8"`)
+		http.Error(w, "authentication required", http.StatusUnauthorized)
+		return
+	}
+	http.Error(w, "missing owner header", http.StatusBadRequest)
+}
+
+func (h *Handler) owner(r *http.Request) (string, bool) {
+	if h.users == nil {
+		owner := r.Header.Get("X-Owner-ID")
+		return owner, owner != ""
+	}
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	want, known := h.users[user]
+	// compare against something either way so unknown users take as long
+	if !known {
+		want = pass + "x"
+	}
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(want)) != 1 {
+		return "", false
+	}
+	return user, true
+}
+
+func (h *Handler) ownerHandler(owner string) *webdav.Handler {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dh, ok := h.byOwner[owner]
+	if !ok {
+		dh = &webdav.Handler{
+			Prefix:     h.prefix,
+			FileSystem: &fileSystem{h: h, owner: owner},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					zap.L().Named("davfs").Debug(r.Method, zap.String("path", r.URL.Path), zap.String("owner", owner), zap.Error(err))
+				}
+			},
+		}
+		h.byOwner[owner] = dh
+	}
+	return dh
+}
@@ -0,0 +1,428 @@
+package davfs_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/studio-b12/gowebdav"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/davfs"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+)
+
+// memFiles is an in-memory stand-in for the file service: versioned files
+// and explicit folders per owner, with folders also implied by file paths.
+type memFiles struct {
+	mu       sync.Mutex
+	next     int
+	data     map[string][]byte           // by file ID
+	versions map[string][]db.FileVersion // by owner/path, oldest first
+	folders  map[string]bool             // by owner/path
+}
+
+func newMemFiles() *memFiles {
+	return &memFiles{data: make(map[string][]byte), versions: make(map[string][]db.FileVersion), folders: make(map[string]bool)}
+}
+
+func (m *memFiles) FilePath(ctx context.Context, owner, p string) (string, error) {
+	p, err := dsde.CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if _, folder, _ := m.Stat(ctx, owner, p); folder {
+		return "", dsde.ErrExists
+	}
+	return p, nil
+}
+
+func (m *memFiles) UploadWithCodec(_ context.Context, owner, name string, _ codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	id := fmt.Sprintf("file-%d", m.next)
+	m.data[id] = data
+	k := owner + "/" + name
+	m.versions[k] = append(m.versions[k], db.FileVersion{FileID: id, Version: len(m.versions[k]) + 1, CreatedAt: time.Now()})
+	return id, nil, nil, nil, nil
+}
+
+func (m *memFiles) UploadChunks(ctx context.Context, owner, name string, r io.Reader) (string, []byte, []byte, []byte, error) {
+	return m.UploadWithCodec(ctx, owner, name, codec.None, r)
+}
+
+func (m *memFiles) Versions(_ context.Context, owner, p string) ([]db.FileVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vs := m.versions[owner+"/"+p]
+	if len(vs) == 0 {
+		return nil, dsde.ErrFileNotFound
+	}
+	out := make([]db.FileVersion, len(vs))
+	for i, v := range vs {
+		out[len(vs)-1-i] = v
+	}
+	return out, nil
+}
+
+func (m *memFiles) Download(_ context.Context, _, fileID string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(m.data[fileID])), nil
+}
+
+func (m *memFiles) Stat(_ context.Context, owner, p string) (bool, bool, error) {
+	p, err := dsde.CleanPath(p)
+	if err != nil {
+		return false, false, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := owner + "/" + p
+	_, file := m.versions[k]
+	if m.folders[k] {
+		return file, true, nil
+	}
+	for f := range m.versions {
+		if strings.HasPrefix(f, k+"/") {
+			return file, true, nil
+		}
+	}
+	return file, false, nil
+}
+
+func (m *memFiles) List(_ context.Context, owner, p string, recursive bool) ([]db.TreeEntry, error) {
+	p, err := dsde.CleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := owner + "/"
+	if p != "" {
+		prefix += p + "/"
+	}
+	seen := make(map[string]bool)
+	var out []db.TreeEntry
+	add := func(rel string, e db.TreeEntry) {
+		dirs := strings.Split(rel, "/")
+		for i := 1; i < len(dirs) && (recursive || i == 1); i++ {
+			dir := strings.TrimPrefix(prefix, owner+"/") + strings.Join(dirs[:i], "/")
+			if !seen[dir] {
+				seen[dir] = true
+				out = append(out, db.TreeEntry{Path: dir, Folder: true})
+			}
+		}
+		if (recursive || len(dirs) == 1) && !seen[e.Path] {
+			seen[e.Path] = true
+			out = append(out, e)
+		}
+	}
+	for k, vs := range m.versions {
+		if rel, ok := strings.CutPrefix(k, prefix); ok {
+			v := vs[len(vs)-1]
+			add(rel, db.TreeEntry{Path: strings.TrimPrefix(k, owner+"/"), FileID: v.FileID, Version: v.Version, CreatedAt: v.CreatedAt})
+		}
+	}
+	for k := range m.folders {
+		if rel, ok := strings.CutPrefix(k, prefix); ok {
+			add(rel, db.TreeEntry{Path: strings.TrimPrefix(k, owner+"/"), Folder: true})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+func (m *memFiles) Mkdir(_ context.Context, owner, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.folders[owner+"/"+p] = true
+	return nil
+}
+
+func (m *memFiles) Rmdir(_ context.Context, owner, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.folders[owner+"/"+p] {
+		return dsde.ErrFileNotFound
+	}
+	delete(m.folders, owner+"/"+p)
+	return nil
+}
+
+func (m *memFiles) Move(_ context.Context, owner, from, to string) error {
+	from, _ = dsde.CleanPath(from)
+	to, _ = dsde.CleanPath(to)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	moved := false
+	rename := func(k string) (string, bool) {
+		rel := strings.TrimPrefix(k, owner+"/")
+		if rel == from {
+			return owner + "/" + to, true
+		}
+		if rest, ok := strings.CutPrefix(rel, from+"/"); ok {
+			return owner + "/" + to + "/" + rest, true
+		}
+		return "", false
+	}
+	for k, vs := range m.versions {
+		if nk, ok := rename(k); ok {
+			delete(m.versions, k)
+			m.versions[nk] = vs
+			moved = true
+		}
+	}
+	for k := range m.folders {
+		if nk, ok := rename(k); ok {
+			delete(m.folders, k)
+			m.folders[nk] = true
+			moved = true
+		}
+	}
+	if !moved {
+		return dsde.ErrFileNotFound
+	}
+	return nil
+}
+
+func (m *memFiles) DeletePath(_ context.Context, owner, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.versions[owner+"/"+p]; !ok {
+		return dsde.ErrFileNotFound
+	}
+	delete(m.versions, owner+"/"+p)
+	return nil
+}
+
+type memMeta struct {
+	mu sync.Mutex
+	m  map[string]db.ObjectMeta
+}
+
+func (m *memMeta) PutObjectMeta(o db.ObjectMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.m[o.FileID] = o
+	return nil
+}
+
+func (m *memMeta) ObjectMetas(ids []string) (map[string]db.ObjectMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]db.ObjectMeta)
+	for _, id := range ids {
+		if o, ok := m.m[id]; ok {
+			out[id] = o
+		}
+	}
+	return out, nil
+}
+
+func newServer(t *testing.T, files *memFiles) *httptest.Server {
+	t.Helper()
+	users, err := davfs.ParseUsers("alice:wonderland,bob:builder")
+	if err != nil {
+		t.Fatalf("ParseUsers: %v", err)
+	}
+	h := davfs.New(files, &memMeta{m: make(map[string]db.ObjectMeta)}, "/dav", davfs.WithUsers(users))
+	mux := http.NewServeMux()
+	mux.Handle("/dav/", h)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func names(infos []os.FileInfo) string {
+	var out []string
+	for _, fi := range infos {
+		n := fi.Name()
+		if fi.IsDir() {
+			n += "/"
+		}
+		out = append(out, n)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+func TestDAV_ClientRoundTrip(t *testing.T) {
+	srv := newServer(t, newMemFiles())
+	c := gowebdav.NewClient(srv.URL+"/dav", "alice", "wonderland")
+
+	if err := c.Mkdir("/docs", 0o755); err != nil {
+		t.Fatalf("MKCOL: %v", err)
+	}
+	body := []byte("hello from a file manager")
+	if err := c.Write("/docs/note.txt", body, 0o644); err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	if err := c.Write("/docs/sub/deep.txt", []byte("deep"), 0o644); err != nil {
+		t.Fatalf("PUT into a new folder: %v", err)
+	}
+
+	got, err := c.Read("/docs/note.txt")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	if !bytes.Equal(got, body) {
+		t.Errorf("GET = %q, want %q", got, body)
+	}
+
+	fi, err := c.Stat("/docs/note.txt")
+	if err != nil {
+		t.Fatalf("PROPFIND file: %v", err)
+	}
+	if fi.Size() != int64(len(body)) || fi.IsDir() {
+		t.Errorf("stat = size %d dir %v, want size %d", fi.Size(), fi.IsDir(), len(body))
+	}
+
+	infos, err := c.ReadDir("/docs")
+	if err != nil {
+		t.Fatalf("PROPFIND folder: %v", err)
+	}
+	if got := names(infos); got != "note.txt,sub/" {
+		t.Errorf("listing = %s, want note.txt,sub/", got)
+	}
+
+	if err := c.Rename("/docs", "/archive", false); err != nil {
+		t.Fatalf("MOVE: %v", err)
+	}
+	if _, err := c.Read("/archive/sub/deep.txt"); err != nil {
+		t.Errorf("GET after MOVE: %v", err)
+	}
+	if _, err := c.Stat("/docs"); !gowebdav.IsErrNotFound(err) {
+		t.Errorf("expected the old folder to be gone, got %v", err)
+	}
+
+	if err := c.Remove("/archive/note.txt"); err != nil {
+		t.Fatalf("DELETE file: %v", err)
+	}
+	if err := c.Remove("/archive"); err != nil {
+		t.Fatalf("DELETE folder: %v", err)
+	}
+	if infos, err := c.ReadDir("/"); err != nil || len(infos) != 0 {
+		t.Errorf("root after DELETE = %s, %v; want empty", names(infos), err)
+	}
+}
+
+func TestDAV_MoveOverwrite(t *testing.T) {
+	srv := newServer(t, newMemFiles())
+	c := gowebdav.NewClient(srv.URL+"/dav", "alice", "wonderland")
+
+	if err := c.Write("/a.txt", []byte("a"), 0o644); err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	if err := c.Write("/b.txt", []byte("b"), 0o644); err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	if err := c.Rename("/a.txt", "/b.txt", false); err == nil {
+		t.Error("MOVE without overwrite onto an existing file succeeded")
+	}
+	if err := c.Rename("/a.txt", "/b.txt", true); err != nil {
+		t.Fatalf("MOVE with overwrite: %v", err)
+	}
+	if got, err := c.Read("/b.txt"); err != nil || string(got) != "a" {
+		t.Errorf("GET after overwrite = %q, %v", got, err)
+	}
+}
+
+func TestDAV_OwnersAreIsolated(t *testing.T) {
+	files := newMemFiles()
+	srv := newServer(t, files)
+	alice := gowebdav.NewClient(srv.URL+"/dav", "alice", "wonderland")
+	bob := gowebdav.NewClient(srv.URL+"/dav", "bob", "builder")
+
+	if err := alice.Write("/secret.txt", []byte("alice only"), 0o644); err != nil {
+		t.Fatalf("PUT: %v", err)
+	}
+	if _, err := bob.Read("/secret.txt"); err == nil {
+		t.Error("bob read alice's file")
+	}
+	if _, ok := files.versions["alice/secret.txt"]; !ok {
+		t.Error("file not stored under alice's namespace")
+	}
+
+	bad := gowebdav.NewClient(srv.URL+"/dav", "alice", "wrong")
+	if _, err := bad.ReadDir("/"); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestDAV_OwnerMiddlewareSeesAuthenticatedOwner(t *testing.T) {
+	users, err := davfs.ParseUsers("alice:wonderland")
+	if err != nil {
+		t.Fatalf("ParseUsers: %v", err)
+	}
+	var (
+		mu   sync.Mutex
+		seen []string
+	)
+	mw := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, r.Header.Get("X-Owner-ID"))
+			mu.Unlock()
+			next.ServeHTTP(w, r)
+		})
+	}
+	h := davfs.New(newMemFiles(), &memMeta{m: make(map[string]db.ObjectMeta)}, "/dav",
+		davfs.WithUsers(users), davfs.WithOwnerMiddleware(mw))
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	for _, c := range []struct {
+		pass, claimed string
+		want          string
+	}{
+		{"wonderland", "", "alice"},
+		{"wonderland", "mallory", "alice"},
+		{"wrong", "alice", ""},
+	} {
+		req, _ := http.NewRequest("PROPFIND", srv.URL+"/dav/", nil)
+		req.SetBasicAuth("alice", c.pass)
+		if c.claimed != "" {
+			req.Header.Set("X-Owner-ID", c.claimed)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("PROPFIND: %v", err)
+		}
+		resp.Body.Close()
+		mu.Lock()
+		got := seen[len(seen)-1]
+		mu.Unlock()
+		if got != c.want {
+			t.Errorf("password %q claiming %q: middleware saw owner %q, want %q", c.pass, c.claimed, got, c.want)
+		}
+	}
+}
+
+func TestParseUsers(t *testing.T) {
+	if _, err := davfs.ParseUsers("alice"); err == nil {
+		t.Error("expected an error for a user without a password")
+	}
+	if _, err := davfs.ParseUsers("alice:a,alice:b"); err == nil {
+		t.Error("expected an error for a duplicate user")
+	}
+	users, err := davfs.ParseUsers(" alice:a:b , bob:c ")
+	if err != nil || users["alice"] != "a:b" || users["bob"] != "c" {
+		t.Errorf("ParseUsers = %v, %v", users, err)
+	}
+}
@@ -1,13 +1,14 @@
 package db
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
 	"time"
 
 	"github.com/jmoiron/sqlx"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	"github.com/Anish-Chanda/double-layer-dedup/internal/config"
 )
@@ -18,16 +19,35 @@ type Client struct {
 
 // FileMeta holds the key DSDE metadata for a file.
 type FileMeta struct {
-	FeaHash   []byte `db:"fea_hash"`
-	DekShared []byte `db:"dek_shared"`
-	DekUser   []byte `db:"dek_user"`
-	Pkg2Len   int    `db:"pkg2_len"`
+	Filename    string `db:"filename"`
+	FeaHash     []byte `db:"fea_hash"`
+	DekShared   []byte `db:"dek_shared"`
+	DekUser     []byte `db:"dek_user"`
+	Pkg2Len     int    `db:"pkg2_len"`
+	EncVersion  int    `db:"enc_version"`
+	SharedSuite int    `db:"shared_suite"` // 0: not recorded (before enc_version 4)
+	UserSuite   int    `db:"user_suite"`
+	StorageMode string `db:"storage_mode"`
+	Codec       string `db:"codec"`
+	Size        int64  `db:"size"` // logical bytes, as uploaded
+	// Merkle root of the content; nil for files stored before roots were
+	// recorded or uploaded already encrypted
+	PowRoot   []byte `db:"pow_root"`
+	PowLeaves int    `db:"pow_leaves"`
 }
 
 // ChunkInfo holds the s3 key and common‐flag for each stored blob.
 type ChunkInfo struct {
-	S3Key    string `db:"s3_key"`
-	IsCommon bool   `db:"is_common"`
+	ChunkHash string `db:"chunk_hash"`
+	S3Key     string `db:"s3_key"`
+	IsCommon  bool   `db:"is_common"`
+	Size      int64  `db:"size"` // stored bytes
+}
+
+// FileRef identifies a file and its owner.
+type FileRef struct {
+	FileID  string `db:"file_id"`
+	OwnerID string `db:"owner_id"`
 }
 
 // New connects to Postgres using DSDE_POSTGRES_DSN.
@@ -52,6 +72,11 @@ func (c *Client) Close() error {
 	return c.db.Close()
 }
 
+// Ping checks that Postgres is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	return c.db.PingContext(ctx)
+}
+
 // ExistsChunk returns true if a chunk hash is already in the table.
 func (c *Client) ExistsChunk(hash string) (bool, error) {
 	var exists bool
@@ -60,48 +85,118 @@ func (c *Client) ExistsChunk(hash string) (bool, error) {
 	return exists, err
 }
 
-// InsertChunk inserts a new chunk record.
-func (c *Client) InsertChunk(hash, s3Key string, isCommon bool) error {
+// GetChunk looks up a chunk by hash.
+func (c *Client) GetChunk(hash string) (ChunkInfo, error) {
+	var info ChunkInfo
+	err := c.db.Get(&info,
+		`SELECT chunk_hash, s3_key, is_common, size FROM chunks WHERE chunk_hash=$1`, hash)
+	return info, err
+}
+
+// InsertChunk inserts a new chunk record for a blob of size bytes. It is
+// charged to an owner once a file links it.
+func (c *Client) InsertChunk(hash, s3Key string, isCommon bool, size int64) error {
 	_, err := c.db.Exec(
-		`INSERT INTO chunks (chunk_hash, s3_key, is_common) VALUES ($1, $2, $3)`,
-		hash, s3Key, isCommon,
+		`INSERT INTO chunks (chunk_hash, s3_key, is_common, size) VALUES ($1, $2, $3, $4)`,
+		hash, s3Key, isCommon, size,
 	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == "chunks_pkey" {
+		return ErrChunkExists
+	}
+	return err
+}
+
+// ErrChunkExists is returned for a chunk that another upload recorded first.
+var ErrChunkExists = errors.New("db: chunk already stored")
+
+// nextVersion is the SQL for the version a new file of owner $1 and
+// filename $2 gets: one past the newest.
+const nextVersion = `(SELECT COALESCE(MAX(version), 0) + 1 FROM files WHERE owner_id=$1 AND filename=$2)`
+
+// insertFile runs an INSERT that numbers its version with nextVersion,
+// retrying when a concurrent upload of the same path took that number.
+func insertFile(insert func() error) error {
+	var err error
+	for range 3 {
+		var pqErr *pq.Error
+		if err = insert(); !errors.As(err, &pqErr) || pqErr.Code != "23505" {
+			return err
+		}
+	}
 	return err
 }
 
 // CreateFile returns the new file’s UUID.
 func (c *Client) CreateFile(ownerID, filename string) (string, error) {
 	var fileID string
-	err := c.db.Get(&fileID,
-		`INSERT INTO files (owner_id, filename) VALUES ($1, $2) RETURNING file_id`,
-		ownerID, filename,
-	)
+	err := insertFile(func() error {
+		return c.db.Get(&fileID,
+			`INSERT INTO files (owner_id, filename, version) VALUES ($1, $2, `+nextVersion+`) RETURNING file_id`,
+			ownerID, filename,
+		)
+	})
 	return fileID, err
 }
 
-// CreateFileWithMeta:
+// CreateFileWithMeta: size is the file's logical size in bytes.
 func (c *Client) CreateFileWithMeta(
 	ownerID, filename string,
 	feaHash, dekShared, dekUser []byte,
-	pkg2Len int,
+	pkg2Len, encVersion, sharedSuite, userSuite int,
+	codec string,
+	size int64,
 ) (string, error) {
 	var fileID string
-	err := c.db.Get(&fileID, `
+	err := insertFile(func() error {
+		return c.db.Get(&fileID, `
       INSERT INTO files
-        (owner_id, filename, fea_hash, dek_shared, dek_user, pkg2_len)
-      VALUES ($1,$2,$3,$4,$5,$6)
+        (owner_id, filename, fea_hash, dek_shared, dek_user, pkg2_len, enc_version, shared_suite, user_suite, codec, size, version)
+      VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,`+nextVersion+`)
       RETURNING file_id`,
-		ownerID, filename, feaHash, dekShared, dekUser, pkg2Len,
-	)
+			ownerID, filename, feaHash, dekShared, dekUser, pkg2Len, encVersion, sharedSuite, userSuite, codec, size,
+		)
+	})
 	return fileID, err
 }
 
-// AddFileChunk links a chunk into a file at the given sequence index.
+// CreateFileWithID is CreateFileWithMeta for a file whose ID was chosen by the
+// caller before its blobs were sealed, stored in storageMode with its
+// contents compressed by codec.
+func (c *Client) CreateFileWithID(
+	fileID, ownerID, filename string,
+	feaHash, dekShared, dekUser []byte,
+	pkg2Len, encVersion, sharedSuite, userSuite int,
+	storageMode, codec string,
+	size int64,
+) error {
+	return insertFile(func() error {
+		_, err := c.db.Exec(`
+      INSERT INTO files
+        (owner_id, filename, file_id, fea_hash, dek_shared, dek_user, pkg2_len, enc_version, shared_suite, user_suite, storage_mode, codec, size, version)
+      VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,`+nextVersion+`)`,
+			ownerID, filename, fileID, feaHash, dekShared, dekUser, pkg2Len, encVersion, sharedSuite, userSuite, storageMode, codec, size,
+		)
+		return err
+	})
+}
+
+// ErrChunkGone is returned for a link to a chunk that is no longer stored:
+// the last file referencing it was deleted after the caller found it.
+var ErrChunkGone = errors.New("db: chunk no longer stored")
+
+// AddFileChunk links a chunk into a file at the given sequence index. The
+// link holds a key-share lock on the chunk until it commits, which DeleteFile
+// waits for, so a linked chunk is never dropped as an orphan.
 func (c *Client) AddFileChunk(fileID, chunkHash string, seq int) error {
 	_, err := c.db.Exec(
 		`INSERT INTO file_chunks (file_id, chunk_hash, seq) VALUES ($1, $2, $3)`,
 		fileID, chunkHash, seq,
 	)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == "23503" && pqErr.Constraint == "file_chunks_chunk_hash_fkey" {
+		return ErrChunkGone
+	}
 	return err
 }
 
@@ -116,7 +211,8 @@ func (c *Client) GetFileChunkHashes(fileID string) ([]string, error) {
 func (c *Client) GetFileMeta(ownerID, fileID string) (FileMeta, []ChunkInfo, error) {
 	var meta FileMeta
 	err := c.db.Get(&meta,
-		`SELECT fea_hash, dek_shared, dek_user, pkg2_len
+		`SELECT filename, fea_hash, dek_shared, dek_user, pkg2_len, enc_version, shared_suite, user_suite, storage_mode, codec, size,
+                pow_root, COALESCE(pow_leaves, 0) AS pow_leaves
            FROM files
           WHERE file_id=$1 AND owner_id=$2`,
 		fileID, ownerID,
@@ -126,7 +222,7 @@ func (c *Client) GetFileMeta(ownerID, fileID string) (FileMeta, []ChunkInfo, err
 	}
 	var infos []ChunkInfo
 	err = c.db.Select(&infos,
-		`SELECT c.s3_key, c.is_common
+		`SELECT c.chunk_hash, c.s3_key, c.is_common, c.size
            FROM file_chunks fc
            JOIN chunks c ON fc.chunk_hash=c.chunk_hash
           WHERE fc.file_id=$1
@@ -136,6 +232,51 @@ func (c *Client) GetFileMeta(ownerID, fileID string) (FileMeta, []ChunkInfo, err
 	return meta, infos, err
 }
 
+// ReplaceFileChunks swaps a file's chunk list for hashes (in seq order) and
+// records how the new blobs were sealed and stored, atomically.
+func (c *Client) ReplaceFileChunks(fileID string, hashes []string, encVersion, sharedSuite, userSuite, pkg2Len int, storageMode string) error {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec(`DELETE FROM file_chunks WHERE file_id=$1`, fileID); err != nil {
+		return err
+	}
+	for seq, h := range hashes {
+		if _, err = tx.Exec(
+			`INSERT INTO file_chunks (file_id, chunk_hash, seq) VALUES ($1, $2, $3)`,
+			fileID, h, seq,
+		); err != nil {
+			return err
+		}
+	}
+	if _, err = tx.Exec(
+		`UPDATE files SET enc_version=$2, shared_suite=$3, user_suite=$4, pkg2_len=$5, storage_mode=$6 WHERE file_id=$1`,
+		fileID, encVersion, sharedSuite, userSuite, pkg2Len, storageMode,
+	); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DeleteChunk removes a chunk record (and, via cascade, any links to it).
+func (c *Client) DeleteChunk(hash string) error {
+	_, err := c.db.Exec(`DELETE FROM chunks WHERE chunk_hash=$1`, hash)
+	return err
+}
+
+// ListFilesBelowEncVersion returns files sealed with a scheme older than version.
+func (c *Client) ListFilesBelowEncVersion(version int) ([]FileRef, error) {
+	var refs []FileRef
+	err := c.db.Select(&refs,
+		`SELECT file_id, owner_id FROM files WHERE enc_version < $1 ORDER BY created_at`,
+		version,
+	)
+	return refs, err
+}
+
 // Feature holds the shared-DEK record for a given fea_hash.
 type Feature struct {
 	FeaHash   []byte `db:"fea_hash"`
@@ -167,3 +308,586 @@ func (c *Client) GetFeatureByFeaHash(feaHash []byte) ([]byte, error) {
 	}
 	return dek, nil
 }
+
+// FilePoW is the proof-of-ownership commitment for one file's content.
+type FilePoW struct {
+	FileRef
+	Root   []byte `db:"pow_root"`
+	Leaves int    `db:"pow_leaves"`
+}
+
+// SetFilePoW records the Merkle root of fileID's content.
+func (c *Client) SetFilePoW(fileID string, root []byte, leaves int) error {
+	_, err := c.db.Exec(
+		`UPDATE files SET pow_root=$2, pow_leaves=$3 WHERE file_id=$1`,
+		fileID, root, leaves,
+	)
+	return err
+}
+
+// FindFileForDedup returns the most recent shared (dsde) file whose content
+// has feaHash and a Merkle root of leaves leaves.
+func (c *Client) FindFileForDedup(feaHash []byte, leaves int) (FilePoW, error) {
+	var p FilePoW
+	err := c.db.Get(&p,
+		`SELECT file_id, owner_id, pow_root, pow_leaves FROM files
+          WHERE fea_hash=$1 AND storage_mode='dsde'
+            AND pow_root IS NOT NULL AND pow_leaves=$2
+          ORDER BY created_at DESC
+          LIMIT 1`,
+		feaHash, leaves,
+	)
+	return p, err
+}
+
+// CountFeatureUpload bumps feaHash's upload counter and returns the new count
+// with the feature's dedup threshold, assigning threshold first if the feature
+// has none yet.
+func (c *Client) CountFeatureUpload(feaHash []byte, threshold int) (count, assigned int, err error) {
+	err = c.db.QueryRowx(
+		`UPDATE features
+            SET upload_count = upload_count + 1,
+                dedup_threshold = COALESCE(dedup_threshold, $2)
+          WHERE fea_hash=$1
+      RETURNING upload_count, dedup_threshold`,
+		feaHash, threshold,
+	).Scan(&count, &assigned)
+	return count, assigned, err
+}
+
+// GetFeatureUploads returns feaHash's upload counter and dedup threshold
+// without changing them. threshold is invalid until one has been assigned.
+func (c *Client) GetFeatureUploads(feaHash []byte) (count int, threshold sql.NullInt64, err error) {
+	err = c.db.QueryRowx(
+		`SELECT upload_count, dedup_threshold FROM features WHERE fea_hash=$1`,
+		feaHash,
+	).Scan(&count, &threshold)
+	return count, threshold, err
+}
+
+// AddFeatureOwner records ownerID as an owner of feaHash's content and returns
+// how many distinct owners it has.
+func (c *Client) AddFeatureOwner(feaHash []byte, ownerID string) (int, error) {
+	if _, err := c.db.Exec(
+		`INSERT INTO feature_owners (fea_hash, owner_id) VALUES ($1, $2)
+         ON CONFLICT DO NOTHING`,
+		feaHash, ownerID,
+	); err != nil {
+		return 0, err
+	}
+	return c.CountFeatureOwners(feaHash)
+}
+
+// CountFeatureOwnersWith returns how many distinct owners feaHash's content
+// would have with ownerID among them, without recording ownerID.
+func (c *Client) CountFeatureOwnersWith(feaHash []byte, ownerID string) (int, error) {
+	var n int
+	err := c.db.Get(&n,
+		`SELECT COUNT(*) + (NOT EXISTS (SELECT 1 FROM feature_owners WHERE fea_hash=$1 AND owner_id=$2))::int
+           FROM feature_owners WHERE fea_hash=$1`,
+		feaHash, ownerID)
+	return n, err
+}
+
+// CountFeatureOwners returns how many distinct owners feaHash's content has.
+func (c *Client) CountFeatureOwners(feaHash []byte) (int, error) {
+	var n int
+	err := c.db.Get(&n,
+		`SELECT COUNT(*) FROM feature_owners WHERE fea_hash=$1`, feaHash)
+	return n, err
+}
+
+// ListFilesByStorageMode returns feaHash's files stored in mode.
+func (c *Client) ListFilesByStorageMode(feaHash []byte, mode string) ([]FileRef, error) {
+	var refs []FileRef
+	err := c.db.Select(&refs,
+		`SELECT file_id, owner_id FROM files
+          WHERE fea_hash=$1 AND storage_mode=$2
+          ORDER BY created_at`,
+		feaHash, mode,
+	)
+	return refs, err
+}
+
+// ListPromotableFeatures returns features that still have private files but
+// at least minOwners distinct owners.
+func (c *Client) ListPromotableFeatures(minOwners int) ([][]byte, error) {
+	var hashes [][]byte
+	err := c.db.Select(&hashes,
+		`SELECT f.fea_hash
+           FROM files f
+          WHERE f.storage_mode='private'
+          GROUP BY f.fea_hash
+         HAVING (SELECT COUNT(*) FROM feature_owners o WHERE o.fea_hash=f.fea_hash) >= $1`,
+		minOwners,
+	)
+	return hashes, err
+}
+
+// Grant is one user's access to another user's file.
+type Grant struct {
+	FileID     string       `db:"file_id" json:"fileID"`
+	OwnerID    string       `db:"owner_id" json:"ownerID"`
+	Filename   string       `db:"filename" json:"filename"`
+	GranteeID  string       `db:"grantee_id" json:"granteeID"`
+	Permission string       `db:"permission" json:"permission"`
+	ExpiresAt  sql.NullTime `db:"expires_at" json:"-"`
+	CreatedAt  time.Time    `db:"created_at" json:"createdAt"`
+}
+
+// UpsertGrant gives granteeID permission on ownerID's file fileID until
+// expiresAt (no expiry if invalid), reviving a revoked or expired grant. It
+// returns sql.ErrNoRows if ownerID does not own the file.
+func (c *Client) UpsertGrant(fileID, ownerID, granteeID, permission string, expiresAt sql.NullTime) error {
+	res, err := c.db.Exec(`
+      INSERT INTO file_grants (file_id, grantee_id, permission, expires_at)
+      SELECT file_id, $3, $4, $5 FROM files WHERE file_id=$1 AND owner_id=$2
+      ON CONFLICT (file_id, grantee_id) DO UPDATE
+        SET permission=EXCLUDED.permission,
+            expires_at=EXCLUDED.expires_at,
+            revoked_at=NULL,
+            created_at=now()`,
+		fileID, ownerID, granteeID, permission, expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// RevokeGrant revokes granteeID's active grant on ownerID's file fileID. It
+// returns sql.ErrNoRows if there is none.
+func (c *Client) RevokeGrant(fileID, ownerID, granteeID string) error {
+	res, err := c.db.Exec(`
+      UPDATE file_grants g SET revoked_at=now()
+        FROM files f
+       WHERE g.file_id=f.file_id AND f.file_id=$1 AND f.owner_id=$2
+         AND g.grantee_id=$3 AND g.revoked_at IS NULL`,
+		fileID, ownerID, granteeID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// activeGrant is the SQL condition for a grant g that is neither revoked nor
+// expired.
+const activeGrant = `g.revoked_at IS NULL AND (g.expires_at IS NULL OR g.expires_at > now())`
+
+// ListGrants returns the active grants on ownerID's file fileID.
+func (c *Client) ListGrants(fileID, ownerID string) ([]Grant, error) {
+	var grants []Grant
+	err := c.db.Select(&grants, `
+      SELECT g.file_id, f.owner_id, f.filename, g.grantee_id, g.permission, g.expires_at, g.created_at
+        FROM file_grants g JOIN files f ON f.file_id=g.file_id
+       WHERE f.file_id=$1 AND f.owner_id=$2 AND `+activeGrant+`
+       ORDER BY g.created_at`,
+		fileID, ownerID,
+	)
+	return grants, err
+}
+
+// ListSharedWith returns the active grants other owners gave granteeID.
+func (c *Client) ListSharedWith(granteeID string) ([]Grant, error) {
+	var grants []Grant
+	err := c.db.Select(&grants, `
+      SELECT g.file_id, f.owner_id, f.filename, g.grantee_id, g.permission, g.expires_at, g.created_at
+        FROM file_grants g JOIN files f ON f.file_id=g.file_id
+       WHERE g.grantee_id=$1 AND `+activeGrant+`
+       ORDER BY g.created_at`,
+		granteeID,
+	)
+	return grants, err
+}
+
+// FileOwnerFor returns the owner of fileID if userID owns it or holds an
+// active grant with permission on it, and sql.ErrNoRows otherwise.
+func (c *Client) FileOwnerFor(userID, fileID, permission string) (string, error) {
+	var ownerID string
+	err := c.db.Get(&ownerID, `
+      SELECT f.owner_id FROM files f
+       WHERE f.file_id=$1
+         AND (f.owner_id=$2 OR EXISTS (
+               SELECT 1 FROM file_grants g
+                WHERE g.file_id=f.file_id AND g.grantee_id=$2 AND g.permission=$3
+                  AND `+activeGrant+`))`,
+		fileID, userID, permission,
+	)
+	return ownerID, err
+}
+
+// FileVersion is one version of an owner's logical path.
+type FileVersion struct {
+	FileID      string    `db:"file_id" json:"fileID"`
+	Version     int       `db:"version" json:"version"`
+	StorageMode string    `db:"storage_mode" json:"storageMode"`
+	CreatedAt   time.Time `db:"created_at" json:"createdAt"`
+}
+
+// FileIDByPath returns the file holding version of ownerID's path, or of its
+// newest version if version is 0.
+func (c *Client) FileIDByPath(ownerID, path string, version int) (string, error) {
+	var fileID string
+	err := c.db.Get(&fileID, `
+      SELECT file_id FROM files
+       WHERE owner_id=$1 AND filename=$2 AND ($3 = 0 OR version=$3)
+       ORDER BY version DESC
+       LIMIT 1`,
+		ownerID, path, version,
+	)
+	return fileID, err
+}
+
+// ListVersions returns the versions of ownerID's path, newest first.
+func (c *Client) ListVersions(ownerID, path string) ([]FileVersion, error) {
+	var versions []FileVersion
+	err := c.db.Select(&versions, `
+      SELECT file_id, version, storage_mode, created_at FROM files
+       WHERE owner_id=$1 AND filename=$2
+       ORDER BY version DESC`,
+		ownerID, path,
+	)
+	return versions, err
+}
+
+// ListPrunableVersions returns the files a retention policy drops: every
+// version but the newest of its path that is either beyond the newest keep
+// (if keep > 0) or was created before the cutoff (if valid).
+func (c *Client) ListPrunableVersions(keep int, before sql.NullTime) ([]FileRef, error) {
+	var refs []FileRef
+	err := c.db.Select(&refs, `
+      SELECT file_id, owner_id FROM (
+        SELECT file_id, owner_id, created_at,
+               row_number() OVER (PARTITION BY owner_id, filename ORDER BY version DESC) AS rank
+          FROM files) v
+       WHERE rank > 1
+         AND (($1 > 0 AND rank > $1) OR ($2::timestamptz IS NOT NULL AND created_at < $2))
+       ORDER BY created_at`,
+		keep, before,
+	)
+	return refs, err
+}
+
+// DeleteFile removes a file and its chunk links, then drops every chunk no
+// file references any more, returning those so the caller can delete their
+// objects once this has committed. A chunk's references are its file_chunks
+// rows, so removing the file is what decrements them. Content stored again
+// after this commits gets a row with a fresh object key, so deleting the
+// returned objects never removes a blob a newer row points at. The owner stops
+// counting towards the file's feature with their last file of it.
+func (c *Client) DeleteFile(fileID string) ([]ChunkInfo, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var hashes []string
+	if err = tx.Select(&hashes, `SELECT chunk_hash FROM file_chunks WHERE file_id=$1`, fileID); err != nil {
+		return nil, err
+	}
+	var deleted struct {
+		OwnerID string `db:"owner_id"`
+		FeaHash []byte `db:"fea_hash"`
+	}
+	if err = tx.Get(&deleted, `DELETE FROM files WHERE file_id=$1 RETURNING owner_id, fea_hash`, fileID); err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(`
+      DELETE FROM feature_owners
+       WHERE fea_hash=$1 AND owner_id=$2
+         AND NOT EXISTS (SELECT 1 FROM files WHERE fea_hash=$1 AND owner_id=$2)`,
+		deleted.FeaHash, deleted.OwnerID,
+	); err != nil {
+		return nil, err
+	}
+	orphans, err := deleteUnused(tx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
+}
+
+// DeleteUnusedChunks deletes those of hashes that no file links and returns
+// them, so their objects can be removed. It cleans up after an upload that
+// stored chunks but failed before linking them.
+func (c *Client) DeleteUnusedChunks(hashes []string) ([]ChunkInfo, error) {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orphans, err := deleteUnused(tx, hashes)
+	if err != nil {
+		return nil, err
+	}
+	return orphans, tx.Commit()
+}
+
+// deleteUnused deletes the chunks among hashes that no file links.
+func deleteUnused(tx *sqlx.Tx, hashes []string) ([]ChunkInfo, error) {
+	// An upload that found one of these chunks stored may be linking it right
+	// now. Its insert holds a key-share lock on the chunk, so taking these
+	// locks waits for it to commit, and the statement below then sees its link.
+	if _, err := tx.Exec(
+		`SELECT 1 FROM chunks WHERE chunk_hash = ANY($1) ORDER BY chunk_hash FOR UPDATE`,
+		pq.Array(hashes),
+	); err != nil {
+		return nil, err
+	}
+	var orphans []ChunkInfo
+	err := tx.Select(&orphans, `
+      DELETE FROM chunks c
+       WHERE c.chunk_hash = ANY($1)
+         AND NOT EXISTS (SELECT 1 FROM file_chunks fc WHERE fc.chunk_hash=c.chunk_hash)
+      RETURNING c.chunk_hash, c.s3_key, c.is_common`,
+		pq.Array(hashes),
+	)
+	return orphans, err
+}
+
+// TreeEntry is a file (its newest version) or an explicitly created folder
+// in an owner's namespace.
+type TreeEntry struct {
+	Path      string    `db:"path" json:"path"`
+	Folder    bool      `db:"folder" json:"folder"`
+	FileID    string    `db:"file_id" json:"fileID,omitempty"`
+	Version   int       `db:"version" json:"version,omitempty"`
+	CreatedAt time.Time `db:"created_at" json:"createdAt"`
+}
+
+// ListTree returns ownerID's files and folders whose paths start with
+// prefix, ordered by path.
+func (c *Client) ListTree(ownerID, prefix string) ([]TreeEntry, error) {
+	var entries []TreeEntry
+	err := c.db.Select(&entries, `
+      (SELECT DISTINCT ON (filename) filename AS path, false AS folder, file_id::text, version, created_at
+         FROM files
+        WHERE owner_id=$1 AND left(filename, length($2))=$2
+        ORDER BY filename, version DESC)
+      UNION ALL
+      (SELECT path, true, '', 0, created_at
+         FROM folders
+        WHERE owner_id=$1 AND left(path, length($2))=$2)
+      ORDER BY path`,
+		ownerID, prefix,
+	)
+	return entries, err
+}
+
+// StatPath reports whether ownerID's path names a file, and whether it names
+// a folder, explicit or implied by the paths beneath it.
+func (c *Client) StatPath(ownerID, path string) (file, folder bool, err error) {
+	err = c.db.QueryRow(`
+      SELECT EXISTS (SELECT 1 FROM files WHERE owner_id=$1 AND filename=$2),
+             EXISTS (SELECT 1 FROM folders WHERE owner_id=$1 AND path=$2)
+          OR EXISTS (SELECT 1 FROM files WHERE owner_id=$1 AND left(filename, length($2)+1)=$2 || '/')
+          OR EXISTS (SELECT 1 FROM folders WHERE owner_id=$1 AND left(path, length($2)+1)=$2 || '/')`,
+		ownerID, path,
+	).Scan(&file, &folder)
+	return file, folder, err
+}
+
+// CreateFolder records ownerID's folder path; it is a no-op if it exists.
+func (c *Client) CreateFolder(ownerID, path string) error {
+	_, err := c.db.Exec(
+		`INSERT INTO folders (owner_id, path) VALUES ($1, $2) ON CONFLICT DO NOTHING`,
+		ownerID, path,
+	)
+	return err
+}
+
+// MovePath renames ownerID's path from to to, with every version of a file
+// there and everything beneath a folder there, atomically. Only metadata
+// changes. It returns sql.ErrNoRows if nothing was at from.
+func (c *Client) MovePath(ownerID, from, to string) error {
+	tx, err := c.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var moved int64
+	for _, q := range []string{
+		`UPDATE files SET filename = $3 || substr(filename, length($2)+1)
+          WHERE owner_id=$1 AND (filename=$2 OR left(filename, length($2)+1)=$2 || '/')`,
+		`UPDATE folders SET path = $3 || substr(path, length($2)+1)
+          WHERE owner_id=$1 AND (path=$2 OR left(path, length($2)+1)=$2 || '/')`,
+	} {
+		res, err := tx.Exec(q, ownerID, from, to)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		moved += n
+	}
+	if moved == 0 {
+		return sql.ErrNoRows
+	}
+	return tx.Commit()
+}
+
+// DeleteFolder removes ownerID's explicit folder path. It returns
+// sql.ErrNoRows if there is none.
+func (c *Client) DeleteFolder(ownerID, path string) error {
+	res, err := c.db.Exec(`DELETE FROM folders WHERE owner_id=$1 AND path=$2`, ownerID, path)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// ObjectMeta holds the S3 attributes of a file.
+type ObjectMeta struct {
+	FileID      string `db:"file_id"`
+	Size        int64  `db:"size"`
+	ETag        string `db:"etag"`
+	ContentType string `db:"content_type"`
+}
+
+// PutObjectMeta records or replaces m.
+func (c *Client) PutObjectMeta(m ObjectMeta) error {
+	_, err := c.db.Exec(`
+      INSERT INTO object_meta (file_id, size, etag, content_type) VALUES ($1, $2, $3, $4)
+      ON CONFLICT (file_id) DO UPDATE
+        SET size=EXCLUDED.size, etag=EXCLUDED.etag, content_type=EXCLUDED.content_type`,
+		m.FileID, m.Size, m.ETag, m.ContentType,
+	)
+	return err
+}
+
+// ObjectMetas returns the recorded S3 attributes of fileIDs, by file ID.
+// Files without any are missing from the map.
+func (c *Client) ObjectMetas(fileIDs []string) (map[string]ObjectMeta, error) {
+	var metas []ObjectMeta
+	err := c.db.Select(&metas,
+		`SELECT file_id, size, etag, content_type FROM object_meta WHERE file_id = ANY($1::uuid[])`,
+		pq.Array(fileIDs),
+	)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]ObjectMeta, len(metas))
+	for _, m := range metas {
+		out[m.FileID] = m
+	}
+	return out, nil
+}
+
+// Stats are service-wide deduplication counters.
+type Stats struct {
+	Files        int64 `db:"files" json:"files"`
+	Owners       int64 `db:"owners" json:"owners"`
+	Features     int64 `db:"features" json:"features"`
+	Chunks       int64 `db:"chunks" json:"chunks"`
+	CommonChunks int64 `db:"common_chunks" json:"commonChunks"`
+}
+
+// Stats counts stored files and their owners, distinct contents (features)
+// and chunks.
+func (c *Client) Stats() (Stats, error) {
+	var s Stats
+	err := c.db.Get(&s, `
+      SELECT
+        (SELECT count(*) FROM files)                  AS files,
+        (SELECT count(DISTINCT owner_id) FROM files)  AS owners,
+        (SELECT count(*) FROM features)               AS features,
+        (SELECT count(*) FROM chunks)                 AS chunks,
+        (SELECT count(*) FROM chunks WHERE is_common) AS common_chunks`)
+	return s, err
+}
+
+// Quota limits an owner's usage in bytes; 0 is unlimited.
+type Quota struct {
+	OwnerID       string `db:"owner_id" json:"owner"`
+	LogicalBytes  int64  `db:"logical_bytes" json:"logicalBytes"`
+	PhysicalBytes int64  `db:"physical_bytes" json:"physicalBytes"`
+}
+
+// Usage is what an owner stores: the logical size of their files and the
+// stored blobs charged to them. Blobs shared by several owners are charged
+// to one of them.
+type Usage struct {
+	OwnerID       string `db:"owner_id" json:"owner"`
+	LogicalBytes  int64  `db:"logical_bytes" json:"logicalBytes"`
+	PhysicalBytes int64  `db:"physical_bytes" json:"physicalBytes"`
+}
+
+// SetQuota records or replaces q.
+func (c *Client) SetQuota(q Quota) error {
+	_, err := c.db.Exec(`
+      INSERT INTO quotas (owner_id, logical_bytes, physical_bytes) VALUES ($1, $2, $3)
+      ON CONFLICT (owner_id) DO UPDATE
+        SET logical_bytes=EXCLUDED.logical_bytes, physical_bytes=EXCLUDED.physical_bytes, updated_at=now()`,
+		q.OwnerID, q.LogicalBytes, q.PhysicalBytes,
+	)
+	return err
+}
+
+// GetQuota returns ownerID's quota, or sql.ErrNoRows if none is set.
+func (c *Client) GetQuota(ownerID string) (Quota, error) {
+	var q Quota
+	err := c.db.Get(&q,
+		`SELECT owner_id, logical_bytes, physical_bytes FROM quotas WHERE owner_id=$1`, ownerID)
+	return q, err
+}
+
+// DeleteQuota removes ownerID's quota, reporting whether there was one.
+func (c *Client) DeleteQuota(ownerID string) (bool, error) {
+	res, err := c.db.Exec(`DELETE FROM quotas WHERE owner_id=$1`, ownerID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// ListQuotas returns every quota that is set, by owner.
+func (c *Client) ListQuotas() ([]Quota, error) {
+	var qs []Quota
+	err := c.db.Select(&qs,
+		`SELECT owner_id, logical_bytes, physical_bytes FROM quotas ORDER BY owner_id`)
+	return qs, err
+}
+
+// GetUsage returns ownerID's usage; owners who never stored anything use
+// nothing.
+func (c *Client) GetUsage(ownerID string) (Usage, error) {
+	u := Usage{OwnerID: ownerID}
+	err := c.db.Get(&u,
+		`SELECT owner_id, logical_bytes, physical_bytes FROM owner_usage WHERE owner_id=$1`, ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return u, nil
+	}
+	return u, err
+}
+
+// ListUsage returns the usage of every owner who stores anything, by owner.
+func (c *Client) ListUsage() ([]Usage, error) {
+	var us []Usage
+	err := c.db.Select(&us, `
+      SELECT owner_id, logical_bytes, physical_bytes FROM owner_usage
+       WHERE logical_bytes <> 0 OR physical_bytes <> 0
+       ORDER BY owner_id`)
+	return us, err
+}
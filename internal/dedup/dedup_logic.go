@@ -3,6 +3,9 @@ package dedup
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 
@@ -13,7 +16,7 @@ import (
 type DB interface {
 	CreateFile(ownerID, filename string) (fileID string, err error)
 	ExistsChunk(hash string) (bool, error)
-	InsertChunk(hash, s3Key string, isCommon bool) error
+	InsertChunk(hash, s3Key string, isCommon bool, size int64) error
 	AddFileChunk(fileID, chunkHash string, seq int) error
 }
 
@@ -34,6 +37,23 @@ func New(dbClient DB, storeClient Store) *Service {
 	}
 }
 
+// CommonKey returns a fresh object key for a common blob with content hash
+// hash. Every stored copy gets its own key: a copy being deleted with the last
+// file that referenced it never shares a key with the copy that replaces it.
+func CommonKey(hash string) (string, error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("common/%s-%x", hash, nonce), nil
+}
+
+// ChunkAAD returns the associated data a chunk stored under s3Key is sealed
+// with, binding each blob to its object key.
+func ChunkAAD(s3Key string) []byte {
+	return encryption.AssociatedData(encryption.SchemeVersion, encryption.RoleChunk, []byte(s3Key))
+}
+
 // Process Chunks
 // - created a file rec
 // - for each chuck:
@@ -47,6 +67,21 @@ func (s *Service) ProcessChunks(ctx context.Context,
 	ownerID, filename string,
 	chunks []extractor.ExtractedChunk,
 	enc *encryption.Service,
+) (string, error) {
+	return s.ProcessChunksWith(ctx, ownerID, filename, chunks, enc, enc)
+}
+
+// ProcessChunksWith is ProcessChunks with separate ciphers: common chunks are
+// sealed deterministically under common, which every uploader must share for
+// them to deduplicate, and unique chunks probabilistically under unique.
+//
+// Common chunks are recorded under their (hex) content hash. Unique chunks are
+// recorded under the hash of their ciphertext, so a chunk first stored as
+// unique is never mistaken for the shared copy of the same content.
+func (s *Service) ProcessChunksWith(ctx context.Context,
+	ownerID, filename string,
+	chunks []extractor.ExtractedChunk,
+	common, unique *encryption.Service,
 ) (string, error) {
 	// 1. Create file metadata
 	fileID, err := s.db.CreateFile(ownerID, filename)
@@ -56,42 +91,48 @@ func (s *Service) ProcessChunks(ctx context.Context,
 
 	// 2. Process each chunk
 	for i, chunk := range chunks {
-		// a. Encrypt
-		ct, err := enc.Encrypt(chunk.Data, chunk.IsCommon)
-		if err != nil {
-			return "", err
-		}
-
-		// Build an S3 key
-		var key string
+		hash := chunk.Hash
 		if chunk.IsCommon {
-			key = fmt.Sprintf("common/%s", chunk.Hash)
-			// b. Only store/record if unseen
-			exists, err := s.db.ExistsChunk(chunk.Hash)
+			// a. Only encrypt/store/record if unseen
+			exists, err := s.db.ExistsChunk(hash)
 			if err != nil {
 				return "", err
 			}
 			if !exists {
+				key, err := CommonKey(hash)
+				if err != nil {
+					return "", err
+				}
+				ct, err := common.EncryptAAD(chunk.Data, true, ChunkAAD(key))
+				if err != nil {
+					return "", err
+				}
 				if err := s.store.PutObject(ctx, key, bytes.NewReader(ct)); err != nil {
 					return "", err
 				}
-				if err := s.db.InsertChunk(chunk.Hash, key, true); err != nil {
+				if err := s.db.InsertChunk(hash, key, true, int64(len(ct))); err != nil {
 					return "", err
 				}
 			}
 		} else {
-			key = fmt.Sprintf("files/%s/%d-%s", fileID, i, chunk.Hash)
-			// c. Always store unique
+			key := fmt.Sprintf("files/%s/%d-%s", fileID, i, chunk.Hash)
+			// b. Always encrypt/store unique
+			ct, err := unique.EncryptAAD(chunk.Data, false, ChunkAAD(key))
+			if err != nil {
+				return "", err
+			}
+			sum := sha256.Sum256(ct)
+			hash = hex.EncodeToString(sum[:])
 			if err := s.store.PutObject(ctx, key, bytes.NewReader(ct)); err != nil {
 				return "", err
 			}
-			if err := s.db.InsertChunk(chunk.Hash, key, false); err != nil {
+			if err := s.db.InsertChunk(hash, key, false, int64(len(ct))); err != nil {
 				return "", err
 			}
 		}
 
-		// d. Link chunk into file sequence
-		if err := s.db.AddFileChunk(fileID, chunk.Hash, i); err != nil {
+		// c. Link chunk into file sequence
+		if err := s.db.AddFileChunk(fileID, hash, i); err != nil {
 			return "", err
 		}
 	}
@@ -5,6 +5,7 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/Anish-Chanda/double-layer-dedup/internal/dedup"
@@ -35,7 +36,7 @@ func (f *fakeDB) CreateFile(ownerID, filename string) (string, error) {
 func (f *fakeDB) ExistsChunk(hash string) (bool, error) {
 	return f.chunkExists[hash], nil
 }
-func (f *fakeDB) InsertChunk(hash, s3Key string, isCommon bool) error {
+func (f *fakeDB) InsertChunk(hash, s3Key string, isCommon bool, size int64) error {
 	f.inserted = append(f.inserted, struct {
 		hash, key string
 		isCommon  bool
@@ -85,8 +86,8 @@ func TestProcessChunks(t *testing.T) {
 	sum := sha256.Sum256(data)
 	hash := hex.EncodeToString(sum[:])
 	chunks := []extractor.ExtractedChunk{
-		{Data: data, Hash: hash, IsCommon: false}, // unique
-		{Data: data, Hash: hash, IsCommon: true},  // common (already inserted)
+		{Data: data, Hash: hash, IsCommon: false}, // unique (first sighting)
+		{Data: data, Hash: hash, IsCommon: true},  // common (seen before)
 	}
 
 	// Call ProcessChunks
@@ -105,21 +106,26 @@ func TestProcessChunks(t *testing.T) {
 		t.Errorf("CreateFile got (%s, %s)", dbf.createdOwner, dbf.createdFilename)
 	}
 
-	// 2. PutObject called only for the unique chunk
-	if len(stf.putKeys) != 1 {
-		t.Fatalf("expected 1 PutObject, got %d", len(stf.putKeys))
+	// 2. PutObject called for the unique copy and the shared copy; the unique
+	// chunk's record must not stand in for the shared one
+	if len(stf.putKeys) != 2 {
+		t.Fatalf("expected 2 PutObject, got %d", len(stf.putKeys))
 	}
-	expectedKey := "files/fake-file-id/0-" + hash
-	if stf.putKeys[0] != expectedKey {
-		t.Errorf("unexpected PutObject key: got %s, want %s", stf.putKeys[0], expectedKey)
+	uniqueKey := "files/fake-file-id/0-" + hash
+	commonKey := stf.putKeys[1]
+	if stf.putKeys[0] != uniqueKey || !strings.HasPrefix(commonKey, "common/"+hash+"-") {
+		t.Errorf("unexpected PutObject keys: got %v, want [%s common/%s-<nonce>]", stf.putKeys, uniqueKey, hash)
 	}
 
-	// 3. InsertChunk called only once (for the unique chunk)
-	if len(dbf.inserted) != 1 {
-		t.Fatalf("expected 1 InsertChunk, got %d", len(dbf.inserted))
+	// 3. InsertChunk: unique under its ciphertext hash, common under the hex content hash
+	if len(dbf.inserted) != 2 {
+		t.Fatalf("expected 2 InsertChunk, got %d", len(dbf.inserted))
 	}
-	if dbf.inserted[0].isCommon {
-		t.Errorf("expected inserted[0].isCommon=false, got true")
+	if dbf.inserted[0].isCommon || dbf.inserted[0].hash == hash {
+		t.Errorf("unique chunk recorded as %+v", dbf.inserted[0])
+	}
+	if !dbf.inserted[1].isCommon || dbf.inserted[1].hash != hash || dbf.inserted[1].key != commonKey {
+		t.Errorf("common chunk recorded as %+v", dbf.inserted[1])
 	}
 
 	// 4. FileChunks links should have both entries
@@ -129,4 +135,42 @@ func TestProcessChunks(t *testing.T) {
 	if dbf.fileChunks[0].seq != 0 || dbf.fileChunks[1].seq != 1 {
 		t.Errorf("fileChunks seqs incorrect: %+v", dbf.fileChunks)
 	}
+	if dbf.fileChunks[0].hash != dbf.inserted[0].hash || dbf.fileChunks[1].hash != hash {
+		t.Errorf("fileChunks hashes incorrect: %+v", dbf.fileChunks)
+	}
+
+	// 5. Blobs open under the AAD of their own key only
+	for _, key := range []string{uniqueKey, commonKey} {
+		pt, err := encSvc.DecryptAAD(stf.bodies[key], dedup.ChunkAAD(key))
+		if err != nil || string(pt) != "foo" {
+			t.Errorf("%s: got %q, %v", key, pt, err)
+		}
+	}
+	if _, err := encSvc.DecryptAAD(stf.bodies[commonKey], dedup.ChunkAAD(uniqueKey)); err == nil {
+		t.Error("common blob opened under another key's AAD")
+	}
+}
+
+func TestProcessChunks_ReusesStoredCommon(t *testing.T) {
+	dbf := &fakeDB{chunkExists: make(map[string]bool)}
+	stf := &fakeStore{}
+	svc := dedup.New(dbf, stf)
+	encSvc, err := encryption.NewWithKey(make([]byte, 32))
+	if err != nil {
+		t.Fatalf("encryption service init: %v", err)
+	}
+
+	sum := sha256.Sum256([]byte("bar"))
+	hash := hex.EncodeToString(sum[:])
+	dbf.chunkExists[hash] = true
+	chunks := []extractor.ExtractedChunk{{Data: []byte("bar"), Hash: hash, IsCommon: true}}
+	if _, err := svc.ProcessChunks(context.Background(), "owner-123", "b.txt", chunks, encSvc); err != nil {
+		t.Fatalf("ProcessChunks error: %v", err)
+	}
+	if len(stf.putKeys) != 0 || len(dbf.inserted) != 0 {
+		t.Errorf("stored common chunk again: puts %v, inserts %+v", stf.putKeys, dbf.inserted)
+	}
+	if len(dbf.fileChunks) != 1 || dbf.fileChunks[0].hash != hash {
+		t.Errorf("expected a link to the stored chunk, got %+v", dbf.fileChunks)
+	}
 }
@@ -0,0 +1,205 @@
+package dsde
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dedup"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/extractor"
+)
+
+// Chunk mode: the alternative to the DSDE scheme. The extractor cuts a file
+// into fixed-size blocks and its Bloom filter marks blocks seen before as
+// common. dedup.Service stores common blocks once, under a deterministic
+// service-wide chunk key, and every other block per file under a fresh user
+// DEK. Files record storage_mode "chunks" and keep their blocks in order in
+// file_chunks, so both modes are served side by side. From
+// encVersionSuiteKeys on, common blocks are recorded under a hash scoped to
+// the shared suite, so they are only ever linked into files that open them
+// with the same cipher.
+
+// ErrChunkModeDisabled is returned for chunk-mode uploads when the service has
+// no extractor.
+var ErrChunkModeDisabled = newError(ErrInvalidArgument, "dsde: chunk mode not enabled")
+
+// chunkFeature is the pseudo-feature whose shared DEK seals common chunks.
+// Chunk-mode files record it as their fea_hash, so dek_shared is always the
+// DEK of the file's feature.
+var chunkFeature = func() []byte {
+	sum := sha256.Sum256([]byte("dsde/chunk-mode"))
+	return sum[:]
+}()
+
+// WithChunkMode enables chunk-mode uploads through ext.
+func WithChunkMode(ext *extractor.Extractor) Option {
+	return func(s *Service) {
+		s.extractor = ext
+	}
+}
+
+// chunkFiles adapts the service's DB to dedup.DB, creating chunk-mode files
+// of size logical bytes sealed under params.
+type chunkFiles struct {
+	DB
+	dekShared, dekUser []byte
+	params             Params
+	size               int64
+}
+
+func (c chunkFiles) CreateFile(ownerID, filename string) (string, error) {
+	fileID, err := newFileID()
+	if err != nil {
+		return "", err
+	}
+	p := c.params
+	err = c.CreateFileWithID(fileID, ownerID, filename, chunkFeature, c.dekShared, c.dekUser, 0, p.EncVersion, int(p.SharedSuite), int(p.UserSuite), storageChunks, string(codec.None), c.size)
+	if err != nil {
+		return "", fmt.Errorf("CreateFileWithID: %w", err)
+	}
+	return fileID, nil
+}
+
+// UploadChunks stores a file in chunk mode.
+func (s *Service) UploadChunks(
+	ctx context.Context,
+	ownerID, filename string,
+	r io.Reader,
+) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
+	log := zap.L().Named("UploadChunks")
+	if s.extractor == nil {
+		return "", nil, nil, nil, ErrChunkModeDisabled
+	}
+
+	chunks, err := s.extractor.Extract(r)
+	if err != nil {
+		log.Error("extract", zap.Error(err))
+		return
+	}
+	// Common chunks are most likely stored already, so only unique ones count
+	// against the physical quota.
+	var size, uniqueSize int64
+	for _, c := range chunks {
+		size += int64(len(c.Data))
+		if !c.IsCommon {
+			uniqueSize += int64(len(c.Data))
+		}
+	}
+	if err = s.checkQuota(ownerID, size, uniqueSize); err != nil {
+		log.Info("over quota", zap.Error(err), zap.String("owner", ownerID))
+		return
+	}
+	if dekShared, err = s.sharedDEK(ctx, chunkFeature); err != nil {
+		log.Error("chunk DEK", zap.Error(err))
+		return
+	}
+	chunkKey, err := s.unwrapShared(ctx, chunkFeature, dekShared)
+	if err != nil {
+		log.Error("Decrypt chunk DEK", zap.Error(err))
+		return
+	}
+	userKey, dekUser, err := s.userDEK(ctx)
+	if err != nil {
+		log.Error("GenerateDataKey(user)", zap.Error(err))
+		return
+	}
+	p := s.params(currentEncVersion)
+	common, unique, err := chunkCiphers(p, chunkKey, userKey)
+	if err != nil {
+		return
+	}
+	for i, c := range chunks {
+		if c.IsCommon {
+			chunks[i].Hash = commonChunkHash(p, c.Hash)
+		}
+	}
+
+	files := chunkFiles{DB: s.db, dekShared: dekShared, dekUser: dekUser, params: p, size: size}
+	fileID, err = dedup.New(files, s.store).ProcessChunksWith(ctx, ownerID, filename, chunks, common, unique)
+	if err != nil {
+		log.Error("ProcessChunks", zap.Error(err))
+		return
+	}
+
+	if s.statsEnabled {
+		shared := 0
+		for _, c := range chunks {
+			if c.IsCommon {
+				shared++
+			}
+		}
+		fmt.Printf("→ chunk stats for file %s: %d of %d chunks common\n", fileID, shared, len(chunks))
+	}
+	log.Info("upload complete", zap.String("fileID", fileID), zap.Int("chunks", len(chunks)))
+	return fileID, chunkFeature, dekShared, dekUser, nil
+}
+
+// openChunks fetches, decrypts and concatenates a chunk-mode file's blocks.
+func (s *Service) openChunks(ctx context.Context, meta db.FileMeta, chunks []db.ChunkInfo) ([]byte, error) {
+	chunkKey, err := s.unwrapShared(ctx, meta.FeaHash, meta.DekShared)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt chunk DEK: %w", err)
+	}
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	common, unique, err := chunkCiphers(s.fileParams(meta), chunkKey, userKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var out bytes.Buffer
+	for i, c := range chunks {
+		rc, err := s.store.GetObject(ctx, c.S3Key)
+		if err != nil {
+			return nil, fmt.Errorf("GetObject(chunk %d): %w", i, err)
+		}
+		blob, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+		enc := unique
+		if c.IsCommon {
+			enc = common
+		}
+		pt, err := enc.DecryptAAD(blob, dedup.ChunkAAD(c.S3Key))
+		if err != nil {
+			return nil, fmt.Errorf("decrypt chunk %d: %w", i, integrityError(err))
+		}
+		out.Write(pt)
+	}
+	return out.Bytes(), nil
+}
+
+// chunkCiphers returns the ciphers for the common and unique blocks of a
+// chunk-mode file sealed under p.
+func chunkCiphers(p Params, chunkKey, userKey []byte) (common, unique *encryption.Service, err error) {
+	if common, err = newLayerCipher(p.EncVersion, chunkKey, p.SharedSuite); err != nil {
+		return nil, nil, err
+	}
+	if unique, err = newLayerCipher(p.EncVersion, userKey, p.UserSuite); err != nil {
+		return nil, nil, err
+	}
+	return common, unique, nil
+}
+
+// commonChunkHash is the hash a common block with content hash hash is
+// recorded under in a file sealed under p. Blocks of earlier versions keep
+// their content hash.
+func commonChunkHash(p Params, hash string) string {
+	if p.EncVersion < encVersionSuiteKeys {
+		return hash
+	}
+	sum := sha256.Sum256(fmt.Appendf(nil, "dsde/chunk/%d/%d/%s", p.EncVersion, p.SharedSuite, hash))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,493 @@
+package dsde
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+)
+
+// Client-side mode: the client runs FG, PG and both encryption layers itself
+// (with Seal and Open), so the plaintext never reaches the server. The server
+// hands out the shared DEK and a fresh user DEK, decides whether d has to be
+// uploaded, and stores ciphertext.
+//
+// Handing out the shared DEK to anyone who names a fea_hash is inherent to
+// the scheme (the server-side upload derives it from the same input). What the
+// server must not do is link an existing d into a file on the strength of its
+// hash alone, so skipping the d upload requires a proof of ownership over d
+// itself, which only someone holding the plaintext can compute.
+
+// ErrUnknownUpload is returned for client-side uploads that were never begun,
+// belong to another owner, have expired or were already committed.
+var ErrUnknownUpload = newError(ErrNotFound, "dsde: unknown or expired client-side upload")
+
+// ErrDMismatch is returned when an uploaded d does not hash to the value the
+// client declared, when a commit arrives before a required d, or when d is
+// sent for an upload that is being stored privately.
+var ErrDMismatch = newError(ErrConflict, "dsde: d missing, unexpected or not matching its declared hash")
+
+const clientUploadTTL = 15 * time.Minute
+
+// ClientKeys carries what a client needs to seal or open a file itself.
+type ClientKeys struct {
+	FileID    string `json:"fileID"`
+	FeaHash   []byte `json:"feaHash"`
+	SharedKey []byte `json:"sharedKey"`
+	UserKey   []byte `json:"userKey"`
+	Pkg2Len   int    `json:"pkg2Len,omitempty"` // downloads only
+	Size      int64  `json:"size,omitempty"`    // downloads only: the plaintext's length
+	Private   bool   `json:"private,omitempty"` // use SealPrivate/OpenPrivate; SharedKey is unset
+	// Codec is the compression the server suggests for an upload, or the one
+	// a downloaded file's plaintext was compressed with.
+	Codec codec.Codec `json:"codec,omitempty"`
+	Params
+}
+
+// DDecision tells a client whether to upload d. When d is already stored the
+// client must instead answer Challenge over the leaves of its own d.
+type DDecision struct {
+	NeedD     bool       `json:"needD"`
+	Challenge *Challenge `json:"challenge,omitempty"`
+}
+
+type clientUpload struct {
+	ownerID, filename           string
+	feaHash, dekShared, dekUser []byte
+	params                      Params // what the client was told to seal under
+	hexD                        string
+	needD, haveD                bool
+	newD                        bool   // this upload stored d first
+	private                     bool   // sealed with SealPrivate; no d
+	root                        []byte // Merkle root of the stored d when !needD
+	challenge                   *Challenge
+	expires                     time.Time
+}
+
+// BeginClientUpload reserves a fileID for a client-side upload of content
+// with feature feaHash, to be stored at filename, and returns the keys to seal
+// it under.
+func (s *Service) BeginClientUpload(
+	ctx context.Context,
+	ownerID, filename string,
+	feaHash []byte,
+) (*ClientKeys, error) {
+	if len(feaHash) != sha256.Size {
+		return nil, fmt.Errorf("feaHash must be %d bytes", sha256.Size)
+	}
+	filename, err := s.FilePath(ctx, ownerID, filename)
+	if err != nil {
+		return nil, err
+	}
+	dekShared, err := s.sharedDEK(ctx, feaHash)
+	if err != nil {
+		return nil, err
+	}
+	private, err := s.staysPrivate(feaHash, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	// Unpopular content is sealed privately, so the shared DEK is not handed out.
+	var sharedKey []byte
+	if !private {
+		if sharedKey, err = s.unwrapShared(ctx, feaHash, dekShared); err != nil {
+			return nil, fmt.Errorf("decrypt shared DEK: %w", err)
+		}
+	}
+	userKey, dekUser, err := s.userDEK(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GenerateDataKey(user): %w", err)
+	}
+	fileID, err := newFileID()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for k, old := range s.uploads {
+		if now.After(old.expires) {
+			delete(s.uploads, k)
+		}
+	}
+	params := s.params(currentEncVersion)
+	s.uploads[fileID] = &clientUpload{
+		ownerID:   ownerID,
+		filename:  filename,
+		feaHash:   feaHash,
+		dekShared: dekShared,
+		dekUser:   dekUser,
+		params:    params,
+		private:   private,
+		expires:   now.Add(clientUploadTTL),
+	}
+	s.mu.Unlock()
+
+	return &ClientKeys{
+		FileID:    fileID,
+		FeaHash:   feaHash,
+		SharedKey: sharedKey,
+		UserKey:   userKey,
+		Private:   private,
+		Codec:     s.codec,
+		Params:    params,
+	}, nil
+}
+
+// upload returns ownerID's pending upload fileID, or ErrUnknownUpload.
+// Callers must hold s.mu.
+func (s *Service) upload(ownerID, fileID string) (*clientUpload, error) {
+	u, ok := s.uploads[fileID]
+	if !ok || u.ownerID != ownerID || time.Now().After(u.expires) {
+		return nil, ErrUnknownUpload
+	}
+	return u, nil
+}
+
+// CheckClientD records the hash of the client's d and decides whether the
+// client has to upload it.
+func (s *Service) CheckClientD(ctx context.Context, ownerID, fileID, hexD string) (*DDecision, error) {
+	defer s.padLatency(ctx, time.Now())
+
+	if raw, err := hex.DecodeString(hexD); err != nil || len(raw) != sha256.Size {
+		return nil, fmt.Errorf("dHash must be %d hex-encoded bytes", sha256.Size)
+	}
+	s.mu.Lock()
+	u, err := s.upload(ownerID, fileID)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if u.private {
+		return nil, ErrDMismatch
+	}
+
+	existed, err := s.db.ExistsChunk(hexD)
+	if err != nil {
+		return nil, fmt.Errorf("ExistsChunk: %w", err)
+	}
+	hide, err := s.hideDedup(u.feaHash)
+	if err != nil {
+		return nil, err
+	}
+	existed = existed && !hide
+	var (
+		root []byte
+		c    *Challenge
+	)
+	if existed {
+		if root, c, err = s.challengeD(ctx, hexD); err != nil {
+			return nil, err
+		}
+		c.ID = fileID
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, err = s.upload(ownerID, fileID); err != nil {
+		return nil, err
+	}
+	u.hexD, u.needD, u.haveD = hexD, !existed, false
+	u.root, u.challenge = root, c
+	return &DDecision{NeedD: !existed, Challenge: c}, nil
+}
+
+// challengeD builds the Merkle tree of a stored d and picks leaves to ask for.
+func (s *Service) challengeD(ctx context.Context, hexD string) ([]byte, *Challenge, error) {
+	info, err := s.db.GetChunk(hexD)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetChunk: %w", err)
+	}
+	rc, err := s.store.GetObject(ctx, info.S3Key)
+	if err != nil {
+		return nil, nil, fmt.Errorf("GetObject(common): %w", err)
+	}
+	d, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	tree := pow.Build(d)
+	indices, err := pow.RandomIndices(tree.NumLeaves(), powChallengeLeaves)
+	if err != nil {
+		return nil, nil, err
+	}
+	return tree.Root(), &Challenge{
+		LeafSize:  pow.LeafSize,
+		NumLeaves: tree.NumLeaves(),
+		Indices:   indices,
+	}, nil
+}
+
+// PutClientD stores the d of a pending upload that CheckClientD asked for.
+func (s *Service) PutClientD(ctx context.Context, ownerID, fileID string, r io.Reader) error {
+	s.mu.Lock()
+	u, err := s.upload(ownerID, fileID)
+	var hexD string
+	if err == nil {
+		if !u.needD {
+			err = ErrDMismatch
+		}
+		hexD = u.hexD
+	}
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	d, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if sum := sha256.Sum256(d); hex.EncodeToString(sum[:]) != hexD {
+		return ErrDMismatch
+	}
+	// d is written even when it is already stored (a hidden dedup, or another
+	// upload racing this one) so both cases cost the same.
+	existed, err := s.db.ExistsChunk(hexD)
+	if err != nil {
+		return fmt.Errorf("ExistsChunk: %w", err)
+	}
+	newD := int64(len(d))
+	if existed && s.thresholdMax == 0 {
+		newD = 0
+	}
+	if err = s.checkQuota(ownerID, 0, newD); err != nil {
+		return err
+	}
+	stored, err := s.storeCommon(ctx, hexD, d)
+	if err != nil {
+		return err
+	}
+	existed = existed || stored
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if u, err = s.upload(ownerID, fileID); err != nil {
+		return err
+	}
+	u.haveD, u.newD = true, !existed
+	return nil
+}
+
+// CommitClientUpload stores the client's sBlob and creates the file. c is the
+// compression the client applied before sealing and size the plaintext's
+// length, which the server cannot see: the file's logical size is taken from
+// it by clientLogicalSize, while physical usage is charged from the
+// ciphertext. proofs answer
+// the DDecision challenge when d was not uploaded. A pending upload is
+// consumed by its first commit, successful or not.
+func (s *Service) CommitClientUpload(
+	ctx context.Context,
+	ownerID, fileID string,
+	pkg2Len int,
+	c codec.Codec,
+	size int64,
+	sBlob []byte,
+	proofs []pow.Proof,
+) (feaHash, dekShared, dekUser []byte, err error) {
+	log := zap.L().Named("CommitClientUpload")
+
+	s.mu.Lock()
+	u, err := s.upload(ownerID, fileID)
+	delete(s.uploads, fileID)
+	s.mu.Unlock()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// the path may have been taken by a folder since the upload began
+	if u.filename, err = s.FilePath(ctx, ownerID, u.filename); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if u.private {
+		return s.commitPrivate(ctx, u, fileID, pkg2Len, c, size, sBlob)
+	}
+	switch {
+	case u.hexD == "":
+		return nil, nil, nil, ErrDMismatch
+	case u.needD && !u.haveD:
+		return nil, nil, nil, ErrDMismatch
+	case !u.needD:
+		byIndex := make(map[int]pow.Proof, len(proofs))
+		for _, p := range proofs {
+			byIndex[p.Index] = p
+		}
+		for _, i := range u.challenge.Indices {
+			p, ok := byIndex[i]
+			if !ok || !pow.Verify(u.root, u.challenge.NumLeaves, p) {
+				log.Warn("proof rejected", zap.String("owner", ownerID), zap.Int("leaf", i))
+				return nil, nil, nil, ErrProofRejected
+			}
+		}
+	}
+	if pkg2Len < 0 || pkg2Len > len(sBlob) {
+		return nil, nil, nil, fmt.Errorf("invalid pkg2Len %d", pkg2Len)
+	}
+	dChunk, err := s.db.GetChunk(u.hexD)
+	if err != nil {
+		log.Error("GetChunk(common)", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	if size, err = s.clientLogicalSize(c, size, dChunk.Size+int64(len(sBlob))); err != nil {
+		return nil, nil, nil, err
+	}
+	newBytes := int64(len(sBlob))
+	if u.newD || s.thresholdMax > 0 {
+		newBytes += dChunk.Size
+	}
+	if err = s.checkQuota(ownerID, size, newBytes); err != nil {
+		return nil, nil, nil, err
+	}
+
+	hexS, err := s.storeUserBlob(ctx, fileID, sBlob)
+	if err != nil {
+		log.Error("storeUserBlob", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	p := u.params
+	if err = s.db.CreateFileWithID(fileID, ownerID, u.filename, u.feaHash, u.dekShared, u.dekUser, pkg2Len, p.EncVersion, int(p.SharedSuite), int(p.UserSuite), storageDSDE, string(c), size); err != nil {
+		log.Error("CreateFileWithID", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	if err = s.linkD(ctx, fileID, u.hexD, nil); err != nil {
+		log.Error("linkD", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	if err = s.db.AddFileChunk(fileID, hexS, 1); err != nil {
+		log.Error("AddFileChunk(sBlob)", zap.Error(err))
+		return nil, nil, nil, err
+	}
+
+	log.Info("client-side upload complete", zap.String("fileID", fileID), zap.Bool("dedup", !u.needD))
+	if err := s.addOwner(u.feaHash, ownerID); err != nil {
+		log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+	}
+	return u.feaHash, u.dekShared, u.dekUser, nil
+}
+
+// clientLogicalSize checks the plaintext size a client declares for content
+// sealed into sealed bytes under compression c and returns the logical size
+// to record and charge: the declared size, but never less than sealed, so
+// understating it does not get around the logical quota. Sealing only adds
+// bytes, so uncompressed content cannot be larger than sealed; compressed
+// content is held to the server's upload limit.
+func (s *Service) clientLogicalSize(c codec.Codec, size, sealed int64) (int64, error) {
+	switch {
+	case size < 0:
+		return 0, fmt.Errorf("%w: negative size %d", ErrInvalidArgument, size)
+	case c == codec.None && size > sealed:
+		return 0, fmt.Errorf("%w: size %d exceeds the %d bytes sealed", ErrInvalidArgument, size, sealed)
+	case s.maxSize > 0 && size > s.maxSize:
+		return 0, fmt.Errorf("%w: size %d exceeds the limit of %d", ErrInvalidArgument, size, s.maxSize)
+	}
+	return max(size, sealed), nil
+}
+
+// commitPrivate stores a client-side upload sealed with SealPrivate.
+func (s *Service) commitPrivate(
+	ctx context.Context,
+	u *clientUpload,
+	fileID string,
+	pkg2Len int,
+	c codec.Codec,
+	size int64,
+	blob []byte,
+) (feaHash, dekShared, dekUser []byte, err error) {
+	log := zap.L().Named("CommitClientUpload")
+
+	if pkg2Len != 0 || u.hexD != "" {
+		return nil, nil, nil, ErrDMismatch
+	}
+	if size, err = s.clientLogicalSize(c, size, int64(len(blob))); err != nil {
+		return nil, nil, nil, err
+	}
+	if err = s.checkQuota(u.ownerID, size, int64(len(blob))); err != nil {
+		return nil, nil, nil, err
+	}
+	hexP, err := s.storeUserBlob(ctx, fileID, blob)
+	if err != nil {
+		log.Error("storeUserBlob", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	p := u.params
+	if err = s.db.CreateFileWithID(fileID, u.ownerID, u.filename, u.feaHash, u.dekShared, u.dekUser, 0, p.EncVersion, int(p.SharedSuite), int(p.UserSuite), storagePrivate, string(c), size); err != nil {
+		log.Error("CreateFileWithID", zap.Error(err))
+		return nil, nil, nil, err
+	}
+	if err = s.db.AddFileChunk(fileID, hexP, 0); err != nil {
+		log.Error("AddFileChunk(private)", zap.Error(err))
+		return nil, nil, nil, err
+	}
+
+	log.Info("client-side upload stored privately", zap.String("fileID", fileID))
+	if err := s.addOwner(u.feaHash, u.ownerID); err != nil {
+		log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+	}
+	return u.feaHash, u.dekShared, u.dekUser, nil
+}
+
+// ClientFile returns the keys and parameters for a client-side download of
+// file ownerID owns or has been granted read access to.
+func (s *Service) ClientFile(ctx context.Context, ownerID, fileID string) (*ClientKeys, error) {
+	ownerID, err := s.readableOwner(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	meta, _, err := s.db.GetFileMeta(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkEncVersion(meta.EncVersion); err != nil {
+		return nil, err
+	}
+	if meta.StorageMode == storageChunks {
+		return nil, fmt.Errorf("file %s is stored in chunk mode", fileID)
+	}
+	private := meta.StorageMode == storagePrivate
+	var sharedKey []byte
+	if !private {
+		if sharedKey, err = s.unwrapShared(ctx, meta.FeaHash, meta.DekShared); err != nil {
+			return nil, fmt.Errorf("decrypt shared DEK: %w", err)
+		}
+	}
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	return &ClientKeys{
+		FileID:    fileID,
+		FeaHash:   meta.FeaHash,
+		SharedKey: sharedKey,
+		UserKey:   userKey,
+		Pkg2Len:   meta.Pkg2Len,
+		Size:      meta.Size,
+		Private:   private,
+		Codec:     codec.Codec(meta.Codec),
+		Params:    s.fileParams(meta),
+	}, nil
+}
+
+// ClientBlob streams the raw ciphertext of chunk seq (0 = d, 1 = sBlob; a
+// private file has only chunk 0) of a file ownerID can read.
+func (s *Service) ClientBlob(ctx context.Context, ownerID, fileID string, seq int) (io.ReadCloser, error) {
+	ownerID, err := s.readableOwner(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	_, chunks, err := s.db.GetFileMeta(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if seq < 0 || seq >= len(chunks) {
+		return nil, fmt.Errorf("file %s has no chunk %d", fileID, seq)
+	}
+	return s.store.GetObject(ctx, chunks[seq].S3Key)
+}
@@ -0,0 +1,176 @@
+package dsde
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dedup"
+)
+
+// ErrFileNotFound is returned when a file does not exist or the caller may
+// not access it.
+var ErrFileNotFound = newError(ErrNotFound, "dsde: file not found")
+
+// CopyFile creates a new file for userID with the contents of srcID, which
+// userID owns or holds an active read grant on, without the data being
+// uploaded again. The copy always belongs to the caller: nobody can place
+// files in another owner's namespace or quota. Shared blobs are linked; only
+// the per-file, user-keyed part is re-encrypted under a fresh user DEK. An
+// empty filename keeps the source's name.
+func (s *Service) CopyFile(
+	ctx context.Context,
+	userID, srcID, filename string,
+) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
+	log := zap.L().Named("CopyFile")
+
+	ownerID, err := s.readableOwner(userID, srcID)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	meta, chunks, err := s.db.GetFileMeta(ownerID, srcID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil, nil, nil, ErrFileNotFound
+	} else if err != nil {
+		log.Error("GetFileMeta", zap.Error(err), zap.String("fileID", srcID))
+		return "", nil, nil, nil, err
+	}
+	if filename == "" {
+		filename = meta.Filename
+	}
+	if filename, err = s.FilePath(ctx, userID, filename); err != nil {
+		return "", nil, nil, nil, err
+	}
+
+	switch meta.StorageMode {
+	case storageDSDE:
+		fileID, _, dekUser, err = s.cloneFile(ctx, db.FileRef{FileID: srcID, OwnerID: ownerID}, userID, filename, nil)
+	case storagePrivate:
+		fileID, dekUser, err = s.copyPrivate(ctx, meta, chunks, srcID, userID, filename)
+	case storageChunks:
+		fileID, dekUser, err = s.copyChunks(ctx, meta, chunks, userID, filename)
+	default:
+		err = fmt.Errorf("unknown storage mode %q for fileID %s", meta.StorageMode, srcID)
+	}
+	if err != nil {
+		log.Error("copy", zap.Error(err), zap.String("src", srcID), zap.String("mode", meta.StorageMode))
+		return "", nil, nil, nil, err
+	}
+
+	// A copy of a file shared by another owner makes the content more popular.
+	if meta.StorageMode != storageChunks && userID != ownerID {
+		if err := s.addOwner(meta.FeaHash, userID); err != nil {
+			log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+		}
+	}
+
+	log.Info("copied", zap.String("fileID", fileID), zap.String("src", srcID), zap.String("owner", userID))
+	return fileID, meta.FeaHash, meta.DekShared, dekUser, nil
+}
+
+// copyPrivate re-encrypts a private file whole under a fresh user DEK.
+func (s *Service) copyPrivate(
+	ctx context.Context,
+	meta db.FileMeta,
+	chunks []db.ChunkInfo,
+	srcID, ownerID, filename string,
+) (fileID string, dekUser []byte, err error) {
+	if len(chunks) != 1 {
+		return "", nil, fmt.Errorf("expected 1 chunk, got %d for private fileID %s", len(chunks), srcID)
+	}
+	data, err := s.openPrivate(ctx, meta, chunks, srcID)
+	if err != nil {
+		return "", nil, err
+	}
+	userKey, dekUser, err := s.userDEK(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("GenerateDataKey(user): %w", err)
+	}
+	if fileID, err = newFileID(); err != nil {
+		return "", nil, err
+	}
+	err = s.storePrivate(ctx, fileID, ownerID, filename, meta.FeaHash, meta.DekShared, dekUser, userKey, data, codec.Codec(meta.Codec), meta.Size)
+	if err != nil {
+		return "", nil, err
+	}
+	return fileID, dekUser, nil
+}
+
+// copyChunks links a chunk-mode file's common chunks into a new file and
+// re-encrypts its unique chunks under a fresh user DEK.
+func (s *Service) copyChunks(
+	ctx context.Context,
+	meta db.FileMeta,
+	chunks []db.ChunkInfo,
+	ownerID, filename string,
+) (fileID string, dekUser []byte, err error) {
+	if err = s.checkQuota(ownerID, meta.Size, copiedBytes(chunks)); err != nil {
+		return "", nil, err
+	}
+	oldKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return "", nil, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	newKey, dekUser, err := s.userDEK(ctx)
+	if err != nil {
+		return "", nil, fmt.Errorf("GenerateDataKey(user): %w", err)
+	}
+	// The copy links the source's common chunks, so it stays on the source's
+	// scheme version and suites.
+	p := s.fileParams(meta)
+	oldEnc, err := newLayerCipher(p.EncVersion, oldKey, p.UserSuite)
+	if err != nil {
+		return "", nil, err
+	}
+	newEnc, err := newLayerCipher(p.EncVersion, newKey, p.UserSuite)
+	if err != nil {
+		return "", nil, err
+	}
+
+	files := chunkFiles{DB: s.db, dekShared: meta.DekShared, dekUser: dekUser, params: p, size: meta.Size}
+	if fileID, err = files.CreateFile(ownerID, filename); err != nil {
+		return "", nil, err
+	}
+	for i, c := range chunks {
+		hash := c.ChunkHash
+		if !c.IsCommon {
+			rc, err := s.store.GetObject(ctx, c.S3Key)
+			if err != nil {
+				return "", nil, fmt.Errorf("GetObject(chunk %d): %w", i, err)
+			}
+			blob, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				return "", nil, err
+			}
+			pt, err := oldEnc.DecryptAAD(blob, dedup.ChunkAAD(c.S3Key))
+			if err != nil {
+				return "", nil, fmt.Errorf("decrypt chunk %d: %w", i, integrityError(err))
+			}
+			key := fmt.Sprintf("files/%s/%d-%x", fileID, i, sha256.Sum256(pt))
+			ct, err := newEnc.EncryptAAD(pt, false, dedup.ChunkAAD(key))
+			if err != nil {
+				return "", nil, fmt.Errorf("encrypt chunk %d: %w", i, err)
+			}
+			hash = fmt.Sprintf("%x", sha256.Sum256(ct))
+			if err = s.store.PutObject(ctx, key, bytes.NewReader(ct)); err != nil {
+				return "", nil, fmt.Errorf("PutObject(chunk %d): %w", i, err)
+			}
+			if err = s.db.InsertChunk(hash, key, false, int64(len(ct))); err != nil {
+				return "", nil, fmt.Errorf("InsertChunk(chunk %d): %w", i, err)
+			}
+		}
+		if err = s.db.AddFileChunk(fileID, hash, i); err != nil {
+			return "", nil, fmt.Errorf("AddFileChunk(chunk %d): %w", i, err)
+		}
+	}
+	return fileID, dekUser, nil
+}
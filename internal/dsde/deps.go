@@ -0,0 +1,90 @@
+package dsde
+
+import (
+	"context"
+	"database/sql"
+	"io"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/storage"
+)
+
+// DB is the metadata store the service keeps files, features and chunks in;
+// *db.Client implements it.
+type DB interface {
+	// files and their content
+	CreateFileWithID(fileID, ownerID, filename string, feaHash, dekShared, dekUser []byte, pkg2Len, encVersion, sharedSuite, userSuite int, storageMode, codec string, size int64) error
+	CreateFileWithMeta(ownerID, filename string, feaHash, dekShared, dekUser []byte, pkg2Len, encVersion, sharedSuite, userSuite int, codec string, size int64) (string, error)
+	GetFileMeta(ownerID, fileID string) (db.FileMeta, []db.ChunkInfo, error)
+	DeleteFile(fileID string) ([]db.ChunkInfo, error)
+	SetFilePoW(fileID string, root []byte, leaves int) error
+	FindFileForDedup(feaHash []byte, leaves int) (db.FilePoW, error)
+	ReplaceFileChunks(fileID string, hashes []string, encVersion, sharedSuite, userSuite, pkg2Len int, storageMode string) error
+	ListFilesBelowEncVersion(version int) ([]db.FileRef, error)
+	ListFilesByStorageMode(feaHash []byte, mode string) ([]db.FileRef, error)
+
+	// chunks
+	ExistsChunk(hash string) (bool, error)
+	InsertChunk(hash, s3Key string, isCommon bool, size int64) error
+	GetChunk(hash string) (db.ChunkInfo, error)
+	DeleteChunk(hash string) error
+	DeleteUnusedChunks(hashes []string) ([]db.ChunkInfo, error)
+	AddFileChunk(fileID, chunkHash string, seq int) error
+
+	// features and their owners
+	CreateFeature(feaHash, dekShared []byte) error
+	GetFeatureByFeaHash(feaHash []byte) ([]byte, error)
+	GetFeatureUploads(feaHash []byte) (count int, threshold sql.NullInt64, err error)
+	CountFeatureUpload(feaHash []byte, threshold int) (count, assigned int, err error)
+	AddFeatureOwner(feaHash []byte, ownerID string) (int, error)
+	CountFeatureOwners(feaHash []byte) (int, error)
+	CountFeatureOwnersWith(feaHash []byte, ownerID string) (int, error)
+	ListPromotableFeatures(minOwners int) ([][]byte, error)
+
+	// the namespace
+	StatPath(ownerID, path string) (file, folder bool, err error)
+	FileIDByPath(ownerID, path string, version int) (string, error)
+	ListTree(ownerID, prefix string) ([]db.TreeEntry, error)
+	ListVersions(ownerID, path string) ([]db.FileVersion, error)
+	ListPrunableVersions(keep int, before sql.NullTime) ([]db.FileRef, error)
+	CreateFolder(ownerID, path string) error
+	DeleteFolder(ownerID, path string) error
+	MovePath(ownerID, from, to string) error
+
+	// sharing
+	FileOwnerFor(userID, fileID, permission string) (string, error)
+	UpsertGrant(fileID, ownerID, granteeID, permission string, expiresAt sql.NullTime) error
+	RevokeGrant(fileID, ownerID, granteeID string) error
+	ListGrants(fileID, ownerID string) ([]db.Grant, error)
+	ListSharedWith(granteeID string) ([]db.Grant, error)
+
+	// quotas and statistics
+	GetQuota(ownerID string) (db.Quota, error)
+	SetQuota(q db.Quota) error
+	DeleteQuota(ownerID string) (bool, error)
+	ListQuotas() ([]db.Quota, error)
+	GetUsage(ownerID string) (db.Usage, error)
+	ListUsage() ([]db.Usage, error)
+	Stats() (db.Stats, error)
+}
+
+// Store holds the encrypted blobs; *storage.Client implements it.
+type Store interface {
+	PutObject(ctx context.Context, key string, body io.Reader) error
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// rangeStore is a Store that can read byte ranges of an object, which lets
+// private files be served without fetching their whole blob.
+type rangeStore interface {
+	NewReaderAt(ctx context.Context, key string) (*storage.ObjectReaderAt, error)
+}
+
+// KMS generates and unwraps data keys; *kms.Client implements it.
+type KMS interface {
+	GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, optFns ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error)
+	Decrypt(ctx context.Context, in *kms.DecryptInput, optFns ...func(*kms.Options)) (*kms.DecryptOutput, error)
+}
@@ -0,0 +1,51 @@
+package dsde
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Error kinds. Every error the service returns on purpose matches one of
+// these under errors.Is, so callers can map failures onto transport status
+// codes without knowing each sentinel.
+var (
+	// ErrNotFound: the file, upload or content does not exist, or the caller
+	// may not see it.
+	ErrNotFound = errors.New("dsde: not found")
+	// ErrForbidden: the caller can see the resource but may not do this to it.
+	ErrForbidden = errors.New("dsde: forbidden")
+	// ErrConflict: the request contradicts the current state.
+	ErrConflict = errors.New("dsde: conflict")
+	// ErrInvalidArgument: the request itself is malformed.
+	ErrInvalidArgument = errors.New("dsde: invalid argument")
+	// ErrQuotaExceeded: storing this would take the owner past their quota.
+	ErrQuotaExceeded = errors.New("dsde: quota exceeded")
+	// ErrIntegrityFailure: stored data failed authentication on decryption.
+	ErrIntegrityFailure = errors.New("dsde: integrity check failed")
+	// ErrKeyUnavailable: KMS refused or failed to generate or unwrap a DEK.
+	ErrKeyUnavailable = errors.New("dsde: key unavailable")
+)
+
+// kindError is a sentinel that also matches its kind.
+type kindError struct {
+	msg  string
+	kind error
+}
+
+func (e *kindError) Error() string { return e.msg }
+func (e *kindError) Unwrap() error { return e.kind }
+
+// newError returns a sentinel with text msg that matches kind.
+func newError(kind error, msg string) error {
+	return &kindError{msg: msg, kind: kind}
+}
+
+// keyError marks a KMS failure as ErrKeyUnavailable.
+func keyError(err error) error {
+	return fmt.Errorf("%w: %w", ErrKeyUnavailable, err)
+}
+
+// integrityError marks a decryption failure as ErrIntegrityFailure.
+func integrityError(err error) error {
+	return fmt.Errorf("%w: %w", ErrIntegrityFailure, err)
+}
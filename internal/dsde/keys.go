@@ -0,0 +1,98 @@
+package dsde
+
+import (
+	"context"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keycache"
+)
+
+// Key caching: without it every upload asks KMS to generate the shared DEK
+// (for new content), decrypt it and generate a user DEK, and every download
+// decrypts both DEKs. A feature's shared DEK never changes, so its plaintext
+// can be kept in memory for a while; user DEKs are unique per file, so they
+// can only be generated ahead of time, never reused.
+
+// WithKeyCache keeps up to size decrypted shared DEKs in memory, each for at
+// most ttl, so uploads and downloads of the same content skip KMS Decrypt.
+// Keys dropped from the cache are zeroed.
+func WithKeyCache(size int, ttl time.Duration) Option {
+	return func(s *Service) {
+		s.sharedKeys = keycache.New(size, ttl)
+	}
+}
+
+// WithUserKeyPool keeps size user DEKs generated ahead of the uploads that
+// take them. It starts generating when the service is built.
+func WithUserKeyPool(size int) Option {
+	return func(s *Service) {
+		if size > 0 {
+			s.userKeys = keycache.NewPool(size, s.generateDEK)
+		}
+	}
+}
+
+// KeyStats describes the shared DEK cache and the user DEK pool; a disabled
+// one reports zeros.
+type KeyStats struct {
+	SharedCache keycache.CacheStats `json:"sharedCache"`
+	UserPool    keycache.PoolStats  `json:"userPool"`
+}
+
+// KeyStats returns the key cache's and pool's current statistics.
+func (s *Service) KeyStats() KeyStats {
+	st := KeyStats{SharedCache: s.sharedKeys.Stats()}
+	if s.userKeys != nil {
+		st.UserPool = s.userKeys.Stats()
+	}
+	return st
+}
+
+// Go runs f in the background with a context that Close cancels. Close
+// waits for f to return, so f may use the service's clients until then.
+func (s *Service) Go(f func(ctx context.Context)) {
+	s.bg.Add(1)
+	go func() {
+		defer s.bg.Done()
+		f(s.bgCtx)
+	}()
+}
+
+// Wait blocks until the background work started by Go has returned.
+func (s *Service) Wait() {
+	s.bg.Wait()
+}
+
+// Close stops the service's background work and waits for it, then zeroes
+// the keys held in memory and stops refilling the user DEK pool. Call it
+// before closing the clients the service was built with.
+func (s *Service) Close() {
+	s.bgCancel()
+	s.Wait()
+	s.sharedKeys.Purge()
+	if s.userKeys != nil {
+		s.userKeys.Close()
+	}
+}
+
+// unwrapShared returns the plaintext of wrapped, feaHash's shared DEK, from
+// the cache or KMS.
+func (s *Service) unwrapShared(ctx context.Context, feaHash, wrapped []byte) ([]byte, error) {
+	if plain, ok := s.sharedKeys.Get(feaHash, wrapped); ok {
+		return plain, nil
+	}
+	plain, err := s.unwrapDEK(ctx, wrapped)
+	if err != nil {
+		return nil, err
+	}
+	s.sharedKeys.Put(feaHash, wrapped, plain)
+	return plain, nil
+}
+
+// userDEK returns a fresh user DEK, from the pool if there is one.
+func (s *Service) userDEK(ctx context.Context) (plain, wrapped []byte, err error) {
+	if s.userKeys != nil {
+		return s.userKeys.Get(ctx)
+	}
+	return s.generateDEK(ctx)
+}
@@ -0,0 +1,225 @@
+package dsde
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+)
+
+// Namespace: a file's name is its path, slash-separated and relative to the
+// owner's root. Folders are the parents of those paths plus any created
+// explicitly, so they can exist empty. Moving or renaming only rewrites
+// paths; blobs are bound to file IDs, not names, and are never touched.
+
+// ErrExists is returned when a path to be created is already taken.
+var ErrExists = newError(ErrConflict, "dsde: path already exists")
+
+// ErrInvalidPath is returned for paths that are empty where a name is
+// needed, contain "." or ".." segments, or move a folder into itself.
+var ErrInvalidPath = newError(ErrInvalidArgument, "dsde: invalid path")
+
+// CleanPath normalizes p to the stored form: no leading, trailing or
+// repeated slashes. The root is "".
+func CleanPath(p string) (string, error) {
+	var parts []string
+	for _, seg := range strings.Split(p, "/") {
+		switch seg {
+		case "":
+		case ".", "..":
+			return "", fmt.Errorf("%w: %q", ErrInvalidPath, p)
+		default:
+			parts = append(parts, seg)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// Stat reports whether ownerID's path is a file or a folder. The root is
+// always a folder.
+func (s *Service) Stat(ctx context.Context, ownerID, p string) (file, folder bool, err error) {
+	if p, err = CleanPath(p); err != nil {
+		return false, false, err
+	}
+	if p == "" {
+		return false, true, nil
+	}
+	return s.db.StatPath(ownerID, p)
+}
+
+// FilePath cleans p for storing a file there, which needs p not to be the
+// root or a folder, and none of its parents to be a file.
+func (s *Service) FilePath(ctx context.Context, ownerID, p string) (string, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", ErrInvalidPath
+	}
+	if _, folder, err := s.db.StatPath(ownerID, p); err != nil {
+		return "", err
+	} else if folder {
+		return "", fmt.Errorf("%w: %q is a folder", ErrExists, p)
+	}
+	if err := s.noFileAbove(ownerID, p); err != nil {
+		return "", err
+	}
+	return p, nil
+}
+
+// noFileAbove returns ErrExists if a parent folder of p is a file.
+func (s *Service) noFileAbove(ownerID, p string) error {
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if file, _, err := s.db.StatPath(ownerID, dir); err != nil {
+			return err
+		} else if file {
+			return fmt.Errorf("%w: %q is a file", ErrExists, dir)
+		}
+	}
+	return nil
+}
+
+// Mkdir creates folder p and any missing parents.
+func (s *Service) Mkdir(ctx context.Context, ownerID, p string) error {
+	p, err := CleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return ErrExists
+	}
+	if file, _, err := s.db.StatPath(ownerID, p); err != nil {
+		return err
+	} else if file {
+		return fmt.Errorf("%w: %q is a file", ErrExists, p)
+	}
+	if err := s.noFileAbove(ownerID, p); err != nil {
+		return err
+	}
+	return s.db.CreateFolder(ownerID, p)
+}
+
+// Rmdir removes ownerID's explicitly created folder p, which must be empty.
+func (s *Service) Rmdir(ctx context.Context, ownerID, p string) error {
+	entries, err := s.List(ctx, ownerID, p, false)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%w: folder is not empty", ErrExists)
+	}
+	p, _ = CleanPath(p)
+	err = s.db.DeleteFolder(ownerID, p)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	return err
+}
+
+// Move renames ownerID's file or folder from to to, which must not exist.
+// Every version of a file moves with it.
+func (s *Service) Move(ctx context.Context, ownerID, from, to string) error {
+	from, err := CleanPath(from)
+	if err != nil {
+		return err
+	}
+	if to, err = CleanPath(to); err != nil {
+		return err
+	}
+	if from == "" || to == "" || to == from || strings.HasPrefix(to, from+"/") {
+		return ErrInvalidPath
+	}
+	file, folder, err := s.db.StatPath(ownerID, to)
+	if err != nil {
+		return err
+	}
+	if file || folder {
+		return ErrExists
+	}
+	if err := s.noFileAbove(ownerID, to); err != nil {
+		return err
+	}
+	err = s.db.MovePath(ownerID, from, to)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	}
+	return err
+}
+
+// List returns the entries in folder p: its direct children, or everything
+// beneath it if recursive. Folders only implied by deeper files are listed
+// as folders too.
+func (s *Service) List(ctx context.Context, ownerID, p string, recursive bool) ([]db.TreeEntry, error) {
+	p, err := CleanPath(p)
+	if err != nil {
+		return nil, err
+	}
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+	entries, err := s.db.ListTree(ownerID, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var out []db.TreeEntry
+	add := func(e db.TreeEntry) {
+		if e.Folder && seen[e.Path] {
+			return
+		}
+		seen[e.Path] = e.Folder
+		out = append(out, e)
+	}
+	for _, e := range entries {
+		rel := strings.TrimPrefix(e.Path, prefix)
+		// implied folders between p and the entry
+		dirs := strings.Split(rel, "/")
+		for i := 1; i < len(dirs); i++ {
+			if !recursive && i > 1 {
+				break
+			}
+			add(db.TreeEntry{Path: prefix + strings.Join(dirs[:i], "/"), Folder: true})
+		}
+		if recursive || len(dirs) == 1 {
+			add(e)
+		}
+	}
+	if p != "" && len(out) == 0 {
+		if _, folder, err := s.db.StatPath(ownerID, p); err != nil {
+			return nil, err
+		} else if !folder {
+			return nil, ErrFileNotFound
+		}
+	}
+	return out, nil
+}
+
+// Remove deletes ownerID's file at p with all its versions, or the empty
+// folder p.
+func (s *Service) Remove(ctx context.Context, ownerID, p string) error {
+	p, err := CleanPath(p)
+	if err != nil {
+		return err
+	}
+	if p == "" {
+		return ErrInvalidPath
+	}
+	file, folder, err := s.Stat(ctx, ownerID, p)
+	if err != nil {
+		return err
+	}
+	switch {
+	case file:
+		return s.DeletePath(ctx, ownerID, p)
+	case folder:
+		return s.Rmdir(ctx, ownerID, p)
+	}
+	return ErrFileNotFound
+}
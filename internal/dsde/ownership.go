@@ -0,0 +1,239 @@
+package dsde
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+)
+
+// ErrNoDedup is returned when content cannot be claimed by proof of
+// ownership (unknown, stored before Merkle roots were recorded, still private
+// under the popularity threshold, or still below its randomized dedup
+// threshold); the client should fall back to a full upload.
+var ErrNoDedup = newError(ErrNotFound, "dsde: content not eligible for proof-of-ownership dedup")
+
+// ErrProofRejected is returned when a proof of ownership fails to verify.
+var ErrProofRejected = newError(ErrForbidden, "dsde: proof of ownership rejected")
+
+const (
+	powChallengeLeaves = 16
+	powChallengeTTL    = 2 * time.Minute
+)
+
+// Challenge asks a client to prove it holds the leaves at Indices.
+type Challenge struct {
+	ID        string `json:"challengeID"`
+	LeafSize  int    `json:"leafSize"`
+	NumLeaves int    `json:"numLeaves"`
+	Indices   []int  `json:"indices"`
+}
+
+type challenge struct {
+	Challenge
+	ownerID, filename string
+	feaHash, root     []byte
+	src               db.FileRef // the file the proof is checked against
+	expires           time.Time
+}
+
+// BeginDedup starts a proof-of-ownership exchange for content the client
+// claims has feature feaHash and length size, to be stored at filename.
+func (s *Service) BeginDedup(
+	ctx context.Context,
+	ownerID, filename string,
+	feaHash []byte,
+	size int64,
+) (*Challenge, error) {
+	defer s.padLatency(ctx, time.Now())
+
+	filename, err := s.FilePath(ctx, ownerID, filename)
+	if err != nil {
+		return nil, err
+	}
+	// Distinct contents can share a feature, so the challenge is bound to
+	// one file's root and only that file can be cloned.
+	leaves := pow.NumLeaves(size)
+	src, err := s.db.FindFileForDedup(feaHash, leaves)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoDedup
+	} else if err != nil {
+		return nil, err
+	}
+	if ok, err := s.dedupRevealed(feaHash); err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrNoDedup
+	}
+
+	indices, err := pow.RandomIndices(leaves, powChallengeLeaves)
+	if err != nil {
+		return nil, err
+	}
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	c := &challenge{
+		Challenge: Challenge{
+			ID:        hex.EncodeToString(id[:]),
+			LeafSize:  pow.LeafSize,
+			NumLeaves: leaves,
+			Indices:   indices,
+		},
+		ownerID:  ownerID,
+		filename: filename,
+		feaHash:  feaHash,
+		root:     src.Root,
+		src:      src.FileRef,
+		expires:  time.Now().Add(powChallengeTTL),
+	}
+
+	s.mu.Lock()
+	now := time.Now()
+	for k, old := range s.challenges {
+		if now.After(old.expires) {
+			delete(s.challenges, k)
+		}
+	}
+	s.challenges[c.ID] = c
+	s.mu.Unlock()
+
+	return &c.Challenge, nil
+}
+
+// CompleteDedup verifies the client's answer to a challenge and, if every
+// challenged leaf checks out against the challenged file's root, links that
+// file's d blob into a new file for ownerID. Challenges are single-use.
+func (s *Service) CompleteDedup(
+	ctx context.Context,
+	ownerID, challengeID string,
+	proofs []pow.Proof,
+) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
+	log := zap.L().Named("CompleteDedup")
+
+	s.mu.Lock()
+	c, ok := s.challenges[challengeID]
+	delete(s.challenges, challengeID)
+	s.mu.Unlock()
+	if !ok || c.ownerID != ownerID || time.Now().After(c.expires) {
+		err = ErrProofRejected
+		return
+	}
+
+	byIndex := make(map[int]pow.Proof, len(proofs))
+	for _, p := range proofs {
+		byIndex[p.Index] = p
+	}
+	for _, i := range c.Indices {
+		p, ok := byIndex[i]
+		if !ok || !pow.Verify(c.root, c.NumLeaves, p) {
+			log.Warn("proof rejected", zap.String("owner", ownerID), zap.Int("leaf", i))
+			err = ErrProofRejected
+			return
+		}
+	}
+
+	// the path may have become a folder since the challenge was issued
+	filename, err := s.FilePath(ctx, ownerID, c.filename)
+	if err != nil {
+		return
+	}
+	src := c.src
+	fileID, meta, dekUser, err := s.cloneFile(ctx, src, ownerID, filename, c.root)
+	if errors.Is(err, sql.ErrNoRows) || errors.Is(err, ErrContentGone) {
+		// deleted since the challenge was issued
+		err = ErrNoDedup
+	}
+	if err != nil {
+		log.Error("cloneFile", zap.Error(err), zap.String("src", src.FileID))
+		return
+	}
+	if err := s.addOwner(c.feaHash, ownerID); err != nil {
+		log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+	}
+	log.Info("dedup by proof of ownership", zap.String("fileID", fileID), zap.String("src", src.FileID))
+	return fileID, meta.FeaHash, meta.DekShared, dekUser, nil
+}
+
+// cloneFile creates a new file for ownerID with the same content as src. The
+// d blob is shared; only pkg2||pkg4 is re-encrypted, under a fresh user DEK
+// and bound to the new fileID. If root is set, src must still have that
+// Merkle root, or ErrNoDedup is returned.
+func (s *Service) cloneFile(
+	ctx context.Context,
+	src db.FileRef,
+	ownerID, filename string,
+	root []byte,
+) (fileID string, meta db.FileMeta, dekUser []byte, err error) {
+	meta, chunks, err := s.db.GetFileMeta(src.OwnerID, src.FileID)
+	if err != nil {
+		return "", meta, nil, err
+	}
+	if root != nil && (meta.StorageMode != storageDSDE || !bytes.Equal(meta.PowRoot, root)) {
+		return "", meta, nil, ErrNoDedup
+	}
+	if len(chunks) != 2 {
+		return "", meta, nil, fmt.Errorf("expected 2 chunks, got %d for fileID %s", len(chunks), src.FileID)
+	}
+	if err = checkEncVersion(meta.EncVersion); err != nil {
+		return "", meta, nil, err
+	}
+	if err = s.checkQuota(ownerID, meta.Size, copiedBytes(chunks)); err != nil {
+		return "", meta, nil, err
+	}
+
+	oldKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	rc, err := s.store.GetObject(ctx, chunks[1].S3Key)
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("GetObject(sBlob): %w", err)
+	}
+	p := s.fileParams(meta)
+	combined, err := openUserLayer(p.EncVersion, oldKey, p.UserSuite, src.FileID, rc)
+	rc.Close()
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("decrypt sBlob: %w", err)
+	}
+
+	newKey, dekUser, err := s.userDEK(ctx)
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("GenerateDataKey(user): %w", err)
+	}
+	// The clone shares d, so it stays on the source's scheme version.
+	fileID, err = s.db.CreateFileWithMeta(ownerID, filename, meta.FeaHash, meta.DekShared, dekUser, meta.Pkg2Len, meta.EncVersion, meta.SharedSuite, int(p.UserSuite), meta.Codec, meta.Size)
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("CreateFileWithMeta: %w", err)
+	}
+	if meta.PowRoot != nil {
+		if err = s.db.SetFilePoW(fileID, meta.PowRoot, meta.PowLeaves); err != nil {
+			return "", meta, nil, fmt.Errorf("SetFilePoW: %w", err)
+		}
+	}
+	sBlob, err := sealUserLayer(p.EncVersion, newKey, p.UserSuite, fileID, combined)
+	if err != nil {
+		return "", meta, nil, fmt.Errorf("encrypt combined: %w", err)
+	}
+	hexS, err := s.storeUserBlob(ctx, fileID, sBlob)
+	if err != nil {
+		return "", meta, nil, err
+	}
+	if err = s.linkD(ctx, fileID, chunks[0].ChunkHash, nil); err != nil {
+		return "", meta, nil, fmt.Errorf("linkD: %w", err)
+	}
+	if err = s.db.AddFileChunk(fileID, hexS, 1); err != nil {
+		return "", meta, nil, fmt.Errorf("AddFileChunk(sBlob): %w", err)
+	}
+	return fileID, meta, dekUser, nil
+}
@@ -0,0 +1,258 @@
+package dsde
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+)
+
+// Popularity threshold: content held by a single owner gains nothing from the
+// shared layer, and its d would still reveal when a second owner uploads the
+// same file. With a threshold t, a feature's files are stored private (the
+// whole file under the owner's DEK, no d) until t distinct owners have
+// uploaded it. The upload that makes the content popular is stored in the
+// DSDE form, and the earlier private files are promoted in the background.
+
+// WithPopularityThreshold keeps content private until t distinct owners have
+// uploaded it. t of 0 or 1 shares everything immediately.
+func WithPopularityThreshold(t int) Option {
+	return func(s *Service) {
+		s.popularity = t
+	}
+}
+
+// staysPrivate reports whether feaHash's content, uploaded by ownerID, would
+// still be below the popularity threshold. ownerID is only counted once their
+// file is stored, by addOwner.
+func (s *Service) staysPrivate(feaHash []byte, ownerID string) (bool, error) {
+	if s.popularity <= 1 {
+		return false, nil
+	}
+	owners, err := s.db.CountFeatureOwnersWith(feaHash, ownerID)
+	if err != nil {
+		return false, fmt.Errorf("CountFeatureOwnersWith: %w", err)
+	}
+	return owners < s.popularity, nil
+}
+
+// addOwner records ownerID, who now stores a file of feaHash's content, as
+// one of its owners, and promotes the feature's private files once that
+// makes the content popular.
+func (s *Service) addOwner(feaHash []byte, ownerID string) error {
+	owners, err := s.db.AddFeatureOwner(feaHash, ownerID)
+	if err != nil {
+		return fmt.Errorf("AddFeatureOwner: %w", err)
+	}
+	if s.popularity > 1 && owners >= s.popularity {
+		s.promote(feaHash)
+	}
+	return nil
+}
+
+// popular reports whether feaHash has reached the popularity threshold.
+func (s *Service) popular(feaHash []byte) (bool, error) {
+	if s.popularity <= 1 {
+		return true, nil
+	}
+	owners, err := s.db.CountFeatureOwners(feaHash)
+	if err != nil {
+		return false, fmt.Errorf("CountFeatureOwners: %w", err)
+	}
+	return owners >= s.popularity, nil
+}
+
+// storePrivate seals data (already compressed with c from size bytes) under
+// the user DEK alone and records the file, if ownerID's quota has room.
+func (s *Service) storePrivate(
+	ctx context.Context,
+	fileID, ownerID, filename string,
+	feaHash, dekShared, dekUser, userKey []byte,
+	data []byte,
+	c codec.Codec,
+	size int64,
+) error {
+	blob, err := SealPrivate(s.params(currentEncVersion), userKey, fileID, data)
+	if err != nil {
+		return fmt.Errorf("seal private: %w", err)
+	}
+	if err = s.checkQuota(ownerID, size, int64(len(blob))); err != nil {
+		return err
+	}
+	hexP, err := s.storeUserBlob(ctx, fileID, blob)
+	if err != nil {
+		return err
+	}
+	if err = s.db.CreateFileWithID(fileID, ownerID, filename, feaHash, dekShared, dekUser, 0, currentEncVersion, int(s.sharedSuite), int(s.userSuite), storagePrivate, string(c), size); err != nil {
+		s.discard(ctx, fileID, hexP)
+		return fmt.Errorf("CreateFileWithID: %w", err)
+	}
+	if err = s.db.AddFileChunk(fileID, hexP, 0); err != nil {
+		s.discard(ctx, fileID, hexP)
+		return fmt.Errorf("AddFileChunk(private): %w", err)
+	}
+	return nil
+}
+
+// openPrivate fetches and decrypts a private file.
+func (s *Service) openPrivate(ctx context.Context, meta db.FileMeta, chunks []db.ChunkInfo, fileID string) ([]byte, error) {
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	rc, err := s.store.GetObject(ctx, chunks[0].S3Key)
+	if err != nil {
+		return nil, fmt.Errorf("GetObject(private): %w", err)
+	}
+	defer rc.Close()
+	return OpenPrivate(s.fileParams(meta), userKey, fileID, rc)
+}
+
+// openPrivateAt gives random access to a private file's plaintext through
+// ranged reads of its blob. ok is false for files stored otherwise and for
+// compressed ones, whose blob holds the compressed bytes, and when the store
+// cannot read ranges.
+func (s *Service) openPrivateAt(ctx context.Context, meta db.FileMeta, chunks []db.ChunkInfo, fileID string) (*encryption.StreamReaderAt, bool, error) {
+	rs, ok := s.store.(rangeStore)
+	if !ok || meta.StorageMode != storagePrivate {
+		return nil, false, nil
+	}
+	if c, err := codec.Parse(meta.Codec); err != nil || c != codec.None {
+		return nil, false, nil
+	}
+	if err := checkPrivateVersion(meta.EncVersion); err != nil {
+		return nil, false, err
+	}
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return nil, false, fmt.Errorf("decrypt user DEK: %w", err)
+	}
+	blob, err := rs.NewReaderAt(ctx, chunks[0].S3Key)
+	if err != nil {
+		return nil, false, fmt.Errorf("HeadObject(private): %w", err)
+	}
+	p := s.fileParams(meta)
+	ra, err := openUserKeyedAt(p.EncVersion, userKey, p.UserSuite, privateAAD(fileID), blob, blob.Size())
+	if err != nil {
+		return nil, false, err
+	}
+	return ra, true, nil
+}
+
+// promote migrates feaHash's remaining private files in the background. At
+// most one migration per feature runs at a time.
+func (s *Service) promote(feaHash []byte) {
+	key := hex.EncodeToString(feaHash)
+	s.mu.Lock()
+	if s.promoting[key] {
+		s.mu.Unlock()
+		return
+	}
+	s.promoting[key] = true
+	s.mu.Unlock()
+
+	s.Go(func(ctx context.Context) {
+		defer func() {
+			s.mu.Lock()
+			delete(s.promoting, key)
+			s.mu.Unlock()
+		}()
+		if _, err := s.promoteFeature(ctx, feaHash); err != nil && ctx.Err() == nil {
+			zap.L().Named("promote").Warn("promote feature", zap.Error(err), zap.String("feaHash", key))
+		}
+	})
+}
+
+// promoteFeature converts every private file of feaHash into the DSDE form
+// and returns how many it converted.
+func (s *Service) promoteFeature(ctx context.Context, feaHash []byte) (int, error) {
+	refs, err := s.db.ListFilesByStorageMode(feaHash, storagePrivate)
+	if err != nil {
+		return 0, fmt.Errorf("ListFilesByStorageMode: %w", err)
+	}
+	n := 0
+	for _, ref := range refs {
+		if err := s.promoteFile(ctx, ref); err != nil {
+			return n, fmt.Errorf("promote %s: %w", ref.FileID, err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+// promoteFile re-seals one private file in the DSDE form under its existing
+// DEKs, links the (deduplicated) d and deletes the private blob.
+func (s *Service) promoteFile(ctx context.Context, ref db.FileRef) error {
+	log := zap.L().Named("promote")
+
+	meta, chunks, err := s.db.GetFileMeta(ref.OwnerID, ref.FileID)
+	if err != nil {
+		return err
+	}
+	if meta.StorageMode != storagePrivate {
+		return nil
+	}
+	if len(chunks) != 1 {
+		return fmt.Errorf("expected 1 chunk, got %d for private fileID %s", len(chunks), ref.FileID)
+	}
+	data, err := s.openPrivate(ctx, meta, chunks, ref.FileID)
+	if err != nil {
+		return err
+	}
+	sharedKey, err := s.unwrapShared(ctx, meta.FeaHash, meta.DekShared)
+	if err != nil {
+		return fmt.Errorf("decrypt shared DEK: %w", err)
+	}
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
+	if err != nil {
+		return fmt.Errorf("decrypt user DEK: %w", err)
+	}
+
+	d, sBlob, pkg2Len, err := Seal(s.params(currentEncVersion), sharedKey, userKey, meta.FeaHash, ref.FileID, data)
+	if err != nil {
+		return err
+	}
+	_, hexD, hexS, err := s.storeBlobs(ctx, ref.FileID, d, sBlob, false)
+	if err != nil {
+		return err
+	}
+	if err = s.db.ReplaceFileChunks(ref.FileID, []string{hexD, hexS}, currentEncVersion, int(s.sharedSuite), int(s.userSuite), pkg2Len, storageDSDE); err != nil {
+		return fmt.Errorf("ReplaceFileChunks: %w", err)
+	}
+
+	old := chunks[0]
+	if err = s.db.DeleteChunk(old.ChunkHash); err != nil {
+		log.Warn("DeleteChunk(private)", zap.Error(err), zap.String("hash", old.ChunkHash))
+	} else if err = s.store.DeleteObject(ctx, old.S3Key); err != nil {
+		log.Warn("DeleteObject(private)", zap.Error(err), zap.String("s3Key", old.S3Key))
+	}
+	log.Info("promoted", zap.String("fileID", ref.FileID))
+	return nil
+}
+
+// PromotePending promotes the private files of every feature that has reached
+// the popularity threshold, finishing migrations a restart interrupted. It
+// returns how many files it converted.
+func (s *Service) PromotePending(ctx context.Context) (int, error) {
+	if s.popularity <= 1 {
+		return 0, nil
+	}
+	features, err := s.db.ListPromotableFeatures(s.popularity)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, feaHash := range features {
+		k, err := s.promoteFeature(ctx, feaHash)
+		n += k
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,200 @@
+package dsde
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+)
+
+// Quotas: the database keeps each owner's usage as files and blobs come and
+// go. Logical bytes are the sizes of the owner's files as uploaded. For
+// client-side uploads, whose plaintext the server never sees, that is the size
+// the client declares but never less than the sealed size; see
+// clientLogicalSize. Physical
+// bytes are the stored blobs charged to the owner; a blob shared by several
+// owners is charged to one of them, so deduplicated content costs its other
+// owners nothing. Uploads that would take an owner past either limit fail
+// with ErrQuotaExceeded before anything is stored. Concurrent uploads by the
+// same owner are checked independently and can overshoot together.
+//
+// Under randomized thresholds that saving would tell an owner their upload
+// deduplicated, so owners are not shown their physical usage (see OwnUsage)
+// and uploads are checked as if their common blob were new.
+
+// ErrInvalidQuota is returned for negative limits.
+var ErrInvalidQuota = newError(ErrInvalidArgument, "dsde: quota limits must not be negative")
+
+// ErrNoQuota is returned when removing a quota that was never set.
+var ErrNoQuota = newError(ErrNotFound, "dsde: owner has no quota of their own")
+
+// WithDefaultQuota limits owners without a quota of their own to logical and
+// physical bytes; 0 leaves that measure unlimited.
+func WithDefaultQuota(logical, physical int64) Option {
+	return func(s *Service) {
+		s.defaultQuota = db.Quota{LogicalBytes: logical, PhysicalBytes: physical}
+	}
+}
+
+// OwnerQuota is the quota that applies to an owner, with their usage.
+type OwnerQuota struct {
+	Owner         string `json:"owner"`
+	LogicalQuota  int64  `json:"logicalQuota"`  // 0: unlimited
+	PhysicalQuota int64  `json:"physicalQuota"` // 0: unlimited
+	Default       bool   `json:"default"`       // no quota of their own; the service default applies
+	LogicalBytes  int64  `json:"logicalBytes"`
+	PhysicalBytes int64  `json:"physicalBytes,omitempty"` // left out of OwnUsage under randomized thresholds
+}
+
+// Quota returns ownerID's quota and usage.
+func (s *Service) Quota(ctx context.Context, ownerID string) (OwnerQuota, error) {
+	q, own, err := s.quota(ownerID)
+	if err != nil {
+		return OwnerQuota{}, err
+	}
+	u, err := s.db.GetUsage(ownerID)
+	if err != nil {
+		return OwnerQuota{}, fmt.Errorf("GetUsage: %w", err)
+	}
+	return ownerQuota(ownerID, q, !own, u), nil
+}
+
+// OwnUsage is Quota as shown to ownerID themselves. Under randomized
+// thresholds it leaves out physical usage, which would show whether an
+// upload below its threshold was deduplicated.
+func (s *Service) OwnUsage(ctx context.Context, ownerID string) (OwnerQuota, error) {
+	oq, err := s.Quota(ctx, ownerID)
+	if err == nil && s.thresholdMax > 0 {
+		oq.PhysicalBytes = 0
+	}
+	return oq, err
+}
+
+// Quotas returns the quota and usage of every owner who stores anything or
+// has a quota of their own, by owner.
+func (s *Service) Quotas(ctx context.Context) ([]OwnerQuota, error) {
+	quotas, err := s.db.ListQuotas()
+	if err != nil {
+		return nil, fmt.Errorf("ListQuotas: %w", err)
+	}
+	usage, err := s.db.ListUsage()
+	if err != nil {
+		return nil, fmt.Errorf("ListUsage: %w", err)
+	}
+	byOwner := make(map[string]*OwnerQuota, len(quotas)+len(usage))
+	for _, q := range quotas {
+		oq := ownerQuota(q.OwnerID, q, false, db.Usage{})
+		byOwner[q.OwnerID] = &oq
+	}
+	for _, u := range usage {
+		oq, ok := byOwner[u.OwnerID]
+		if !ok {
+			v := ownerQuota(u.OwnerID, s.defaultQuota, true, u)
+			byOwner[u.OwnerID] = &v
+			continue
+		}
+		oq.LogicalBytes, oq.PhysicalBytes = u.LogicalBytes, u.PhysicalBytes
+	}
+	out := make([]OwnerQuota, 0, len(byOwner))
+	for _, oq := range byOwner {
+		out = append(out, *oq)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Owner < out[j].Owner })
+	return out, nil
+}
+
+// SetQuota gives ownerID their own limits, replacing the default; 0 leaves a
+// measure unlimited. Usage already past a new limit is kept, but blocks
+// further uploads.
+func (s *Service) SetQuota(ctx context.Context, ownerID string, logical, physical int64) error {
+	if logical < 0 || physical < 0 {
+		return ErrInvalidQuota
+	}
+	return s.db.SetQuota(db.Quota{OwnerID: ownerID, LogicalBytes: logical, PhysicalBytes: physical})
+}
+
+// RemoveQuota puts ownerID back under the default quota.
+func (s *Service) RemoveQuota(ctx context.Context, ownerID string) error {
+	ok, err := s.db.DeleteQuota(ownerID)
+	if err == nil && !ok {
+		return ErrNoQuota
+	}
+	return err
+}
+
+// quota returns the limits that apply to ownerID and whether they are the
+// owner's own.
+func (s *Service) quota(ownerID string) (db.Quota, bool, error) {
+	q, err := s.db.GetQuota(ownerID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.defaultQuota, false, nil
+	} else if err != nil {
+		return db.Quota{}, false, fmt.Errorf("GetQuota: %w", err)
+	}
+	return q, true, nil
+}
+
+func ownerQuota(ownerID string, q db.Quota, dflt bool, u db.Usage) OwnerQuota {
+	return OwnerQuota{
+		Owner:         ownerID,
+		LogicalQuota:  q.LogicalBytes,
+		PhysicalQuota: q.PhysicalBytes,
+		Default:       dflt,
+		LogicalBytes:  u.LogicalBytes,
+		PhysicalBytes: u.PhysicalBytes,
+	}
+}
+
+// checkQuota returns ErrQuotaExceeded if storing logical more logical and
+// physical more physical bytes would take ownerID past their quota.
+func (s *Service) checkQuota(ownerID string, logical, physical int64) error {
+	q, _, err := s.quota(ownerID)
+	if err != nil || (q.LogicalBytes == 0 && q.PhysicalBytes == 0) {
+		return err
+	}
+	u, err := s.db.GetUsage(ownerID)
+	if err != nil {
+		return fmt.Errorf("GetUsage: %w", err)
+	}
+	if q.LogicalBytes > 0 && u.LogicalBytes+logical > q.LogicalBytes {
+		return fmt.Errorf("%w: %d logical bytes stored, %d more would exceed the limit of %d",
+			ErrQuotaExceeded, u.LogicalBytes, logical, q.LogicalBytes)
+	}
+	if q.PhysicalBytes > 0 && u.PhysicalBytes+physical > q.PhysicalBytes {
+		return fmt.Errorf("%w: %d physical bytes stored, %d more would exceed the limit of %d",
+			ErrQuotaExceeded, u.PhysicalBytes, physical, q.PhysicalBytes)
+	}
+	return nil
+}
+
+// newBlobBytes is what storing the common blob with hash hexD and size n
+// adds to physical usage: nothing if it is already stored. Under randomized
+// thresholds it is always n, so a refusal does not show that it is stored.
+func (s *Service) newBlobBytes(hexD string, n int) (int64, error) {
+	if s.thresholdMax > 0 {
+		return int64(n), nil
+	}
+	existed, err := s.db.ExistsChunk(hexD)
+	if err != nil {
+		return 0, fmt.Errorf("ExistsChunk: %w", err)
+	}
+	if existed {
+		return 0, nil
+	}
+	return int64(n), nil
+}
+
+// copiedBytes is what copying a file with chunks adds to physical usage: its
+// per-file blobs, which are re-encrypted. Common blobs are linked.
+func copiedBytes(chunks []db.ChunkInfo) int64 {
+	var n int64
+	for _, c := range chunks {
+		if !c.IsCommon {
+			n += c.Size
+		}
+	}
+	return n
+}
@@ -0,0 +1,298 @@
+package dsde
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/split"
+)
+
+// Scheme versions recorded in files.enc_version.
+const (
+	encVersionLegacy = 0 // sealed without associated data
+	encVersionAAD    = 1 // pkg3C bound to fea_hash, sBlob bound to fileID
+	encVersionSuites = 2 // as encVersionAAD, blobs carry a cipher-suite header
+	encVersionStream = 3 // as encVersionSuites, sBlob uses the segmented stream format
+	// as encVersionStream, each suite under its own subkey with the suite
+	// bound into the AAD, and blobs open only under the file's recorded suites
+	encVersionSuiteKeys = 4
+
+	currentEncVersion = encVersionSuiteKeys
+)
+
+// The stream format of encVersionStream changes how sBlobs are encrypted, not
+// how much of them is held: PG splits a whole file, and Merge needs all of
+// pkg2||pkg4, so a DSDE file is still sealed and opened in memory, and only
+// the upload limit keeps that in bounds. Only private files, which are one
+// user-keyed stream, are read by range (openPrivateAt).
+
+// Storage modes recorded in files.storage_mode.
+const (
+	storageDSDE    = "dsde"    // d under common/ plus a per-file sBlob
+	storagePrivate = "private" // the whole file under the user DEK; see WithPopularityThreshold
+	storageChunks  = "chunks"  // fixed-size blocks through dedup.Service; see WithChunkMode
+)
+
+// checkEncVersion rejects versions this build does not know how to open.
+func checkEncVersion(version int) error {
+	if version < encVersionLegacy || version > currentEncVersion {
+		return fmt.Errorf("unsupported enc_version %d", version)
+	}
+	return nil
+}
+
+// checkPrivateVersion rejects versions private files cannot be sealed under.
+func checkPrivateVersion(version int) error {
+	if version < encVersionStream || version > currentEncVersion {
+		return fmt.Errorf("unsupported enc_version %d for a private file", version)
+	}
+	return nil
+}
+
+// sharedAAD returns the associated data pkg3C is sealed with. pkg3C must be
+// identical for every owner of the same content or d stops deduplicating, so
+// it is bound to the feature rather than to a fileID.
+func sharedAAD(version int, feaHash []byte) []byte {
+	if version == encVersionLegacy {
+		return nil
+	}
+	return encryption.AssociatedData(encryption.SchemeVersion, encryption.RoleShared, feaHash)
+}
+
+// userAAD returns the associated data the per-file sBlob is sealed with.
+func userAAD(version int, fileID string) []byte {
+	if version == encVersionLegacy {
+		return nil
+	}
+	return encryption.AssociatedData(encryption.SchemeVersion, encryption.RoleUser, []byte(fileID))
+}
+
+// privateAAD returns the associated data a not-yet-shared file is sealed with.
+func privateAAD(fileID string) []byte {
+	return encryption.AssociatedData(encryption.SchemeVersion, encryption.RolePrivate, []byte(fileID))
+}
+
+// newLayerCipher builds the cipher for one DSDE layer under version. Before
+// encVersionSuiteKeys suite only matters when sealing, as blobs name their own
+// suite when opened; from it on, only blobs sealed under suite open.
+func newLayerCipher(version int, key []byte, suite encryption.Suite) (*encryption.Service, error) {
+	switch {
+	case version < encVersionSuites:
+		return encryption.NewWithKey(key)
+	case version < encVersionSuiteKeys:
+		return encryption.NewWithSuite(key, suite)
+	default:
+		return encryption.NewForSuite(key, suite)
+	}
+}
+
+// sealUserLayer encrypts pkg2||pkg4 into the sBlob under the user DEK.
+func sealUserLayer(version int, key []byte, suite encryption.Suite, fileID string, combined []byte) ([]byte, error) {
+	return sealUserKeyed(version, key, suite, userAAD(version, fileID), combined)
+}
+
+// openUserLayer decrypts an sBlob read from r back into pkg2||pkg4. Streamed
+// sBlobs are authenticated segment by segment as they are read, but the
+// plaintext is returned whole.
+func openUserLayer(version int, key []byte, suite encryption.Suite, fileID string, r io.Reader) ([]byte, error) {
+	return openUserKeyed(version, key, suite, userAAD(version, fileID), r)
+}
+
+// sealUserKeyed seals plaintext under a user DEK in the format version uses
+// for user-keyed blobs. The blob is built in memory.
+func sealUserKeyed(version int, key []byte, suite encryption.Suite, aad, plaintext []byte) ([]byte, error) {
+	if version < encVersionStream {
+		enc, err := newLayerCipher(version, key, suite)
+		if err != nil {
+			return nil, err
+		}
+		return enc.EncryptAAD(plaintext, false, aad)
+	}
+
+	var buf bytes.Buffer
+	var w *encryption.StreamWriter
+	var err error
+	if version < encVersionSuiteKeys {
+		w, err = encryption.NewStreamWriter(&buf, key, suite, aad)
+	} else {
+		w, err = encryption.NewSuiteStreamWriter(&buf, key, suite, aad)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(plaintext); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// openUserKeyed reverses sealUserKeyed for a blob read from r.
+func openUserKeyed(version int, key []byte, suite encryption.Suite, aad []byte, r io.Reader) ([]byte, error) {
+	if version < encVersionStream {
+		blob, err := io.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		enc, err := newLayerCipher(version, key, suite)
+		if err != nil {
+			return nil, err
+		}
+		pt, err := enc.DecryptAAD(blob, aad)
+		if err != nil {
+			return nil, integrityError(err)
+		}
+		return pt, nil
+	}
+
+	var sr *encryption.StreamReader
+	var err error
+	if version < encVersionSuiteKeys {
+		sr, err = encryption.NewStreamReader(r, key, aad)
+	} else {
+		sr, err = encryption.NewSuiteStreamReader(r, key, suite, aad)
+	}
+	if errors.Is(err, encryption.ErrStreamCorrupt) {
+		return nil, integrityError(err)
+	} else if err != nil {
+		return nil, err
+	}
+	pt, err := io.ReadAll(sr)
+	if errors.Is(err, encryption.ErrStreamCorrupt) {
+		return nil, integrityError(err)
+	}
+	return pt, err
+}
+
+// openUserKeyedAt gives random access to a streamed user-keyed blob of size
+// bytes held in r.
+func openUserKeyedAt(version int, key []byte, suite encryption.Suite, aad []byte, r io.ReaderAt, size int64) (*encryption.StreamReaderAt, error) {
+	var ra *encryption.StreamReaderAt
+	var err error
+	if version < encVersionSuiteKeys {
+		ra, err = encryption.NewStreamReaderAt(r, size, key, aad)
+	} else {
+		ra, err = encryption.NewSuiteStreamReaderAt(r, size, key, suite, aad)
+	}
+	if errors.Is(err, encryption.ErrStreamCorrupt) {
+		return nil, integrityError(err)
+	}
+	return ra, err
+}
+
+// Params are the scheme parameters a file is sealed under. Client-side
+// uploads receive them from the server so both ends split and encrypt alike.
+type Params struct {
+	EncVersion  int              `json:"encVersion"`
+	PGB         int              `json:"pgB"`
+	SharedSuite encryption.Suite `json:"sharedSuite"`
+	UserSuite   encryption.Suite `json:"userSuite"`
+}
+
+// Seal runs the double-layer encryption for one file: PG(data) → (pkg1, pkg2),
+// pkg1 → pkg3C under the shared DEK, PG(pkg3C) → (d, pkg4), and pkg2||pkg4 →
+// sBlob under the user DEK. pkg2Len is needed to split the sBlob again.
+func Seal(
+	p Params,
+	sharedKey, userKey []byte,
+	feaHash []byte,
+	fileID string,
+	data []byte,
+) (d, sBlob []byte, pkg2Len int, err error) {
+	pkg1, pkg2 := split.PG(feaHash, data, p.PGB)
+
+	enc1, err := newLayerCipher(p.EncVersion, sharedKey, p.SharedSuite)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	pkg3C, err := enc1.EncryptAAD(pkg1, true, sharedAAD(p.EncVersion, feaHash))
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("encrypt pkg1: %w", err)
+	}
+	d, pkg4 := split.PG(feaHash, pkg3C, p.PGB)
+
+	combined := make([]byte, 0, len(pkg2)+len(pkg4))
+	combined = append(combined, pkg2...)
+	combined = append(combined, pkg4...)
+	sBlob, err = sealUserLayer(p.EncVersion, userKey, p.UserSuite, fileID, combined)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("encrypt combined: %w", err)
+	}
+	return d, sBlob, len(pkg2), nil
+}
+
+// Open reverses Seal, reading the sBlob from sBlob.
+func Open(
+	p Params,
+	sharedKey, userKey []byte,
+	feaHash []byte,
+	fileID string,
+	pkg2Len int,
+	d []byte,
+	sBlob io.Reader,
+) ([]byte, error) {
+	if err := checkEncVersion(p.EncVersion); err != nil {
+		return nil, err
+	}
+	combined, err := openUserLayer(p.EncVersion, userKey, p.UserSuite, fileID, sBlob)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt sBlob: %w", err)
+	}
+	if pkg2Len < 0 || pkg2Len > len(combined) {
+		return nil, fmt.Errorf("%w: invalid pkg2Len %d for sBlob of length %d", ErrIntegrityFailure, pkg2Len, len(combined))
+	}
+	pkg2, pkg4 := combined[:pkg2Len], combined[pkg2Len:]
+
+	pkg3C, err := split.Merge(feaHash, d, pkg4, p.PGB)
+	if err != nil {
+		return nil, fmt.Errorf("reconstruct pkg3C: %w", err)
+	}
+	enc1, err := newLayerCipher(p.EncVersion, sharedKey, p.SharedSuite)
+	if err != nil {
+		return nil, err
+	}
+	pkg1, err := enc1.DecryptAAD(pkg3C, sharedAAD(p.EncVersion, feaHash))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt pkg3C: %w", integrityError(err))
+	}
+	data, err := split.Merge(feaHash, pkg1, pkg2, p.PGB)
+	if err != nil {
+		return nil, fmt.Errorf("reconstruct file: %w", err)
+	}
+	return data, nil
+}
+
+// newFileID returns a random (version 4) UUID for a file whose row is
+// inserted only after its blobs are sealed and stored.
+func newFileID() (string, error) {
+	var u [16]byte
+	if _, err := rand.Read(u[:]); err != nil {
+		return "", err
+	}
+	u[6] = u[6]&0x0f | 0x40
+	u[8] = u[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16]), nil
+}
+
+// SealPrivate encrypts a whole file under the user DEK alone, for content not
+// yet popular enough to share. Private blobs always use the stream format.
+func SealPrivate(p Params, userKey []byte, fileID string, data []byte) ([]byte, error) {
+	if p.EncVersion < encVersionStream {
+		return nil, fmt.Errorf("private files need enc_version %d or later", encVersionStream)
+	}
+	return sealUserKeyed(p.EncVersion, userKey, p.UserSuite, privateAAD(fileID), data)
+}
+
+// OpenPrivate reverses SealPrivate, reading the blob from r.
+func OpenPrivate(p Params, userKey []byte, fileID string, r io.Reader) ([]byte, error) {
+	if err := checkPrivateVersion(p.EncVersion); err != nil {
+		return nil, err
+	}
+	return openUserKeyed(p.EncVersion, userKey, p.UserSuite, privateAAD(fileID), r)
+}
@@ -5,15 +5,21 @@ import (
 	"context"
 	"crypto/sha256"
 	"database/sql"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
-	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption" // Correct package
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dedup"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/extractor"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keycache"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
 	"github.com/Anish-Chanda/double-layer-dedup/internal/split"
-	"github.com/Anish-Chanda/double-layer-dedup/internal/storage"
 
 	"github.com/aws/aws-sdk-go-v2/service/kms"
 	"go.uber.org/zap"
@@ -23,25 +29,92 @@ import (
 type Service struct {
 	fg           *split.FG
 	pgB          int
-	kmsClient    *kms.Client
+	kmsClient    KMS
 	kmsKeyID     string
-	db           *db.Client
-	store        *storage.Client
+	db           DB
+	store        Store
 	statsEnabled bool
+
+	sharedSuite encryption.Suite // seals pkg1 → pkg3C; must be deterministic-safe
+	userSuite   encryption.Suite // seals pkg2||pkg4 → sBlob
+
+	keys      *keyserver.Server    // nil: fea_hash is the raw FG feature
+	extractor *extractor.Extractor // nil: chunk mode disabled
+	codec     codec.Codec          // default compression for uploads
+	maxSize   int64                // decompression limit for files without a size; 0 is none
+
+	thresholdMax int           // 0: randomized dedup thresholds disabled
+	minLatency   time.Duration // pad dedup-revealing responses to at least this
+	popularity   int           // distinct owners before content is shared; <= 1 shares at once
+
+	keepVersions int           // versions kept per path; 0 keeps all
+	retainFor    time.Duration // age past which older versions are pruned; 0 keeps them
+
+	defaultQuota db.Quota // limits for owners without their own; 0 fields are unlimited
+
+	sharedKeys *keycache.Cache // decrypted shared DEKs by fea_hash; nil: unwrap every time
+	userKeys   *keycache.Pool  // user DEKs generated ahead; nil: generate on demand
+
+	mu         sync.Mutex
+	challenges map[string]*challenge    // outstanding proof-of-ownership challenges
+	uploads    map[string]*clientUpload // pending client-side uploads by fileID
+	promoting  map[string]bool          // features with a promotion in flight, by hex fea_hash
+	bg         sync.WaitGroup           // background work started by Go
+	bgCtx      context.Context          // cancelled by Close to stop background work
+	bgCancel   context.CancelFunc
+}
+
+// Option customises a Service built by NewService.
+type Option func(*Service)
+
+// WithSuites selects the AEAD suites for the shared and user layers. Changing
+// the shared suite only affects new features' dedup: d blobs sealed under the
+// old suite keep opening but no longer match new uploads.
+func WithSuites(shared, user encryption.Suite) Option {
+	return func(s *Service) {
+		s.sharedSuite = shared
+		s.userSuite = user
+	}
+}
+
+// WithKeyServer derives fea_hash through the key server instead of using the
+// raw feature, so dedup tags depend on the server secret. Content uploaded
+// before and after enabling it does not deduplicate together.
+func WithKeyServer(ks *keyserver.Server) Option {
+	return func(s *Service) {
+		s.keys = ks
+	}
+}
+
+// WithMaxFileSize bounds how far a stored file is allowed to decompress when
+// it has no recorded size, normally the upload limit. Files with a size may
+// not decompress past it.
+func WithMaxFileSize(n int64) Option {
+	return func(s *Service) {
+		s.maxSize = n
+	}
+}
+
+// WithCodec compresses uploads with c by default, before they are split and
+// sealed. Incompressible content is still stored as is.
+func WithCodec(c codec.Codec) Option {
+	return func(s *Service) {
+		s.codec = c
+	}
 }
 
 // NewService constructs it.
 func NewService(
 	fg *split.FG,
 	pgB int,
-	kmsClient *kms.Client,
+	kmsClient KMS,
 	kmsKeyID string,
-	dbClient *db.Client,
-	storeClient *storage.Client,
+	dbClient DB,
+	storeClient Store,
 	statsEnabled bool,
-
+	opts ...Option,
 ) *Service {
-	return &Service{
+	s := &Service{
 		fg:           fg,
 		pgB:          pgB,
 		kmsClient:    kmsClient,
@@ -49,17 +122,42 @@ func NewService(
 		db:           dbClient,
 		store:        storeClient,
 		statsEnabled: statsEnabled,
-	}
+		sharedSuite:  encryption.SuiteAESGCMSIV,
+		userSuite:    encryption.SuiteXChaCha20Poly1305,
+		codec:        codec.None,
+		challenges:   make(map[string]*challenge),
+		uploads:      make(map[string]*clientUpload),
+		promoting:    make(map[string]bool),
+	}
+	s.bgCtx, s.bgCancel = context.WithCancel(context.Background())
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
 }
 
-// Upload implements the paper’s upload with double-layer encryption and dedupe.
+// Upload implements the paper’s upload with double-layer encryption and dedupe,
+// compressing with the service's default codec.
 func (s *Service) Upload(
 	ctx context.Context,
 	ownerID, filename string,
 	r io.Reader,
+) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
+	return s.UploadWithCodec(ctx, ownerID, filename, s.codec, r)
+}
+
+// UploadWithCodec is Upload with the file's compression chosen by the caller.
+// FG and the proof-of-ownership tree still cover the uncompressed content, so
+// a file deduplicates with the same content under the same codec only.
+func (s *Service) UploadWithCodec(
+	ctx context.Context,
+	ownerID, filename string,
+	c codec.Codec,
+	r io.Reader,
 ) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
 	log := zap.L().Named("Upload")
 	log.Debug("start", zap.String("owner", ownerID), zap.String("file", filename))
+	defer s.padLatency(ctx, time.Now())
 
 	// 1) Read the entire file
 	data, readErr := io.ReadAll(r)
@@ -68,6 +166,11 @@ func (s *Service) Upload(
 		err = readErr
 		return
 	}
+	size := int64(len(data))
+	if err = s.checkQuota(ownerID, size, 0); err != nil {
+		log.Info("over quota", zap.Error(err), zap.String("owner", ownerID))
+		return
+	}
 
 	// 2) Compute FG
 	feaHash, err = s.fg.Feature(bytes.NewReader(data))
@@ -75,132 +178,131 @@ func (s *Service) Upload(
 		log.Error("compute feature", zap.Error(err))
 		return
 	}
-
-	// 3) First PG split → pkg1, pkg2_orig
-	pkg1, pkg2_orig := split.PG(feaHash, data, s.pgB)
-	pkg2Len := len(pkg2_orig)
-
-	// 4) Get-or-create shared DEK
-	var sharedCipher []byte
-	if sharedCipher, err = s.db.GetFeatureByFeaHash(feaHash); errors.Is(err, sql.ErrNoRows) {
-		out, gerr := s.kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
-			KeyId:   &s.kmsKeyID,
-			KeySpec: "AES_256",
-		})
-		if gerr != nil {
-			log.Error("GenerateDataKey(shared)", zap.Error(gerr))
-			err = gerr
+	if s.keys != nil {
+		if feaHash, err = s.keys.Tag(ownerID, keyserver.Source(ctx), feaHash); err != nil {
+			log.Warn("key server", zap.Error(err), zap.String("owner", ownerID))
 			return
 		}
-		sharedCipher = out.CiphertextBlob
-		if err = s.db.CreateFeature(feaHash, sharedCipher); err != nil {
-			log.Error("CreateFeature", zap.Error(err))
-			return
-		}
-	} else if err != nil {
-		log.Error("GetFeatureByFeaHash", zap.Error(err))
+	}
+
+	// 3) Get-or-create shared DEK
+	if dekShared, err = s.sharedDEK(ctx, feaHash); err != nil {
+		log.Error("shared DEK", zap.Error(err))
 		return
 	}
-	dekShared = sharedCipher
 
-	// 5) Decrypt shared DEK
-	resp1, derr := s.kmsClient.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: dekShared})
-	if derr != nil {
-		log.Error("Decrypt shared DEK", zap.Error(derr))
-		err = derr
+	// 3a) Content below the popularity threshold stays private
+	private, err := s.staysPrivate(feaHash, ownerID)
+	if err != nil {
+		log.Error("staysPrivate", zap.Error(err))
 		return
 	}
-	enc1, err := encryption.NewWithKey(resp1.Plaintext)
+
+	// 3b) Commit to the content for later proofs of ownership
+	tree := pow.Build(data)
+
+	// 4) Decrypt shared DEK
+	sharedKey, err := s.unwrapShared(ctx, feaHash, dekShared)
 	if err != nil {
-		log.Error("NewWithKey(shared)", zap.Error(err))
+		log.Error("Decrypt shared DEK", zap.Error(err))
 		return
 	}
 
-	// 6) Encrypt pkg1 → pkg3C
-	pkg3C, err := enc1.Encrypt(pkg1, true)
+	// 5) Generate user DEK
+	userKey, dekUser, err := s.userDEK(ctx)
 	if err != nil {
-		log.Error("Encrypt pkg1", zap.Error(err))
+		log.Error("GenerateDataKey(user)", zap.Error(err))
 		return
 	}
 
-	// 7) Second PG split on pkg3C → d, pkg4
-	d, pkg4 := split.PG(feaHash, pkg3C, s.pgB)
+	// 5b) Compress (deterministically) unless the content looks incompressible
+	stored, used, err := codec.Choose(c, data)
+	if err != nil {
+		log.Error("compress", zap.Error(err), zap.String("codec", string(c)))
+		return
+	}
 
-	// 8) Generate user DEK
-	out2, uerr := s.kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
-		KeyId:   &s.kmsKeyID,
-		KeySpec: "AES_256",
-	})
-	if uerr != nil {
-		log.Error("GenerateDataKey(user)", zap.Error(uerr))
-		err = uerr
+	// 6) Pick the fileID up front; the sBlob is bound to it
+	if fileID, err = newFileID(); err != nil {
+		log.Error("newFileID", zap.Error(err))
 		return
 	}
-	dekUser = out2.CiphertextBlob
-	enc2, err := encryption.NewWithKey(out2.Plaintext)
-	if err != nil {
-		log.Error("NewWithKey(user)", zap.Error(err))
+
+	// 6b) Unpopular content: the whole file under the user DEK, no d
+	if private {
+		if err = s.storePrivate(ctx, fileID, ownerID, filename, feaHash, dekShared, dekUser, userKey, stored, used, size); err != nil {
+			log.Error("storePrivate", zap.Error(err))
+			return
+		}
+		if err = s.db.SetFilePoW(fileID, tree.Root(), tree.NumLeaves()); err != nil {
+			log.Error("SetFilePoW", zap.Error(err))
+			s.discard(ctx, fileID)
+			return
+		}
+		if err := s.addOwner(feaHash, ownerID); err != nil {
+			log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+		}
+		log.Info("upload complete (private)", zap.String("fileID", fileID))
 		return
 	}
 
-	// 9) Encrypt pkg2_orig||pkg4 → sBlob
-	combined := append(pkg2_orig, pkg4...)
-	sBlob, err := enc2.Encrypt(combined, false)
+	// 7) PG → pkg1 → pkg3C → (d, pkg4); pkg2||pkg4 → sBlob
+	d, sBlob, pkg2Len, err := Seal(s.params(currentEncVersion), sharedKey, userKey, feaHash, fileID, stored)
 	if err != nil {
-		log.Error("Encrypt combined", zap.Error(err))
+		log.Error("seal", zap.Error(err))
 		return
 	}
 
-	// 10) Persist file record (remember pkg2Len)
-	fileID, err = s.db.CreateFileWithMeta(ownerID, filename, feaHash, dekShared, dekUser, pkg2Len)
+	// 7b) Refuse what the owner's physical quota has no room for
+	newD, err := s.newBlobBytes(fmt.Sprintf("%x", sha256.Sum256(d)), len(d))
 	if err != nil {
-		log.Error("CreateFileWithMeta", zap.Error(err))
+		log.Error("newBlobBytes", zap.Error(err))
+		return
+	}
+	if err = s.checkQuota(ownerID, size, newD+int64(len(sBlob))); err != nil {
+		log.Info("over quota", zap.Error(err), zap.String("owner", ownerID))
 		return
 	}
 
-	// 11) Store & dedupe “d”
-	hashD := sha256.Sum256(d)
-	hexD := fmt.Sprintf("%x", hashD[:])
-	keyD := "common/" + hexD
-
-	existed, err := s.db.ExistsChunk(hexD)
+	// 8) Store & dedupe “d” (below its threshold, as if new), store sBlob
+	hide, err := s.hideDedup(feaHash)
 	if err != nil {
-		log.Error("ExistsChunk", zap.Error(err))
+		log.Error("hideDedup", zap.Error(err))
 		return
 	}
-	if !existed {
-		if err = s.store.PutObject(ctx, keyD, bytes.NewReader(d)); err != nil {
-			log.Error("PutObject(common)", zap.Error(err))
-			return
-		}
-		if err = s.db.InsertChunk(hexD, keyD, true); err != nil {
-			log.Error("InsertChunk(common)", zap.Error(err))
-			return
+	defer func() {
+		if err != nil {
+			s.discard(ctx, fileID, fmt.Sprintf("%x", sha256.Sum256(d)), fmt.Sprintf("%x", sha256.Sum256(sBlob)))
 		}
-	}
-	if err = s.db.AddFileChunk(fileID, hexD, 0); err != nil {
-		log.Error("AddFileChunk(common)", zap.Error(err))
+	}()
+	existed, hexD, hexS, err := s.storeBlobs(ctx, fileID, d, sBlob, hide)
+	if err != nil {
+		log.Error("storeBlobs", zap.Error(err))
 		return
 	}
 
-	// 12) Store sBlob
-	hashS := sha256.Sum256(sBlob)
-	hexS := fmt.Sprintf("%x", hashS[:])
-	keyS := fmt.Sprintf("files/%s/s-%s", fileID, hexS)
-	if err = s.store.PutObject(ctx, keyS, bytes.NewReader(sBlob)); err != nil {
-		log.Error("PutObject(sBlob)", zap.Error(err))
+	// 9) Persist file record (remember pkg2Len) and link its chunks
+	if err = s.db.CreateFileWithID(fileID, ownerID, filename, feaHash, dekShared, dekUser, pkg2Len, currentEncVersion, int(s.sharedSuite), int(s.userSuite), storageDSDE, string(used), size); err != nil {
+		log.Error("CreateFileWithID", zap.Error(err))
 		return
 	}
-	if err = s.db.InsertChunk(hexS, keyS, false); err != nil {
-		log.Error("InsertChunk(sBlob)", zap.Error(err))
+	if err = s.linkD(ctx, fileID, hexD, d); err != nil {
+		log.Error("linkD", zap.Error(err))
 		return
 	}
 	if err = s.db.AddFileChunk(fileID, hexS, 1); err != nil {
 		log.Error("AddFileChunk(sBlob)", zap.Error(err))
 		return
 	}
+	if err = s.db.SetFilePoW(fileID, tree.Root(), tree.NumLeaves()); err != nil {
+		log.Error("SetFilePoW", zap.Error(err))
+		return
+	}
 
 	log.Info("upload complete", zap.String("fileID", fileID))
+	if err := s.addOwner(feaHash, ownerID); err != nil {
+		log.Warn("addOwner", zap.Error(err), zap.String("fileID", fileID))
+	}
 
 	// ── print per-upload stats if enabled ───────────────────────────────────
 	if s.statsEnabled {
@@ -214,12 +316,205 @@ func (s *Service) Upload(
 			"→ dedupe stats for file %s: reused %d bytes; saved %.1f%% of this upload’s payload\n",
 			fileID, saved, pct,
 		)
+		if used != codec.None {
+			fmt.Printf("→ %s compressed %d bytes to %d\n", used, len(data), len(stored))
+		}
 	}
 
 	return
 }
 
-// Download reverses the upload steps to reconstruct F.
+// sharedDEK returns the wrapped shared DEK for feaHash, creating the feature
+// on first sight.
+func (s *Service) sharedDEK(ctx context.Context, feaHash []byte) ([]byte, error) {
+	wrapped, err := s.db.GetFeatureByFeaHash(feaHash)
+	if err == nil {
+		return wrapped, nil
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("GetFeatureByFeaHash: %w", err)
+	}
+	plain, wrapped, err := s.generateDEK(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("GenerateDataKey(shared): %w", err)
+	}
+	defer clear(plain)
+	if err = s.db.CreateFeature(feaHash, wrapped); err != nil {
+		return nil, fmt.Errorf("CreateFeature: %w", err)
+	}
+	// the upload about to unwrap it finds it cached
+	s.sharedKeys.Put(feaHash, wrapped, plain)
+	return wrapped, nil
+}
+
+// generateDEK asks KMS for a fresh data key.
+func (s *Service) generateDEK(ctx context.Context) (plain, wrapped []byte, err error) {
+	out, err := s.kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
+		KeyId:   &s.kmsKeyID,
+		KeySpec: "AES_256",
+	})
+	if err != nil {
+		return nil, nil, keyError(err)
+	}
+	return out.Plaintext, out.CiphertextBlob, nil
+}
+
+// unwrapDEK decrypts a KMS-encrypted DEK.
+func (s *Service) unwrapDEK(ctx context.Context, wrapped []byte) ([]byte, error) {
+	resp, err := s.kmsClient.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: wrapped})
+	if err != nil {
+		return nil, keyError(err)
+	}
+	return resp.Plaintext, nil
+}
+
+// params returns the scheme parameters for sealing under version.
+func (s *Service) params(version int) Params {
+	return Params{
+		EncVersion:  version,
+		PGB:         s.pgB,
+		SharedSuite: s.sharedSuite,
+		UserSuite:   s.userSuite,
+	}
+}
+
+// fileParams returns the scheme parameters meta was sealed under: the suites
+// it records, or the configured ones for files sealed before suites were
+// recorded, whose blobs name their own.
+func (s *Service) fileParams(meta db.FileMeta) Params {
+	p := s.params(meta.EncVersion)
+	if meta.SharedSuite != 0 {
+		p.SharedSuite = encryption.Suite(meta.SharedSuite)
+	}
+	if meta.UserSuite != 0 {
+		p.UserSuite = encryption.Suite(meta.UserSuite)
+	}
+	return p
+}
+
+// storeBlobs uploads d under common/ (skipping it if already present, unless
+// hide asks for the dedup to stay invisible) and the sBlob under
+// files/<fileID>/, recording both in the chunks table. reused reports whether
+// the d upload was actually saved.
+func (s *Service) storeBlobs(
+	ctx context.Context,
+	fileID string,
+	d, sBlob []byte,
+	hide bool,
+) (reused bool, hexD, hexS string, err error) {
+	hashD := sha256.Sum256(d)
+	hexD = fmt.Sprintf("%x", hashD[:])
+
+	existed, err := s.db.ExistsChunk(hexD)
+	if err != nil {
+		return false, "", "", fmt.Errorf("ExistsChunk: %w", err)
+	}
+	if !existed || hide {
+		if existed, err = s.storeCommon(ctx, hexD, d); err != nil {
+			return false, "", "", err
+		}
+	}
+
+	hexS, err = s.storeUserBlob(ctx, fileID, sBlob)
+	if err != nil {
+		return false, "", "", err
+	}
+	return existed && !hide, hexD, hexS, nil
+}
+
+// discard undoes an upload that failed after storing some of its blobs: it
+// deletes the file, if it was recorded, and those of hashes that no file
+// links, with their objects. An upload linking one of them concurrently
+// either commits first and keeps it, or finds it gone and stores it again.
+func (s *Service) discard(ctx context.Context, fileID string, hashes ...string) {
+	log := zap.L().Named("discard")
+	ctx = context.WithoutCancel(ctx)
+
+	orphans, err := s.db.DeleteFile(fileID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		log.Warn("DeleteFile", zap.Error(err), zap.String("fileID", fileID))
+	}
+	unused, err := s.db.DeleteUnusedChunks(hashes)
+	if err != nil {
+		log.Warn("DeleteUnusedChunks", zap.Error(err), zap.String("fileID", fileID))
+	}
+	for _, c := range append(orphans, unused...) {
+		if err := s.store.DeleteObject(ctx, c.S3Key); err != nil {
+			log.Warn("DeleteObject", zap.Error(err), zap.String("s3Key", c.S3Key))
+		}
+	}
+	log.Debug("discarded", zap.String("fileID", fileID), zap.Int("orphans", len(orphans)+len(unused)))
+}
+
+// ErrContentGone is returned when the shared content a new file was to link
+// was deleted, with the last file holding it, in the meantime.
+var ErrContentGone = newError(ErrConflict, "dsde: shared content was deleted while linking it; retry")
+
+// linkD links the common blob hexD into fileID as its first chunk. If the
+// last file sharing it was deleted since it was found stored, d is stored
+// again when the caller has it, and ErrContentGone is returned when not.
+func (s *Service) linkD(ctx context.Context, fileID, hexD string, d []byte) error {
+	err := s.db.AddFileChunk(fileID, hexD, 0)
+	if !errors.Is(err, db.ErrChunkGone) {
+		return err
+	}
+	if d == nil {
+		return ErrContentGone
+	}
+	if _, err = s.storeCommon(ctx, hexD, d); err != nil {
+		return err
+	}
+	return s.db.AddFileChunk(fileID, hexD, 0)
+}
+
+// storeCommon uploads d under a fresh key and records it as the common blob
+// hexD. If another upload recorded hexD first, the copy just uploaded is
+// deleted again and existed is true. The fresh key keeps a delete of an
+// earlier, orphaned copy of d from removing this one.
+func (s *Service) storeCommon(ctx context.Context, hexD string, d []byte) (existed bool, err error) {
+	keyD, err := dedup.CommonKey(hexD)
+	if err != nil {
+		return false, err
+	}
+	if err = s.store.PutObject(ctx, keyD, bytes.NewReader(d)); err != nil {
+		return false, fmt.Errorf("PutObject(common): %w", err)
+	}
+	err = s.db.InsertChunk(hexD, keyD, true, int64(len(d)))
+	if errors.Is(err, db.ErrChunkExists) {
+		if err := s.store.DeleteObject(ctx, keyD); err != nil {
+			zap.L().Named("storeCommon").Warn("DeleteObject", zap.Error(err), zap.String("s3Key", keyD))
+		}
+		return true, nil
+	} else if err != nil {
+		if err := s.store.DeleteObject(context.WithoutCancel(ctx), keyD); err != nil {
+			zap.L().Named("storeCommon").Warn("DeleteObject", zap.Error(err), zap.String("s3Key", keyD))
+		}
+		return false, fmt.Errorf("InsertChunk(common): %w", err)
+	}
+	return false, nil
+}
+
+// storeUserBlob uploads a file's sBlob under files/<fileID>/ and records it.
+func (s *Service) storeUserBlob(ctx context.Context, fileID string, sBlob []byte) (string, error) {
+	hashS := sha256.Sum256(sBlob)
+	hexS := fmt.Sprintf("%x", hashS[:])
+	keyS := fmt.Sprintf("files/%s/s-%s", fileID, hexS)
+	if err := s.store.PutObject(ctx, keyS, bytes.NewReader(sBlob)); err != nil {
+		return "", fmt.Errorf("PutObject(sBlob): %w", err)
+	}
+	if err := s.db.InsertChunk(hexS, keyS, false, int64(len(sBlob))); err != nil {
+		if err := s.store.DeleteObject(context.WithoutCancel(ctx), keyS); err != nil {
+			zap.L().Named("storeUserBlob").Warn("DeleteObject", zap.Error(err), zap.String("s3Key", keyS))
+		}
+		return "", fmt.Errorf("InsertChunk(sBlob): %w", err)
+	}
+	return hexS, nil
+}
+
+// Download reverses the upload steps to reconstruct F. The reader it returns
+// also implements io.Seeker and io.ReaderAt. A DSDE or chunk-mode file is
+// reconstructed in memory: its shared layer is one AEAD message over nearly
+// the whole file. An uncompressed private file is read straight from the
+// store instead, fetching and decrypting only the segments read.
 func (s *Service) Download(
 	ctx context.Context,
 	ownerID, fileID string,
@@ -227,190 +522,218 @@ func (s *Service) Download(
 	log := zap.L().Named("Download")
 	log.Debug("start", zap.String("owner", ownerID), zap.String("fileID", fileID))
 
-	// 1) Metadata + chunk infos
+	// 1) Metadata + chunk infos, for the owner or a grantee
+	ownerID, err := s.readableOwner(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
 	meta, chunks, err := s.db.GetFileMeta(ownerID, fileID)
 	if err != nil {
 		log.Error("GetFileMeta", zap.Error(err), zap.String("fileID", fileID))
 		return nil, err
 	}
-	if len(chunks) != 2 {
-		err = fmt.Errorf("expected 2 chunks, got %d for fileID %s", len(chunks), fileID)
+	want := 2
+	switch meta.StorageMode {
+	case storagePrivate:
+		want = 1
+	case storageChunks:
+		want = len(chunks)
+	}
+	if len(chunks) != want {
+		err = fmt.Errorf("expected %d chunks, got %d for fileID %s", want, len(chunks), fileID)
 		log.Error("Chunk count error", zap.Error(err))
 		return nil, err
 	}
-	pkg2Len_stored := meta.Pkg2Len
-	log.Debug("meta+chunks loaded", zap.Int("pkg2Len_stored", pkg2Len_stored), zap.Any("chunks", chunks))
+	if ra, ok, err := s.openPrivateAt(ctx, meta, chunks, fileID); err != nil {
+		log.Error("open private", zap.Error(err), zap.String("fileID", fileID))
+		return nil, err
+	} else if ok {
+		log.Info("download streaming", zap.String("fileID", fileID), zap.Int64("bytes_out", ra.Size()))
+		return fileReader{io.NewSectionReader(ra, 0, ra.Size())}, nil
+	}
+	outputFileBytes, err := s.reconstruct(ctx, meta, chunks, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if outputFileBytes, err = s.decompress(meta, outputFileBytes); err != nil {
+		log.Error("decompress", zap.Error(err), zap.String("fileID", fileID), zap.String("codec", meta.Codec))
+		return nil, err
+	}
 
-	// 2) Decrypt shared DEK
-	resp1, err := s.kmsClient.Decrypt(ctx, &kms.DecryptInput{
-		CiphertextBlob: meta.DekShared,
-	})
+	log.Info("download complete", zap.String("fileID", fileID), zap.Int("bytes_out", len(outputFileBytes)))
+	return fileReader{io.NewSectionReader(bytes.NewReader(outputFileBytes), 0, int64(len(outputFileBytes)))}, nil
+}
+
+// decompress undoes the compression of a file's stored bytes, refusing
+// output past its recorded size. Data that authenticated but does not
+// decompress to the file is corrupt.
+func (s *Service) decompress(meta db.FileMeta, data []byte) ([]byte, error) {
+	limit := meta.Size
+	if limit <= 0 {
+		limit = s.maxSize
+	}
+	out, err := codec.Decompress(codec.Codec(meta.Codec), data, limit)
+	if err != nil {
+		return nil, integrityError(err)
+	}
+	return out, nil
+}
+
+// fileReader is a downloaded file. It implements io.Seeker and io.ReaderAt,
+// so callers can serve byte ranges without reading what comes before them.
+type fileReader struct {
+	*io.SectionReader
+}
+
+func (fileReader) Close() error { return nil }
+
+// reconstruct fetches and decrypts a file's d and sBlob and merges them back
+// into the original plaintext.
+func (s *Service) reconstruct(
+	ctx context.Context,
+	meta db.FileMeta,
+	chunks []db.ChunkInfo,
+	fileID string,
+) ([]byte, error) {
+	log := zap.L().Named("Download")
+	log.Debug("meta+chunks loaded", zap.Int("pkg2Len", meta.Pkg2Len), zap.Int("enc_version", meta.EncVersion), zap.Any("chunks", chunks))
+
+	if meta.StorageMode == storagePrivate {
+		data, err := s.openPrivate(ctx, meta, chunks, fileID)
+		if err != nil {
+			log.Error("open private", zap.Error(err), zap.String("fileID", fileID))
+		}
+		return data, err
+	}
+	if meta.StorageMode == storageChunks {
+		data, err := s.openChunks(ctx, meta, chunks)
+		if err != nil {
+			log.Error("open chunks", zap.Error(err), zap.String("fileID", fileID))
+		}
+		return data, err
+	}
+
+	// 2) Decrypt both DEKs
+	sharedKey, err := s.unwrapShared(ctx, meta.FeaHash, meta.DekShared)
 	if err != nil {
 		log.Error("Decrypt shared DEK", zap.Error(err), zap.String("fileID", fileID))
 		return nil, err
 	}
-	enc1, err := encryption.NewWithKey(resp1.Plaintext) // CORRECTED: NewWithKey returns *encryption.Service, error
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
 	if err != nil {
-		log.Error("NewWithKey(shared)", zap.Error(err), zap.String("fileID", fileID))
+		log.Error("Decrypt user DEK", zap.Error(err), zap.String("fileID", fileID))
 		return nil, err
 	}
 
-	// 3) Fetch dData
+	// 3) Fetch d
 	dRc, err := s.store.GetObject(ctx, chunks[0].S3Key)
 	if err != nil {
-		log.Error("GetObject dData", zap.Error(err), zap.String("s3Key", chunks[0].S3Key), zap.String("fileID", fileID))
+		log.Error("GetObject d", zap.Error(err), zap.String("s3Key", chunks[0].S3Key), zap.String("fileID", fileID))
 		return nil, err
 	}
-	dData, readErr := io.ReadAll(dRc)
+	d, err := io.ReadAll(dRc)
 	dRc.Close()
-	if readErr != nil {
-		log.Error("ReadAll dData", zap.Error(readErr), zap.String("fileID", fileID))
-		return nil, readErr
+	if err != nil {
+		log.Error("ReadAll d", zap.Error(err), zap.String("fileID", fileID))
+		return nil, err
 	}
-	log.Debug("read dData", zap.Int("len", len(dData)))
 
-	// 4) Decrypt user DEK
-	resp2, err := s.kmsClient.Decrypt(ctx, &kms.DecryptInput{
-		CiphertextBlob: meta.DekUser,
-	})
+	// 4) Decrypt the sBlob through Open as it is read
+	sRc, err := s.store.GetObject(ctx, chunks[1].S3Key)
 	if err != nil {
-		log.Error("Decrypt user DEK", zap.Error(err), zap.String("fileID", fileID))
+		log.Error("GetObject sBlob", zap.Error(err), zap.String("s3Key", chunks[1].S3Key), zap.String("fileID", fileID))
 		return nil, err
 	}
-	enc2, err := encryption.NewWithKey(resp2.Plaintext) // CORRECTED: NewWithKey returns *encryption.Service, error
+	defer sRc.Close()
+	data, err := Open(s.fileParams(meta), sharedKey, userKey, meta.FeaHash, fileID, meta.Pkg2Len, d, sRc)
 	if err != nil {
-		log.Error("NewWithKey(user)", zap.Error(err), zap.String("fileID", fileID))
+		log.Error("open", zap.Error(err), zap.String("fileID", fileID))
 		return nil, err
 	}
+	return data, nil
+}
 
-	// 5) Fetch & decrypt sBlob → combinedForSBlob_decrypted
-	sRc, err := s.store.GetObject(ctx, chunks[1].S3Key)
+// Reseal re-encrypts a file sealed under an older scheme version with the
+// current one, reusing its wrapped shared and user DEKs. The new d is
+// deduplicated as usual; the file's old sBlob is deleted.
+func (s *Service) Reseal(ctx context.Context, ownerID, fileID string) error {
+	log := zap.L().Named("Reseal")
+
+	meta, chunks, err := s.db.GetFileMeta(ownerID, fileID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrFileNotFound
+	} else if err != nil {
+		log.Error("GetFileMeta", zap.Error(err), zap.String("fileID", fileID))
+		return err
+	}
+	if meta.EncVersion >= currentEncVersion || meta.StorageMode != storageDSDE {
+		return nil
+	}
+	if len(chunks) != 2 {
+		return fmt.Errorf("expected 2 chunks, got %d for fileID %s", len(chunks), fileID)
+	}
+
+	data, err := s.reconstruct(ctx, meta, chunks, fileID)
 	if err != nil {
-		log.Error("GetObject sBlob", zap.Error(err), zap.String("s3Key", chunks[1].S3Key), zap.String("fileID", fileID))
-		return nil, err
+		return err
 	}
-	sBlob, readErr := io.ReadAll(sRc)
-	sRc.Close()
-	if readErr != nil {
-		log.Error("ReadAll sBlob", zap.Error(readErr), zap.String("fileID", fileID))
-		return nil, readErr
+	sharedKey, err := s.unwrapShared(ctx, meta.FeaHash, meta.DekShared)
+	if err != nil {
+		log.Error("Decrypt shared DEK", zap.Error(err), zap.String("fileID", fileID))
+		return err
 	}
-	combinedForSBlob_decrypted, err := enc2.Decrypt(sBlob)
+	userKey, err := s.unwrapDEK(ctx, meta.DekUser)
 	if err != nil {
-		log.Error("Decrypt sBlob", zap.Error(err), zap.String("fileID", fileID))
-		return nil, err
+		log.Error("Decrypt user DEK", zap.Error(err), zap.String("fileID", fileID))
+		return err
 	}
-	log.Debug("combinedForSBlob_decrypted", zap.Int("len", len(combinedForSBlob_decrypted)))
 
-	// 6) Split combinedForSBlob_decrypted using pkg2Len_stored
-	if pkg2Len_stored < 0 || pkg2Len_stored > len(combinedForSBlob_decrypted) {
-		err = fmt.Errorf("invalid pkg2Len_stored %d for combinedForSBlob_decrypted length %d. FileID: %s", pkg2Len_stored, len(combinedForSBlob_decrypted), fileID)
-		log.Error("pkg2Len_stored split error", zap.Error(err))
-		return nil, err
+	d, sBlob, pkg2Len, err := Seal(s.params(currentEncVersion), sharedKey, userKey, meta.FeaHash, fileID, data)
+	if err != nil {
+		log.Error("seal", zap.Error(err), zap.String("fileID", fileID))
+		return err
 	}
-	original_pkg2_retrieved := combinedForSBlob_decrypted[:pkg2Len_stored]
-	pkg4_from_split_retrieved := combinedForSBlob_decrypted[pkg2Len_stored:]
-	log.Debug("split combinedForSBlob_decrypted", zap.Int("len_original_pkg2_retrieved", len(original_pkg2_retrieved)), zap.Int("len_pkg4_from_split_retrieved", len(pkg4_from_split_retrieved)))
-
-	// 7) Reconstruct pkg3C from dData & pkg4_from_split_retrieved
-	lf_pkg3C := len(dData) + len(pkg4_from_split_retrieved)
-	D_pkg3C_mask := make([]bool, lf_pkg3C)
-	for i := 1; i <= s.pgB; i++ {
-		h := sha256.New()
-		h.Write(meta.FeaHash)
-		var idx [8]byte
-		binary.BigEndian.PutUint64(idx[:], uint64(i))
-		h.Write(idx[:])
-		pos := binary.BigEndian.Uint64(h.Sum(nil)[:8]) % uint64(lf_pkg3C)
-		D_pkg3C_mask[pos] = true
-	}
-
-	pkg3C := make([]byte, lf_pkg3C)
-	di_pkg3C, p4i_pkg3C := 0, 0
-	for j := 0; j < lf_pkg3C; j++ {
-		if D_pkg3C_mask[j] {
-			if p4i_pkg3C >= len(pkg4_from_split_retrieved) {
-				err = fmt.Errorf("reconstruction error (pkg3C): p4i_pkg3C out of bounds. p4i: %d, len: %d. FileID: %s", p4i_pkg3C, len(pkg4_from_split_retrieved), fileID)
-				log.Error("Boundary error p4i_pkg3C", zap.Error(err))
-				return nil, err
-			}
-			pkg3C[j] = pkg4_from_split_retrieved[p4i_pkg3C]
-			p4i_pkg3C++
-		} else {
-			if di_pkg3C >= len(dData) {
-				err = fmt.Errorf("reconstruction error (pkg3C): di_pkg3C out of bounds. di: %d, len: %d. FileID: %s", di_pkg3C, len(dData), fileID)
-				log.Error("Boundary error di_pkg3C", zap.Error(err))
-				return nil, err
-			}
-			pkg3C[j] = dData[di_pkg3C]
-			di_pkg3C++
-		}
+	_, hexD, hexS, err := s.storeBlobs(ctx, fileID, d, sBlob, false)
+	if err != nil {
+		log.Error("storeBlobs", zap.Error(err), zap.String("fileID", fileID))
+		return err
 	}
-	if p4i_pkg3C != len(pkg4_from_split_retrieved) {
-		err = fmt.Errorf("reconstruction error (pkg3C): not all bytes from pkg4_from_split_retrieved used. p4i: %d, len: %d. FileID: %s", p4i_pkg3C, len(pkg4_from_split_retrieved), fileID)
-		log.Error("Consumption mismatch pkg4_from_split_retrieved", zap.Error(err))
-		return nil, err
+	if err = s.db.ReplaceFileChunks(fileID, []string{hexD, hexS}, currentEncVersion, int(s.sharedSuite), int(s.userSuite), pkg2Len, storageDSDE); err != nil {
+		log.Error("ReplaceFileChunks", zap.Error(err), zap.String("fileID", fileID))
+		return err
 	}
-	if di_pkg3C != len(dData) {
-		err = fmt.Errorf("reconstruction error (pkg3C): not all bytes from dData used. di: %d, len: %d. FileID: %s", di_pkg3C, len(dData), fileID)
-		log.Error("Consumption mismatch dData", zap.Error(err))
-		return nil, err
+
+	// The old sBlob belonged to this file alone. The old d may still back
+	// other legacy files, so it is left in place.
+	old := chunks[1]
+	if err = s.db.DeleteChunk(old.ChunkHash); err != nil {
+		log.Warn("DeleteChunk(old sBlob)", zap.Error(err), zap.String("hash", old.ChunkHash))
+	} else if err = s.store.DeleteObject(ctx, old.S3Key); err != nil {
+		log.Warn("DeleteObject(old sBlob)", zap.Error(err), zap.String("s3Key", old.S3Key))
 	}
-	log.Debug("reconstructed pkg3C", zap.Int("len", len(pkg3C)))
 
-	// 8) Decrypt pkg3C → original_pkg1_retrieved
-	original_pkg1_retrieved, err := enc1.Decrypt(pkg3C)
+	log.Info("resealed", zap.String("fileID", fileID), zap.Int("from", meta.EncVersion), zap.Int("to", currentEncVersion))
+	return nil
+}
+
+// ResealAll reseals every file still on an older scheme version and returns
+// how many were migrated.
+func (s *Service) ResealAll(ctx context.Context) (int, error) {
+	refs, err := s.db.ListFilesBelowEncVersion(currentEncVersion)
 	if err != nil {
-		log.Error("Decrypt pkg3C", zap.Error(err), zap.String("fileID", fileID))
-		return nil, err
+		return 0, err
 	}
-	log.Debug("decrypted original_pkg1_retrieved", zap.Int("len", len(original_pkg1_retrieved)))
-
-	// 9) Merge original_pkg1_retrieved + original_pkg2_retrieved
-	lf_original := len(original_pkg1_retrieved) + len(original_pkg2_retrieved)
-	D_original_mask := make([]bool, lf_original)
-	for i := 1; i <= s.pgB; i++ {
-		h := sha256.New()
-		h.Write(meta.FeaHash)
-		var idx [8]byte
-		binary.BigEndian.PutUint64(idx[:], uint64(i))
-		h.Write(idx[:])
-		pos := binary.BigEndian.Uint64(h.Sum(nil)[:8]) % uint64(lf_original)
-		D_original_mask[pos] = true
-	}
-
-	outputFileBytes := make([]byte, lf_original)
-	i1_orig, i2_orig := 0, 0
-	for j := 0; j < lf_original; j++ {
-		if D_original_mask[j] {
-			if i2_orig >= len(original_pkg2_retrieved) {
-				err = fmt.Errorf("reconstruction error (original file): i2_orig out of bounds. i2: %d, len: %d. FileID: %s", i2_orig, len(original_pkg2_retrieved), fileID)
-				log.Error("Boundary error i2_orig", zap.Error(err))
-				return nil, err
-			}
-			outputFileBytes[j] = original_pkg2_retrieved[i2_orig]
-			i2_orig++
-		} else {
-			if i1_orig >= len(original_pkg1_retrieved) {
-				err = fmt.Errorf("reconstruction error (original file): i1_orig out of bounds. i1: %d, len: %d. FileID: %s", i1_orig, len(original_pkg1_retrieved), fileID)
-				log.Error("Boundary error i1_orig", zap.Error(err))
-				return nil, err
-			}
-			outputFileBytes[j] = original_pkg1_retrieved[i1_orig]
-			i1_orig++
+	n := 0
+	for _, ref := range refs {
+		if err := s.Reseal(ctx, ref.OwnerID, ref.FileID); err != nil {
+			return n, fmt.Errorf("reseal %s: %w", ref.FileID, err)
 		}
+		n++
 	}
-	if i2_orig != len(original_pkg2_retrieved) {
-		err = fmt.Errorf("reconstruction error (original file): not all bytes from original_pkg2_retrieved used. i2: %d, len: %d. FileID: %s", i2_orig, len(original_pkg2_retrieved), fileID)
-		log.Error("Consumption mismatch original_pkg2_retrieved", zap.Error(err))
-		return nil, err
-	}
-	if i1_orig != len(original_pkg1_retrieved) {
-		err = fmt.Errorf("reconstruction error (original file): not all bytes from original_pkg1_retrieved used. i1: %d, len: %d. FileID: %s", i1_orig, len(original_pkg1_retrieved), fileID)
-		log.Error("Consumption mismatch original_pkg1_retrieved", zap.Error(err))
-		return nil, err
-	}
+	return n, nil
+}
 
-	log.Info("download complete", zap.String("fileID", fileID), zap.Int("bytes_out", len(outputFileBytes)))
-	return io.NopCloser(bytes.NewReader(outputFileBytes)), nil
+// Stats reports service-wide deduplication counters.
+func (s *Service) Stats(ctx context.Context) (db.Stats, error) {
+	return s.db.Stats()
 }
@@ -0,0 +1,1108 @@
+package dsde_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/kms"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/split"
+)
+
+// --- fakes ---
+
+var errUnsupported = errors.New("not supported by the fake")
+
+type fakeFile struct {
+	ref    db.FileRef
+	meta   db.FileMeta
+	chunks []string // chunk hashes by seq
+}
+
+type fakeChunk struct {
+	info  db.ChunkInfo
+	owner string // charged with its size; set by the first file linking it
+}
+
+type fakeGrant struct {
+	fileID, ownerID, granteeID, permission string
+}
+
+// fakeDB keeps the tables the service uses in memory, with the semantics of
+// the Postgres client that matter to it.
+type fakeDB struct {
+	mu       sync.Mutex
+	nextID   int
+	files    map[string]*fakeFile
+	order    []string // fileIDs, oldest first
+	chunks   map[string]*fakeChunk
+	features map[string][]byte          // wrapped shared DEK by hex fea_hash
+	owners   map[string]map[string]bool // feature owners by hex fea_hash
+	uploads  map[string]int
+	quotas   map[string]db.Quota
+	grants   []fakeGrant
+	failPoW  error // returned by SetFilePoW when set
+}
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		files:    make(map[string]*fakeFile),
+		chunks:   make(map[string]*fakeChunk),
+		features: make(map[string][]byte),
+		owners:   make(map[string]map[string]bool),
+		uploads:  make(map[string]int),
+		quotas:   make(map[string]db.Quota),
+	}
+}
+
+func (f *fakeDB) file(fileID string) (*fakeFile, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	return ff, ok
+}
+
+func (f *fakeDB) ownerFiles(ownerID string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for _, id := range f.order {
+		if f.files[id].ref.OwnerID == ownerID {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func (f *fakeDB) insertFile(fileID, ownerID, filename string, meta db.FileMeta) {
+	meta.Filename = filename
+	f.files[fileID] = &fakeFile{ref: db.FileRef{FileID: fileID, OwnerID: ownerID}, meta: meta}
+	f.order = append(f.order, fileID)
+}
+
+func (f *fakeDB) CreateFileWithID(fileID, ownerID, filename string, feaHash, dekShared, dekUser []byte, pkg2Len, encVersion, sharedSuite, userSuite int, storageMode, codec string, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.files[fileID]; ok {
+		return fmt.Errorf("duplicate file %s", fileID)
+	}
+	f.insertFile(fileID, ownerID, filename, db.FileMeta{
+		FeaHash: feaHash, DekShared: dekShared, DekUser: dekUser, Pkg2Len: pkg2Len,
+		EncVersion: encVersion, SharedSuite: sharedSuite, UserSuite: userSuite,
+		StorageMode: storageMode, Codec: codec, Size: size,
+	})
+	return nil
+}
+
+func (f *fakeDB) CreateFileWithMeta(ownerID, filename string, feaHash, dekShared, dekUser []byte, pkg2Len, encVersion, sharedSuite, userSuite int, codec string, size int64) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	fileID := fmt.Sprintf("file-%d", f.nextID)
+	f.insertFile(fileID, ownerID, filename, db.FileMeta{
+		FeaHash: feaHash, DekShared: dekShared, DekUser: dekUser, Pkg2Len: pkg2Len,
+		EncVersion: encVersion, SharedSuite: sharedSuite, UserSuite: userSuite,
+		StorageMode: "dsde", Codec: codec, Size: size,
+	})
+	return fileID, nil
+}
+
+func (f *fakeDB) GetFileMeta(ownerID, fileID string) (db.FileMeta, []db.ChunkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	if !ok || ff.ref.OwnerID != ownerID {
+		return db.FileMeta{}, nil, sql.ErrNoRows
+	}
+	var chunks []db.ChunkInfo
+	for _, h := range ff.chunks {
+		if h != "" {
+			chunks = append(chunks, f.chunks[h].info)
+		}
+	}
+	return ff.meta, chunks, nil
+}
+
+func (f *fakeDB) DeleteFile(fileID string) ([]db.ChunkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	delete(f.files, fileID)
+	for i, id := range f.order {
+		if id == fileID {
+			f.order = append(f.order[:i], f.order[i+1:]...)
+			break
+		}
+	}
+	feature := hex.EncodeToString(ff.meta.FeaHash)
+	stillOwner := false
+	for _, other := range f.files {
+		if other.ref.OwnerID == ff.ref.OwnerID && bytes.Equal(other.meta.FeaHash, ff.meta.FeaHash) {
+			stillOwner = true
+		}
+	}
+	if !stillOwner {
+		delete(f.owners[feature], ff.ref.OwnerID)
+	}
+	var orphans []db.ChunkInfo
+	for _, h := range ff.chunks {
+		if h != "" && !f.linked(h) {
+			orphans = append(orphans, f.chunks[h].info)
+			delete(f.chunks, h)
+		}
+	}
+	return orphans, nil
+}
+
+func (f *fakeDB) linked(hash string) bool {
+	for _, ff := range f.files {
+		for _, h := range ff.chunks {
+			if h == hash {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (f *fakeDB) SetFilePoW(fileID string, root []byte, leaves int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failPoW != nil {
+		return f.failPoW
+	}
+	ff, ok := f.files[fileID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	ff.meta.PowRoot, ff.meta.PowLeaves = root, leaves
+	return nil
+}
+
+func (f *fakeDB) FindFileForDedup(feaHash []byte, leaves int) (db.FilePoW, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.order) - 1; i >= 0; i-- {
+		ff := f.files[f.order[i]]
+		if bytes.Equal(ff.meta.FeaHash, feaHash) && ff.meta.StorageMode == "dsde" &&
+			ff.meta.PowRoot != nil && ff.meta.PowLeaves == leaves {
+			return db.FilePoW{FileRef: ff.ref, Root: ff.meta.PowRoot, Leaves: leaves}, nil
+		}
+	}
+	return db.FilePoW{}, sql.ErrNoRows
+}
+
+func (f *fakeDB) ReplaceFileChunks(fileID string, hashes []string, encVersion, sharedSuite, userSuite, pkg2Len int, storageMode string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	ff.chunks = nil
+	for seq, h := range hashes {
+		if err := f.link(ff, h, seq); err != nil {
+			return err
+		}
+	}
+	ff.meta.EncVersion, ff.meta.Pkg2Len, ff.meta.StorageMode = encVersion, pkg2Len, storageMode
+	ff.meta.SharedSuite, ff.meta.UserSuite = sharedSuite, userSuite
+	return nil
+}
+
+func (f *fakeDB) ListFilesBelowEncVersion(version int) ([]db.FileRef, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var refs []db.FileRef
+	for _, id := range f.order {
+		if ff := f.files[id]; ff.meta.EncVersion < version {
+			refs = append(refs, ff.ref)
+		}
+	}
+	return refs, nil
+}
+
+func (f *fakeDB) ListFilesByStorageMode(feaHash []byte, mode string) ([]db.FileRef, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var refs []db.FileRef
+	for _, id := range f.order {
+		if ff := f.files[id]; bytes.Equal(ff.meta.FeaHash, feaHash) && ff.meta.StorageMode == mode {
+			refs = append(refs, ff.ref)
+		}
+	}
+	return refs, nil
+}
+
+func (f *fakeDB) ExistsChunk(hash string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.chunks[hash]
+	return ok, nil
+}
+
+func (f *fakeDB) InsertChunk(hash, s3Key string, isCommon bool, size int64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.chunks[hash]; ok {
+		return db.ErrChunkExists
+	}
+	f.chunks[hash] = &fakeChunk{info: db.ChunkInfo{ChunkHash: hash, S3Key: s3Key, IsCommon: isCommon, Size: size}}
+	return nil
+}
+
+func (f *fakeDB) GetChunk(hash string) (db.ChunkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.chunks[hash]
+	if !ok {
+		return db.ChunkInfo{}, sql.ErrNoRows
+	}
+	return c.info, nil
+}
+
+func (f *fakeDB) DeleteChunk(hash string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.chunks, hash)
+	return nil
+}
+
+func (f *fakeDB) DeleteUnusedChunks(hashes []string) ([]db.ChunkInfo, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var orphans []db.ChunkInfo
+	for _, h := range hashes {
+		if c, ok := f.chunks[h]; ok && !f.linked(h) {
+			orphans = append(orphans, c.info)
+			delete(f.chunks, h)
+		}
+	}
+	return orphans, nil
+}
+
+func (f *fakeDB) AddFileChunk(fileID, chunkHash string, seq int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	return f.link(ff, chunkHash, seq)
+}
+
+func (f *fakeDB) link(ff *fakeFile, hash string, seq int) error {
+	c, ok := f.chunks[hash]
+	if !ok {
+		return db.ErrChunkGone
+	}
+	if c.owner == "" {
+		c.owner = ff.ref.OwnerID
+	}
+	for len(ff.chunks) <= seq {
+		ff.chunks = append(ff.chunks, "")
+	}
+	ff.chunks[seq] = hash
+	return nil
+}
+
+func (f *fakeDB) CreateFeature(feaHash, dekShared []byte) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.features[hex.EncodeToString(feaHash)] = dekShared
+	return nil
+}
+
+func (f *fakeDB) GetFeatureByFeaHash(feaHash []byte) ([]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dek, ok := f.features[hex.EncodeToString(feaHash)]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return dek, nil
+}
+
+func (f *fakeDB) GetFeatureUploads(feaHash []byte) (int, sql.NullInt64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.uploads[hex.EncodeToString(feaHash)], sql.NullInt64{}, nil
+}
+
+func (f *fakeDB) CountFeatureUpload(feaHash []byte, threshold int) (int, int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := hex.EncodeToString(feaHash)
+	f.uploads[key]++
+	return f.uploads[key], threshold, nil
+}
+
+func (f *fakeDB) AddFeatureOwner(feaHash []byte, ownerID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := hex.EncodeToString(feaHash)
+	if f.owners[key] == nil {
+		f.owners[key] = make(map[string]bool)
+	}
+	f.owners[key][ownerID] = true
+	return len(f.owners[key]), nil
+}
+
+func (f *fakeDB) CountFeatureOwners(feaHash []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.owners[hex.EncodeToString(feaHash)]), nil
+}
+
+func (f *fakeDB) CountFeatureOwnersWith(feaHash []byte, ownerID string) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	owners := f.owners[hex.EncodeToString(feaHash)]
+	if owners[ownerID] {
+		return len(owners), nil
+	}
+	return len(owners) + 1, nil
+}
+
+func (f *fakeDB) ListPromotableFeatures(minOwners int) ([][]byte, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	seen := make(map[string]bool)
+	var hashes [][]byte
+	for _, ff := range f.files {
+		key := hex.EncodeToString(ff.meta.FeaHash)
+		if ff.meta.StorageMode == "private" && !seen[key] && len(f.owners[key]) >= minOwners {
+			seen[key] = true
+			hashes = append(hashes, ff.meta.FeaHash)
+		}
+	}
+	return hashes, nil
+}
+
+func (f *fakeDB) StatPath(ownerID, path string) (bool, bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ff := range f.files {
+		if ff.ref.OwnerID == ownerID && ff.meta.Filename == path {
+			return true, false, nil
+		}
+	}
+	return false, false, nil
+}
+
+func (f *fakeDB) FileIDByPath(ownerID, path string, version int) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := len(f.order) - 1; i >= 0; i-- {
+		if ff := f.files[f.order[i]]; ff.ref.OwnerID == ownerID && ff.meta.Filename == path {
+			return ff.ref.FileID, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (f *fakeDB) ListTree(ownerID, prefix string) ([]db.TreeEntry, error) {
+	return nil, errUnsupported
+}
+
+func (f *fakeDB) ListVersions(ownerID, path string) ([]db.FileVersion, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var versions []db.FileVersion
+	for _, id := range f.order {
+		if ff := f.files[id]; ff.ref.OwnerID == ownerID && ff.meta.Filename == path {
+			v := db.FileVersion{FileID: id, Version: len(versions) + 1, StorageMode: ff.meta.StorageMode}
+			versions = append([]db.FileVersion{v}, versions...)
+		}
+	}
+	return versions, nil
+}
+
+func (f *fakeDB) ListPrunableVersions(keep int, before sql.NullTime) ([]db.FileRef, error) {
+	return nil, nil
+}
+
+func (f *fakeDB) CreateFolder(ownerID, path string) error             { return errUnsupported }
+func (f *fakeDB) DeleteFolder(ownerID, path string) error             { return errUnsupported }
+func (f *fakeDB) MovePath(ownerID, from, to string) error             { return errUnsupported }
+func (f *fakeDB) RevokeGrant(fileID, ownerID, granteeID string) error { return errUnsupported }
+
+func (f *fakeDB) FileOwnerFor(userID, fileID, permission string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ff, ok := f.files[fileID]
+	if !ok {
+		return "", sql.ErrNoRows
+	}
+	if ff.ref.OwnerID == userID {
+		return userID, nil
+	}
+	for _, g := range f.grants {
+		if g.fileID == fileID && g.granteeID == userID && g.permission == permission {
+			return ff.ref.OwnerID, nil
+		}
+	}
+	return "", sql.ErrNoRows
+}
+
+func (f *fakeDB) UpsertGrant(fileID, ownerID, granteeID, permission string, expiresAt sql.NullTime) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if ff, ok := f.files[fileID]; !ok || ff.ref.OwnerID != ownerID {
+		return sql.ErrNoRows
+	}
+	f.grants = append(f.grants, fakeGrant{fileID, ownerID, granteeID, permission})
+	return nil
+}
+
+func (f *fakeDB) ListGrants(fileID, ownerID string) ([]db.Grant, error) {
+	return nil, errUnsupported
+}
+
+func (f *fakeDB) ListSharedWith(granteeID string) ([]db.Grant, error) {
+	return nil, errUnsupported
+}
+
+func (f *fakeDB) GetQuota(ownerID string) (db.Quota, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, ok := f.quotas[ownerID]
+	if !ok {
+		return db.Quota{}, sql.ErrNoRows
+	}
+	return q, nil
+}
+
+func (f *fakeDB) SetQuota(q db.Quota) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.quotas[q.OwnerID] = q
+	return nil
+}
+
+func (f *fakeDB) DeleteQuota(ownerID string) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.quotas[ownerID]
+	delete(f.quotas, ownerID)
+	return ok, nil
+}
+
+func (f *fakeDB) ListQuotas() ([]db.Quota, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var qs []db.Quota
+	for _, q := range f.quotas {
+		qs = append(qs, q)
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].OwnerID < qs[j].OwnerID })
+	return qs, nil
+}
+
+func (f *fakeDB) GetUsage(ownerID string) (db.Usage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	u := db.Usage{OwnerID: ownerID}
+	for _, ff := range f.files {
+		if ff.ref.OwnerID == ownerID {
+			u.LogicalBytes += ff.meta.Size
+		}
+	}
+	for _, c := range f.chunks {
+		if c.owner == ownerID {
+			u.PhysicalBytes += c.info.Size
+		}
+	}
+	return u, nil
+}
+
+func (f *fakeDB) ListUsage() ([]db.Usage, error) {
+	return nil, errUnsupported
+}
+
+func (f *fakeDB) Stats() (db.Stats, error) {
+	return db.Stats{}, errUnsupported
+}
+
+// fakeStore is an in-memory object store. onDelete, if set, runs before an
+// object is deleted.
+type fakeStore struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	onDelete func(key string)
+}
+
+func (s *fakeStore) PutObject(ctx context.Context, key string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *fakeStore) GetObject(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("no object %s", key)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (s *fakeStore) DeleteObject(ctx context.Context, key string) error {
+	if s.onDelete != nil {
+		s.onDelete(key)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeStore) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.objects)
+}
+
+// fakeKMS hands out random data keys, wrapped as opaque handles.
+type fakeKMS struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (k *fakeKMS) GenerateDataKey(ctx context.Context, in *kms.GenerateDataKeyInput, _ ...func(*kms.Options)) (*kms.GenerateDataKeyOutput, error) {
+	plain := make([]byte, 32)
+	wrapped := make([]byte, 16)
+	if _, err := rand.Read(plain); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(wrapped); err != nil {
+		return nil, err
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[string(wrapped)] = bytes.Clone(plain)
+	return &kms.GenerateDataKeyOutput{Plaintext: plain, CiphertextBlob: wrapped}, nil
+}
+
+func (k *fakeKMS) Decrypt(ctx context.Context, in *kms.DecryptInput, _ ...func(*kms.Options)) (*kms.DecryptOutput, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	plain, ok := k.keys[string(in.CiphertextBlob)]
+	if !ok {
+		return nil, errors.New("unknown key")
+	}
+	return &kms.DecryptOutput{Plaintext: bytes.Clone(plain)}, nil
+}
+
+// --- helpers ---
+
+const testPGB = 3
+
+type testEnv struct {
+	svc   *dsde.Service
+	db    *fakeDB
+	store *fakeStore
+	kms   *fakeKMS
+}
+
+func newTestEnv(t *testing.T, opts ...dsde.Option) *testEnv {
+	t.Helper()
+	e := &testEnv{
+		db:    newFakeDB(),
+		store: &fakeStore{objects: make(map[string][]byte)},
+		kms:   &fakeKMS{keys: make(map[string][]byte)},
+	}
+	e.svc = dsde.NewService(split.NewDefaultFG(), testPGB, e.kms, "test-key", e.db, e.store, false, opts...)
+	t.Cleanup(e.svc.Close)
+	return e
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func feature(t *testing.T, data []byte) []byte {
+	t.Helper()
+	fea, err := split.NewDefaultFG().Feature(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fea
+}
+
+func (e *testEnv) upload(t *testing.T, ownerID, filename string, data []byte) string {
+	t.Helper()
+	fileID, _, _, _, err := e.svc.Upload(context.Background(), ownerID, filename, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Upload(%s, %s): %v", ownerID, filename, err)
+	}
+	return fileID
+}
+
+func (e *testEnv) download(t *testing.T, ownerID, fileID string) []byte {
+	t.Helper()
+	rc, err := e.svc.Download(context.Background(), ownerID, fileID)
+	if err != nil {
+		t.Fatalf("Download(%s, %s): %v", ownerID, fileID, err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+func (e *testEnv) storageMode(t *testing.T, fileID string) string {
+	t.Helper()
+	ff, ok := e.db.file(fileID)
+	if !ok {
+		t.Fatalf("file %s not found", fileID)
+	}
+	return ff.meta.StorageMode
+}
+
+// answer proves the leaves a challenge asks for from data.
+func answer(t *testing.T, c *dsde.Challenge, data []byte) []pow.Proof {
+	t.Helper()
+	tree := pow.Build(data)
+	proofs := make([]pow.Proof, 0, len(c.Indices))
+	for _, i := range c.Indices {
+		p, err := tree.Prove(data, i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proofs = append(proofs, p)
+	}
+	return proofs
+}
+
+// --- tests ---
+
+func TestCompleteDedup_ClonesOnValidProof(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	e.upload(t, "alice", "a.bin", data)
+
+	c, err := e.svc.BeginDedup(ctx, "bob", "b.bin", feature(t, data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("BeginDedup: %v", err)
+	}
+	fileID, _, _, _, err := e.svc.CompleteDedup(ctx, "bob", c.ID, answer(t, c, data))
+	if err != nil {
+		t.Fatalf("CompleteDedup: %v", err)
+	}
+	if got := e.download(t, "bob", fileID); !bytes.Equal(got, data) {
+		t.Fatal("deduplicated file does not download as the original")
+	}
+}
+
+func TestCompleteDedup_RejectsBadProof(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	e.upload(t, "alice", "a.bin", data)
+
+	c, err := e.svc.BeginDedup(ctx, "bob", "b.bin", feature(t, data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("BeginDedup: %v", err)
+	}
+	proofs := answer(t, c, data)
+	proofs[0].Leaf = bytes.Clone(proofs[0].Leaf)
+	proofs[0].Leaf[0] ^= 0xff
+
+	_, _, _, _, err = e.svc.CompleteDedup(ctx, "bob", c.ID, proofs)
+	if !errors.Is(err, dsde.ErrProofRejected) {
+		t.Fatalf("CompleteDedup with a tampered leaf = %v, want ErrProofRejected", err)
+	}
+	if ids := e.db.ownerFiles("bob"); len(ids) != 0 {
+		t.Fatalf("bob has files %v after a rejected proof", ids)
+	}
+
+	// the challenge is spent even though the proof failed
+	_, _, _, _, err = e.svc.CompleteDedup(ctx, "bob", c.ID, answer(t, c, data))
+	if !errors.Is(err, dsde.ErrProofRejected) {
+		t.Fatalf("CompleteDedup reusing a challenge = %v, want ErrProofRejected", err)
+	}
+}
+
+func TestCompleteDedup_CollidingFeatures(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	// Below the 64-byte FG window every file has the same feature.
+	alice := []byte("alice's secret note")
+	bob := []byte("bob's different note")
+	if !bytes.Equal(feature(t, alice), feature(t, bob)) {
+		t.Fatal("test contents do not share a feature")
+	}
+	e.upload(t, "alice", "a.txt", alice)
+
+	c, err := e.svc.BeginDedup(ctx, "bob", "b.txt", feature(t, bob), int64(len(bob)))
+	if err != nil {
+		t.Fatalf("BeginDedup: %v", err)
+	}
+	_, _, _, _, err = e.svc.CompleteDedup(ctx, "bob", c.ID, answer(t, c, bob))
+	if !errors.Is(err, dsde.ErrProofRejected) {
+		t.Fatalf("CompleteDedup for other content of the same feature = %v, want ErrProofRejected", err)
+	}
+	if ids := e.db.ownerFiles("bob"); len(ids) != 0 {
+		t.Fatalf("bob has files %v cloned from content they do not hold", ids)
+	}
+}
+
+func TestUpload_PromotesAtPopularityThreshold(t *testing.T) {
+	e := newTestEnv(t, dsde.WithPopularityThreshold(2))
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	fea := feature(t, data)
+
+	first := e.upload(t, "alice", "a.bin", data)
+	if mode := e.storageMode(t, first); mode != "private" {
+		t.Fatalf("first owner's file stored %q, want private", mode)
+	}
+	// a second copy by the same owner does not make the content popular
+	again := e.upload(t, "alice", "a2.bin", data)
+	if mode := e.storageMode(t, again); mode != "private" {
+		t.Fatalf("first owner's second file stored %q, want private", mode)
+	}
+	if _, err := e.svc.BeginDedup(ctx, "bob", "b.bin", fea, int64(len(data))); !errors.Is(err, dsde.ErrNoDedup) {
+		t.Fatalf("BeginDedup for private content = %v, want ErrNoDedup", err)
+	}
+
+	second := e.upload(t, "bob", "b.bin", data)
+	if mode := e.storageMode(t, second); mode != "dsde" {
+		t.Fatalf("second owner's file stored %q, want dsde", mode)
+	}
+	e.svc.Wait()
+	for _, id := range []string{first, again} {
+		if mode := e.storageMode(t, id); mode != "dsde" {
+			t.Fatalf("earlier file %s is %q after the content became popular, want dsde", id, mode)
+		}
+		if got := e.download(t, "alice", id); !bytes.Equal(got, data) {
+			t.Fatalf("promoted file %s does not download as the original", id)
+		}
+	}
+	if n, _ := e.db.CountFeatureOwners(fea); n != 2 {
+		t.Fatalf("feature has %d owners, want 2", n)
+	}
+}
+
+func TestUpload_QuotaExceededStoresNothing(t *testing.T) {
+	for _, tc := range []struct {
+		name              string
+		logical, physical int64
+	}{
+		{"logical", 1000, 0},
+		{"physical", 0, 1000},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newTestEnv(t)
+			ctx := context.Background()
+			if err := e.svc.SetQuota(ctx, "alice", tc.logical, tc.physical); err != nil {
+				t.Fatal(err)
+			}
+			data := randomBytes(t, 5000)
+
+			_, _, _, _, err := e.svc.Upload(ctx, "alice", "a.bin", bytes.NewReader(data))
+			if !errors.Is(err, dsde.ErrQuotaExceeded) {
+				t.Fatalf("Upload over quota = %v, want ErrQuotaExceeded", err)
+			}
+			if ids := e.db.ownerFiles("alice"); len(ids) != 0 {
+				t.Fatalf("refused upload left files %v", ids)
+			}
+			if n := e.store.len(); n != 0 {
+				t.Fatalf("refused upload left %d objects", n)
+			}
+			if u, _ := e.db.GetUsage("alice"); u.LogicalBytes != 0 || u.PhysicalBytes != 0 {
+				t.Fatalf("refused upload is charged: %+v", u)
+			}
+			if n, _ := e.db.CountFeatureOwners(feature(t, data)); n != 0 {
+				t.Fatalf("refused upload counted %d feature owners", n)
+			}
+		})
+	}
+}
+
+func TestUpload_FailureRemovesStoredBlobs(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	aliceID := e.upload(t, "alice", "a.bin", data)
+	objects, chunks := e.store.len(), len(e.db.chunks)
+
+	e.db.failPoW = errors.New("injected")
+	if _, _, _, _, err := e.svc.Upload(ctx, "bob", "b.bin", bytes.NewReader(data)); err == nil {
+		t.Fatal("Upload succeeded despite the failure")
+	}
+	if _, _, _, _, err := e.svc.Upload(ctx, "carol", "c.bin", bytes.NewReader(randomBytes(t, 5000))); err == nil {
+		t.Fatal("Upload succeeded despite the failure")
+	}
+	e.db.failPoW = nil
+
+	for _, owner := range []string{"bob", "carol"} {
+		if ids := e.db.ownerFiles(owner); len(ids) != 0 {
+			t.Fatalf("failed upload left %s files %v", owner, ids)
+		}
+	}
+	if n := e.store.len(); n != objects {
+		t.Fatalf("failed uploads left %d objects, want %d", n, objects)
+	}
+	if n := len(e.db.chunks); n != chunks {
+		t.Fatalf("failed uploads left %d chunks, want %d", n, chunks)
+	}
+	if got := e.download(t, "alice", aliceID); !bytes.Equal(got, data) {
+		t.Fatal("failed upload of shared content broke the existing file")
+	}
+}
+
+func TestRandomizedThreshold_HidesPhysicalSaving(t *testing.T) {
+	e := newTestEnv(t, dsde.WithRandomizedThreshold(10, 0))
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	e.upload(t, "bob", "b.bin", data)
+	bob, err := e.svc.Quota(ctx, "bob")
+	if err != nil || bob.PhysicalBytes == 0 {
+		t.Fatalf("Quota(bob) = %+v, %v; want physical usage for operators", bob, err)
+	}
+	if own, err := e.svc.OwnUsage(ctx, "bob"); err != nil || own.PhysicalBytes != 0 || own.LogicalBytes != int64(len(data)) {
+		t.Fatalf("OwnUsage(bob) = %+v, %v; want logical usage only", own, err)
+	}
+
+	// Only alice's sBlob would be new, but a refusal must not show that d is
+	// already stored.
+	if err := e.svc.SetQuota(ctx, "alice", 0, bob.PhysicalBytes-1); err != nil {
+		t.Fatal(err)
+	}
+	_, _, _, _, err = e.svc.Upload(ctx, "alice", "a.bin", bytes.NewReader(data))
+	if !errors.Is(err, dsde.ErrQuotaExceeded) {
+		t.Fatalf("Upload of stored content = %v, want ErrQuotaExceeded as for new content", err)
+	}
+}
+
+func TestReseal_RoundTrip(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	fileID := e.upload(t, "alice", "a.bin", data)
+
+	// Re-seal the file by hand as scheme version 2 (suite headers, sBlob in
+	// one AEAD message), as a file uploaded before streaming sBlobs would be.
+	const oldVersion = 2
+	ff, _ := e.db.file(fileID)
+	meta := ff.meta
+	sharedKey, _ := e.kms.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: meta.DekShared})
+	userKey, _ := e.kms.Decrypt(ctx, &kms.DecryptInput{CiphertextBlob: meta.DekUser})
+	p := dsde.Params{
+		EncVersion:  oldVersion,
+		PGB:         testPGB,
+		SharedSuite: encryption.SuiteAESGCMSIV,
+		UserSuite:   encryption.SuiteXChaCha20Poly1305,
+	}
+	d, sBlob, pkg2Len, err := dsde.Seal(p, sharedKey.Plaintext, userKey.Plaintext, meta.FeaHash, fileID, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hexD, hexS := "old-d", "old-s"
+	for _, c := range []struct {
+		hash, key string
+		blob      []byte
+		common    bool
+	}{
+		{hexD, "common/old-d", d, true},
+		{hexS, "files/" + fileID + "/s-old", sBlob, false},
+	} {
+		if err := e.store.PutObject(ctx, c.key, bytes.NewReader(c.blob)); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.db.InsertChunk(c.hash, c.key, c.common, int64(len(c.blob))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.db.ReplaceFileChunks(fileID, []string{hexD, hexS}, oldVersion, 0, 0, pkg2Len, "dsde"); err != nil {
+		t.Fatal(err)
+	}
+	if got := e.download(t, "alice", fileID); !bytes.Equal(got, data) {
+		t.Fatal("hand-sealed old version does not download")
+	}
+
+	if err := e.svc.Reseal(ctx, "alice", fileID); err != nil {
+		t.Fatalf("Reseal: %v", err)
+	}
+	if ff, _ := e.db.file(fileID); ff.meta.EncVersion <= oldVersion {
+		t.Fatalf("enc_version is %d after Reseal, want past %d", ff.meta.EncVersion, oldVersion)
+	}
+	if got := e.download(t, "alice", fileID); !bytes.Equal(got, data) {
+		t.Fatal("resealed file does not download as the original")
+	}
+	if _, err := e.store.GetObject(ctx, "files/"+fileID+"/s-old"); err == nil {
+		t.Fatal("old sBlob still stored after Reseal")
+	}
+	if refs, _ := e.db.ListFilesBelowEncVersion(oldVersion + 1); len(refs) != 0 {
+		t.Fatalf("files still below the current version: %v", refs)
+	}
+}
+
+func TestSuites_OpenedAsRecorded(t *testing.T) {
+	e := newTestEnv(t, dsde.WithSuites(encryption.SuiteAESGCMSIV, encryption.SuiteXChaCha20Poly1305))
+	data := randomBytes(t, 5000)
+	fileID := e.upload(t, "alice", "a.bin", data)
+
+	// Files keep opening under the suites they record after the configured
+	// ones change.
+	other := dsde.NewService(split.NewDefaultFG(), testPGB, e.kms, "test-key", e.db, e.store, false,
+		dsde.WithSuites(encryption.SuiteAESGCM, encryption.SuiteAESGCM))
+	t.Cleanup(other.Close)
+	rc, err := other.Download(context.Background(), "alice", fileID)
+	if err != nil {
+		t.Fatalf("Download after a suite change: %v", err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatal("Download after a suite change returned other content")
+	}
+
+	// A blob is not opened under a suite the record does not name.
+	e.db.mu.Lock()
+	e.db.files[fileID].meta.UserSuite = int(encryption.SuiteAESGCM)
+	e.db.mu.Unlock()
+	if _, err := e.svc.Download(context.Background(), "alice", fileID); !errors.Is(err, dsde.ErrIntegrityFailure) {
+		t.Fatalf("Download under another recorded suite = %v, want ErrIntegrityFailure", err)
+	}
+}
+
+func TestCopyFile_RequiresConsent(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	src := e.upload(t, "alice", "a.bin", data)
+
+	// bob holds no grant on alice's file, so it cannot end up in his namespace
+	_, _, _, _, err := e.svc.CopyFile(ctx, "bob", src, "stolen.bin")
+	if !errors.Is(err, dsde.ErrNotFound) {
+		t.Fatalf("CopyFile without a grant = %v, want ErrNotFound", err)
+	}
+	if ids := e.db.ownerFiles("bob"); len(ids) != 0 {
+		t.Fatalf("bob has files %v copied without consent", ids)
+	}
+
+	// once alice shares it, bob may copy it into his own namespace
+	if err := e.svc.ShareFile(ctx, "alice", src, "bob", time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	fileID, _, _, _, err := e.svc.CopyFile(ctx, "bob", src, "b.bin")
+	if err != nil {
+		t.Fatalf("CopyFile of a shared file: %v", err)
+	}
+	if ff, _ := e.db.file(fileID); ff.ref.OwnerID != "bob" {
+		t.Fatalf("copy belongs to %q, want bob", ff.ref.OwnerID)
+	}
+	if got := e.download(t, "bob", fileID); !bytes.Equal(got, data) {
+		t.Fatal("copy does not download as the original")
+	}
+	if ids := e.db.ownerFiles("alice"); len(ids) != 1 {
+		t.Fatalf("alice has files %v, want only her original", ids)
+	}
+}
+
+func TestDeletePath_RacingReuploadKeepsContent(t *testing.T) {
+	e := newTestEnv(t)
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	e.upload(t, "alice", "a.bin", data)
+
+	// bob uploads the same content after alice's delete has dropped the
+	// shared chunk's row but before it deletes the chunk's object
+	var bobFile string
+	e.store.onDelete = func(key string) {
+		if strings.HasPrefix(key, "common/") && bobFile == "" {
+			bobFile = e.upload(t, "bob", "b.bin", data)
+		}
+	}
+	if err := e.svc.DeletePath(ctx, "alice", "a.bin"); err != nil {
+		t.Fatalf("DeletePath: %v", err)
+	}
+	if bobFile == "" {
+		t.Fatal("delete removed no common blob")
+	}
+	if got := e.download(t, "bob", bobFile); !bytes.Equal(got, data) {
+		t.Fatal("file uploaded during the delete lost its content")
+	}
+}
+
+func TestCommitClientUpload_ChargesAtLeastSealedSize(t *testing.T) {
+	ctx := context.Background()
+	data := randomBytes(t, 5000)
+	for _, tc := range []struct {
+		name     string
+		size     int64
+		wantErr  error
+		wantSize func(sealed int64) int64
+	}{
+		{"understated", 0, nil, func(sealed int64) int64 { return sealed }},
+		{"exact", int64(len(data)), nil, func(sealed int64) int64 { return sealed }},
+		{"overstated", 1 << 20, dsde.ErrInvalidArgument, nil},
+		{"negative", -1, dsde.ErrInvalidArgument, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// below the popularity threshold the client seals the file whole
+			e := newTestEnv(t, dsde.WithPopularityThreshold(2))
+			keys, err := e.svc.BeginClientUpload(ctx, "alice", "a.bin", feature(t, data))
+			if err != nil {
+				t.Fatalf("BeginClientUpload: %v", err)
+			}
+			if !keys.Private {
+				t.Fatal("first upload of new content is not private")
+			}
+			blob, err := dsde.SealPrivate(keys.Params, keys.UserKey, keys.FileID, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, _, _, err = e.svc.CommitClientUpload(ctx, "alice", keys.FileID, 0, keys.Codec, tc.size, blob, nil)
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("CommitClientUpload(size %d) = %v, want %v", tc.size, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("CommitClientUpload: %v", err)
+			}
+			u, _ := e.db.GetUsage("alice")
+			if want := tc.wantSize(int64(len(blob))); u.LogicalBytes != want {
+				t.Fatalf("logical usage %d for declared size %d, want %d", u.LogicalBytes, tc.size, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package dsde
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+)
+
+// Sharing: an owner grants another user read access to a file. Every DEK is
+// wrapped under the same KMS key, so nothing is re-wrapped per grantee; the
+// grant only widens who may have the server unwrap the file's DEKs. Revoking
+// or letting a grant expire takes effect on the grantee's next request.
+
+// PermRead is the only permission a grant carries for now.
+const PermRead = "read"
+
+// ErrInvalidGrant is returned for grants to the owner themself or with an
+// expiry in the past.
+var ErrInvalidGrant = newError(ErrInvalidArgument, "dsde: invalid grant")
+
+// ShareFile gives granteeID read access to ownerID's file fileID until
+// expiresAt, or indefinitely if expiresAt is zero. Sharing a file again
+// replaces the previous grant.
+func (s *Service) ShareFile(ctx context.Context, ownerID, fileID, granteeID string, expiresAt time.Time) error {
+	if granteeID == "" || granteeID == ownerID || (!expiresAt.IsZero() && !expiresAt.After(time.Now())) {
+		return ErrInvalidGrant
+	}
+	exp := sql.NullTime{Time: expiresAt, Valid: !expiresAt.IsZero()}
+	err := s.db.UpsertGrant(fileID, ownerID, granteeID, PermRead, exp)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.notOwned(ownerID, fileID)
+	} else if err != nil {
+		zap.L().Named("ShareFile").Error("UpsertGrant", zap.Error(err), zap.String("fileID", fileID))
+		return err
+	}
+	zap.L().Named("ShareFile").Info("shared", zap.String("fileID", fileID), zap.String("grantee", granteeID))
+	return nil
+}
+
+// Unshare revokes granteeID's access to ownerID's file fileID.
+func (s *Service) Unshare(ctx context.Context, ownerID, fileID, granteeID string) error {
+	err := s.db.RevokeGrant(fileID, ownerID, granteeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.notOwned(ownerID, fileID)
+	}
+	return err
+}
+
+// Grants lists the active grants on ownerID's file fileID.
+func (s *Service) Grants(ctx context.Context, ownerID, fileID string) ([]db.Grant, error) {
+	grants, err := s.db.ListGrants(fileID, ownerID)
+	if err != nil || len(grants) > 0 {
+		return grants, err
+	}
+	// no grants: the file may be unshared, or not ownerID's
+	owner, err := s.readableOwner(ownerID, fileID)
+	if err != nil {
+		return nil, err
+	}
+	if owner != ownerID {
+		return nil, s.notOwned(ownerID, fileID)
+	}
+	return nil, nil
+}
+
+// SharedWith lists the files other owners currently share with userID.
+func (s *Service) SharedWith(ctx context.Context, userID string) ([]db.Grant, error) {
+	return s.db.ListSharedWith(userID)
+}
+
+// CanRead reports ErrFileNotFound unless userID owns fileID or holds an
+// active read grant on it.
+func (s *Service) CanRead(ctx context.Context, userID, fileID string) error {
+	_, err := s.readableOwner(userID, fileID)
+	return err
+}
+
+// notOwned explains why userID cannot manage the grants on fileID: a
+// grantee may read the file but not share it, anyone else cannot see it.
+func (s *Service) notOwned(userID, fileID string) error {
+	if _, err := s.readableOwner(userID, fileID); err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: only the owner may share file %s", ErrForbidden, fileID)
+}
+
+// readableOwner returns the owner of fileID if userID owns it or holds an
+// active read grant on it, and ErrFileNotFound otherwise.
+func (s *Service) readableOwner(userID, fileID string) (string, error) {
+	ownerID, err := s.db.FileOwnerFor(userID, fileID, PermRead)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+	return ownerID, err
+}
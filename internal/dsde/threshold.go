@@ -0,0 +1,72 @@
+package dsde
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Randomized dedup thresholds (Harnik, Pinkas and Shulman-Peleg, "Side
+// Channels in Cloud Services"): each feature draws a secret threshold t
+// uniformly from [2, max], and the first t uploads of it behave exactly as if
+// the content were new. d is written again, client-side uploads are told to
+// send it, and proof-of-ownership dedup is refused. An uploader who sees the
+// saving therefore learns only that the content has been uploaded t times in
+// total, their own attempts included, and not whether anyone else holds it.
+// Responses are additionally padded to a minimum latency, so the skipped
+// PutObject does not show up in timing either.
+
+// WithRandomizedThreshold enables randomized dedup thresholds drawn from
+// [2, limit] and pads Upload, CheckClientD and BeginDedup to at least
+// minLatency. limit below 2 is raised to 2.
+func WithRandomizedThreshold(limit int, minLatency time.Duration) Option {
+	return func(s *Service) {
+		s.thresholdMax = max(limit, 2)
+		s.minLatency = minLatency
+	}
+}
+
+// hideDedup counts an upload of feaHash and reports whether it must still look
+// like a first upload.
+func (s *Service) hideDedup(feaHash []byte) (bool, error) {
+	if s.thresholdMax == 0 {
+		return false, nil
+	}
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(s.thresholdMax-1)))
+	if err != nil {
+		return false, err
+	}
+	count, threshold, err := s.db.CountFeatureUpload(feaHash, 2+int(n.Int64()))
+	if err != nil {
+		return false, fmt.Errorf("CountFeatureUpload: %w", err)
+	}
+	return count <= threshold, nil
+}
+
+// dedupRevealed reports, without counting an upload, whether feaHash has
+// crossed its threshold and may be deduplicated visibly.
+func (s *Service) dedupRevealed(feaHash []byte) (bool, error) {
+	if s.thresholdMax == 0 {
+		return true, nil
+	}
+	count, threshold, err := s.db.GetFeatureUploads(feaHash)
+	if err != nil {
+		return false, fmt.Errorf("GetFeatureUploads: %w", err)
+	}
+	return threshold.Valid && int64(count) > threshold.Int64, nil
+}
+
+// padLatency blocks until minLatency has passed since start, or ctx is done.
+func (s *Service) padLatency(ctx context.Context, start time.Time) {
+	if s.minLatency <= 0 {
+		return
+	}
+	t := time.NewTimer(time.Until(start.Add(s.minLatency)))
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
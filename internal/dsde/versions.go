@@ -0,0 +1,141 @@
+package dsde
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+)
+
+// Versions: an owner's filename is a logical path, and every file stored
+// under it (upload, dedup claim, copy or restore) is its next version. The
+// newest version is what the path resolves to. A retention policy prunes
+// older versions; a pruned version's chunks lose a reference, and chunks no
+// file references any more, common ones included, are deleted.
+
+// WithRetention prunes all but the newest keep versions of a path (0 keeps
+// all) and versions older than maxAge (0 keeps them). The newest version of
+// a path is never pruned.
+func WithRetention(keep int, maxAge time.Duration) Option {
+	return func(s *Service) {
+		s.keepVersions = keep
+		s.retainFor = maxAge
+	}
+}
+
+// ResolvePath returns the file holding version of ownerID's path, or its
+// newest version if version is 0.
+func (s *Service) ResolvePath(ctx context.Context, ownerID, path string, version int) (string, error) {
+	fileID, err := s.db.FileIDByPath(ownerID, path, version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFileNotFound
+	}
+	return fileID, err
+}
+
+// Versions lists the versions of ownerID's path, newest first.
+func (s *Service) Versions(ctx context.Context, ownerID, path string) ([]db.FileVersion, error) {
+	versions, err := s.db.ListVersions(ownerID, path)
+	if err == nil && len(versions) == 0 {
+		return nil, ErrFileNotFound
+	}
+	return versions, err
+}
+
+// Restore makes version of ownerID's path its newest version again, by
+// copying it to a new version on the server.
+func (s *Service) Restore(
+	ctx context.Context,
+	ownerID, path string,
+	version int,
+) (fileID string, feaHash, dekShared, dekUser []byte, err error) {
+	srcID, err := s.ResolvePath(ctx, ownerID, path, version)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	return s.CopyFile(ctx, ownerID, srcID, path)
+}
+
+// DeletePath deletes every version of ownerID's file at path.
+func (s *Service) DeletePath(ctx context.Context, ownerID, path string) error {
+	path, err := CleanPath(path)
+	if err != nil {
+		return err
+	}
+	versions, err := s.db.ListVersions(ownerID, path)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return ErrFileNotFound
+	}
+	for _, v := range versions {
+		if err := s.deleteFile(ctx, db.FileRef{FileID: v.FileID, OwnerID: ownerID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneVersions applies the retention policy and reports how many versions it
+// deleted. It does nothing without one.
+func (s *Service) PruneVersions(ctx context.Context) (int, error) {
+	if s.keepVersions <= 0 && s.retainFor <= 0 {
+		return 0, nil
+	}
+	log := zap.L().Named("PruneVersions")
+
+	var before sql.NullTime
+	if s.retainFor > 0 {
+		before = sql.NullTime{Time: time.Now().Add(-s.retainFor), Valid: true}
+	}
+	refs, err := s.db.ListPrunableVersions(s.keepVersions, before)
+	if err != nil {
+		return 0, err
+	}
+	pruned := 0
+	for _, ref := range refs {
+		if err := ctx.Err(); err != nil {
+			return pruned, err
+		}
+		if err := s.deleteFile(ctx, ref); err != nil {
+			log.Warn("deleteFile", zap.Error(err), zap.String("fileID", ref.FileID))
+			continue
+		}
+		pruned++
+	}
+	if pruned > 0 {
+		log.Info("pruned versions", zap.Int("count", pruned))
+	}
+	return pruned, nil
+}
+
+// deleteFile removes a file, then the chunks and objects no other file
+// references. A chunk-mode file's dropped common chunks also leave the
+// extractor's filter, so the next upload of that block stores it again.
+func (s *Service) deleteFile(ctx context.Context, ref db.FileRef) error {
+	log := zap.L().Named("deleteFile")
+
+	meta, _, err := s.db.GetFileMeta(ref.OwnerID, ref.FileID)
+	if err != nil {
+		return err
+	}
+	orphans, err := s.db.DeleteFile(ref.FileID)
+	if err != nil {
+		return err
+	}
+	for _, c := range orphans {
+		if c.IsCommon && meta.StorageMode == storageChunks && s.extractor != nil {
+			s.extractor.Remove(c.ChunkHash)
+		}
+		if err := s.store.DeleteObject(ctx, c.S3Key); err != nil {
+			log.Warn("DeleteObject", zap.Error(err), zap.String("s3Key", c.S3Key))
+		}
+	}
+	log.Debug("deleted", zap.String("fileID", ref.FileID), zap.Int("orphans", len(orphans)))
+	return nil
+}
@@ -4,12 +4,16 @@ import (
 	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 
 	"github.com/aws/aws-sdk-go-v2/service/kms"
+	"golang.org/x/crypto/hkdf"
 )
 
 // Service handles DEK generation (via KMS) and chunk encrypt/decrypt.
@@ -17,6 +21,9 @@ type Service struct {
 	dekPlain  []byte      // plaintext data key
 	dekCipher []byte      // KMS-encrypted data key blob
 	aead      cipher.AEAD // AES-GCM AEAD for encryption/decryption
+	suite     Suite       // zero for headerless legacy blobs
+	nonceKey  []byte      // HMAC key for deterministic nonces (suite mode only)
+	bound     bool        // suite subkeys, suite in the AAD, only suite opened
 }
 
 // NewWithKey builds a Service from a raw 32-byte key (for tests or manual DEK).
@@ -35,6 +42,80 @@ func NewWithKey(rawKey []byte) (*Service, error) {
 	return &Service{dekPlain: rawKey, aead: aead}, nil
 }
 
+// NewWithSuite builds a Service that seals with suite and prefixes every blob
+// with the suite ID, giving suite||nonce||ciphertext. Its Decrypt reads the
+// header, so it opens blobs sealed under any known suite with the same key.
+func NewWithSuite(rawKey []byte, suite Suite) (*Service, error) {
+	if len(rawKey) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	aead, err := suite.newAEAD(rawKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, rawKey)
+	mac.Write([]byte("dsde/deterministic-nonce"))
+	return &Service{
+		dekPlain: rawKey,
+		aead:     aead,
+		suite:    suite,
+		nonceKey: mac.Sum(nil),
+	}, nil
+}
+
+// NewForSuite is NewWithSuite for blobs bound to their suite: they are sealed
+// under the suite's own subkey of rawKey (see SuiteKey), with the suite ID
+// folded into the associated data, and only blobs sealed under suite open.
+// A blob's suite header therefore cannot be swapped to have it opened by
+// another construction, or under the key another suite uses.
+func NewForSuite(rawKey []byte, suite Suite) (*Service, error) {
+	if len(rawKey) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	key, err := deriveKey(rawKey, "dsde/suite", suite)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonceKey, err := deriveKey(rawKey, "dsde/nonce", suite)
+	if err != nil {
+		return nil, err
+	}
+	return &Service{
+		dekPlain: rawKey,
+		aead:     aead,
+		suite:    suite,
+		nonceKey: nonceKey,
+		bound:    true,
+	}, nil
+}
+
+// SuiteKey derives the key suite seals under from rawKey:
+// HKDF-SHA256(rawKey, info = "dsde/suite" || suite), so no two suites ever
+// use the same key.
+func SuiteKey(rawKey []byte, suite Suite) ([]byte, error) {
+	return deriveKey(rawKey, "dsde/suite", suite)
+}
+
+func deriveKey(rawKey []byte, label string, suite Suite) ([]byte, error) {
+	info := append([]byte(label), byte(suite))
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, rawKey, nil, info), key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// suiteAAD binds suite into aad.
+func suiteAAD(suite Suite, aad []byte) []byte {
+	out := make([]byte, 0, 1+len(aad))
+	out = append(out, byte(suite))
+	return append(out, aad...)
+}
+
 // New uses KMS to generate a fresh data key for encryption.
 func New(ctx context.Context, kmsClient *kms.Client, keyID string) (*Service, error) {
 	out, err := kmsClient.GenerateDataKey(ctx, &kms.GenerateDataKeyInput{
@@ -58,32 +139,111 @@ func (s *Service) DEKCipher() []byte {
 	return s.dekCipher
 }
 
+// Role identifies which DSDE layer a ciphertext belongs to. It is bound into
+// the associated data so a blob sealed for one layer cannot be opened as another.
+type Role byte
+
+const (
+	RoleShared  Role = 1 // pkg3C: pkg1 under the shared (feature) DEK
+	RoleUser    Role = 2 // sBlob: pkg2||pkg4 under the user DEK
+	RolePrivate Role = 3 // a whole file under the user DEK, not yet shared
+	RoleChunk   Role = 4 // one block of a chunk-mode file, bound to its object key
+)
+
+// SchemeVersion is the version of the associated-data layout built by
+// AssociatedData.
+const SchemeVersion byte = 1
+
+// AssociatedData builds the AAD that binds a blob to its identity:
+// "dsde" || version || role || len(id) || id.
+func AssociatedData(version byte, role Role, id []byte) []byte {
+	aad := make([]byte, 0, 4+1+1+4+len(id))
+	aad = append(aad, "dsde"...)
+	aad = append(aad, version, byte(role))
+	aad = binary.BigEndian.AppendUint32(aad, uint32(len(id)))
+	return append(aad, id...)
+}
+
 // Encrypt encrypts chunk data. For common==true it uses deterministic nonce
 // derived from SHA-256(data); otherwise random nonce for probabilistic encryption.
 // The output is nonce||ciphertext.
 func (s *Service) Encrypt(data []byte, common bool) ([]byte, error) {
+	return s.EncryptAAD(data, common, nil)
+}
+
+// EncryptAAD is Encrypt with associated data folded into the AEAD tag. For
+// common==true the deterministic nonce is derived from SHA-256(aad||data), or
+// from a keyed HMAC over (aad, data) for suite-headered Services, so equal
+// (aad, data) pairs still produce equal ciphertexts.
+func (s *Service) EncryptAAD(data []byte, common bool, aad []byte) ([]byte, error) {
+	if s.bound {
+		aad = suiteAAD(s.suite, aad)
+	}
 	nonceSize := s.aead.NonceSize()
 	var nonce []byte
-	if common {
-		sum := sha256.Sum256(data)
-		nonce = sum[:nonceSize]
-	} else {
+	switch {
+	case common && s.suite != 0:
+		mac := hmac.New(sha256.New, s.nonceKey)
+		var n [4]byte
+		binary.BigEndian.PutUint32(n[:], uint32(len(aad)))
+		mac.Write(n[:])
+		mac.Write(aad)
+		mac.Write(data)
+		nonce = mac.Sum(nil)[:nonceSize]
+	case common:
+		h := sha256.New()
+		h.Write(aad)
+		h.Write(data)
+		nonce = h.Sum(nil)[:nonceSize]
+	default:
 		nonce = make([]byte, nonceSize)
 		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 			return nil, err
 		}
 	}
-	ct := s.aead.Seal(nil, nonce, data, nil)
-	return append(nonce, ct...), nil
+
+	var out []byte
+	if s.suite != 0 {
+		out = make([]byte, 0, 1+nonceSize+len(data)+s.aead.Overhead())
+		out = append(out, byte(s.suite))
+	}
+	out = append(out, nonce...)
+	return s.aead.Seal(out, nonce, data, aad), nil
 }
 
 // Decrypt reverses Encrypt by splitting nonce||ciphertext.
 func (s *Service) Decrypt(blob []byte) ([]byte, error) {
-	nonceSize := s.aead.NonceSize()
+	return s.DecryptAAD(blob, nil)
+}
+
+// DecryptAAD reverses EncryptAAD. It fails if aad differs from the value the
+// blob was sealed with, or, for NewForSuite Services, if the blob names
+// another suite.
+func (s *Service) DecryptAAD(blob, aad []byte) ([]byte, error) {
+	aead := s.aead
+	if s.suite != 0 {
+		if len(blob) < 1 {
+			return nil, errors.New("ciphertext too short")
+		}
+		suite := Suite(blob[0])
+		blob = blob[1:]
+		if s.bound {
+			if suite != s.suite {
+				return nil, fmt.Errorf("blob sealed under %s, want %s", suite, s.suite)
+			}
+			aad = suiteAAD(suite, aad)
+		} else if suite != s.suite {
+			var err error
+			if aead, err = suite.newAEAD(s.dekPlain); err != nil {
+				return nil, err
+			}
+		}
+	}
+	nonceSize := aead.NonceSize()
 	if len(blob) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
 	nonce := blob[:nonceSize]
 	ct := blob[nonceSize:]
-	return s.aead.Open(nil, nonce, ct, nil)
+	return aead.Open(nil, nonce, ct, aad)
 }
@@ -0,0 +1,205 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+)
+
+// gcmSIV implements AEAD_AES_256_GCM_SIV from RFC 8452. Reusing a nonce only
+// reveals whether two (aad, plaintext) pairs are equal, which is exactly the
+// property the deterministic pkg1 layer wants.
+type gcmSIV struct {
+	kgk cipher.Block // key-generating key
+}
+
+const (
+	gcmSIVNonceSize = 12
+	gcmSIVTagSize   = 16
+)
+
+var errOpen = errors.New("cipher: message authentication failed")
+
+func newGCMSIV(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, errors.New("AES-GCM-SIV key must be 32 bytes")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return &gcmSIV{kgk: block}, nil
+}
+
+func (g *gcmSIV) NonceSize() int { return gcmSIVNonceSize }
+func (g *gcmSIV) Overhead() int  { return gcmSIVTagSize }
+
+// deriveKeys returns the per-nonce POLYVAL key and AES-256 encryption block.
+func (g *gcmSIV) deriveKeys(nonce []byte) ([16]byte, cipher.Block) {
+	var in, out [16]byte
+	var derived [48]byte
+	copy(in[4:], nonce)
+	for i := 0; i < 6; i++ {
+		binary.LittleEndian.PutUint32(in[:4], uint32(i))
+		g.kgk.Encrypt(out[:], in[:])
+		copy(derived[i*8:], out[:8])
+	}
+	var authKey [16]byte
+	copy(authKey[:], derived[:16])
+	encBlock, _ := aes.NewCipher(derived[16:48])
+	return authKey, encBlock
+}
+
+// tag computes the SIV tag over aad and plaintext.
+func (g *gcmSIV) tag(authKey [16]byte, enc cipher.Block, nonce, plaintext, aad []byte) [16]byte {
+	p := newPolyval(authKey)
+	p.update(aad)
+	p.update(plaintext)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[:8], uint64(len(aad))*8)
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(plaintext))*8)
+	p.update(lengths[:])
+
+	s := p.sum()
+	for i := range nonce {
+		s[i] ^= nonce[i]
+	}
+	s[15] &= 0x7f
+	var t [16]byte
+	enc.Encrypt(t[:], s[:])
+	return t
+}
+
+// ctr XORs src with the GCM-SIV keystream, which counts in the low 32 bits
+// (little-endian) of a counter block seeded from the tag.
+func ctr(enc cipher.Block, tag [16]byte, dst, src []byte) {
+	block := tag
+	block[15] |= 0x80
+	counter := binary.LittleEndian.Uint32(block[:4])
+	var ks [16]byte
+	for len(src) > 0 {
+		binary.LittleEndian.PutUint32(block[:4], counter)
+		enc.Encrypt(ks[:], block[:])
+		n := subtle.XORBytes(dst, src, ks[:])
+		dst, src = dst[n:], src[n:]
+		counter++
+	}
+}
+
+func (g *gcmSIV) Seal(dst, nonce, plaintext, aad []byte) []byte {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("encryption: incorrect nonce length given to AES-GCM-SIV")
+	}
+	authKey, enc := g.deriveKeys(nonce)
+	t := g.tag(authKey, enc, nonce, plaintext, aad)
+
+	ret, out := sliceForAppend(dst, len(plaintext)+gcmSIVTagSize)
+	ctr(enc, t, out[:len(plaintext)], plaintext)
+	copy(out[len(plaintext):], t[:])
+	return ret
+}
+
+func (g *gcmSIV) Open(dst, nonce, ciphertext, aad []byte) ([]byte, error) {
+	if len(nonce) != gcmSIVNonceSize {
+		panic("encryption: incorrect nonce length given to AES-GCM-SIV")
+	}
+	if len(ciphertext) < gcmSIVTagSize {
+		return nil, errOpen
+	}
+	authKey, enc := g.deriveKeys(nonce)
+	var t [16]byte
+	copy(t[:], ciphertext[len(ciphertext)-gcmSIVTagSize:])
+	ct := ciphertext[:len(ciphertext)-gcmSIVTagSize]
+
+	ret, out := sliceForAppend(dst, len(ct))
+	ctr(enc, t, out, ct)
+	want := g.tag(authKey, enc, nonce, out, aad)
+	if subtle.ConstantTimeCompare(want[:], t[:]) != 1 {
+		clear(out)
+		return nil, errOpen
+	}
+	return ret, nil
+}
+
+// sliceForAppend extends in by n bytes, returning the whole slice and the tail.
+func sliceForAppend(in []byte, n int) (head, tail []byte) {
+	if total := len(in) + n; cap(in) >= total {
+		head = in[:total]
+	} else {
+		head = make([]byte, total)
+		copy(head, in)
+	}
+	tail = head[len(in):]
+	return
+}
+
+// polyval accumulates POLYVAL (RFC 8452 §3) over zero-padded 16-byte blocks.
+// It runs GHASH arithmetic on byte-reversed inputs, per RFC 8452 Appendix A.
+type polyval struct {
+	hHi, hLo uint64 // mulX_GHASH(ByteReverse(H))
+	sHi, sLo uint64
+}
+
+func newPolyval(h [16]byte) *polyval {
+	hr := reverse16(h[:])
+	hi, lo := binary.BigEndian.Uint64(hr[:8]), binary.BigEndian.Uint64(hr[8:])
+	hi, lo = ghashMulX(hi, lo)
+	return &polyval{hHi: hi, hLo: lo}
+}
+
+func (p *polyval) update(data []byte) {
+	for len(data) > 0 {
+		var block [16]byte
+		n := copy(block[:], data)
+		data = data[n:]
+		r := reverse16(block[:])
+		p.sHi ^= binary.BigEndian.Uint64(r[:8])
+		p.sLo ^= binary.BigEndian.Uint64(r[8:])
+		p.sHi, p.sLo = ghashMul(p.sHi, p.sLo, p.hHi, p.hLo)
+	}
+}
+
+func (p *polyval) sum() [16]byte {
+	var s [16]byte
+	binary.BigEndian.PutUint64(s[:8], p.sHi)
+	binary.BigEndian.PutUint64(s[8:], p.sLo)
+	return reverse16(s[:])
+}
+
+func reverse16(b []byte) [16]byte {
+	var r [16]byte
+	for i := 0; i < 16; i++ {
+		r[i] = b[15-i]
+	}
+	return r
+}
+
+// ghashMulX multiplies by x in the GHASH field (one right shift with reduction).
+func ghashMulX(hi, lo uint64) (uint64, uint64) {
+	carry := lo & 1
+	lo = lo>>1 | hi<<63
+	hi >>= 1
+	hi ^= (0xe1 << 56) * carry
+	return hi, lo
+}
+
+// ghashMul multiplies x by y in the GHASH field (NIST SP 800-38D, Algorithm 1).
+func ghashMul(xHi, xLo, yHi, yLo uint64) (uint64, uint64) {
+	var zHi, zLo uint64
+	vHi, vLo := yHi, yLo
+	for i := 0; i < 128; i++ {
+		var bit uint64
+		if i < 64 {
+			bit = xHi >> (63 - i) & 1
+		} else {
+			bit = xLo >> (127 - i) & 1
+		}
+		mask := -bit
+		zHi ^= vHi & mask
+		zLo ^= vLo & mask
+		vHi, vLo = ghashMulX(vHi, vLo)
+	}
+	return zHi, zLo
+}
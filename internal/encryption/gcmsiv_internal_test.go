@@ -0,0 +1,99 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestPolyval_RFC8452(t *testing.T) {
+	var h [16]byte
+	copy(h[:], unhex(t, "25629347589242761d31f826ba4b757b"))
+	p := newPolyval(h)
+	p.update(unhex(t, "4f4f95668c83dfb6401762bb2d01a262"))
+	p.update(unhex(t, "d1a24ddd2721d006bbe45f20d3c9f362"))
+	got := p.sum()
+	if want := unhex(t, "f7a3b47b846119fae5b7866cf5e5b77e"); !bytes.Equal(got[:], want) {
+		t.Errorf("POLYVAL = %x; want %x", got, want)
+	}
+}
+
+const (
+	rfcKey   = "0100000000000000000000000000000000000000000000000000000000000000"
+	rfcNonce = "030000000000000000000000"
+)
+
+// gcmSIVVectors are the AEAD_AES_256_GCM_SIV test vectors of RFC 8452,
+// Appendix C.2, and its counter-wrap vector from C.3.
+var gcmSIVVectors = []struct {
+	name                             string
+	key, nonce, plaintext, aad, want string
+}{
+	{"empty", rfcKey, rfcNonce, "", "", "07f5f4169bbf55a8400cd47ea6fd400f"},
+	{"8 bytes", rfcKey, rfcNonce, "0100000000000000", "", "c2ef328e5c71c83b843122130f7364b761e0b97427e3df28"},
+	{"12 bytes", rfcKey, rfcNonce, "010000000000000000000000", "", "9aab2aeb3faa0a34aea8e2b18ca50da9ae6559e48fd10f6e5c9ca17e"},
+	{"16 bytes", rfcKey, rfcNonce, "01000000000000000000000000000000", "", "85a01b63025ba19b7fd3ddfc033b3e76c9eac6fa700942702e90862383c6c366"},
+	{"8 bytes, AAD", rfcKey, rfcNonce, "0200000000000000", "01", "1de22967237a813291213f267e3b452f02d01ae33e4ec854"},
+	{"12 bytes, AAD", rfcKey, rfcNonce, "020000000000000000000000", "01", "163d6f9cc1b346cd453a2e4cc1a4a19ae800941ccdc57cc8413c277f"},
+	{"16 bytes, AAD", rfcKey, rfcNonce, "02000000000000000000000000000000", "01", "c91545823cc24f17dbb0e9e807d5ec17b292d28ff61189e8e49f3875ef91aff7"},
+	{"4 bytes, 12-byte AAD", rfcKey, rfcNonce, "02000000", "010000000000000000000000", "22b3f4cd1835e517741dfddccfa07fa4661b74cf"},
+	{
+		"counter wrap",
+		"0000000000000000000000000000000000000000000000000000000000000000",
+		"000000000000000000000000",
+		"000000000000000000000000000000004db923dc793ee6497c76dcc03a98e108",
+		"",
+		"f3f80f2cf0cb2dd9c5984fcda908456cc537703b5ba70324a6793a7bf218d3eaffffffff000000000000000000000000",
+	},
+}
+
+func TestGCMSIV_RFC8452(t *testing.T) {
+	for _, v := range gcmSIVVectors {
+		t.Run(v.name, func(t *testing.T) {
+			aead, err := newGCMSIV(unhex(t, v.key))
+			if err != nil {
+				t.Fatal(err)
+			}
+			nonce, plaintext, aad, want := unhex(t, v.nonce), unhex(t, v.plaintext), unhex(t, v.aad), unhex(t, v.want)
+			if got := aead.Seal(nil, nonce, plaintext, aad); !bytes.Equal(got, want) {
+				t.Errorf("Seal = %x; want %x", got, want)
+			}
+			got, err := aead.Open(nil, nonce, want, aad)
+			if err != nil || !bytes.Equal(got, plaintext) {
+				t.Errorf("Open = %x, %v; want %x", got, err, plaintext)
+			}
+		})
+	}
+}
+
+func TestGCMSIV_RejectsTampering(t *testing.T) {
+	v := gcmSIVVectors[5]
+	aead, err := newGCMSIV(unhex(t, v.key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, aad, sealed := unhex(t, v.nonce), unhex(t, v.aad), unhex(t, v.want)
+
+	for _, i := range []int{0, len(sealed) - 1} { // first ciphertext byte, last tag byte
+		bad := bytes.Clone(sealed)
+		bad[i] ^= 0x01
+		if _, err := aead.Open(nil, nonce, bad, aad); err == nil {
+			t.Errorf("Open accepted a flipped bit at byte %d", i)
+		}
+	}
+	if _, err := aead.Open(nil, nonce, sealed, []byte{0x02}); err == nil {
+		t.Error("Open accepted the wrong AAD")
+	}
+	if _, err := aead.Open(nil, nonce, sealed[:len(sealed)-1], aad); err == nil {
+		t.Error("Open accepted a truncated tag")
+	}
+}
@@ -0,0 +1,397 @@
+package encryption
+
+import (
+	"bufio"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Streaming AEAD format (STREAM construction, Tink-style key derivation):
+//
+//	header  = suite(1) || salt(32) || noncePrefix(nonceSize-5)
+//	segment = AEAD(segKey, noncePrefix || BE32(i) || last, plaintext_i)
+//
+// segKey = HKDF-SHA256(key, salt, aad), so the caller's associated data is
+// bound into every segment. Each ciphertext segment is SegmentSize bytes except
+// the last; the counter defeats reordering and the last-segment flag defeats
+// truncation at a segment boundary.
+
+// SegmentSize is the ciphertext size of every segment but the last.
+const SegmentSize = 64 << 10
+
+const streamSaltSize = 32
+
+// ErrStreamCorrupt is returned when a segment fails authentication, which
+// includes truncated, reordered and tampered streams.
+var ErrStreamCorrupt = errors.New("encryption: stream truncated or corrupted")
+
+type streamHeader struct {
+	suite  Suite
+	salt   []byte
+	prefix []byte
+}
+
+func (h streamHeader) size() int { return 1 + len(h.salt) + len(h.prefix) }
+
+func (h streamHeader) aead(key, aad []byte) (cipher.AEAD, error) {
+	segKey := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, key, h.salt, aad), segKey); err != nil {
+		return nil, err
+	}
+	return h.suite.newAEAD(segKey)
+}
+
+// bind returns the key and associated data a stream bound to suite is sealed
+// under, refusing a header that names another suite. A zero suite accepts any
+// header and leaves key and aad alone.
+func (h streamHeader) bind(key []byte, suite Suite, aad []byte) ([]byte, []byte, error) {
+	if suite == 0 {
+		return key, aad, nil
+	}
+	if h.suite != suite {
+		return nil, nil, fmt.Errorf("%w: stream sealed under %s, want %s", ErrStreamCorrupt, h.suite, suite)
+	}
+	subkey, err := SuiteKey(key, suite)
+	if err != nil {
+		return nil, nil, err
+	}
+	return subkey, suiteAAD(suite, aad), nil
+}
+
+func readStreamHeader(r io.Reader) (streamHeader, error) {
+	var s [1]byte
+	if _, err := io.ReadFull(r, s[:]); err != nil {
+		return streamHeader{}, fmt.Errorf("read stream header: %w", err)
+	}
+	aead, err := Suite(s[0]).newAEAD(make([]byte, 32))
+	if err != nil {
+		return streamHeader{}, err
+	}
+	h := streamHeader{
+		suite:  Suite(s[0]),
+		salt:   make([]byte, streamSaltSize),
+		prefix: make([]byte, aead.NonceSize()-5),
+	}
+	if _, err := io.ReadFull(r, h.salt); err != nil {
+		return streamHeader{}, fmt.Errorf("read stream header: %w", err)
+	}
+	if _, err := io.ReadFull(r, h.prefix); err != nil {
+		return streamHeader{}, fmt.Errorf("read stream header: %w", err)
+	}
+	return h, nil
+}
+
+func segmentNonce(prefix []byte, i uint32, last bool) []byte {
+	nonce := make([]byte, 0, len(prefix)+5)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, i)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// StreamWriter encrypts everything written to it as a segmented stream.
+// Close must be called to seal the final segment.
+type StreamWriter struct {
+	dst    io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	buf    []byte // pending plaintext, at most one full segment
+	seq    uint32
+	closed bool
+}
+
+// NewStreamWriter writes a stream header to dst and returns a writer that
+// seals plaintext under key (32 bytes) with suite, bound to aad.
+func NewStreamWriter(dst io.Writer, key []byte, suite Suite, aad []byte) (*StreamWriter, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	probe, err := suite.newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	h := streamHeader{
+		suite:  suite,
+		salt:   make([]byte, streamSaltSize),
+		prefix: make([]byte, probe.NonceSize()-5),
+	}
+	if _, err := io.ReadFull(rand.Reader, h.salt); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, h.prefix); err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(key, aad)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := make([]byte, 0, h.size())
+	hdr = append(hdr, byte(h.suite))
+	hdr = append(hdr, h.salt...)
+	hdr = append(hdr, h.prefix...)
+	if _, err := dst.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &StreamWriter{
+		dst:    dst,
+		aead:   aead,
+		prefix: h.prefix,
+		buf:    make([]byte, 0, SegmentSize-aead.Overhead()),
+	}, nil
+}
+
+// Write buffers p, sealing each full segment once more data follows it.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errors.New("encryption: write to closed stream")
+	}
+	n := len(p)
+	for len(p) > 0 {
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(false); err != nil {
+				return n - len(p), err
+			}
+		}
+		k := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// Close seals the buffered plaintext as the last segment. It does not close
+// the underlying writer.
+func (w *StreamWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	return w.flush(true)
+}
+
+func (w *StreamWriter) flush(last bool) error {
+	if w.seq == ^uint32(0) {
+		return errors.New("encryption: stream too long")
+	}
+	ct := w.aead.Seal(nil, segmentNonce(w.prefix, w.seq, last), w.buf, nil)
+	w.seq++
+	w.buf = w.buf[:0]
+	_, err := w.dst.Write(ct)
+	return err
+}
+
+// StreamReader decrypts a stream written by StreamWriter, in order.
+type StreamReader struct {
+	src    *bufio.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint32
+	seg    []byte // ciphertext scratch
+	out    []byte // decrypted, unread plaintext
+	done   bool
+}
+
+// NewSuiteStreamWriter is NewStreamWriter for a stream bound to its suite:
+// it is sealed under the suite's own subkey of key (see SuiteKey), with the
+// suite folded into aad. Open it with NewSuiteStreamReader or
+// NewSuiteStreamReaderAt.
+func NewSuiteStreamWriter(dst io.Writer, key []byte, suite Suite, aad []byte) (*StreamWriter, error) {
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	subkey, err := SuiteKey(key, suite)
+	if err != nil {
+		return nil, err
+	}
+	return NewStreamWriter(dst, subkey, suite, suiteAAD(suite, aad))
+}
+
+// NewStreamReader reads the stream header from src and returns a reader that
+// yields the authenticated plaintext.
+func NewStreamReader(src io.Reader, key, aad []byte) (*StreamReader, error) {
+	return newStreamReader(src, key, 0, aad)
+}
+
+// NewSuiteStreamReader opens a stream written by NewSuiteStreamWriter with
+// suite, refusing streams whose header names another suite.
+func NewSuiteStreamReader(src io.Reader, key []byte, suite Suite, aad []byte) (*StreamReader, error) {
+	return newStreamReader(src, key, suite, aad)
+}
+
+// newStreamReader opens a stream; a nonzero suite requires a stream bound to
+// that suite.
+func newStreamReader(src io.Reader, key []byte, suite Suite, aad []byte) (*StreamReader, error) {
+	br := bufio.NewReaderSize(src, SegmentSize+1)
+	h, err := readStreamHeader(br)
+	if err != nil {
+		return nil, err
+	}
+	if key, aad, err = h.bind(key, suite, aad); err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(key, aad)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamReader{
+		src:    br,
+		aead:   aead,
+		prefix: h.prefix,
+		seg:    make([]byte, SegmentSize),
+	}, nil
+}
+
+func (r *StreamReader) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// next decrypts one segment. A segment is the last one when it is short or
+// when nothing follows it.
+func (r *StreamReader) next() error {
+	n, err := io.ReadFull(r.src, r.seg)
+	last := false
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, perr := r.src.Peek(1); perr == io.EOF {
+			last = true
+		} else if perr != nil {
+			return perr
+		}
+	}
+	pt, oerr := r.aead.Open(r.seg[:0:0], segmentNonce(r.prefix, r.seq, last), r.seg[:n], nil)
+	if oerr != nil {
+		return ErrStreamCorrupt
+	}
+	r.seq++
+	r.out = pt
+	r.done = last
+	return nil
+}
+
+// StreamReaderAt gives random access to the plaintext of a stream, decrypting
+// only the segments a read touches. The last segment decrypted is kept, so
+// sequential reads smaller than a segment fetch each segment once.
+type StreamReaderAt struct {
+	src      io.ReaderAt
+	aead     cipher.AEAD
+	prefix   []byte
+	hdrSize  int64
+	segments int64
+	ctSize   int64
+	ptSize   int64
+
+	mu      sync.Mutex
+	lastSeg int64 // index of lastPT; -1 before the first read
+	lastPT  []byte
+}
+
+// NewStreamReaderAt opens a stream of size ciphertext bytes held in src.
+func NewStreamReaderAt(src io.ReaderAt, size int64, key, aad []byte) (*StreamReaderAt, error) {
+	return newStreamReaderAt(src, size, key, 0, aad)
+}
+
+// NewSuiteStreamReaderAt is NewStreamReaderAt for a stream written by
+// NewSuiteStreamWriter with suite.
+func NewSuiteStreamReaderAt(src io.ReaderAt, size int64, key []byte, suite Suite, aad []byte) (*StreamReaderAt, error) {
+	return newStreamReaderAt(src, size, key, suite, aad)
+}
+
+func newStreamReaderAt(src io.ReaderAt, size int64, key []byte, suite Suite, aad []byte) (*StreamReaderAt, error) {
+	h, err := readStreamHeader(io.NewSectionReader(src, 0, size))
+	if err != nil {
+		return nil, err
+	}
+	if key, aad, err = h.bind(key, suite, aad); err != nil {
+		return nil, err
+	}
+	aead, err := h.aead(key, aad)
+	if err != nil {
+		return nil, err
+	}
+	ctSize := size - int64(h.size())
+	if ctSize < int64(aead.Overhead()) {
+		return nil, ErrStreamCorrupt
+	}
+	segments := (ctSize + SegmentSize - 1) / SegmentSize
+	return &StreamReaderAt{
+		src:      src,
+		aead:     aead,
+		prefix:   h.prefix,
+		hdrSize:  int64(h.size()),
+		segments: segments,
+		ctSize:   ctSize,
+		ptSize:   ctSize - segments*int64(aead.Overhead()),
+		lastSeg:  -1,
+	}, nil
+}
+
+// Size returns the plaintext length of the stream.
+func (r *StreamReaderAt) Size() int64 { return r.ptSize }
+
+// ReadAt reads len(p) plaintext bytes starting at off.
+func (r *StreamReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("encryption: negative offset")
+	}
+	plainSeg := int64(SegmentSize - r.aead.Overhead())
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.ptSize {
+			return n, io.EOF
+		}
+		i := pos / plainSeg
+		pt, err := r.segment(i)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], pt[pos-i*plainSeg:])
+	}
+	return n, nil
+}
+
+func (r *StreamReaderAt) segment(i int64) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if i == r.lastSeg {
+		return r.lastPT, nil
+	}
+	start := i * SegmentSize
+	end := min(start+SegmentSize, r.ctSize)
+	buf := make([]byte, end-start)
+	if _, err := r.src.ReadAt(buf, r.hdrSize+start); err != nil && err != io.EOF {
+		return nil, err
+	}
+	last := i == r.segments-1
+	pt, err := r.aead.Open(buf[:0], segmentNonce(r.prefix, uint32(i), last), buf, nil)
+	if err != nil {
+		return nil, ErrStreamCorrupt
+	}
+	r.lastSeg, r.lastPT = i, pt
+	return pt, nil
+}
@@ -0,0 +1,215 @@
+package encryption_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+)
+
+const plainSeg = encryption.SegmentSize - 16
+
+func sealStream(t *testing.T, key, aad, plain []byte, suite encryption.Suite) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := encryption.NewStreamWriter(&buf, key, suite, aad)
+	if err != nil {
+		t.Fatalf("NewStreamWriter error: %v", err)
+	}
+	// Write in odd-sized pieces to exercise segment buffering.
+	for p := plain; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := w.Write(p[:n]); err != nil {
+			t.Fatalf("Write error: %v", err)
+		}
+		p = p[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func randBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b)
+	return b
+}
+
+func TestStream_RoundTrip(t *testing.T) {
+	key := randBytes(32)
+	aad := []byte("file-1")
+	for _, suite := range allSuites {
+		for _, size := range []int{0, 1, plainSeg - 1, plainSeg, plainSeg + 1, 3*plainSeg + 17} {
+			plain := randBytes(size)
+			ct := sealStream(t, key, aad, plain, suite)
+
+			r, err := encryption.NewStreamReader(bytes.NewReader(ct), key, aad)
+			if err != nil {
+				t.Fatalf("%s/%d: NewStreamReader error: %v", suite, size, err)
+			}
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("%s/%d: ReadAll error: %v", suite, size, err)
+			}
+			if !bytes.Equal(got, plain) {
+				t.Errorf("%s/%d: plaintext mismatch", suite, size)
+			}
+		}
+	}
+}
+
+func TestStream_DetectsTruncation(t *testing.T) {
+	key := randBytes(32)
+	plain := randBytes(3 * plainSeg)
+	ct := sealStream(t, key, nil, plain, encryption.SuiteAESGCM)
+
+	hdr := len(ct) - 3*encryption.SegmentSize
+	for _, cut := range []int{hdr + encryption.SegmentSize, hdr + 2*encryption.SegmentSize, len(ct) - 1} {
+		r, err := encryption.NewStreamReader(bytes.NewReader(ct[:cut]), key, nil)
+		if err != nil {
+			t.Fatalf("NewStreamReader error: %v", err)
+		}
+		if _, err := io.ReadAll(r); !errors.Is(err, encryption.ErrStreamCorrupt) {
+			t.Errorf("cut at %d: err = %v; want ErrStreamCorrupt", cut, err)
+		}
+	}
+}
+
+func TestStream_DetectsReordering(t *testing.T) {
+	key := randBytes(32)
+	plain := randBytes(3 * plainSeg)
+	ct := sealStream(t, key, nil, plain, encryption.SuiteXChaCha20Poly1305)
+
+	hdr := len(ct) - 3*encryption.SegmentSize
+	swapped := append([]byte{}, ct[:hdr]...)
+	swapped = append(swapped, ct[hdr+encryption.SegmentSize:hdr+2*encryption.SegmentSize]...)
+	swapped = append(swapped, ct[hdr:hdr+encryption.SegmentSize]...)
+	swapped = append(swapped, ct[hdr+2*encryption.SegmentSize:]...)
+
+	r, _ := encryption.NewStreamReader(bytes.NewReader(swapped), key, nil)
+	if _, err := io.ReadAll(r); !errors.Is(err, encryption.ErrStreamCorrupt) {
+		t.Errorf("err = %v; want ErrStreamCorrupt", err)
+	}
+}
+
+func TestStream_AADMismatch(t *testing.T) {
+	key := randBytes(32)
+	ct := sealStream(t, key, []byte("file-1"), []byte("payload"), encryption.SuiteAESGCMSIV)
+	r, _ := encryption.NewStreamReader(bytes.NewReader(ct), key, []byte("file-2"))
+	if _, err := io.ReadAll(r); !errors.Is(err, encryption.ErrStreamCorrupt) {
+		t.Errorf("err = %v; want ErrStreamCorrupt", err)
+	}
+}
+
+func TestStreamReaderAt_Ranges(t *testing.T) {
+	key := randBytes(32)
+	plain := randBytes(2*plainSeg + 500)
+	ct := sealStream(t, key, nil, plain, encryption.SuiteAESGCM)
+
+	ra, err := encryption.NewStreamReaderAt(bytes.NewReader(ct), int64(len(ct)), key, nil)
+	if err != nil {
+		t.Fatalf("NewStreamReaderAt error: %v", err)
+	}
+	if ra.Size() != int64(len(plain)) {
+		t.Fatalf("Size = %d; want %d", ra.Size(), len(plain))
+	}
+	for _, rng := range [][2]int{{0, 10}, {plainSeg - 5, 10}, {plainSeg, plainSeg}, {2*plainSeg + 490, 10}} {
+		buf := make([]byte, rng[1])
+		n, err := ra.ReadAt(buf, int64(rng[0]))
+		if err != nil {
+			t.Fatalf("ReadAt(%d, %d) error: %v", rng[0], rng[1], err)
+		}
+		if !bytes.Equal(buf[:n], plain[rng[0]:rng[0]+rng[1]]) {
+			t.Errorf("ReadAt(%d, %d) mismatch", rng[0], rng[1])
+		}
+	}
+
+	buf := make([]byte, 20)
+	n, err := ra.ReadAt(buf, int64(len(plain)-10))
+	if n != 10 || err != io.EOF {
+		t.Errorf("ReadAt past end = %d, %v; want 10, EOF", n, err)
+	}
+
+	// Dropping the final segment must not go unnoticed by random access either.
+	trunc := ct[:len(ct)-(500+16)]
+	ra, err = encryption.NewStreamReaderAt(bytes.NewReader(trunc), int64(len(trunc)), key, nil)
+	if err != nil {
+		t.Fatalf("NewStreamReaderAt(truncated) error: %v", err)
+	}
+	if _, err := ra.ReadAt(make([]byte, 1), int64(plainSeg)); !errors.Is(err, encryption.ErrStreamCorrupt) {
+		t.Errorf("truncated ReadAt err = %v; want ErrStreamCorrupt", err)
+	}
+}
+
+// countingReaderAt counts the reads made of the ciphertext.
+type countingReaderAt struct {
+	r     io.ReaderAt
+	reads int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.reads++
+	return c.r.ReadAt(p, off)
+}
+
+func TestStreamReaderAt_SequentialReadsFetchEachSegmentOnce(t *testing.T) {
+	key := randBytes(32)
+	plain := randBytes(3*plainSeg + 100)
+	ct := sealStream(t, key, nil, plain, encryption.SuiteXChaCha20Poly1305)
+
+	src := &countingReaderAt{r: bytes.NewReader(ct)}
+	ra, err := encryption.NewStreamReaderAt(src, int64(len(ct)), key, nil)
+	if err != nil {
+		t.Fatalf("NewStreamReaderAt error: %v", err)
+	}
+	headerReads := src.reads
+	var got bytes.Buffer
+	if _, err := io.CopyBuffer(&got, io.NewSectionReader(ra, 0, ra.Size()), make([]byte, 4096)); err != nil {
+		t.Fatalf("copy error: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), plain) {
+		t.Fatal("sequential read mismatch")
+	}
+	if reads := src.reads - headerReads; reads != 4 {
+		t.Errorf("fetched %d segments; want 4", reads)
+	}
+}
+
+func TestSuiteStream_RefusesOtherSuites(t *testing.T) {
+	key, aad, plain := randBytes(32), []byte("fileID"), randBytes(plainSeg+100)
+	var buf bytes.Buffer
+	w, err := encryption.NewSuiteStreamWriter(&buf, key, encryption.SuiteXChaCha20Poly1305, aad)
+	if err != nil {
+		t.Fatalf("NewSuiteStreamWriter error: %v", err)
+	}
+	w.Write(plain)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	ct := buf.Bytes()
+
+	r, err := encryption.NewSuiteStreamReader(bytes.NewReader(ct), key, encryption.SuiteXChaCha20Poly1305, aad)
+	if err != nil {
+		t.Fatalf("NewSuiteStreamReader error: %v", err)
+	}
+	if got, err := io.ReadAll(r); err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("ReadAll = %d bytes, %v", len(got), err)
+	}
+	ra, err := encryption.NewSuiteStreamReaderAt(bytes.NewReader(ct), int64(len(ct)), key, encryption.SuiteXChaCha20Poly1305, aad)
+	if err != nil || ra.Size() != int64(len(plain)) {
+		t.Fatalf("NewSuiteStreamReaderAt = %v, %v", ra, err)
+	}
+
+	if _, err := encryption.NewSuiteStreamReader(bytes.NewReader(ct), key, encryption.SuiteAESGCM, aad); !errors.Is(err, encryption.ErrStreamCorrupt) {
+		t.Errorf("open as another suite: got %v, want ErrStreamCorrupt", err)
+	}
+	if r, err := encryption.NewStreamReader(bytes.NewReader(ct), key, aad); err == nil {
+		if _, err := io.ReadAll(r); !errors.Is(err, encryption.ErrStreamCorrupt) {
+			t.Errorf("open under the raw key: got %v, want ErrStreamCorrupt", err)
+		}
+	}
+}
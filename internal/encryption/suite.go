@@ -0,0 +1,62 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Suite identifies an AEAD construction. Services built with NewWithSuite
+// write it as a one-byte header on every blob, so blobs sealed under different
+// suites can coexist and be opened with the same key. NewForSuite Services
+// write the same header but open only their own suite.
+type Suite byte
+
+const (
+	SuiteAESGCM            Suite = 1 // AES-256-GCM, 12-byte nonce
+	SuiteAESGCMSIV         Suite = 2 // AES-256-GCM-SIV (RFC 8452), nonce-misuse resistant
+	SuiteXChaCha20Poly1305 Suite = 3 // XChaCha20-Poly1305, 24-byte random-safe nonce
+)
+
+var suiteNames = map[Suite]string{
+	SuiteAESGCM:            "aes-gcm",
+	SuiteAESGCMSIV:         "aes-gcm-siv",
+	SuiteXChaCha20Poly1305: "xchacha20-poly1305",
+}
+
+// ParseSuite maps a config name such as "aes-gcm-siv" to its Suite.
+func ParseSuite(name string) (Suite, error) {
+	for s, n := range suiteNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cipher suite %q", name)
+}
+
+func (s Suite) String() string {
+	if n, ok := suiteNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("suite(%d)", byte(s))
+}
+
+// newAEAD builds the suite's AEAD from a 32-byte key.
+func (s Suite) newAEAD(key []byte) (cipher.AEAD, error) {
+	switch s {
+	case SuiteAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	case SuiteAESGCMSIV:
+		return newGCMSIV(key)
+	case SuiteXChaCha20Poly1305:
+		return chacha20poly1305.NewX(key)
+	default:
+		return nil, fmt.Errorf("unknown cipher suite %d", byte(s))
+	}
+}
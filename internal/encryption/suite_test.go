@@ -0,0 +1,167 @@
+package encryption_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+)
+
+var allSuites = []encryption.Suite{
+	encryption.SuiteAESGCM,
+	encryption.SuiteAESGCMSIV,
+	encryption.SuiteXChaCha20Poly1305,
+}
+
+func TestSuite_RoundTrip(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	plain := []byte("the quick brown fox")
+	aad := encryption.AssociatedData(encryption.SchemeVersion, encryption.RoleShared, []byte("fea"))
+	for _, suite := range allSuites {
+		svc, err := encryption.NewWithSuite(key, suite)
+		if err != nil {
+			t.Fatalf("NewWithSuite(%s) error: %v", suite, err)
+		}
+		for _, common := range []bool{true, false} {
+			ct, err := svc.EncryptAAD(plain, common, aad)
+			if err != nil {
+				t.Fatalf("%s EncryptAAD(common=%v) error: %v", suite, common, err)
+			}
+			if encryption.Suite(ct[0]) != suite {
+				t.Errorf("%s: header = %d; want %d", suite, ct[0], suite)
+			}
+			pt, err := svc.DecryptAAD(ct, aad)
+			if err != nil {
+				t.Fatalf("%s DecryptAAD(common=%v) error: %v", suite, common, err)
+			}
+			if !bytes.Equal(pt, plain) {
+				t.Errorf("%s DecryptAAD(common=%v) = %q; want %q", suite, common, pt, plain)
+			}
+		}
+	}
+}
+
+func TestSuite_Deterministic(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	data := []byte("repeatable data")
+	for _, suite := range allSuites {
+		svc, _ := encryption.NewWithSuite(key, suite)
+		c1, _ := svc.Encrypt(data, true)
+		c2, _ := svc.Encrypt(data, true)
+		if !bytes.Equal(c1, c2) {
+			t.Errorf("%s: expected deterministic encryption for common chunks", suite)
+		}
+		u1, _ := svc.Encrypt(data, false)
+		u2, _ := svc.Encrypt(data, false)
+		if bytes.Equal(u1, u2) {
+			t.Errorf("%s: expected nondeterministic encryption for unique chunks", suite)
+		}
+	}
+}
+
+func TestSuite_MixedSuitesCoexist(t *testing.T) {
+	// A Service opens blobs sealed under any suite, as long as the key matches.
+	key := bytes.Repeat([]byte{9}, 32)
+	data := []byte("mixed")
+	reader, _ := encryption.NewWithSuite(key, encryption.SuiteXChaCha20Poly1305)
+	for _, suite := range allSuites {
+		writer, _ := encryption.NewWithSuite(key, suite)
+		ct, err := writer.Encrypt(data, false)
+		if err != nil {
+			t.Fatalf("%s Encrypt error: %v", suite, err)
+		}
+		pt, err := reader.Decrypt(ct)
+		if err != nil {
+			t.Fatalf("open %s blob: %v", suite, err)
+		}
+		if !bytes.Equal(pt, data) {
+			t.Errorf("open %s blob = %q; want %q", suite, pt, data)
+		}
+	}
+}
+
+func TestSuite_TamperedHeader(t *testing.T) {
+	key := bytes.Repeat([]byte{9}, 32)
+	svc, _ := encryption.NewWithSuite(key, encryption.SuiteAESGCMSIV)
+	ct, _ := svc.Encrypt([]byte("data"), true)
+	ct[0] = byte(encryption.SuiteAESGCM)
+	if _, err := svc.Decrypt(ct); err == nil {
+		t.Error("expected Decrypt to fail after header tampering")
+	}
+	ct[0] = 0xff
+	if _, err := svc.Decrypt(ct); err == nil {
+		t.Error("expected Decrypt to fail for unknown suite")
+	}
+}
+
+func TestForSuite_OpensOnlyItsSuite(t *testing.T) {
+	key := bytes.Repeat([]byte{9}, 32)
+	aad := []byte("fileID")
+	for _, suite := range allSuites {
+		svc, err := encryption.NewForSuite(key, suite)
+		if err != nil {
+			t.Fatalf("NewForSuite(%s) error: %v", suite, err)
+		}
+		for _, common := range []bool{true, false} {
+			ct, err := svc.EncryptAAD([]byte("data"), common, aad)
+			if err != nil {
+				t.Fatalf("%s EncryptAAD error: %v", suite, err)
+			}
+			if pt, err := svc.DecryptAAD(ct, aad); err != nil || string(pt) != "data" {
+				t.Fatalf("%s DecryptAAD = %q, %v", suite, pt, err)
+			}
+			// Neither the raw key nor a Service for another suite opens it,
+			// with or without the header rewritten to match.
+			raw, _ := encryption.NewWithSuite(key, suite)
+			if _, err := raw.DecryptAAD(ct, aad); err == nil {
+				t.Errorf("%s: blob opened under the raw key", suite)
+			}
+			for _, other := range allSuites {
+				if other == suite {
+					continue
+				}
+				o, _ := encryption.NewForSuite(key, other)
+				if _, err := o.DecryptAAD(ct, aad); err == nil {
+					t.Errorf("%s blob opened as %s", suite, other)
+				}
+				swapped := append([]byte{byte(other)}, ct[1:]...)
+				if _, err := o.DecryptAAD(swapped, aad); err == nil {
+					t.Errorf("%s blob opened as %s after rewriting its header", suite, other)
+				}
+				if _, err := svc.DecryptAAD(swapped, aad); err == nil {
+					t.Errorf("%s Service opened a blob whose header names %s", suite, other)
+				}
+			}
+		}
+	}
+}
+
+func TestSuiteKey_DiffersPerSuite(t *testing.T) {
+	key := bytes.Repeat([]byte{9}, 32)
+	seen := map[string]encryption.Suite{}
+	for _, suite := range allSuites {
+		k, err := encryption.SuiteKey(key, suite)
+		if err != nil || len(k) != 32 {
+			t.Fatalf("SuiteKey(%s) = %x, %v", suite, k, err)
+		}
+		if bytes.Equal(k, key) {
+			t.Errorf("SuiteKey(%s) is the raw key", suite)
+		}
+		if prev, ok := seen[string(k)]; ok {
+			t.Errorf("SuiteKey(%s) equals SuiteKey(%s)", suite, prev)
+		}
+		seen[string(k)] = suite
+	}
+}
+
+func TestParseSuite(t *testing.T) {
+	for _, suite := range allSuites {
+		got, err := encryption.ParseSuite(suite.String())
+		if err != nil || got != suite {
+			t.Errorf("ParseSuite(%q) = %v, %v; want %v", suite.String(), got, err, suite)
+		}
+	}
+	if _, err := encryption.ParseSuite("rot13"); err == nil {
+		t.Error("expected error for unknown suite name")
+	}
+}
@@ -2,32 +2,60 @@ package extractor
 
 import (
 	"crypto/sha256"
+	"encoding/hex"
 	"io"
-
-	"github.com/bits-and-blooms/bloom/v3"
+	"sync"
 )
 
-// this is one piece of data with its had and common flag
+// this is one piece of data with its hash and common flag
 type ExtractedChunk struct {
 	Data     []byte
-	Hash     string
+	Hash     string // hex-encoded SHA-256 of Data
 	IsCommon bool
 }
 
 type Extractor struct {
-	filter    *bloom.BloomFilter
+	mu        sync.Mutex
+	filter    *Filter
 	chunkSize int
+	dirty     bool // changed since the last Save
 }
 
-// New creates an Extractor with a Bloom filter sized for capacity items
-// at the given false‐positive rate, using chunkSize bytes per block.
+// New creates an Extractor with a scalable Bloom filter whose first layer
+// holds capacity items at the given false‐positive rate, using chunkSize
+// bytes per block.
 func New(capacity uint, fpRate float64, chunkSize int) *Extractor {
 	return &Extractor{
-		filter:    bloom.NewWithEstimates(capacity, fpRate),
+		filter:    NewFilter(capacity, fpRate),
 		chunkSize: chunkSize,
 	}
 }
 
+// ChunkSize returns the block size Extract splits input into.
+func (e *Extractor) ChunkSize() int {
+	return e.chunkSize
+}
+
+// Remove forgets one occurrence of a chunk whose Hash is hash, e.g. when the
+// last file referencing it is deleted.
+func (e *Extractor) Remove(hash string) bool {
+	sum, err := hex.DecodeString(hash)
+	if err != nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.dirty = true
+	return e.filter.Remove(sum)
+}
+
+// Stats returns the statistics of the extractor's filter.
+func (e *Extractor) Stats() FilterStats {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.filter.Stats()
+}
+
 func (e *Extractor) Extract(r io.Reader) ([]ExtractedChunk, error) {
 	var chunks []ExtractedChunk
 	buf := make([]byte, e.chunkSize)
@@ -46,15 +74,17 @@ func (e *Extractor) Extract(r io.Reader) ([]ExtractedChunk, error) {
 		copy(data, buf[:n])
 
 		sum := sha256.Sum256(data)
+		e.mu.Lock()
 		isCommon := e.filter.Test(sum[:])
-
 		if !isCommon {
 			e.filter.Add(sum[:])
+			e.dirty = true
 		}
+		e.mu.Unlock()
 
 		chunks = append(chunks, ExtractedChunk{
 			Data:     data,
-			Hash:     string(sum[:]),
+			Hash:     hex.EncodeToString(sum[:]),
 			IsCommon: isCommon,
 		})
 
@@ -0,0 +1,252 @@
+package extractor
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Filter is a scalable counting Bloom filter (Almeida et al., "Scalable Bloom
+// Filters"). Items go into the newest layer; when it reaches its capacity a
+// new layer is stacked on top, twice as large and with half the false-positive
+// rate, so the compound rate stays below the configured one however many items
+// arrive. Each slot is a 4-bit counter rather than a bit, so items can be
+// removed again.
+//
+// A Filter is not safe for concurrent use.
+type Filter struct {
+	fpRate float64
+	layers []*layer
+}
+
+const (
+	growth     = 2   // capacity factor between consecutive layers
+	tightening = 0.5 // false-positive factor between consecutive layers
+	maxCounter = 15  // counters saturate here and are never decremented again
+)
+
+// layer is one fixed-size counting Bloom filter.
+type layer struct {
+	capacity uint64 // items before the next layer is stacked
+	count    uint64 // items currently held
+	k        uint32 // hash functions
+	m        uint64 // counters
+	counters []byte // two 4-bit counters per byte
+}
+
+// NewFilter returns a Filter whose first layer holds capacity items and whose
+// overall false-positive rate stays below fpRate.
+func NewFilter(capacity uint, fpRate float64) *Filter {
+	if capacity == 0 {
+		capacity = 1
+	}
+	f := &Filter{fpRate: fpRate}
+	f.layers = []*layer{newLayer(uint64(capacity), fpRate*(1-tightening))}
+	return f
+}
+
+func newLayer(capacity uint64, fpRate float64) *layer {
+	m := uint64(math.Ceil(-float64(capacity) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Ceil(float64(m) / float64(capacity) * math.Ln2))
+	return &layer{
+		capacity: capacity,
+		k:        max(k, 1),
+		m:        max(m, 1),
+		counters: make([]byte, (max(m, 1)+1)/2),
+	}
+}
+
+// locations returns the base hashes for double hashing. They only depend on
+// the item, so a reloaded filter finds the same slots.
+func locations(item []byte) (h1, h2 uint64) {
+	sum := sha256.Sum256(item)
+	return binary.BigEndian.Uint64(sum[0:8]), binary.BigEndian.Uint64(sum[8:16]) | 1
+}
+
+func (l *layer) get(i uint64) byte {
+	if i%2 == 0 {
+		return l.counters[i/2] & 0x0f
+	}
+	return l.counters[i/2] >> 4
+}
+
+func (l *layer) set(i uint64, v byte) {
+	if i%2 == 0 {
+		l.counters[i/2] = l.counters[i/2]&0xf0 | v
+	} else {
+		l.counters[i/2] = l.counters[i/2]&0x0f | v<<4
+	}
+}
+
+func (l *layer) test(h1, h2 uint64) bool {
+	for i := uint64(0); i < uint64(l.k); i++ {
+		if l.get((h1+i*h2)%l.m) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *layer) add(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(l.k); i++ {
+		j := (h1 + i*h2) % l.m
+		if c := l.get(j); c < maxCounter {
+			l.set(j, c+1)
+		}
+	}
+	l.count++
+}
+
+func (l *layer) remove(h1, h2 uint64) {
+	for i := uint64(0); i < uint64(l.k); i++ {
+		j := (h1 + i*h2) % l.m
+		if c := l.get(j); c > 0 && c < maxCounter {
+			l.set(j, c-1)
+		}
+	}
+	if l.count > 0 {
+		l.count--
+	}
+}
+
+// estimatedFP is the layer's false-positive probability at its current fill.
+func (l *layer) estimatedFP() float64 {
+	return math.Pow(1-math.Exp(-float64(l.k)*float64(l.count)/float64(l.m)), float64(l.k))
+}
+
+// Test reports whether item may have been added.
+func (f *Filter) Test(item []byte) bool {
+	h1, h2 := locations(item)
+	for _, l := range f.layers {
+		if l.test(h1, h2) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add inserts item, stacking a new layer first if the newest one is full.
+func (f *Filter) Add(item []byte) {
+	top := f.layers[len(f.layers)-1]
+	if top.count >= top.capacity {
+		fp := f.fpRate * (1 - tightening) * math.Pow(tightening, float64(len(f.layers)))
+		top = newLayer(top.capacity*growth, fp)
+		f.layers = append(f.layers, top)
+	}
+	top.add(locations(item))
+}
+
+// Remove deletes one earlier Add of item from the newest layer that holds it,
+// and reports whether any did. Removing an item that was never added may
+// remove a different one that shares its slots.
+func (f *Filter) Remove(item []byte) bool {
+	h1, h2 := locations(item)
+	for i := len(f.layers) - 1; i >= 0; i-- {
+		if f.layers[i].test(h1, h2) {
+			f.layers[i].remove(h1, h2)
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStats describes a Filter's size and fill.
+type FilterStats struct {
+	Layers          int     `json:"layers"`
+	Items           uint64  `json:"items"`
+	Capacity        uint64  `json:"capacity"`
+	Counters        uint64  `json:"counters"`
+	Bytes           uint64  `json:"bytes"`
+	TargetFPRate    float64 `json:"targetFPRate"`
+	EstimatedFPRate float64 `json:"estimatedFPRate"`
+}
+
+// Stats returns the filter's current statistics.
+func (f *Filter) Stats() FilterStats {
+	st := FilterStats{Layers: len(f.layers), TargetFPRate: f.fpRate}
+	pass := 1.0
+	for _, l := range f.layers {
+		st.Items += l.count
+		st.Capacity += l.capacity
+		st.Counters += l.m
+		st.Bytes += uint64(len(l.counters))
+		pass *= 1 - l.estimatedFP()
+	}
+	st.EstimatedFPRate = 1 - pass
+	return st
+}
+
+var filterMagic = [4]byte{'D', 'S', 'B', 'F'}
+
+const filterFormat = 1
+
+type filterHeader struct {
+	Magic  [4]byte
+	Format uint16
+	FPRate float64
+	Layers uint32
+}
+
+type layerHeader struct {
+	Capacity, Count uint64
+	K               uint32
+	M               uint64
+}
+
+// MarshalBinary encodes the filter for persistence.
+func (f *Filter) MarshalBinary() ([]byte, error) {
+	var buf bytes.Buffer
+	h := filterHeader{filterMagic, filterFormat, f.fpRate, uint32(len(f.layers))}
+	if err := binary.Write(&buf, binary.BigEndian, h); err != nil {
+		return nil, err
+	}
+	for _, l := range f.layers {
+		lh := layerHeader{l.capacity, l.count, l.k, l.m}
+		if err := binary.Write(&buf, binary.BigEndian, lh); err != nil {
+			return nil, err
+		}
+		buf.Write(l.counters)
+	}
+	return buf.Bytes(), nil
+}
+
+// UnmarshalBinary replaces the filter with one encoded by MarshalBinary.
+func (f *Filter) UnmarshalBinary(data []byte) error {
+	r := bytes.NewReader(data)
+	var h filterHeader
+	if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		return fmt.Errorf("bloom filter header: %w", err)
+	}
+	if h.Magic != filterMagic {
+		return errors.New("not a bloom filter")
+	}
+	if h.Format != filterFormat {
+		return fmt.Errorf("unsupported bloom filter format %d", h.Format)
+	}
+	if h.Layers == 0 {
+		return errors.New("bloom filter has no layers")
+	}
+	layers := make([]*layer, 0, h.Layers)
+	for i := uint32(0); i < h.Layers; i++ {
+		var lh layerHeader
+		if err := binary.Read(r, binary.BigEndian, &lh); err != nil {
+			return fmt.Errorf("bloom filter layer %d: %w", i, err)
+		}
+		if lh.K == 0 || lh.M == 0 || (lh.M+1)/2 > uint64(r.Len()) {
+			return fmt.Errorf("bloom filter layer %d is corrupt", i)
+		}
+		l := &layer{capacity: lh.Capacity, count: lh.Count, k: lh.K, m: lh.M, counters: make([]byte, (lh.M+1)/2)}
+		if _, err := r.Read(l.counters); err != nil {
+			return fmt.Errorf("bloom filter layer %d: %w", i, err)
+		}
+		layers = append(layers, l)
+	}
+	if r.Len() != 0 {
+		return errors.New("trailing data after bloom filter")
+	}
+	f.fpRate, f.layers = h.FPRate, layers
+	return nil
+}
@@ -0,0 +1,151 @@
+package extractor_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/extractor"
+)
+
+func item(i int) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(i))
+	sum := sha256.Sum256(b[:])
+	return sum[:]
+}
+
+func TestFilter_ScalesPastCapacity(t *testing.T) {
+	f := extractor.NewFilter(100, 0.01)
+	for i := 0; i < 5000; i++ {
+		f.Add(item(i))
+	}
+	for i := 0; i < 5000; i++ {
+		if !f.Test(item(i)) {
+			t.Fatalf("item %d: false negative", i)
+		}
+	}
+	st := f.Stats()
+	if st.Layers < 2 {
+		t.Errorf("expected the filter to stack layers, got %d", st.Layers)
+	}
+	if st.Items != 5000 {
+		t.Errorf("expected 5000 items, got %d", st.Items)
+	}
+
+	fp := 0
+	for i := 5000; i < 25000; i++ {
+		if f.Test(item(i)) {
+			fp++
+		}
+	}
+	if rate := float64(fp) / 20000; rate > 0.02 {
+		t.Errorf("false-positive rate %.4f well above the 0.01 target", rate)
+	}
+}
+
+func TestFilter_Remove(t *testing.T) {
+	f := extractor.NewFilter(100, 0.01)
+	f.Add(item(1))
+	f.Add(item(2))
+	if !f.Remove(item(1)) {
+		t.Fatal("Remove reported item 1 absent")
+	}
+	if f.Test(item(1)) {
+		t.Error("item 1 still present after Remove")
+	}
+	if !f.Test(item(2)) {
+		t.Error("Remove of item 1 lost item 2")
+	}
+	if got := f.Stats().Items; got != 1 {
+		t.Errorf("expected 1 item, got %d", got)
+	}
+}
+
+func TestFilter_MarshalRoundTrip(t *testing.T) {
+	f := extractor.NewFilter(50, 0.01)
+	for i := 0; i < 300; i++ {
+		f.Add(item(i))
+	}
+	data, err := f.MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary: %v", err)
+	}
+	var g extractor.Filter
+	if err := g.UnmarshalBinary(data); err != nil {
+		t.Fatalf("UnmarshalBinary: %v", err)
+	}
+	if f.Stats() != g.Stats() {
+		t.Errorf("stats differ after round trip: %+v vs %+v", f.Stats(), g.Stats())
+	}
+	for i := 0; i < 300; i++ {
+		if !g.Test(item(i)) {
+			t.Fatalf("item %d lost in round trip", i)
+		}
+	}
+
+	if err := g.UnmarshalBinary(data[:len(data)-1]); err == nil {
+		t.Error("expected an error for a truncated filter")
+	}
+}
+
+var errNotFound = errors.New("not found")
+
+type memStore map[string][]byte
+
+func (m memStore) PutObject(_ context.Context, key string, body io.Reader) error {
+	b, err := io.ReadAll(body)
+	m[key] = b
+	return err
+}
+
+func (m memStore) GetObject(_ context.Context, key string) (io.ReadCloser, error) {
+	b, ok := m[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func TestExtractor_SaveLoad(t *testing.T) {
+	ctx := context.Background()
+	store := memStore{}
+	data := []byte("abcdefghi")
+
+	ext := extractor.New(10, 0.01, 3)
+	if err := ext.Load(ctx, store); !errors.Is(err, errNotFound) {
+		t.Fatalf("expected not-found on first load, got %v", err)
+	}
+	if _, err := ext.Extract(bytes.NewReader(data)); err != nil {
+		t.Fatalf("Extract error: %v", err)
+	}
+	if err := ext.Save(ctx, store); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	restarted := extractor.New(10, 0.01, 3)
+	if err := restarted.Load(ctx, store); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	chunks, err := restarted.Extract(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("Extract error: %v", err)
+	}
+	for i, c := range chunks {
+		if !c.IsCommon {
+			t.Errorf("chunk %d: expected common after reload", i)
+		}
+	}
+
+	if !restarted.Remove(chunks[0].Hash) {
+		t.Fatal("Remove reported chunk 0 absent")
+	}
+	chunks, _ = restarted.Extract(bytes.NewReader(data[:3]))
+	if chunks[0].IsCommon {
+		t.Error("removed chunk still reported common")
+	}
+}
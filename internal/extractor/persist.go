@@ -0,0 +1,89 @@
+package extractor
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Store is the blob store the filter is persisted to.
+type Store interface {
+	PutObject(ctx context.Context, key string, body io.Reader) error
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// FilterKey is the object key the filter is persisted under.
+const FilterKey = "meta/extractor-bloom"
+
+// Save writes the filter to store if it changed since it was last saved or
+// loaded.
+func (e *Extractor) Save(ctx context.Context, store Store) error {
+	e.mu.Lock()
+	if !e.dirty {
+		e.mu.Unlock()
+		return nil
+	}
+	data, err := e.filter.MarshalBinary()
+	e.dirty = false
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err = store.PutObject(ctx, FilterKey, bytes.NewReader(data)); err != nil {
+		e.mu.Lock()
+		e.dirty = true
+		e.mu.Unlock()
+		return fmt.Errorf("PutObject(%s): %w", FilterKey, err)
+	}
+	return nil
+}
+
+// Load replaces the filter with the one persisted in store. The store's
+// not-found error is returned as is when nothing was saved yet.
+func (e *Extractor) Load(ctx context.Context, store Store) error {
+	rc, err := store.GetObject(ctx, FilterKey)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return fmt.Errorf("GetObject(%s): %w", FilterKey, err)
+	}
+	f := &Filter{}
+	if err = f.UnmarshalBinary(data); err != nil {
+		return err
+	}
+	e.mu.Lock()
+	e.filter, e.dirty = f, false
+	e.mu.Unlock()
+	return nil
+}
+
+// Persist saves the filter every interval until ctx is done, then saves it a
+// final time.
+func (e *Extractor) Persist(ctx context.Context, store Store, interval time.Duration) {
+	log := zap.L().Named("extractor")
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := e.Save(ctx, store); err != nil {
+				log.Warn("save bloom filter", zap.Error(err))
+			}
+		case <-ctx.Done():
+			// ctx is already cancelled, so the last save gets a fresh one.
+			sctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			if err := e.Save(sctx, store); err != nil {
+				log.Error("save bloom filter on shutdown", zap.Error(err))
+			}
+			cancel()
+			return
+		}
+	}
+}
@@ -0,0 +1,875 @@
+// gRPC API of the DSDE file service. Calls act for the owner named in the
+// x-owner-id metadata key, as the HTTP API's X-Owner-ID header does.
+//
+// Regenerate with protoc-gen-go and protoc-gen-go-grpc:
+//
+//	protoc --go_out=. --go_opt=paths=source_relative \
+//	  --go-grpc_out=. --go-grpc_opt=paths=source_relative \
+//	  internal/grpcapi/dsdepb/dsde.proto
+
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.6
+// 	protoc        v5.29.3
+// source: internal/grpcapi/dsdepb/dsde.proto
+
+package dsdepb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+type UploadHeader struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	Path  string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	// "dsde" or "chunks"; empty uses the server's default.
+	StorageMode string `protobuf:"bytes,2,opt,name=storage_mode,json=storageMode,proto3" json:"storage_mode,omitempty"`
+	// "none", "gzip" or "zstd"; empty uses the server's default.
+	Codec         string `protobuf:"bytes,3,opt,name=codec,proto3" json:"codec,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadHeader) Reset() {
+	*x = UploadHeader{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadHeader) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadHeader) ProtoMessage() {}
+
+func (x *UploadHeader) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadHeader.ProtoReflect.Descriptor instead.
+func (*UploadHeader) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *UploadHeader) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *UploadHeader) GetStorageMode() string {
+	if x != nil {
+		return x.StorageMode
+	}
+	return ""
+}
+
+func (x *UploadHeader) GetCodec() string {
+	if x != nil {
+		return x.Codec
+	}
+	return ""
+}
+
+type UploadRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Msg:
+	//
+	//	*UploadRequest_Header
+	//	*UploadRequest_Data
+	Msg           isUploadRequest_Msg `protobuf_oneof:"msg"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadRequest) Reset() {
+	*x = UploadRequest{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[1]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadRequest) ProtoMessage() {}
+
+func (x *UploadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[1]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadRequest.ProtoReflect.Descriptor instead.
+func (*UploadRequest) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{1}
+}
+
+func (x *UploadRequest) GetMsg() isUploadRequest_Msg {
+	if x != nil {
+		return x.Msg
+	}
+	return nil
+}
+
+func (x *UploadRequest) GetHeader() *UploadHeader {
+	if x != nil {
+		if x, ok := x.Msg.(*UploadRequest_Header); ok {
+			return x.Header
+		}
+	}
+	return nil
+}
+
+func (x *UploadRequest) GetData() []byte {
+	if x != nil {
+		if x, ok := x.Msg.(*UploadRequest_Data); ok {
+			return x.Data
+		}
+	}
+	return nil
+}
+
+type isUploadRequest_Msg interface {
+	isUploadRequest_Msg()
+}
+
+type UploadRequest_Header struct {
+	Header *UploadHeader `protobuf:"bytes,1,opt,name=header,proto3,oneof"`
+}
+
+type UploadRequest_Data struct {
+	Data []byte `protobuf:"bytes,2,opt,name=data,proto3,oneof"`
+}
+
+func (*UploadRequest_Header) isUploadRequest_Msg() {}
+
+func (*UploadRequest_Data) isUploadRequest_Msg() {}
+
+type UploadResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	FileId        string                 `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	FeaHash       []byte                 `protobuf:"bytes,2,opt,name=fea_hash,json=feaHash,proto3" json:"fea_hash,omitempty"`
+	DekShared     []byte                 `protobuf:"bytes,3,opt,name=dek_shared,json=dekShared,proto3" json:"dek_shared,omitempty"`
+	DekUser       []byte                 `protobuf:"bytes,4,opt,name=dek_user,json=dekUser,proto3" json:"dek_user,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *UploadResponse) Reset() {
+	*x = UploadResponse{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[2]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *UploadResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*UploadResponse) ProtoMessage() {}
+
+func (x *UploadResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[2]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use UploadResponse.ProtoReflect.Descriptor instead.
+func (*UploadResponse) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{2}
+}
+
+func (x *UploadResponse) GetFileId() string {
+	if x != nil {
+		return x.FileId
+	}
+	return ""
+}
+
+func (x *UploadResponse) GetFeaHash() []byte {
+	if x != nil {
+		return x.FeaHash
+	}
+	return nil
+}
+
+func (x *UploadResponse) GetDekShared() []byte {
+	if x != nil {
+		return x.DekShared
+	}
+	return nil
+}
+
+func (x *UploadResponse) GetDekUser() []byte {
+	if x != nil {
+		return x.DekUser
+	}
+	return nil
+}
+
+type DownloadRequest struct {
+	state protoimpl.MessageState `protogen:"open.v1"`
+	// Types that are valid to be assigned to Target:
+	//
+	//	*DownloadRequest_FileId
+	//	*DownloadRequest_Path
+	Target isDownloadRequest_Target `protobuf_oneof:"target"`
+	// Version of path to fetch; 0 is the newest.
+	Version       int32 `protobuf:"varint,3,opt,name=version,proto3" json:"version,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownloadRequest) Reset() {
+	*x = DownloadRequest{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[3]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownloadRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownloadRequest) ProtoMessage() {}
+
+func (x *DownloadRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[3]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownloadRequest.ProtoReflect.Descriptor instead.
+func (*DownloadRequest) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{3}
+}
+
+func (x *DownloadRequest) GetTarget() isDownloadRequest_Target {
+	if x != nil {
+		return x.Target
+	}
+	return nil
+}
+
+func (x *DownloadRequest) GetFileId() string {
+	if x != nil {
+		if x, ok := x.Target.(*DownloadRequest_FileId); ok {
+			return x.FileId
+		}
+	}
+	return ""
+}
+
+func (x *DownloadRequest) GetPath() string {
+	if x != nil {
+		if x, ok := x.Target.(*DownloadRequest_Path); ok {
+			return x.Path
+		}
+	}
+	return ""
+}
+
+func (x *DownloadRequest) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+type isDownloadRequest_Target interface {
+	isDownloadRequest_Target()
+}
+
+type DownloadRequest_FileId struct {
+	FileId string `protobuf:"bytes,1,opt,name=file_id,json=fileId,proto3,oneof"`
+}
+
+type DownloadRequest_Path struct {
+	Path string `protobuf:"bytes,2,opt,name=path,proto3,oneof"`
+}
+
+func (*DownloadRequest_FileId) isDownloadRequest_Target() {}
+
+func (*DownloadRequest_Path) isDownloadRequest_Target() {}
+
+type DownloadResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Data          []byte                 `protobuf:"bytes,1,opt,name=data,proto3" json:"data,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DownloadResponse) Reset() {
+	*x = DownloadResponse{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[4]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DownloadResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DownloadResponse) ProtoMessage() {}
+
+func (x *DownloadResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[4]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DownloadResponse.ProtoReflect.Descriptor instead.
+func (*DownloadResponse) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{4}
+}
+
+func (x *DownloadResponse) GetData() []byte {
+	if x != nil {
+		return x.Data
+	}
+	return nil
+}
+
+type ListRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Path          string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Recursive     bool                   `protobuf:"varint,2,opt,name=recursive,proto3" json:"recursive,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListRequest) Reset() {
+	*x = ListRequest{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[5]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListRequest) ProtoMessage() {}
+
+func (x *ListRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[5]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListRequest.ProtoReflect.Descriptor instead.
+func (*ListRequest) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{5}
+}
+
+func (x *ListRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *ListRequest) GetRecursive() bool {
+	if x != nil {
+		return x.Recursive
+	}
+	return false
+}
+
+type Entry struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Path          string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	Folder        bool                   `protobuf:"varint,2,opt,name=folder,proto3" json:"folder,omitempty"`
+	FileId        string                 `protobuf:"bytes,3,opt,name=file_id,json=fileId,proto3" json:"file_id,omitempty"`
+	Version       int32                  `protobuf:"varint,4,opt,name=version,proto3" json:"version,omitempty"`
+	CreatedAtUnix int64                  `protobuf:"varint,5,opt,name=created_at_unix,json=createdAtUnix,proto3" json:"created_at_unix,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *Entry) Reset() {
+	*x = Entry{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[6]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *Entry) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*Entry) ProtoMessage() {}
+
+func (x *Entry) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[6]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use Entry.ProtoReflect.Descriptor instead.
+func (*Entry) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{6}
+}
+
+func (x *Entry) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+func (x *Entry) GetFolder() bool {
+	if x != nil {
+		return x.Folder
+	}
+	return false
+}
+
+func (x *Entry) GetFileId() string {
+	if x != nil {
+		return x.FileId
+	}
+	return ""
+}
+
+func (x *Entry) GetVersion() int32 {
+	if x != nil {
+		return x.Version
+	}
+	return 0
+}
+
+func (x *Entry) GetCreatedAtUnix() int64 {
+	if x != nil {
+		return x.CreatedAtUnix
+	}
+	return 0
+}
+
+type ListResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Entries       []*Entry               `protobuf:"bytes,1,rep,name=entries,proto3" json:"entries,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *ListResponse) Reset() {
+	*x = ListResponse{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[7]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *ListResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*ListResponse) ProtoMessage() {}
+
+func (x *ListResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[7]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use ListResponse.ProtoReflect.Descriptor instead.
+func (*ListResponse) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{7}
+}
+
+func (x *ListResponse) GetEntries() []*Entry {
+	if x != nil {
+		return x.Entries
+	}
+	return nil
+}
+
+type DeleteRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Path          string                 `protobuf:"bytes,1,opt,name=path,proto3" json:"path,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteRequest) Reset() {
+	*x = DeleteRequest{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[8]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteRequest) ProtoMessage() {}
+
+func (x *DeleteRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[8]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteRequest.ProtoReflect.Descriptor instead.
+func (*DeleteRequest) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{8}
+}
+
+func (x *DeleteRequest) GetPath() string {
+	if x != nil {
+		return x.Path
+	}
+	return ""
+}
+
+type DeleteResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *DeleteResponse) Reset() {
+	*x = DeleteResponse{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[9]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *DeleteResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*DeleteResponse) ProtoMessage() {}
+
+func (x *DeleteResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[9]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use DeleteResponse.ProtoReflect.Descriptor instead.
+func (*DeleteResponse) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{9}
+}
+
+type StatsRequest struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatsRequest) Reset() {
+	*x = StatsRequest{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[10]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsRequest) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsRequest) ProtoMessage() {}
+
+func (x *StatsRequest) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[10]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsRequest.ProtoReflect.Descriptor instead.
+func (*StatsRequest) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{10}
+}
+
+type StatsResponse struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Files         int64                  `protobuf:"varint,1,opt,name=files,proto3" json:"files,omitempty"`
+	Owners        int64                  `protobuf:"varint,2,opt,name=owners,proto3" json:"owners,omitempty"`
+	Features      int64                  `protobuf:"varint,3,opt,name=features,proto3" json:"features,omitempty"`
+	Chunks        int64                  `protobuf:"varint,4,opt,name=chunks,proto3" json:"chunks,omitempty"`
+	CommonChunks  int64                  `protobuf:"varint,5,opt,name=common_chunks,json=commonChunks,proto3" json:"common_chunks,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *StatsResponse) Reset() {
+	*x = StatsResponse{}
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[11]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *StatsResponse) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*StatsResponse) ProtoMessage() {}
+
+func (x *StatsResponse) ProtoReflect() protoreflect.Message {
+	mi := &file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[11]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use StatsResponse.ProtoReflect.Descriptor instead.
+func (*StatsResponse) Descriptor() ([]byte, []int) {
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP(), []int{11}
+}
+
+func (x *StatsResponse) GetFiles() int64 {
+	if x != nil {
+		return x.Files
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetOwners() int64 {
+	if x != nil {
+		return x.Owners
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetFeatures() int64 {
+	if x != nil {
+		return x.Features
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetChunks() int64 {
+	if x != nil {
+		return x.Chunks
+	}
+	return 0
+}
+
+func (x *StatsResponse) GetCommonChunks() int64 {
+	if x != nil {
+		return x.CommonChunks
+	}
+	return 0
+}
+
+var File_internal_grpcapi_dsdepb_dsde_proto protoreflect.FileDescriptor
+
+const file_internal_grpcapi_dsdepb_dsde_proto_rawDesc = "" +
+	"\n" +
+	"\"internal/grpcapi/dsdepb/dsde.proto\x12\adsde.v1\"[\n" +
+	"\fUploadHeader\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12!\n" +
+	"\fstorage_mode\x18\x02 \x01(\tR\vstorageMode\x12\x14\n" +
+	"\x05codec\x18\x03 \x01(\tR\x05codec\"]\n" +
+	"\rUploadRequest\x12/\n" +
+	"\x06header\x18\x01 \x01(\v2\x15.dsde.v1.UploadHeaderH\x00R\x06header\x12\x14\n" +
+	"\x04data\x18\x02 \x01(\fH\x00R\x04dataB\x05\n" +
+	"\x03msg\"~\n" +
+	"\x0eUploadResponse\x12\x17\n" +
+	"\afile_id\x18\x01 \x01(\tR\x06fileId\x12\x19\n" +
+	"\bfea_hash\x18\x02 \x01(\fR\afeaHash\x12\x1d\n" +
+	"\n" +
+	"dek_shared\x18\x03 \x01(\fR\tdekShared\x12\x19\n" +
+	"\bdek_user\x18\x04 \x01(\fR\adekUser\"f\n" +
+	"\x0fDownloadRequest\x12\x19\n" +
+	"\afile_id\x18\x01 \x01(\tH\x00R\x06fileId\x12\x14\n" +
+	"\x04path\x18\x02 \x01(\tH\x00R\x04path\x12\x18\n" +
+	"\aversion\x18\x03 \x01(\x05R\aversionB\b\n" +
+	"\x06target\"&\n" +
+	"\x10DownloadResponse\x12\x12\n" +
+	"\x04data\x18\x01 \x01(\fR\x04data\"?\n" +
+	"\vListRequest\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x1c\n" +
+	"\trecursive\x18\x02 \x01(\bR\trecursive\"\x8e\x01\n" +
+	"\x05Entry\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\x12\x16\n" +
+	"\x06folder\x18\x02 \x01(\bR\x06folder\x12\x17\n" +
+	"\afile_id\x18\x03 \x01(\tR\x06fileId\x12\x18\n" +
+	"\aversion\x18\x04 \x01(\x05R\aversion\x12&\n" +
+	"\x0fcreated_at_unix\x18\x05 \x01(\x03R\rcreatedAtUnix\"8\n" +
+	"\fListResponse\x12(\n" +
+	"\aentries\x18\x01 \x03(\v2\x0e.dsde.v1.EntryR\aentries\"#\n" +
+	"\rDeleteRequest\x12\x12\n" +
+	"\x04path\x18\x01 \x01(\tR\x04path\"\x10\n" +
+	"\x0eDeleteResponse\"\x0e\n" +
+	"\fStatsRequest\"\x96\x01\n" +
+	"\rStatsResponse\x12\x14\n" +
+	"\x05files\x18\x01 \x01(\x03R\x05files\x12\x16\n" +
+	"\x06owners\x18\x02 \x01(\x03R\x06owners\x12\x1a\n" +
+	"\bfeatures\x18\x03 \x01(\x03R\bfeatures\x12\x16\n" +
+	"\x06chunks\x18\x04 \x01(\x03R\x06chunks\x12#\n" +
+	"\rcommon_chunks\x18\x05 \x01(\x03R\fcommonChunks2\xae\x02\n" +
+	"\x04DSDE\x12;\n" +
+	"\x06Upload\x12\x16.dsde.v1.UploadRequest\x1a\x17.dsde.v1.UploadResponse(\x01\x12A\n" +
+	"\bDownload\x12\x18.dsde.v1.DownloadRequest\x1a\x19.dsde.v1.DownloadResponse0\x01\x123\n" +
+	"\x04List\x12\x14.dsde.v1.ListRequest\x1a\x15.dsde.v1.ListResponse\x129\n" +
+	"\x06Delete\x12\x16.dsde.v1.DeleteRequest\x1a\x17.dsde.v1.DeleteResponse\x126\n" +
+	"\x05Stats\x12\x15.dsde.v1.StatsRequest\x1a\x16.dsde.v1.StatsResponseBDZBgithub.com/Anish-Chanda/double-layer-dedup/internal/grpcapi/dsdepbb\x06proto3"
+
+var (
+	file_internal_grpcapi_dsdepb_dsde_proto_rawDescOnce sync.Once
+	file_internal_grpcapi_dsdepb_dsde_proto_rawDescData []byte
+)
+
+func file_internal_grpcapi_dsdepb_dsde_proto_rawDescGZIP() []byte {
+	file_internal_grpcapi_dsdepb_dsde_proto_rawDescOnce.Do(func() {
+		file_internal_grpcapi_dsdepb_dsde_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_internal_grpcapi_dsdepb_dsde_proto_rawDesc), len(file_internal_grpcapi_dsdepb_dsde_proto_rawDesc)))
+	})
+	return file_internal_grpcapi_dsdepb_dsde_proto_rawDescData
+}
+
+var file_internal_grpcapi_dsdepb_dsde_proto_msgTypes = make([]protoimpl.MessageInfo, 12)
+var file_internal_grpcapi_dsdepb_dsde_proto_goTypes = []any{
+	(*UploadHeader)(nil),     // 0: dsde.v1.UploadHeader
+	(*UploadRequest)(nil),    // 1: dsde.v1.UploadRequest
+	(*UploadResponse)(nil),   // 2: dsde.v1.UploadResponse
+	(*DownloadRequest)(nil),  // 3: dsde.v1.DownloadRequest
+	(*DownloadResponse)(nil), // 4: dsde.v1.DownloadResponse
+	(*ListRequest)(nil),      // 5: dsde.v1.ListRequest
+	(*Entry)(nil),            // 6: dsde.v1.Entry
+	(*ListResponse)(nil),     // 7: dsde.v1.ListResponse
+	(*DeleteRequest)(nil),    // 8: dsde.v1.DeleteRequest
+	(*DeleteResponse)(nil),   // 9: dsde.v1.DeleteResponse
+	(*StatsRequest)(nil),     // 10: dsde.v1.StatsRequest
+	(*StatsResponse)(nil),    // 11: dsde.v1.StatsResponse
+}
+var file_internal_grpcapi_dsdepb_dsde_proto_depIdxs = []int32{
+	0,  // 0: dsde.v1.UploadRequest.header:type_name -> dsde.v1.UploadHeader
+	6,  // 1: dsde.v1.ListResponse.entries:type_name -> dsde.v1.Entry
+	1,  // 2: dsde.v1.DSDE.Upload:input_type -> dsde.v1.UploadRequest
+	3,  // 3: dsde.v1.DSDE.Download:input_type -> dsde.v1.DownloadRequest
+	5,  // 4: dsde.v1.DSDE.List:input_type -> dsde.v1.ListRequest
+	8,  // 5: dsde.v1.DSDE.Delete:input_type -> dsde.v1.DeleteRequest
+	10, // 6: dsde.v1.DSDE.Stats:input_type -> dsde.v1.StatsRequest
+	2,  // 7: dsde.v1.DSDE.Upload:output_type -> dsde.v1.UploadResponse
+	4,  // 8: dsde.v1.DSDE.Download:output_type -> dsde.v1.DownloadResponse
+	7,  // 9: dsde.v1.DSDE.List:output_type -> dsde.v1.ListResponse
+	9,  // 10: dsde.v1.DSDE.Delete:output_type -> dsde.v1.DeleteResponse
+	11, // 11: dsde.v1.DSDE.Stats:output_type -> dsde.v1.StatsResponse
+	7,  // [7:12] is the sub-list for method output_type
+	2,  // [2:7] is the sub-list for method input_type
+	2,  // [2:2] is the sub-list for extension type_name
+	2,  // [2:2] is the sub-list for extension extendee
+	0,  // [0:2] is the sub-list for field type_name
+}
+
+func init() { file_internal_grpcapi_dsdepb_dsde_proto_init() }
+func file_internal_grpcapi_dsdepb_dsde_proto_init() {
+	if File_internal_grpcapi_dsdepb_dsde_proto != nil {
+		return
+	}
+	file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[1].OneofWrappers = []any{
+		(*UploadRequest_Header)(nil),
+		(*UploadRequest_Data)(nil),
+	}
+	file_internal_grpcapi_dsdepb_dsde_proto_msgTypes[3].OneofWrappers = []any{
+		(*DownloadRequest_FileId)(nil),
+		(*DownloadRequest_Path)(nil),
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_internal_grpcapi_dsdepb_dsde_proto_rawDesc), len(file_internal_grpcapi_dsdepb_dsde_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   12,
+			NumExtensions: 0,
+			NumServices:   1,
+		},
+		GoTypes:           file_internal_grpcapi_dsdepb_dsde_proto_goTypes,
+		DependencyIndexes: file_internal_grpcapi_dsdepb_dsde_proto_depIdxs,
+		MessageInfos:      file_internal_grpcapi_dsdepb_dsde_proto_msgTypes,
+	}.Build()
+	File_internal_grpcapi_dsdepb_dsde_proto = out.File
+	file_internal_grpcapi_dsdepb_dsde_proto_goTypes = nil
+	file_internal_grpcapi_dsdepb_dsde_proto_depIdxs = nil
+}
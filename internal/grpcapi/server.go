@@ -0,0 +1,396 @@
+// Package grpcapi serves the DSDE file service over gRPC: streaming upload
+// and download, listing, deletion and dedup statistics. It shares the
+// service core with the HTTP API and names the owner the same way, in the
+// x-owner-id metadata key.
+package grpcapi
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi/dsdepb"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+// OwnerKey is the metadata key naming the owner a call acts for.
+const OwnerKey = "x-owner-id"
+
+// downloadChunk is the size of each streamed download message.
+const downloadChunk = 64 << 10
+
+// Files is the file service behind the API; *dsde.Service implements it.
+type Files interface {
+	FilePath(ctx context.Context, ownerID, p string) (string, error)
+	UploadWithCodec(ctx context.Context, ownerID, filename string, c codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error)
+	UploadChunks(ctx context.Context, ownerID, filename string, r io.Reader) (string, []byte, []byte, []byte, error)
+	ResolvePath(ctx context.Context, ownerID, path string, version int) (string, error)
+	Download(ctx context.Context, ownerID, fileID string) (io.ReadCloser, error)
+	List(ctx context.Context, ownerID, p string, recursive bool) ([]db.TreeEntry, error)
+	Remove(ctx context.Context, ownerID, p string) error
+	Stats(ctx context.Context) (db.Stats, error)
+}
+
+// Server implements dsdepb.DSDEServer.
+type Server struct {
+	dsdepb.UnimplementedDSDEServer
+
+	files     Files
+	codec     codec.Codec
+	mode      string // default storage mode: "dsde" or "chunks"
+	peerOwner func(*tls.ConnectionState) (string, bool)
+	limits    *ratelimit.Limiter         // nil: unlimited
+	operator  func(context.Context) bool // nil: no operator calls
+	maxUpload int64                      // 0: unlimited
+}
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithCodec compresses uploads that name no codec with c.
+func WithCodec(c codec.Codec) Option {
+	return func(s *Server) {
+		s.codec = c
+	}
+}
+
+// WithStorageMode stores uploads that name no storage mode in mode.
+func WithStorageMode(mode string) Option {
+	return func(s *Server) {
+		s.mode = mode
+	}
+}
+
+// WithPeerOwners names the owner of calls made with a verified client
+// certificate through owner; such calls may not claim anyone else in their
+// metadata.
+func WithPeerOwners(owner func(*tls.ConnectionState) (string, bool)) Option {
+	return func(s *Server) {
+		s.peerOwner = owner
+	}
+}
+
+// WithLimiter holds each owner's calls to l's request rates, byte rates and
+// concurrent upload cap.
+func WithLimiter(l *ratelimit.Limiter) Option {
+	return func(s *Server) {
+		s.limits = l
+	}
+}
+
+// WithMaxUploadSize refuses uploads of more than n bytes with
+// ResourceExhausted, as the HTTP API refuses larger bodies with 413.
+func WithMaxUploadSize(n int64) Option {
+	return func(s *Server) {
+		s.maxUpload = n
+	}
+}
+
+// WithOperator lets calls for which isOperator reports true use the operator
+// RPCs (Stats). Without it those are refused.
+func WithOperator(isOperator func(context.Context) bool) Option {
+	return func(s *Server) {
+		s.operator = isOperator
+	}
+}
+
+// New returns a Server over files.
+func New(files Files, opts ...Option) *Server {
+	s := &Server{files: files, codec: codec.None, mode: "dsde"}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Register adds the DSDE service to gs.
+func (s *Server) Register(gs *grpc.Server) {
+	dsdepb.RegisterDSDEServer(gs, s)
+}
+
+func (s *Server) owner(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var claimed string
+	if v := md.Get(OwnerKey); len(v) == 1 {
+		claimed = v[0]
+	}
+	if cs := verifiedPeer(ctx); cs != nil && s.peerOwner != nil {
+		owner, ok := s.peerOwner(cs)
+		if !ok {
+			return "", status.Error(codes.PermissionDenied, "client certificate maps to no owner")
+		}
+		if claimed != "" && claimed != owner {
+			return "", status.Error(codes.PermissionDenied, "client certificate belongs to another owner")
+		}
+		return owner, nil
+	}
+	if claimed != "" {
+		return claimed, nil
+	}
+	return "", status.Error(codes.Unauthenticated, "missing "+OwnerKey+" metadata")
+}
+
+// admit returns the owner of a call that is within the request limits.
+func (s *Server) admit(ctx context.Context) (string, error) {
+	owner, err := s.owner(ctx)
+	if err != nil {
+		return "", err
+	}
+	if err := s.limits.Allow(owner); err != nil {
+		return "", statusError(err)
+	}
+	return owner, nil
+}
+
+// peerAddr is the host a call came from, or "" if it is unknown.
+func peerAddr(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(p.Addr.String())
+	if err != nil {
+		return p.Addr.String()
+	}
+	return host
+}
+
+// verifiedPeer returns the TLS state of a call whose client certificate
+// was verified, or nil.
+func verifiedPeer(ctx context.Context) *tls.ConnectionState {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return nil
+	}
+	return &info.State
+}
+
+// statusError maps the file service's errors onto gRPC status codes.
+func statusError(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, dsde.ErrNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, dsde.ErrExists):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, dsde.ErrConflict):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, dsde.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, dsde.ErrInvalidArgument):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, dsde.ErrQuotaExceeded):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, dsde.ErrKeyUnavailable):
+		return status.Error(codes.Unavailable, "the key service could not provide the file's keys")
+	case errors.Is(err, dsde.ErrIntegrityFailure):
+		return status.Error(codes.DataLoss, "stored data failed its integrity check")
+	case errors.Is(err, keyserver.ErrRateLimited), errors.Is(err, ratelimit.ErrLimited):
+		return status.Error(codes.ResourceExhausted, err.Error())
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func (s *Server) Upload(stream grpc.ClientStreamingServer[dsdepb.UploadRequest, dsdepb.UploadResponse]) error {
+	ctx := keyserver.WithSource(stream.Context(), peerAddr(stream.Context()))
+	ownerID, err := s.admit(ctx)
+	if err != nil {
+		return err
+	}
+	release, err := s.limits.StartUpload(ownerID)
+	if err != nil {
+		return statusError(err)
+	}
+	defer release()
+	first, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+	hdr := first.GetHeader()
+	if hdr == nil {
+		return status.Error(codes.InvalidArgument, "first message must be the upload header")
+	}
+	c := s.codec
+	if hdr.Codec != "" {
+		if c, err = codec.Parse(hdr.Codec); err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+	mode := hdr.StorageMode
+	if mode == "" {
+		mode = s.mode
+	}
+	p, err := s.files.FilePath(ctx, ownerID, hdr.Path)
+	if err != nil {
+		return statusError(err)
+	}
+
+	body := &uploadReader{stream: stream, max: s.maxUpload}
+	r := s.limits.Reader(ctx, ownerID, body)
+	var (
+		fileID                      string
+		feaHash, dekShared, dekUser []byte
+	)
+	switch mode {
+	case "dsde":
+		fileID, feaHash, dekShared, dekUser, err = s.files.UploadWithCodec(ctx, ownerID, p, c, r)
+	case "chunks":
+		fileID, feaHash, dekShared, dekUser, err = s.files.UploadChunks(ctx, ownerID, p, r)
+	default:
+		return status.Error(codes.InvalidArgument, "unknown storage mode "+mode)
+	}
+	if body.err != nil {
+		return body.err
+	}
+	if err != nil {
+		return statusError(err)
+	}
+	return stream.SendAndClose(&dsdepb.UploadResponse{FileId: fileID, FeaHash: feaHash, DekShared: dekShared, DekUser: dekUser})
+}
+
+// uploadReader reads the data messages of an upload stream. A stream
+// error, a second header, or data past max bytes is kept in err so it is
+// returned as is rather than as the service's wrapping of it.
+type uploadReader struct {
+	stream grpc.ClientStreamingServer[dsdepb.UploadRequest, dsdepb.UploadResponse]
+	buf    []byte
+	err    error
+	max, n int64 // max 0: unlimited
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	for len(u.buf) == 0 {
+		if u.err != nil {
+			return 0, u.err
+		}
+		msg, err := u.stream.Recv()
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			u.err = err
+			return 0, err
+		}
+		if msg.GetHeader() != nil {
+			u.err = status.Error(codes.InvalidArgument, "upload header sent twice")
+			return 0, u.err
+		}
+		u.buf = msg.GetData()
+		if u.n += int64(len(u.buf)); u.max > 0 && u.n > u.max {
+			u.buf = nil
+			u.err = status.Errorf(codes.ResourceExhausted, "upload exceeds the limit of %d bytes", u.max)
+			return 0, u.err
+		}
+	}
+	n := copy(p, u.buf)
+	u.buf = u.buf[n:]
+	return n, nil
+}
+
+func (s *Server) Download(req *dsdepb.DownloadRequest, stream grpc.ServerStreamingServer[dsdepb.DownloadResponse]) error {
+	ctx := stream.Context()
+	ownerID, err := s.admit(ctx)
+	if err != nil {
+		return err
+	}
+	fileID := req.GetFileId()
+	if fileID == "" {
+		if req.GetPath() == "" {
+			return status.Error(codes.InvalidArgument, "file_id or path is required")
+		}
+		if fileID, err = s.files.ResolvePath(ctx, ownerID, req.GetPath(), int(req.Version)); err != nil {
+			return statusError(err)
+		}
+	}
+	rc, err := s.files.Download(ctx, ownerID, fileID)
+	if err != nil {
+		return statusError(err)
+	}
+	defer rc.Close()
+	body := s.limits.Reader(ctx, ownerID, rc)
+
+	buf := make([]byte, downloadChunk)
+	for {
+		n, err := io.ReadFull(body, buf)
+		if n > 0 {
+			if err := stream.Send(&dsdepb.DownloadResponse{Data: buf[:n]}); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return statusError(err)
+		}
+	}
+}
+
+func (s *Server) List(ctx context.Context, req *dsdepb.ListRequest) (*dsdepb.ListResponse, error) {
+	ownerID, err := s.admit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.files.List(ctx, ownerID, req.Path, req.Recursive)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	resp := &dsdepb.ListResponse{Entries: make([]*dsdepb.Entry, len(entries))}
+	for i, e := range entries {
+		resp.Entries[i] = &dsdepb.Entry{Path: e.Path, Folder: e.Folder, FileId: e.FileID, Version: int32(e.Version)}
+		if !e.CreatedAt.IsZero() {
+			resp.Entries[i].CreatedAtUnix = e.CreatedAt.Unix()
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) Delete(ctx context.Context, req *dsdepb.DeleteRequest) (*dsdepb.DeleteResponse, error) {
+	ownerID, err := s.admit(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.files.Remove(ctx, ownerID, req.Path); err != nil {
+		return nil, statusError(err)
+	}
+	return &dsdepb.DeleteResponse{}, nil
+}
+
+// Stats is an operator call: the counters show whether an upload
+// deduplicated.
+func (s *Server) Stats(ctx context.Context, _ *dsdepb.StatsRequest) (*dsdepb.StatsResponse, error) {
+	if s.operator == nil || !s.operator(ctx) {
+		return nil, status.Error(codes.PermissionDenied, "stats need the admin token or an operator's client certificate")
+	}
+	if err := s.limits.Allow(""); err != nil {
+		return nil, statusError(err)
+	}
+	st, err := s.files.Stats(ctx)
+	if err != nil {
+		return nil, statusError(err)
+	}
+	return &dsdepb.StatsResponse{Files: st.Files, Owners: st.Owners, Features: st.Features, Chunks: st.Chunks, CommonChunks: st.CommonChunks}, nil
+}
@@ -0,0 +1,318 @@
+package grpcapi_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/grpcapi/dsdepb"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+// memFiles keeps the newest upload of each owner's path in memory.
+type memFiles struct {
+	mu     sync.Mutex
+	next   int
+	data   map[string][]byte // by file ID
+	paths  map[string]string // file ID by owner/path
+	owners map[string]string // owner by file ID
+	modes  map[string]string // storage mode by file ID
+	broken map[string]error  // download failure by file ID
+}
+
+func newMemFiles() *memFiles {
+	return &memFiles{data: map[string][]byte{}, paths: map[string]string{}, owners: map[string]string{}, modes: map[string]string{}, broken: map[string]error{}}
+}
+
+func (m *memFiles) FilePath(_ context.Context, _, p string) (string, error) {
+	p, err := dsde.CleanPath(p)
+	if err == nil && p == "" {
+		err = dsde.ErrInvalidPath
+	}
+	return p, err
+}
+
+func (m *memFiles) store(owner, name, mode string, r io.Reader) (string, []byte, []byte, []byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, nil, nil, fmt.Errorf("read upload: %w", err)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	id := fmt.Sprintf("file-%d", m.next)
+	m.data[id] = data
+	m.paths[owner+"/"+name] = id
+	m.owners[id] = owner
+	m.modes[id] = mode
+	return id, []byte("fea"), nil, nil, nil
+}
+
+func (m *memFiles) UploadWithCodec(_ context.Context, owner, name string, _ codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error) {
+	return m.store(owner, name, "dsde", r)
+}
+
+func (m *memFiles) UploadChunks(_ context.Context, owner, name string, r io.Reader) (string, []byte, []byte, []byte, error) {
+	return m.store(owner, name, "chunks", r)
+}
+
+func (m *memFiles) ResolvePath(_ context.Context, owner, p string, _ int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, ok := m.paths[owner+"/"+p]
+	if !ok {
+		return "", dsde.ErrFileNotFound
+	}
+	return id, nil
+}
+
+func (m *memFiles) Download(_ context.Context, owner, fileID string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.owners[fileID] != owner {
+		return nil, dsde.ErrFileNotFound
+	}
+	if err := m.broken[fileID]; err != nil {
+		return nil, err
+	}
+	return io.NopCloser(bytes.NewReader(m.data[fileID])), nil
+}
+
+func (m *memFiles) List(_ context.Context, owner, p string, _ bool) ([]db.TreeEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var out []db.TreeEntry
+	for k, id := range m.paths {
+		if rel, ok := strings.CutPrefix(k, owner+"/"); ok && strings.HasPrefix(rel, p) {
+			out = append(out, db.TreeEntry{Path: rel, FileID: id, Version: 1, CreatedAt: time.Unix(1700000000, 0)})
+		}
+	}
+	return out, nil
+}
+
+func (m *memFiles) Remove(_ context.Context, owner, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.paths[owner+"/"+p]; !ok {
+		return dsde.ErrFileNotFound
+	}
+	delete(m.paths, owner+"/"+p)
+	return nil
+}
+
+func (m *memFiles) Stats(context.Context) (db.Stats, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return db.Stats{Files: int64(len(m.paths))}, nil
+}
+
+func dial(t *testing.T, files *memFiles, opts ...grpcapi.Option) dsdepb.DSDEClient {
+	t.Helper()
+	lis := bufconn.Listen(1 << 20)
+	gs := grpc.NewServer()
+	grpcapi.New(files, opts...).Register(gs)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return dsdepb.NewDSDEClient(conn)
+}
+
+func as(owner string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), grpcapi.OwnerKey, owner)
+}
+
+func upload(t *testing.T, c dsdepb.DSDEClient, ctx context.Context, hdr *dsdepb.UploadHeader, parts ...[]byte) (*dsdepb.UploadResponse, error) {
+	t.Helper()
+	stream, err := c.Upload(ctx)
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if err := stream.Send(&dsdepb.UploadRequest{Msg: &dsdepb.UploadRequest_Header{Header: hdr}}); err != nil {
+		t.Fatalf("Send(header): %v", err)
+	}
+	for _, p := range parts {
+		if err := stream.Send(&dsdepb.UploadRequest{Msg: &dsdepb.UploadRequest_Data{Data: p}}); err != nil {
+			t.Fatalf("Send(data): %v", err)
+		}
+	}
+	return stream.CloseAndRecv()
+}
+
+func TestUploadDownloadRoundTrip(t *testing.T) {
+	files := newMemFiles()
+	isOperator := func(ctx context.Context) bool {
+		md, _ := metadata.FromIncomingContext(ctx)
+		return len(md.Get("operator")) > 0
+	}
+	c := dial(t, files, grpcapi.WithOperator(isOperator))
+	ctx := as("alice")
+
+	big := bytes.Repeat([]byte("0123456789abcdef"), 10000) // spans several download messages
+	resp, err := upload(t, c, ctx, &dsdepb.UploadHeader{Path: "docs/big.bin", StorageMode: "chunks"}, big[:50000], big[50000:])
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if files.modes[resp.FileId] != "chunks" {
+		t.Errorf("stored in mode %q, want chunks", files.modes[resp.FileId])
+	}
+
+	for _, req := range []*dsdepb.DownloadRequest{
+		{Target: &dsdepb.DownloadRequest_FileId{FileId: resp.FileId}},
+		{Target: &dsdepb.DownloadRequest_Path{Path: "docs/big.bin"}},
+	} {
+		stream, err := c.Download(ctx, req)
+		if err != nil {
+			t.Fatalf("Download: %v", err)
+		}
+		var got []byte
+		for {
+			msg, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Recv: %v", err)
+			}
+			got = append(got, msg.Data...)
+		}
+		if !bytes.Equal(got, big) {
+			t.Errorf("Download(%v) returned %d bytes, want %d", req, len(got), len(big))
+		}
+	}
+
+	list, err := c.List(ctx, &dsdepb.ListRequest{Path: "docs"})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list.Entries) != 1 || list.Entries[0].Path != "docs/big.bin" || list.Entries[0].FileId != resp.FileId {
+		t.Errorf("List = %v", list.Entries)
+	}
+
+	if _, err := c.Stats(ctx, &dsdepb.StatsRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("Stats as an owner: got %v, want PermissionDenied", err)
+	}
+	st, err := c.Stats(metadata.AppendToOutgoingContext(ctx, "operator", "yes"), &dsdepb.StatsRequest{})
+	if err != nil || st.Files != 1 {
+		t.Errorf("Stats = %v, %v", st, err)
+	}
+
+	if _, err := c.Delete(ctx, &dsdepb.DeleteRequest{Path: "docs/big.bin"}); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := c.Delete(ctx, &dsdepb.DeleteRequest{Path: "docs/big.bin"}); status.Code(err) != codes.NotFound {
+		t.Errorf("second Delete: got %v, want NotFound", err)
+	}
+}
+
+func TestStatusCodes(t *testing.T) {
+	files := newMemFiles()
+	c := dial(t, files)
+
+	if _, err := c.List(context.Background(), &dsdepb.ListRequest{}); status.Code(err) != codes.Unauthenticated {
+		t.Errorf("List without owner: got %v, want Unauthenticated", err)
+	}
+	if _, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "../x"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Upload to a bad path: got %v, want InvalidArgument", err)
+	}
+	if _, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "x", Codec: "lzma"}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Upload with an unknown codec: got %v, want InvalidArgument", err)
+	}
+
+	resp, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "private.txt"}, []byte("secret"))
+	if err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	stream, err := c.Download(as("bob"), &dsdepb.DownloadRequest{Target: &dsdepb.DownloadRequest_FileId{FileId: resp.FileId}})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("Download of another owner's file: got %v, want NotFound", err)
+	}
+
+	for _, tc := range []struct {
+		err  error
+		want codes.Code
+	}{
+		{fmt.Errorf("%w: s3://bucket/files/x", dsde.ErrIntegrityFailure), codes.DataLoss},
+		{fmt.Errorf("%w: AccessDeniedException", dsde.ErrKeyUnavailable), codes.Unavailable},
+		{dsde.ErrProofRejected, codes.PermissionDenied},
+		{dsde.ErrUnknownUpload, codes.NotFound},
+		{fmt.Errorf("%w: 10 logical bytes stored", dsde.ErrQuotaExceeded), codes.ResourceExhausted},
+	} {
+		files.broken[resp.FileId] = tc.err
+		stream, err := c.Download(as("alice"), &dsdepb.DownloadRequest{Target: &dsdepb.DownloadRequest_FileId{FileId: resp.FileId}})
+		if err == nil {
+			_, err = stream.Recv()
+		}
+		if status.Code(err) != tc.want {
+			t.Errorf("Download failing with %v: got %v, want %v", tc.err, err, tc.want)
+		}
+		if strings.Contains(status.Convert(err).Message(), "s3://") {
+			t.Errorf("Download failing with %v leaked %q", tc.err, status.Convert(err).Message())
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limits := ratelimit.NewLimiter(ratelimit.Limits{OwnerRequests: 0.001, OwnerBurst: 2})
+	c := dial(t, newMemFiles(), grpcapi.WithLimiter(limits))
+
+	if _, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "a.txt"}, []byte("a")); err != nil {
+		t.Fatalf("Upload: %v", err)
+	}
+	if _, err := c.List(as("alice"), &dsdepb.ListRequest{}); err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if _, err := c.List(as("alice"), &dsdepb.ListRequest{}); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("List past the burst: got %v, want ResourceExhausted", err)
+	}
+	if _, err := c.List(as("bob"), &dsdepb.ListRequest{}); err != nil {
+		t.Errorf("List by another owner: %v", err)
+	}
+}
+
+func TestUpload_SizeLimit(t *testing.T) {
+	files := newMemFiles()
+	c := dial(t, files, grpcapi.WithMaxUploadSize(100))
+
+	if _, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "small.bin"}, make([]byte, 60), make([]byte, 40)); err != nil {
+		t.Fatalf("Upload at the limit: %v", err)
+	}
+	_, err := upload(t, c, as("alice"), &dsdepb.UploadHeader{Path: "big.bin"}, make([]byte, 60), make([]byte, 41))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("Upload past the limit: got %v, want ResourceExhausted", err)
+	}
+	list, err := c.List(as("alice"), &dsdepb.ListRequest{})
+	if err != nil {
+		t.Fatalf("List: %v", err)
+	}
+	if len(list.Entries) != 1 {
+		t.Errorf("List = %v, want only the upload within the limit", list.Entries)
+	}
+}
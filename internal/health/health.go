@@ -0,0 +1,133 @@
+// Package health serves liveness and readiness probes. Liveness only says
+// the process is serving; readiness runs the registered dependency checks
+// and fails once the server starts draining, so load balancers stop
+// routing new requests to it before it shuts down.
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// errDraining is reported by readiness once Drain has been called.
+var errDraining = errors.New("shutting down")
+
+// Check reports whether one dependency is usable.
+type Check func(ctx context.Context) error
+
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Checker holds the readiness checks.
+type Checker struct {
+	timeout  time.Duration
+	checks   []namedCheck
+	draining atomic.Bool
+}
+
+// Option configures a Checker.
+type Option func(*Checker)
+
+// WithTimeout bounds each readiness probe; checks still running when it
+// expires count as failed.
+func WithTimeout(d time.Duration) Option {
+	return func(c *Checker) {
+		c.timeout = d
+	}
+}
+
+// New returns a Checker with no checks.
+func New(opts ...Option) *Checker {
+	c := &Checker{timeout: 5 * time.Second}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// Add registers check under name. Checks must be added before serving.
+func (c *Checker) Add(name string, check Check) {
+	c.checks = append(c.checks, namedCheck{name: name, check: check})
+}
+
+// Drain makes every readiness probe from now on fail.
+func (c *Checker) Drain() {
+	c.draining.Store(true)
+}
+
+// report is the JSON body of a probe.
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+// Live answers liveness probes: 200 for as long as the process serves.
+func (c *Checker) Live(w http.ResponseWriter, _ *http.Request) {
+	writeReport(w, http.StatusOK, report{Status: "ok"})
+}
+
+// Ready answers readiness probes: 200 if every check passes, 503 with the
+// failing checks' errors otherwise.
+func (c *Checker) Ready(w http.ResponseWriter, r *http.Request) {
+	if c.draining.Load() {
+		writeReport(w, http.StatusServiceUnavailable, report{Status: "unavailable", Checks: map[string]string{"server": errDraining.Error()}})
+		return
+	}
+	errs := c.run(r.Context())
+	rep := report{Status: "ok", Checks: make(map[string]string, len(errs))}
+	status := http.StatusOK
+	for name, err := range errs {
+		if err != nil {
+			rep.Checks[name] = err.Error()
+			rep.Status, status = "unavailable", http.StatusServiceUnavailable
+		} else {
+			rep.Checks[name] = "ok"
+		}
+	}
+	writeReport(w, status, rep)
+}
+
+// run executes all checks concurrently under the probe timeout.
+func (c *Checker) run(ctx context.Context) map[string]error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs = make(map[string]error, len(c.checks))
+	)
+	for _, nc := range c.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			done := make(chan error, 1)
+			go func() { done <- nc.check(ctx) }()
+			var err error
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+			mu.Lock()
+			errs[nc.name] = err
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return errs
+}
+
+func writeReport(w http.ResponseWriter, status int, rep report) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(rep)
+}
@@ -0,0 +1,75 @@
+package health_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/health"
+)
+
+type report struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func probe(t *testing.T, h http.HandlerFunc) (int, report) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest("GET", "/", nil))
+	var rep report
+	if err := json.NewDecoder(rec.Body).Decode(&rep); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	return rec.Code, rep
+}
+
+func TestReady(t *testing.T) {
+	c := health.New(health.WithTimeout(50 * time.Millisecond))
+	var dbErr error
+	c.Add("postgres", func(context.Context) error { return dbErr })
+	c.Add("kms", func(context.Context) error { return nil })
+
+	if code, rep := probe(t, c.Ready); code != http.StatusOK || rep.Status != "ok" || rep.Checks["postgres"] != "ok" {
+		t.Errorf("healthy: got %d %+v", code, rep)
+	}
+
+	dbErr = errors.New("connection refused")
+	code, rep := probe(t, c.Ready)
+	if code != http.StatusServiceUnavailable || rep.Checks["postgres"] != "connection refused" || rep.Checks["kms"] != "ok" {
+		t.Errorf("postgres down: got %d %+v", code, rep)
+	}
+}
+
+func TestReady_SlowCheckTimesOut(t *testing.T) {
+	c := health.New(health.WithTimeout(20 * time.Millisecond))
+	c.Add("s3", func(context.Context) error {
+		time.Sleep(time.Second) // ignores its context
+		return nil
+	})
+	start := time.Now()
+	code, rep := probe(t, c.Ready)
+	if code != http.StatusServiceUnavailable || rep.Checks["s3"] != context.DeadlineExceeded.Error() {
+		t.Errorf("got %d %+v", code, rep)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("probe took %s despite a 20ms timeout", d)
+	}
+}
+
+func TestDrain(t *testing.T) {
+	c := health.New()
+	c.Add("postgres", func(context.Context) error { return nil })
+	c.Drain()
+
+	if code, _ := probe(t, c.Ready); code != http.StatusServiceUnavailable {
+		t.Errorf("Ready while draining: got %d, want 503", code)
+	}
+	if code, rep := probe(t, c.Live); code != http.StatusOK || rep.Status != "ok" {
+		t.Errorf("Live while draining: got %d %+v", code, rep)
+	}
+}
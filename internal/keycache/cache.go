@@ -0,0 +1,163 @@
+// Package keycache keeps KMS round-trips off the hot path: a bounded cache of
+// decrypted shared DEKs by fea_hash, and a pool of user DEKs generated ahead
+// of the uploads that need them. Plaintext keys handed out are the caller's
+// own; those held inside are zeroed when they are dropped.
+package keycache
+
+import (
+	"bytes"
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Cache keeps decrypted shared DEKs by fea_hash for at most a TTL after they
+// were unwrapped, dropping the least recently used when full. An entry only
+// matches the wrapped DEK it was decrypted from, so a stale one is a miss
+// rather than a wrong key. Expiry is checked on each use. A nil *Cache caches
+// nothing.
+type Cache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*entry
+	lru     *list.List // most recently used first
+	byAge   *list.List // oldest first
+
+	hits, misses, evictions, expirations uint64
+}
+
+type entry struct {
+	feaHash        string
+	wrapped, plain []byte
+	expires        time.Time
+	used, aged     *list.Element
+}
+
+// New returns a cache of up to size keys, each kept for ttl; a ttl of 0
+// keeps them until evicted. A size of 0 returns nil.
+func New(size int, ttl time.Duration) *Cache {
+	if size <= 0 {
+		return nil
+	}
+	return &Cache{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[string]*entry),
+		lru:     list.New(),
+		byAge:   list.New(),
+	}
+}
+
+// Get returns a copy of the plaintext of wrapped, the shared DEK of feaHash,
+// if it is cached.
+func (c *Cache) Get(feaHash, wrapped []byte) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.expire(time.Now())
+	e, ok := c.entries[string(feaHash)]
+	if !ok || !bytes.Equal(e.wrapped, wrapped) {
+		c.misses++
+		return nil, false
+	}
+	c.hits++
+	c.lru.MoveToFront(e.used)
+	return bytes.Clone(e.plain), true
+}
+
+// Put caches a copy of plain, the plaintext of feaHash's shared DEK wrapped.
+func (c *Cache) Put(feaHash, wrapped, plain []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	c.expire(now)
+	if e, ok := c.entries[string(feaHash)]; ok {
+		c.remove(e)
+	}
+	for len(c.entries) >= c.size {
+		c.remove(c.lru.Back().Value.(*entry))
+		c.evictions++
+	}
+	e := &entry{
+		feaHash: string(feaHash),
+		wrapped: bytes.Clone(wrapped),
+		plain:   bytes.Clone(plain),
+		expires: now.Add(c.ttl),
+	}
+	e.used = c.lru.PushFront(e)
+	e.aged = c.byAge.PushBack(e)
+	c.entries[e.feaHash] = e
+}
+
+// Purge drops every entry.
+func (c *Cache) Purge() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, e := range c.entries {
+		c.remove(e)
+	}
+}
+
+// expire drops the entries past their TTL.
+func (c *Cache) expire(now time.Time) {
+	if c.ttl <= 0 {
+		return
+	}
+	for f := c.byAge.Front(); f != nil; f = c.byAge.Front() {
+		e := f.Value.(*entry)
+		if now.Before(e.expires) {
+			return
+		}
+		c.remove(e)
+		c.expirations++
+	}
+}
+
+// remove drops e, zeroing its key.
+func (c *Cache) remove(e *entry) {
+	clear(e.plain)
+	c.lru.Remove(e.used)
+	c.byAge.Remove(e.aged)
+	delete(c.entries, e.feaHash)
+}
+
+// CacheStats describes a Cache's size and effectiveness.
+type CacheStats struct {
+	Entries     int     `json:"entries"`
+	Capacity    int     `json:"capacity"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Evictions   uint64  `json:"evictions"`   // dropped to make room
+	Expirations uint64  `json:"expirations"` // dropped past their TTL
+	HitRate     float64 `json:"hitRate"`     // hits per lookup; 0 before any
+}
+
+// Stats returns the cache's current statistics.
+func (c *Cache) Stats() CacheStats {
+	if c == nil {
+		return CacheStats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	st := CacheStats{
+		Entries:     len(c.entries),
+		Capacity:    c.size,
+		Hits:        c.hits,
+		Misses:      c.misses,
+		Evictions:   c.evictions,
+		Expirations: c.expirations,
+	}
+	if lookups := c.hits + c.misses; lookups > 0 {
+		st.HitRate = float64(c.hits) / float64(lookups)
+	}
+	return st
+}
@@ -0,0 +1,166 @@
+package keycache_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keycache"
+)
+
+func TestCache_HitsAndMisses(t *testing.T) {
+	c := keycache.New(4, time.Minute)
+	fea, wrapped, plain := []byte("fea"), []byte("wrapped"), []byte("plain-key")
+
+	if _, ok := c.Get(fea, wrapped); ok {
+		t.Fatal("expected a miss on an empty cache")
+	}
+	c.Put(fea, wrapped, plain)
+	got, ok := c.Get(fea, wrapped)
+	if !ok || !bytes.Equal(got, plain) {
+		t.Fatalf("expected the cached key, got %q, %v", got, ok)
+	}
+	got[0] ^= 0xff
+	if again, _ := c.Get(fea, wrapped); !bytes.Equal(again, plain) {
+		t.Error("changing a returned key changed the cached one")
+	}
+	if _, ok := c.Get(fea, []byte("other-wrapped")); ok {
+		t.Error("expected a miss for a different wrapped DEK")
+	}
+
+	st := c.Stats()
+	if st.Hits != 2 || st.Misses != 2 || st.Entries != 1 || st.HitRate != 0.5 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestCache_EvictsLeastRecentlyUsed(t *testing.T) {
+	c := keycache.New(2, 0)
+	key := func(i int) []byte { return []byte(fmt.Sprint("fea-", i)) }
+	c.Put(key(1), []byte("w1"), []byte("k1"))
+	c.Put(key(2), []byte("w2"), []byte("k2"))
+	c.Get(key(1), []byte("w1"))
+	c.Put(key(3), []byte("w3"), []byte("k3"))
+
+	if _, ok := c.Get(key(2), []byte("w2")); ok {
+		t.Error("expected the least recently used key to be evicted")
+	}
+	if _, ok := c.Get(key(1), []byte("w1")); !ok {
+		t.Error("expected the recently used key to stay")
+	}
+	if st := c.Stats(); st.Evictions != 1 || st.Entries != 2 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestCache_Expires(t *testing.T) {
+	c := keycache.New(4, 20*time.Millisecond)
+	c.Put([]byte("fea"), []byte("w"), []byte("k"))
+	time.Sleep(40 * time.Millisecond)
+	if _, ok := c.Get([]byte("fea"), []byte("w")); ok {
+		t.Error("expected the key to expire")
+	}
+	if st := c.Stats(); st.Expirations != 1 || st.Entries != 0 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestCache_NilAndPurge(t *testing.T) {
+	var nilCache *keycache.Cache
+	nilCache.Put([]byte("fea"), []byte("w"), []byte("k"))
+	if _, ok := nilCache.Get([]byte("fea"), []byte("w")); ok {
+		t.Error("expected a nil cache to cache nothing")
+	}
+	if keycache.New(0, time.Minute) != nil {
+		t.Error("expected size 0 to disable the cache")
+	}
+
+	c := keycache.New(4, time.Minute)
+	c.Put([]byte("fea"), []byte("w"), []byte("k"))
+	c.Purge()
+	if _, ok := c.Get([]byte("fea"), []byte("w")); ok {
+		t.Error("expected Purge to drop every key")
+	}
+}
+
+// counter generates numbered keys.
+func counter(n *atomic.Int64) keycache.Generator {
+	return func(context.Context) ([]byte, []byte, error) {
+		i := n.Add(1)
+		return []byte(fmt.Sprint("plain-", i)), []byte(fmt.Sprint("wrapped-", i)), nil
+	}
+}
+
+// waitReady waits for p to hold n keys.
+func waitReady(t *testing.T, p *keycache.Pool, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Ready < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("pool holds %d keys, want %d", p.Stats().Ready, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPool_HandsOutEachKeyOnce(t *testing.T) {
+	var n atomic.Int64
+	p := keycache.NewPool(3, counter(&n))
+	defer p.Close()
+	waitReady(t, p, 3)
+
+	seen := make(map[string]bool)
+	for range 10 {
+		plain, wrapped, err := p.Get(context.Background())
+		if err != nil {
+			t.Fatalf("Get: %v", err)
+		}
+		if seen[string(wrapped)] {
+			t.Fatalf("key %s handed out twice", wrapped)
+		}
+		seen[string(wrapped)] = true
+		if want := "plain-" + string(wrapped[len("wrapped-"):]); string(plain) != want {
+			t.Errorf("got plaintext %s for %s", plain, wrapped)
+		}
+	}
+	if st := p.Stats(); st.Hits+st.Misses != 10 || st.Hits < 3 {
+		t.Errorf("unexpected stats: %+v", st)
+	}
+}
+
+func TestPool_FallsBackAndCloses(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	var n atomic.Int64
+	gen := counter(&n)
+	p := keycache.NewPool(2, func(ctx context.Context) ([]byte, []byte, error) {
+		if fail.Load() {
+			return nil, nil, errors.New("kms down")
+		}
+		return gen(ctx)
+	})
+	deadline := time.Now().Add(2 * time.Second)
+	for p.Stats().Failures == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, _, err := p.Get(context.Background()); err == nil {
+		t.Error("expected Get to report the generator's error on an empty pool")
+	}
+
+	fail.Store(false)
+	if _, _, err := p.Get(context.Background()); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	waitReady(t, p, 2)
+	p.Close()
+	if st := p.Stats(); st.Ready != 0 {
+		t.Errorf("expected Close to empty the pool, %d keys left", st.Ready)
+	}
+	if _, _, err := p.Get(context.Background()); err != nil {
+		t.Errorf("Get after Close: %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package keycache
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Generator returns a fresh data key and its KMS-wrapped form.
+type Generator func(ctx context.Context) (plain, wrapped []byte, err error)
+
+// refillTimeout bounds each key generation made to refill a Pool.
+const refillTimeout = 10 * time.Second
+
+// Pool hands out data keys generated ahead of time, each exactly once. It
+// refills in the background whenever a key is taken; when it is empty, Get
+// generates a key itself. A failed refill is retried on the next Get.
+type Pool struct {
+	gen  Generator
+	keys chan dek
+
+	mu      sync.Mutex
+	filling bool
+	closed  bool
+
+	hits, misses, failures uint64
+}
+
+type dek struct {
+	plain, wrapped []byte
+}
+
+// NewPool returns a pool of up to size keys from gen and starts filling it.
+func NewPool(size int, gen Generator) *Pool {
+	p := &Pool{gen: gen, keys: make(chan dek, size)}
+	p.refill()
+	return p
+}
+
+// Get takes a key from the pool, or generates one if it is empty.
+func (p *Pool) Get(ctx context.Context) (plain, wrapped []byte, err error) {
+	select {
+	case k := <-p.keys:
+		p.mu.Lock()
+		p.hits++
+		p.mu.Unlock()
+		p.refill()
+		return k.plain, k.wrapped, nil
+	default:
+	}
+	p.mu.Lock()
+	p.misses++
+	p.mu.Unlock()
+	p.refill()
+	return p.gen(ctx)
+}
+
+// Close stops refilling and zeroes the keys left in the pool. Get still
+// works, generating every key.
+func (p *Pool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+	for {
+		select {
+		case k := <-p.keys:
+			clear(k.plain)
+		default:
+			return
+		}
+	}
+}
+
+// refill starts filling the pool unless it is full, closed or filling.
+func (p *Pool) refill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.filling || p.closed || len(p.keys) == cap(p.keys) {
+		return
+	}
+	p.filling = true
+	go p.fill()
+}
+
+func (p *Pool) fill() {
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), refillTimeout)
+		plain, wrapped, err := p.gen(ctx)
+		cancel()
+		if err != nil {
+			zap.L().Named("keycache").Warn("pre-generate DEK", zap.Error(err))
+			p.mu.Lock()
+			p.failures++
+			p.filling = false
+			p.mu.Unlock()
+			return
+		}
+		if !p.put(dek{plain: plain, wrapped: wrapped}) {
+			return
+		}
+	}
+}
+
+// put adds k to the pool, zeroing it instead if the pool is closed or full,
+// and reports whether filling should go on.
+func (p *Pool) put(k dek) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	added := false
+	if !p.closed {
+		select {
+		case p.keys <- k:
+			added = true
+		default:
+		}
+	}
+	if !added {
+		clear(k.plain)
+	}
+	if !added || len(p.keys) == cap(p.keys) {
+		p.filling = false
+		return false
+	}
+	return true
+}
+
+// PoolStats describes a Pool's fill and effectiveness.
+type PoolStats struct {
+	Ready    int     `json:"ready"` // keys waiting to be handed out
+	Capacity int     `json:"capacity"`
+	Hits     uint64  `json:"hits"`     // keys handed out from the pool
+	Misses   uint64  `json:"misses"`   // keys generated on demand
+	Failures uint64  `json:"failures"` // failed refills
+	HitRate  float64 `json:"hitRate"`  // hits per Get; 0 before any
+}
+
+// Stats returns the pool's current statistics.
+func (p *Pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	st := PoolStats{
+		Ready:    len(p.keys),
+		Capacity: cap(p.keys),
+		Hits:     p.hits,
+		Misses:   p.misses,
+		Failures: p.failures,
+	}
+	if gets := p.hits + p.misses; gets > 0 {
+		st.HitRate = float64(p.hits) / float64(gets)
+	}
+	return st
+}
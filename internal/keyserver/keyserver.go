@@ -0,0 +1,256 @@
+// Package keyserver implements DupLESS-style server-aided convergent key
+// derivation: dedup tags are RSA-FDH signatures over the content feature
+// under a server secret, evaluated obliviously through blind signatures and
+// rate limited, so confirming a guess needs one online query per guess
+// instead of an offline hash.
+//
+// User IDs are whatever the client claims, so each evaluation is also charged
+// to the address it came from and, optionally, to a global budget: switching
+// IDs does not buy more guesses.
+package keyserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+// ErrRateLimited is returned when a user has exhausted their evaluation budget.
+var ErrRateLimited = errors.New("keyserver: rate limit exceeded")
+
+// ErrInvalidElement is returned for blinded inputs outside [1, N).
+var ErrInvalidElement = errors.New("keyserver: invalid blinded element")
+
+// errSignFault is returned when a signature fails its own verification, so a
+// faulty computation never reaches a client, who could factor N from it.
+var errSignFault = errors.New("keyserver: signature failed verification")
+
+// Server holds the OPRF secret and the evaluation limiters.
+type Server struct {
+	priv    *rsa.PrivateKey
+	users   *ratelimit.Keyed
+	sources *ratelimit.Keyed
+	global  *ratelimit.Bucket // nil: no global budget
+}
+
+// Option customises a Server built by New.
+type Option func(*Server)
+
+// WithGlobalLimit caps evaluations over all users and sources at rate per
+// second, up to burst.
+func WithGlobalLimit(rate float64, burst int) Option {
+	return func(s *Server) {
+		s.global = ratelimit.NewBucket(rate, burst)
+	}
+}
+
+// New returns a Server allowing each user, and each source address, rate
+// evaluations per second, up to burst.
+func New(priv *rsa.PrivateKey, rate float64, burst int, opts ...Option) *Server {
+	s := &Server{
+		priv:    priv,
+		users:   ratelimit.NewKeyed(rate, burst),
+		sources: ratelimit.NewKeyed(rate, burst),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+type sourceKey struct{}
+
+// WithSource returns a copy of ctx recording the client address a request
+// came from, for evaluations made on its behalf.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// Source returns the client address recorded in ctx, or "".
+func Source(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+// allow charges one evaluation to userID, to source unless it is empty, and
+// to the global budget.
+func (s *Server) allow(userID, source string) error {
+	if ok, _ := s.users.Allow(userID); !ok {
+		return ErrRateLimited
+	}
+	if source != "" {
+		if ok, _ := s.sources.Allow(source); !ok {
+			return ErrRateLimited
+		}
+	}
+	if s.global != nil {
+		if ok, _ := s.global.AllowN(time.Now(), 1); !ok {
+			return ErrRateLimited
+		}
+	}
+	return nil
+}
+
+// LoadKey reads a PEM-encoded RSA private key (PKCS#1 or PKCS#8).
+func LoadKey(path string) (*rsa.PrivateKey, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an RSA key", path)
+	}
+	return rk, nil
+}
+
+// PublicKey returns the key clients blind against.
+func (s *Server) PublicKey() *rsa.PublicKey {
+	return &s.priv.PublicKey
+}
+
+// Evaluate signs a blinded element for userID, whose request came from
+// source.
+func (s *Server) Evaluate(userID, source string, blinded []byte) ([]byte, error) {
+	if err := s.allow(userID, source); err != nil {
+		return nil, err
+	}
+	x := new(big.Int).SetBytes(blinded)
+	if x.Sign() <= 0 || x.Cmp(s.priv.N) >= 0 {
+		return nil, ErrInvalidElement
+	}
+	sig, err := s.sign(x)
+	if err != nil {
+		return nil, err
+	}
+	return sig.FillBytes(make([]byte, s.priv.Size())), nil
+}
+
+// Tag derives the dedup tag for a feature on behalf of userID without the
+// blinding round trip, for uploads where the server already holds the
+// plaintext. It is rate limited like Evaluate and yields the same tag a client
+// gets from Blind, Evaluate and Finalize.
+func (s *Server) Tag(userID, source string, feature []byte) ([]byte, error) {
+	if err := s.allow(userID, source); err != nil {
+		return nil, err
+	}
+	sig, err := s.sign(fdh(&s.priv.PublicKey, feature))
+	if err != nil {
+		return nil, err
+	}
+	return tagFromSignature(&s.priv.PublicKey, sig), nil
+}
+
+// sign is the raw RSA private-key operation x^d mod N. big.Int exponentiation
+// is not constant time, so x is blinded by a fresh r^e first and the result
+// unblinded by r⁻¹: the timing of the exponentiation is then independent of
+// the input an attacker chose. The result is checked against x before it is
+// returned.
+func (s *Server) sign(x *big.Int) (*big.Int, error) {
+	pub := &s.priv.PublicKey
+	var r, rInv *big.Int
+	for rInv == nil {
+		var err error
+		if r, err = rand.Int(rand.Reader, pub.N); err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 {
+			rInv = new(big.Int).ModInverse(r, pub.N)
+		}
+	}
+	e := big.NewInt(int64(pub.E))
+	blinded := new(big.Int).Exp(r, e, pub.N)
+	blinded.Mul(blinded, x).Mod(blinded, pub.N)
+
+	sig := new(big.Int).Exp(blinded, s.priv.D, pub.N)
+	sig.Mul(sig, rInv).Mod(sig, pub.N)
+	if new(big.Int).Exp(sig, e, pub.N).Cmp(x) != 0 {
+		return nil, errSignFault
+	}
+	return sig, nil
+}
+
+// BlindState is the client's secret for one evaluation.
+type BlindState struct {
+	h *big.Int // FDH(feature)
+	r *big.Int // blinding factor
+}
+
+// Blind hashes feature onto Z_N and multiplies by r^e for a random r.
+func Blind(pub *rsa.PublicKey, feature []byte) ([]byte, *BlindState, error) {
+	h := fdh(pub, feature)
+	var r *big.Int
+	for {
+		var err error
+		r, err = rand.Int(rand.Reader, pub.N)
+		if err != nil {
+			return nil, nil, err
+		}
+		if r.Sign() > 0 && new(big.Int).GCD(nil, nil, r, pub.N).Cmp(big.NewInt(1)) == 0 {
+			break
+		}
+	}
+	e := big.NewInt(int64(pub.E))
+	blinded := new(big.Int).Exp(r, e, pub.N)
+	blinded.Mul(blinded, h).Mod(blinded, pub.N)
+	return blinded.FillBytes(make([]byte, pub.Size())), &BlindState{h: h, r: r}, nil
+}
+
+// Finalize unblinds the server's answer, verifies it is a valid signature on
+// FDH(feature) and returns the dedup tag.
+func Finalize(pub *rsa.PublicKey, st *BlindState, evaluated []byte) ([]byte, error) {
+	s := new(big.Int).SetBytes(evaluated)
+	rInv := new(big.Int).ModInverse(st.r, pub.N)
+	if rInv == nil {
+		return nil, errors.New("keyserver: blinding factor not invertible")
+	}
+	s.Mul(s, rInv).Mod(s, pub.N)
+	if new(big.Int).Exp(s, big.NewInt(int64(pub.E)), pub.N).Cmp(st.h) != 0 {
+		return nil, errors.New("keyserver: evaluation does not verify")
+	}
+	return tagFromSignature(pub, s), nil
+}
+
+// fdh is a full-domain hash of feature onto Z_N: SHA-256 in counter mode,
+// expanded to the modulus length and reduced.
+func fdh(pub *rsa.PublicKey, feature []byte) *big.Int {
+	out := make([]byte, 0, pub.Size()+sha256.Size)
+	for ctr := uint32(0); len(out) < pub.Size(); ctr++ {
+		h := sha256.New()
+		h.Write([]byte("dsde/keyserver/fdh"))
+		var c [4]byte
+		binary.BigEndian.PutUint32(c[:], ctr)
+		h.Write(c[:])
+		h.Write(feature)
+		out = h.Sum(out)
+	}
+	return new(big.Int).Mod(new(big.Int).SetBytes(out[:pub.Size()]), pub.N)
+}
+
+// tagFromSignature hashes the fixed-length signature into a 32-byte tag.
+func tagFromSignature(pub *rsa.PublicKey, sig *big.Int) []byte {
+	sum := sha256.Sum256(sig.FillBytes(make([]byte, pub.Size())))
+	return sum[:]
+}
@@ -0,0 +1,180 @@
+package keyserver_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+)
+
+var (
+	keyOnce sync.Once
+	testKey *rsa.PrivateKey
+)
+
+func key(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	keyOnce.Do(func() {
+		var err error
+		if testKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("GenerateKey: %v", err)
+		}
+	})
+	return testKey
+}
+
+func TestBlindEvaluateFinalize_MatchesTag(t *testing.T) {
+	srv := keyserver.New(key(t), 100, 100)
+	feature := []byte("feature-of-some-file")
+
+	blinded, st, err := keyserver.Blind(srv.PublicKey(), feature)
+	if err != nil {
+		t.Fatalf("Blind error: %v", err)
+	}
+	evaluated, err := srv.Evaluate("alice", "10.0.0.1", blinded)
+	if err != nil {
+		t.Fatalf("Evaluate error: %v", err)
+	}
+	tag, err := keyserver.Finalize(srv.PublicKey(), st, evaluated)
+	if err != nil {
+		t.Fatalf("Finalize error: %v", err)
+	}
+
+	direct, err := srv.Tag("bob", "", feature)
+	if err != nil {
+		t.Fatalf("Tag error: %v", err)
+	}
+	if !bytes.Equal(tag, direct) {
+		t.Error("oblivious and direct evaluation disagree")
+	}
+	if bytes.Equal(tag, feature) || len(tag) != 32 {
+		t.Errorf("unexpected tag %x", tag)
+	}
+}
+
+func TestBlind_HidesFeature(t *testing.T) {
+	pub := &key(t).PublicKey
+	b1, _, _ := keyserver.Blind(pub, []byte("same"))
+	b2, _, _ := keyserver.Blind(pub, []byte("same"))
+	if bytes.Equal(b1, b2) {
+		t.Error("expected blinded elements for the same feature to differ")
+	}
+}
+
+func TestFinalize_RejectsBadEvaluation(t *testing.T) {
+	srv := keyserver.New(key(t), 100, 100)
+	_, st, _ := keyserver.Blind(srv.PublicKey(), []byte("x"))
+	other, _, _ := keyserver.Blind(srv.PublicKey(), []byte("y"))
+	evaluated, _ := srv.Evaluate("alice", "10.0.0.1", other)
+	if _, err := keyserver.Finalize(srv.PublicKey(), st, evaluated); err == nil {
+		t.Error("expected Finalize to reject an evaluation of a different element")
+	}
+}
+
+func TestEvaluate_RateLimited(t *testing.T) {
+	srv := keyserver.New(key(t), 0.001, 2)
+	blinded, _, _ := keyserver.Blind(srv.PublicKey(), []byte("guess"))
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Evaluate("mallory", "10.0.0.2", blinded); err != nil {
+			t.Fatalf("evaluation %d: %v", i, err)
+		}
+	}
+	if _, err := srv.Evaluate("mallory", "10.0.0.2", blinded); !errors.Is(err, keyserver.ErrRateLimited) {
+		t.Errorf("err = %v; want ErrRateLimited", err)
+	}
+	if _, err := srv.Tag("mallory", "", []byte("guess")); !errors.Is(err, keyserver.ErrRateLimited) {
+		t.Errorf("Tag err = %v; want ErrRateLimited", err)
+	}
+	if _, err := srv.Evaluate("alice", "10.0.0.1", blinded); err != nil {
+		t.Errorf("other users must not be limited: %v", err)
+	}
+}
+
+func TestEvaluate_RateLimitedPerSourceAndGlobally(t *testing.T) {
+	srv := keyserver.New(key(t), 0.001, 2, keyserver.WithGlobalLimit(0.001, 3))
+	blinded, _, _ := keyserver.Blind(srv.PublicKey(), []byte("guess"))
+
+	// a new ID per guess is still one client
+	for i := 0; i < 2; i++ {
+		if _, err := srv.Evaluate(fmt.Sprint("sybil-", i), "10.0.0.2", blinded); err != nil {
+			t.Fatalf("evaluation %d: %v", i, err)
+		}
+	}
+	if _, err := srv.Evaluate("sybil-2", "10.0.0.2", blinded); !errors.Is(err, keyserver.ErrRateLimited) {
+		t.Errorf("switching IDs: err = %v; want ErrRateLimited", err)
+	}
+
+	// and many clients share the global budget
+	if _, err := srv.Evaluate("alice", "10.0.0.3", blinded); err != nil {
+		t.Fatalf("third evaluation: %v", err)
+	}
+	if _, err := srv.Tag("bob", "10.0.0.4", []byte("guess")); !errors.Is(err, keyserver.ErrRateLimited) {
+		t.Errorf("over the global budget: err = %v; want ErrRateLimited", err)
+	}
+}
+
+func TestEvaluate_IsTheRSASignature(t *testing.T) {
+	// The server blinds its own exponentiation; the answer must still be
+	// exactly x^d mod N, the same on every call.
+	srv := keyserver.New(key(t), 100, 100)
+	pub := srv.PublicKey()
+	x := new(big.Int).Sub(pub.N, big.NewInt(12345))
+	in := x.FillBytes(make([]byte, pub.Size()))
+	first, err := srv.Evaluate("alice", "10.0.0.1", in)
+	if err != nil {
+		t.Fatalf("Evaluate error: %v", err)
+	}
+	second, err := srv.Evaluate("alice", "10.0.0.1", in)
+	if err != nil {
+		t.Fatalf("Evaluate error: %v", err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Error("Evaluate answers differ for the same input")
+	}
+	sig := new(big.Int).SetBytes(first)
+	if new(big.Int).Exp(sig, big.NewInt(int64(pub.E)), pub.N).Cmp(x) != 0 {
+		t.Error("Evaluate answer is not a signature on its input")
+	}
+}
+
+func TestEvaluate_RejectsOutOfRange(t *testing.T) {
+	srv := keyserver.New(key(t), 100, 100)
+	if _, err := srv.Evaluate("alice", "10.0.0.1", []byte{0}); !errors.Is(err, keyserver.ErrInvalidElement) {
+		t.Errorf("zero: err = %v; want ErrInvalidElement", err)
+	}
+	tooBig := bytes.Repeat([]byte{0xff}, srv.PublicKey().Size())
+	if _, err := srv.Evaluate("alice", "10.0.0.1", tooBig); !errors.Is(err, keyserver.ErrInvalidElement) {
+		t.Errorf(">= N: err = %v; want ErrInvalidElement", err)
+	}
+}
+
+func TestLoadKey(t *testing.T) {
+	k := key(t)
+	dir := t.TempDir()
+
+	pkcs1 := filepath.Join(dir, "pkcs1.pem")
+	os.WriteFile(pkcs1, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}), 0o600)
+	der, _ := x509.MarshalPKCS8PrivateKey(k)
+	pkcs8 := filepath.Join(dir, "pkcs8.pem")
+	os.WriteFile(pkcs8, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+
+	for _, p := range []string{pkcs1, pkcs8} {
+		got, err := keyserver.LoadKey(p)
+		if err != nil {
+			t.Fatalf("LoadKey(%s) error: %v", filepath.Base(p), err)
+		}
+		if got.N.Cmp(k.N) != 0 {
+			t.Errorf("LoadKey(%s) returned a different key", filepath.Base(p))
+		}
+	}
+}
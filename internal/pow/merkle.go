@@ -0,0 +1,157 @@
+// Package pow implements Merkle-tree proofs of ownership (Halevi et al.): a
+// server that keeps only a file's Merkle root can challenge a client for
+// random leaves and their authentication paths, and so check that the client
+// holds the whole file rather than just its hash.
+package pow
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+)
+
+// LeafSize is the number of file bytes under each leaf.
+const LeafSize = 1024
+
+// NumLeaves returns the leaf count for a file of size bytes (at least one).
+func NumLeaves(size int64) int {
+	if size <= 0 {
+		return 1
+	}
+	return int((size + LeafSize - 1) / LeafSize)
+}
+
+// leaf returns the bytes under leaf i of data.
+func leaf(data []byte, i int) []byte {
+	start := i * LeafSize
+	end := min(start+LeafSize, len(data))
+	return data[start:end]
+}
+
+func leafHash(b []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(b)
+	return h.Sum(nil)
+}
+
+func nodeHash(l, r []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(l)
+	h.Write(r)
+	return h.Sum(nil)
+}
+
+// Tree is a Merkle tree over a file's leaves. A node without a sibling is
+// carried up to the next level unchanged.
+type Tree struct {
+	levels [][][]byte // levels[0] = leaf hashes, last level = root
+}
+
+// Build hashes data into a Tree.
+func Build(data []byte) *Tree {
+	n := NumLeaves(int64(len(data)))
+	level := make([][]byte, n)
+	for i := range level {
+		level[i] = leafHash(leaf(data, i))
+	}
+	t := &Tree{levels: [][][]byte{level}}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, nodeHash(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Root returns the tree's root hash.
+func (t *Tree) Root() []byte {
+	return t.levels[len(t.levels)-1][0]
+}
+
+// NumLeaves returns the number of leaves in the tree.
+func (t *Tree) NumLeaves() int {
+	return len(t.levels[0])
+}
+
+// Proof is a leaf and the sibling hashes on its path to the root.
+type Proof struct {
+	Index int      `json:"index"`
+	Leaf  []byte   `json:"leaf"`
+	Path  [][]byte `json:"path"`
+}
+
+// Prove builds the proof for leaf index of data, which must be the data the
+// tree was built from.
+func (t *Tree) Prove(data []byte, index int) (Proof, error) {
+	if index < 0 || index >= t.NumLeaves() {
+		return Proof{}, fmt.Errorf("pow: leaf %d out of range [0, %d)", index, t.NumLeaves())
+	}
+	p := Proof{Index: index, Leaf: leaf(data, index)}
+	idx := index
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sib := idx ^ 1
+		if sib < len(level) {
+			p.Path = append(p.Path, level[sib])
+		}
+		idx /= 2
+	}
+	return p, nil
+}
+
+// Verify checks p against a tree of numLeaves leaves with the given root.
+func Verify(root []byte, numLeaves int, p Proof) bool {
+	if p.Index < 0 || p.Index >= numLeaves || len(p.Leaf) > LeafSize {
+		return false
+	}
+	h := leafHash(p.Leaf)
+	idx, n, used := p.Index, numLeaves, 0
+	for n > 1 {
+		switch {
+		case idx%2 == 1:
+			if used >= len(p.Path) {
+				return false
+			}
+			h = nodeHash(p.Path[used], h)
+			used++
+		case idx+1 < n:
+			if used >= len(p.Path) {
+				return false
+			}
+			h = nodeHash(h, p.Path[used])
+			used++
+		}
+		idx /= 2
+		n = (n + 1) / 2
+	}
+	return used == len(p.Path) && bytes.Equal(h, root)
+}
+
+// RandomIndices picks min(k, numLeaves) distinct leaf indices uniformly.
+func RandomIndices(numLeaves, k int) ([]int, error) {
+	k = min(k, numLeaves)
+	seen := make(map[int]bool, k)
+	out := make([]int, 0, k)
+	for len(out) < k {
+		v, err := rand.Int(rand.Reader, big.NewInt(int64(numLeaves)))
+		if err != nil {
+			return nil, err
+		}
+		i := int(v.Int64())
+		if !seen[i] {
+			seen[i] = true
+			out = append(out, i)
+		}
+	}
+	return out, nil
+}
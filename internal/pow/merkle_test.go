@@ -0,0 +1,77 @@
+package pow_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/pow"
+)
+
+func TestProveVerify_AllLeaves(t *testing.T) {
+	for _, size := range []int{0, 1, pow.LeafSize, pow.LeafSize + 1, 5*pow.LeafSize + 3, 8 * pow.LeafSize} {
+		data := make([]byte, size)
+		rand.Read(data)
+		tree := pow.Build(data)
+		if tree.NumLeaves() != pow.NumLeaves(int64(size)) {
+			t.Fatalf("size %d: NumLeaves = %d; want %d", size, tree.NumLeaves(), pow.NumLeaves(int64(size)))
+		}
+		for i := 0; i < tree.NumLeaves(); i++ {
+			p, err := tree.Prove(data, i)
+			if err != nil {
+				t.Fatalf("size %d: Prove(%d) error: %v", size, i, err)
+			}
+			if !pow.Verify(tree.Root(), tree.NumLeaves(), p) {
+				t.Errorf("size %d: proof for leaf %d rejected", size, i)
+			}
+		}
+	}
+}
+
+func TestVerify_RejectsForgeries(t *testing.T) {
+	data := make([]byte, 7*pow.LeafSize)
+	rand.Read(data)
+	tree := pow.Build(data)
+	p, _ := tree.Prove(data, 3)
+
+	bad := p
+	bad.Leaf = bytes.Repeat([]byte{0}, len(p.Leaf))
+	if pow.Verify(tree.Root(), tree.NumLeaves(), bad) {
+		t.Error("accepted a proof with the wrong leaf bytes")
+	}
+
+	bad = p
+	bad.Index = 2
+	if pow.Verify(tree.Root(), tree.NumLeaves(), bad) {
+		t.Error("accepted a proof for the wrong index")
+	}
+
+	bad = p
+	bad.Path = p.Path[:len(p.Path)-1]
+	if pow.Verify(tree.Root(), tree.NumLeaves(), bad) {
+		t.Error("accepted a proof with a short path")
+	}
+
+	// Leaf 6 of 7 has no sibling; under an 8-leaf shape the path is too short.
+	last, _ := tree.Prove(data, 6)
+	if pow.Verify(tree.Root(), tree.NumLeaves()+1, last) {
+		t.Error("accepted a proof against the wrong leaf count")
+	}
+}
+
+func TestRandomIndices(t *testing.T) {
+	idx, err := pow.RandomIndices(10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := map[int]bool{}
+	for _, i := range idx {
+		if i < 0 || i >= 10 || seen[i] {
+			t.Fatalf("bad indices %v", idx)
+		}
+		seen[i] = true
+	}
+	if all, _ := pow.RandomIndices(3, 10); len(all) != 3 {
+		t.Errorf("expected k to be capped at numLeaves, got %v", all)
+	}
+}
@@ -0,0 +1,234 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrLimited is matched by every error a Limiter returns.
+var ErrLimited = errors.New("ratelimit: limit exceeded")
+
+// Error names the limit a request ran into and when to try again.
+type Error struct {
+	Limit      string // e.g. "owner request rate"
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ratelimit: %s exceeded; retry in %s", e.Limit, e.RetryAfter.Round(time.Millisecond))
+}
+
+func (e *Error) Is(target error) bool { return target == ErrLimited }
+
+// RetryAfter returns the Retry-After header for err, in whole seconds
+// rounded up, or "" if err is not an *Error.
+func RetryAfter(err error) string {
+	var e *Error
+	if !errors.As(err, &e) {
+		return ""
+	}
+	return strconv.Itoa(max(1, int(math.Ceil(e.RetryAfter.Seconds()))))
+}
+
+// uploadRetry is the Retry-After suggested when all of an owner's upload
+// slots are taken; when one frees up cannot be known.
+const uploadRetry = time.Second
+
+// minByteBurst is the smallest burst of a byte bucket, so that reads and
+// writes are not cut into tiny pieces at low rates.
+const minByteBurst = 64 << 10
+
+// Limits configures a Limiter. A zero rate or cap leaves that limit off.
+type Limits struct {
+	OwnerRequests  float64 // requests per second per owner
+	OwnerBurst     int
+	GlobalRequests float64 // requests per second over all owners
+	GlobalBurst    int
+	OwnerBytes     float64 // body bytes per second per owner, each way
+	GlobalBytes    float64 // body bytes per second over all owners, each way
+	OwnerUploads   int     // concurrent uploads per owner
+}
+
+// Limiter applies per-owner and global request rates, byte rates and a
+// per-owner cap on concurrent uploads. Requests over a request rate or the
+// upload cap are refused; bodies over a byte rate are slowed down. A nil
+// *Limiter limits nothing.
+type Limiter struct {
+	ownerReqs   *Keyed
+	globalReqs  *Bucket
+	ownerBytes  *Keyed
+	globalBytes *Bucket
+	byteChunk   int // largest piece of a body charged at once
+
+	maxUploads int
+	mu         sync.Mutex
+	uploads    map[string]int // uploads in flight by owner
+}
+
+// NewLimiter returns a Limiter enforcing l.
+func NewLimiter(l Limits) *Limiter {
+	lim := &Limiter{maxUploads: l.OwnerUploads, uploads: make(map[string]int)}
+	if l.OwnerRequests > 0 {
+		lim.ownerReqs = NewKeyed(l.OwnerRequests, max(l.OwnerBurst, 1))
+	}
+	if l.GlobalRequests > 0 {
+		lim.globalReqs = NewBucket(l.GlobalRequests, max(l.GlobalBurst, 1))
+	}
+	// Byte buckets hold a second's worth; a body is charged in pieces no
+	// larger than the smallest of them.
+	lim.byteChunk = 1 << 30
+	if l.OwnerBytes > 0 {
+		burst := max(int(l.OwnerBytes), minByteBurst)
+		lim.ownerBytes = NewKeyed(l.OwnerBytes, burst)
+		lim.byteChunk = min(lim.byteChunk, burst)
+	}
+	if l.GlobalBytes > 0 {
+		burst := max(int(l.GlobalBytes), minByteBurst)
+		lim.globalBytes = NewBucket(l.GlobalBytes, burst)
+		lim.byteChunk = min(lim.byteChunk, burst)
+	}
+	return lim
+}
+
+// Allow admits one request by owner, or returns an *Error. An empty owner
+// is only held to the global rate.
+func (l *Limiter) Allow(owner string) error {
+	if l == nil {
+		return nil
+	}
+	if l.ownerReqs != nil && owner != "" {
+		if ok, wait := l.ownerReqs.Allow(owner); !ok {
+			return &Error{Limit: "owner request rate", RetryAfter: wait}
+		}
+	}
+	if l.globalReqs != nil {
+		if ok, wait := l.globalReqs.AllowN(time.Now(), 1); !ok {
+			return &Error{Limit: "global request rate", RetryAfter: wait}
+		}
+	}
+	return nil
+}
+
+// StartUpload takes one of owner's upload slots, or returns an *Error if
+// all are taken. release gives the slot back; calling it again does nothing.
+func (l *Limiter) StartUpload(owner string) (release func(), err error) {
+	if l == nil || l.maxUploads <= 0 {
+		return func() {}, nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.uploads[owner] >= l.maxUploads {
+		return nil, &Error{Limit: "concurrent uploads", RetryAfter: uploadRetry}
+	}
+	l.uploads[owner]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.uploads[owner]--; l.uploads[owner] == 0 {
+				delete(l.uploads, owner)
+			}
+		})
+	}, nil
+}
+
+// buckets returns the byte buckets owner's bodies are charged to.
+func (l *Limiter) buckets(owner string) []*Bucket {
+	if l == nil {
+		return nil
+	}
+	var bs []*Bucket
+	if l.ownerBytes != nil && owner != "" {
+		bs = append(bs, l.ownerBytes.bucket(owner, time.Now()))
+	}
+	if l.globalBytes != nil {
+		bs = append(bs, l.globalBytes)
+	}
+	return bs
+}
+
+// Reader slows reads from r to owner's byte rates. Waiting ends with ctx.
+func (l *Limiter) Reader(ctx context.Context, owner string, r io.Reader) io.Reader {
+	bs := l.buckets(owner)
+	if len(bs) == 0 {
+		return r
+	}
+	return &reader{ctx: ctx, r: r, buckets: bs, chunk: l.byteChunk}
+}
+
+// ResponseWriter slows writes to w to owner's byte rates. Waiting ends with
+// ctx.
+func (l *Limiter) ResponseWriter(ctx context.Context, owner string, w http.ResponseWriter) http.ResponseWriter {
+	bs := l.buckets(owner)
+	if len(bs) == 0 {
+		return w
+	}
+	return &responseWriter{ResponseWriter: w, ctx: ctx, buckets: bs, chunk: l.byteChunk}
+}
+
+// waitAll takes n tokens from each bucket in turn.
+func waitAll(ctx context.Context, buckets []*Bucket, n int) error {
+	for _, b := range buckets {
+		if err := b.WaitN(ctx, float64(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type reader struct {
+	ctx     context.Context
+	r       io.Reader
+	buckets []*Bucket
+	chunk   int
+}
+
+// Read charges what it read, so a short read never waits for bytes that
+// did not come.
+func (t *reader) Read(p []byte) (int, error) {
+	if len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := waitAll(t.ctx, t.buckets, n); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+type responseWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*Bucket
+	chunk   int
+}
+
+func (t *responseWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), t.chunk)
+		if err := waitAll(t.ctx, t.buckets, n); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(p[:n])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (t *responseWriter) Unwrap() http.ResponseWriter { return t.ResponseWriter }
@@ -0,0 +1,119 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket refilled at rate tokens per second, holding at
+// most burst tokens. It starts full.
+type Bucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket returns a full bucket.
+func NewBucket(rate float64, burst int) *Bucket {
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// refill tops the bucket up for the time elapsed since the last call.
+func (b *Bucket) refill(now time.Time) {
+	if !b.last.IsZero() {
+		b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	}
+	b.last = now
+}
+
+// AllowN takes n tokens if available. Otherwise it takes nothing and reports
+// how long until n tokens will be.
+func (b *Bucket) AllowN(now time.Time, n float64) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens >= n {
+		b.tokens -= n
+		return true, 0
+	}
+	if b.rate <= 0 {
+		return false, time.Duration(1<<63 - 1)
+	}
+	return false, time.Duration((n - b.tokens) / b.rate * float64(time.Second))
+}
+
+// WaitN blocks until n tokens are available and takes them, or returns
+// ctx's error once it is done. n must not exceed the burst.
+func (b *Bucket) WaitN(ctx context.Context, n float64) error {
+	for {
+		ok, wait := b.AllowN(time.Now(), n)
+		if ok {
+			return nil
+		}
+		t := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// full reports whether the bucket has refilled completely, i.e. it carries no
+// state worth keeping.
+func (b *Bucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// sweepThreshold is the number of tracked keys above which Keyed drops idle
+// buckets.
+const sweepThreshold = 10000
+
+// Keyed keeps one Bucket per key, e.g. per owner.
+type Keyed struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   int
+	buckets map[string]*Bucket
+}
+
+// NewKeyed returns a limiter granting each key rate tokens per second up to burst.
+func NewKeyed(rate float64, burst int) *Keyed {
+	return &Keyed{rate: rate, burst: burst, buckets: make(map[string]*Bucket)}
+}
+
+// Allow takes one token from key's bucket.
+func (k *Keyed) Allow(key string) (bool, time.Duration) {
+	return k.AllowN(key, 1)
+}
+
+// AllowN takes n tokens from key's bucket.
+func (k *Keyed) AllowN(key string, n float64) (bool, time.Duration) {
+	now := time.Now()
+	return k.bucket(key, now).AllowN(now, n)
+}
+
+func (k *Keyed) bucket(key string, now time.Time) *Bucket {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	b, ok := k.buckets[key]
+	if !ok {
+		if len(k.buckets) >= sweepThreshold {
+			for key, idle := range k.buckets {
+				if idle.full(now) {
+					delete(k.buckets, key)
+				}
+			}
+		}
+		b = NewBucket(k.rate, k.burst)
+		k.buckets[key] = b
+	}
+	return b
+}
@@ -0,0 +1,140 @@
+package ratelimit_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+func TestBucket_BurstThenRefill(t *testing.T) {
+	b := ratelimit.NewBucket(2, 3) // 2 tokens/s, burst 3
+	now := time.Unix(1000, 0)
+	for i := 0; i < 3; i++ {
+		if ok, _ := b.AllowN(now, 1); !ok {
+			t.Fatalf("request %d within burst was denied", i)
+		}
+	}
+	ok, wait := b.AllowN(now, 1)
+	if ok {
+		t.Fatal("expected request beyond burst to be denied")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v; want 500ms", wait)
+	}
+	if ok, _ := b.AllowN(now.Add(500*time.Millisecond), 1); !ok {
+		t.Error("expected a token after refilling for 500ms")
+	}
+}
+
+func TestBucket_NeverExceedsBurst(t *testing.T) {
+	b := ratelimit.NewBucket(100, 2)
+	now := time.Unix(1000, 0)
+	b.AllowN(now, 0)
+	later := now.Add(time.Hour)
+	if ok, _ := b.AllowN(later, 3); ok {
+		t.Error("expected 3 tokens to exceed a burst of 2")
+	}
+	if ok, _ := b.AllowN(later, 2); !ok {
+		t.Error("expected burst worth of tokens to be available")
+	}
+}
+
+func TestKeyed_Independent(t *testing.T) {
+	k := ratelimit.NewKeyed(0.001, 1)
+	if ok, _ := k.Allow("alice"); !ok {
+		t.Fatal("first alice request denied")
+	}
+	if ok, _ := k.Allow("alice"); ok {
+		t.Error("second alice request should be limited")
+	}
+	if ok, _ := k.Allow("bob"); !ok {
+		t.Error("bob should have a separate bucket")
+	}
+}
+
+func TestLimiter_Requests(t *testing.T) {
+	l := ratelimit.NewLimiter(ratelimit.Limits{OwnerRequests: 0.001, OwnerBurst: 1, GlobalRequests: 0.001, GlobalBurst: 3})
+	if err := l.Allow("alice"); err != nil {
+		t.Fatalf("first alice request: %v", err)
+	}
+	err := l.Allow("alice")
+	var le *ratelimit.Error
+	if !errors.Is(err, ratelimit.ErrLimited) || !errors.As(err, &le) || le.RetryAfter <= 0 {
+		t.Fatalf("second alice request: got %v, want a limit error with a retry time", err)
+	}
+	if err := l.Allow("bob"); err != nil {
+		t.Errorf("bob's first request: %v", err)
+	}
+	if err := l.Allow(""); err != nil {
+		t.Errorf("anonymous request within the global burst: %v", err)
+	}
+	if err := l.Allow("carol"); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Errorf("request past the global burst: got %v", err)
+	}
+}
+
+func TestLimiter_UploadSlots(t *testing.T) {
+	l := ratelimit.NewLimiter(ratelimit.Limits{OwnerUploads: 2})
+	r1, err := l.StartUpload("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.StartUpload("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.StartUpload("alice"); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Fatalf("third concurrent upload: got %v", err)
+	}
+	if _, err := l.StartUpload("bob"); err != nil {
+		t.Errorf("bob's upload: %v", err)
+	}
+	r1()
+	r1() // releasing twice frees one slot only
+	if _, err := l.StartUpload("alice"); err != nil {
+		t.Errorf("upload after a release: %v", err)
+	}
+	if _, err := l.StartUpload("alice"); !errors.Is(err, ratelimit.ErrLimited) {
+		t.Errorf("double release freed a second slot: got %v", err)
+	}
+}
+
+func TestLimiter_ReaderThrottles(t *testing.T) {
+	const rate = 64 << 10
+	l := ratelimit.NewLimiter(ratelimit.Limits{OwnerBytes: rate})
+	data := make([]byte, rate+rate/4) // a full burst, then a quarter second's worth
+	start := time.Now()
+	got, err := io.ReadAll(l.Reader(context.Background(), "alice", bytes.NewReader(data)))
+	if err != nil || len(got) != len(data) {
+		t.Fatalf("read %d bytes, %v", len(got), err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("read %d bytes at %d/s in %s", len(data), rate, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := io.ReadAll(l.Reader(ctx, "alice", bytes.NewReader(data))); !errors.Is(err, context.Canceled) {
+		t.Errorf("throttled read after cancel: got %v", err)
+	}
+}
+
+func TestLimiter_Nil(t *testing.T) {
+	var l *ratelimit.Limiter
+	if err := l.Allow("alice"); err != nil {
+		t.Error(err)
+	}
+	release, err := l.StartUpload("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release()
+	r := bytes.NewReader(nil)
+	if l.Reader(context.Background(), "alice", r) != io.Reader(r) {
+		t.Error("nil limiter wrapped a reader")
+	}
+}
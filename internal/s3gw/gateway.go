@@ -0,0 +1,399 @@
+// Package s3gw serves an S3-compatible API over the DSDE file service, so
+// tools that speak S3 (restic, rclone, the AWS CLI) store objects that are
+// deduplicated and double-layer encrypted like any other upload.
+//
+// Buckets are owners and keys are paths in the owner's namespace: PUT
+// s3://alice/photos/cat.jpg uploads a new version of alice's
+// photos/cat.jpg. Each access key is bound to one owner and may only use
+// that owner's bucket. Requests are authenticated with AWS Signature V4 in
+// the Authorization header, path-style addressing only. A key ending in "/"
+// is a folder marker and maps to a folder.
+//
+// Objects are buffered in memory, like every upload to the service, so
+// their size is bounded; multipart uploads keep their parts sealed under a
+// per-upload key in the object store until they are completed.
+package s3gw
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/keyserver"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+)
+
+// Files is the namespace and file service objects live in; *dsde.Service
+// implements it.
+type Files interface {
+	FilePath(ctx context.Context, ownerID, p string) (string, error)
+	UploadWithCodec(ctx context.Context, ownerID, filename string, c codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error)
+	UploadChunks(ctx context.Context, ownerID, filename string, r io.Reader) (string, []byte, []byte, []byte, error)
+	Versions(ctx context.Context, ownerID, path string) ([]db.FileVersion, error)
+	Download(ctx context.Context, ownerID, fileID string) (io.ReadCloser, error)
+	Stat(ctx context.Context, ownerID, p string) (file, folder bool, err error)
+	List(ctx context.Context, ownerID, p string, recursive bool) ([]db.TreeEntry, error)
+	Mkdir(ctx context.Context, ownerID, p string) error
+	Rmdir(ctx context.Context, ownerID, p string) error
+	DeletePath(ctx context.Context, ownerID, path string) error
+	Quota(ctx context.Context, ownerID string) (dsde.OwnerQuota, error)
+}
+
+// Meta records S3 attributes by file ID; *db.Client implements it.
+type Meta interface {
+	PutObjectMeta(m db.ObjectMeta) error
+	ObjectMetas(fileIDs []string) (map[string]db.ObjectMeta, error)
+}
+
+// Blobs holds multipart parts until they are assembled; *storage.Client
+// implements it.
+type Blobs interface {
+	PutObject(ctx context.Context, key string, body io.Reader) error
+	GetObject(ctx context.Context, key string) (io.ReadCloser, error)
+	DeleteObject(ctx context.Context, key string) error
+}
+
+// Gateway is the S3 front end. It is an http.Handler.
+type Gateway struct {
+	files Files
+	meta  Meta
+	blobs Blobs
+	creds map[string]Credential // by access key
+
+	codec     codec.Codec
+	chunks    bool  // store objects in chunk mode instead of DSDE
+	maxObject int64 // largest object accepted, in bytes
+	maxSkew   time.Duration
+	limits    *ratelimit.Limiter // nil: unlimited
+
+	mu      sync.Mutex
+	uploads map[string]*multipartUpload // in-progress multipart uploads by ID
+}
+
+// Option configures a Gateway.
+type Option func(*Gateway)
+
+// WithCodec compresses objects with c before they are sealed.
+func WithCodec(c codec.Codec) Option {
+	return func(g *Gateway) {
+		g.codec = c
+	}
+}
+
+// WithChunkMode stores objects in chunk mode.
+func WithChunkMode() Option {
+	return func(g *Gateway) {
+		g.chunks = true
+	}
+}
+
+// WithMaxObjectSize bounds objects, and so the memory one upload takes, to n
+// bytes. The default is 1 GiB.
+func WithMaxObjectSize(n int64) Option {
+	return func(g *Gateway) {
+		g.maxObject = n
+	}
+}
+
+// WithLimiter holds each owner's requests to l's request rates, byte rates
+// and concurrent upload cap. Refused requests get SlowDown with a
+// Retry-After.
+func WithLimiter(l *ratelimit.Limiter) Option {
+	return func(g *Gateway) {
+		g.limits = l
+	}
+}
+
+// New returns a Gateway storing objects in files, their attributes in meta
+// and multipart parts in blobs, for the owners creds give access to.
+func New(files Files, meta Meta, blobs Blobs, creds []Credential, opts ...Option) *Gateway {
+	g := &Gateway{
+		files:     files,
+		meta:      meta,
+		blobs:     blobs,
+		creds:     make(map[string]Credential, len(creds)),
+		codec:     codec.None,
+		maxObject: 1 << 30,
+		maxSkew:   15 * time.Minute,
+		uploads:   make(map[string]*multipartUpload),
+	}
+	for _, c := range creds {
+		g.creds[c.AccessKey] = c
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	return g
+}
+
+// ServeHTTP authenticates the request and dispatches it on bucket, key,
+// method and query.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cred, body, err := g.authenticate(r, time.Now())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+
+	if err := g.limits.Allow(cred.Owner); err != nil {
+		slowDown(w, r, err)
+		return
+	}
+	if r.Method == http.MethodPut && key != "" {
+		release, err := g.limits.StartUpload(cred.Owner)
+		if err != nil {
+			slowDown(w, r, err)
+			return
+		}
+		defer release()
+	}
+	r.Body = io.NopCloser(g.limits.Reader(r.Context(), cred.Owner, body))
+	w = g.limits.ResponseWriter(r.Context(), cred.Owner, w)
+
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		g.listBuckets(w, cred)
+		return
+	}
+	if bucket != cred.Owner {
+		writeError(w, r, errAccessDenied)
+		return
+	}
+
+	q := r.URL.Query()
+	// SDKs tag requests with the operation name; it carries no meaning
+	delete(q, "x-id")
+	if key == "" {
+		err = g.serveBucket(w, r, bucket, q)
+	} else {
+		err = g.serveObject(w, r, bucket, key, q)
+	}
+	if err != nil {
+		writeError(w, r, err)
+	}
+}
+
+func (g *Gateway) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, q map[string][]string) error {
+	has := func(k string) bool { _, ok := q[k]; return ok }
+	switch {
+	case r.Method == http.MethodHead:
+		return nil
+	case r.Method == http.MethodPut && len(q) == 0:
+		// the bucket exists as soon as its owner does
+		return nil
+	case r.Method == http.MethodGet && has("location"):
+		return writeXML(w, http.StatusOK, locationConstraint{})
+	case r.Method == http.MethodGet && !has("uploads") && !has("versions") && !has("policy") && !has("acl"):
+		return g.listObjects(w, r, bucket)
+	case r.Method == http.MethodPost && has("delete"):
+		return g.deleteObjects(w, r, bucket)
+	}
+	return errNotImplemented
+}
+
+func (g *Gateway) serveObject(w http.ResponseWriter, r *http.Request, bucket, key string, q map[string][]string) error {
+	has := func(k string) bool { _, ok := q[k]; return ok }
+	switch r.Method {
+	case http.MethodPut:
+		switch {
+		case has("partNumber") && has("uploadId"):
+			return g.uploadPart(w, r, bucket, key)
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			return errNotImplemented
+		case len(q) == 0:
+			return g.putObject(w, r, bucket, key)
+		}
+	case http.MethodGet:
+		if len(q) == 0 || onlyResponseOverrides(q) {
+			return g.getObject(w, r, bucket, key, true)
+		}
+	case http.MethodHead:
+		if len(q) == 0 {
+			return g.getObject(w, r, bucket, key, false)
+		}
+	case http.MethodDelete:
+		switch {
+		case has("uploadId"):
+			return g.abortMultipart(w, r, bucket, key)
+		case len(q) == 0:
+			return g.deleteObject(w, r, bucket, key)
+		}
+	case http.MethodPost:
+		switch {
+		case has("uploads"):
+			return g.createMultipart(w, r, bucket, key)
+		case has("uploadId"):
+			return g.completeMultipart(w, r, bucket, key)
+		}
+	}
+	return errNotImplemented
+}
+
+// onlyResponseOverrides reports whether a GET's query only asks to override
+// response headers, which the gateway ignores.
+func onlyResponseOverrides(q map[string][]string) bool {
+	for k := range q {
+		if !strings.HasPrefix(k, "response-") {
+			return false
+		}
+	}
+	return true
+}
+
+// keyPath maps an object key to a namespace path. Keys that would not map
+// back to themselves ("a//b", "/a", "a/./b") are rejected.
+func keyPath(key string) (p string, folder bool, err error) {
+	folder = strings.HasSuffix(key, "/")
+	trimmed := strings.TrimSuffix(key, "/")
+	p, err = dsde.CleanPath(trimmed)
+	if err != nil || p != trimmed || p == "" {
+		return "", false, errInvalidKey
+	}
+	return p, folder, nil
+}
+
+// fileError maps a file service error to an S3 error.
+func fileError(err error) error {
+	switch {
+	case errors.Is(err, dsde.ErrFileNotFound):
+		return errNoSuchKey
+	case errors.Is(err, dsde.ErrExists):
+		return &apiError{http.StatusConflict, "OperationAborted", err.Error()}
+	case errors.Is(err, dsde.ErrInvalidPath):
+		return errInvalidKey
+	case errors.Is(err, dsde.ErrQuotaExceeded):
+		return &apiError{http.StatusInsufficientStorage, "QuotaExceeded", err.Error()}
+	case errors.Is(err, keyserver.ErrRateLimited):
+		return errSlowDown
+	}
+	return err
+}
+
+// slowDown refuses a request over a limit, saying when to retry.
+func slowDown(w http.ResponseWriter, r *http.Request, err error) {
+	if after := ratelimit.RetryAfter(err); after != "" {
+		w.Header().Set("Retry-After", after)
+	}
+	writeError(w, r, errSlowDown)
+}
+
+// apiError is an S3 error response.
+type apiError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *apiError) Error() string { return e.Code + ": " + e.Message }
+
+var (
+	errAccessDenied       = &apiError{http.StatusForbidden, "AccessDenied", "Access Denied"}
+	errInvalidAccessKeyID = &apiError{http.StatusForbidden, "InvalidAccessKeyId", "The access key ID you provided does not exist in our records."}
+	errSignatureMismatch  = &apiError{http.StatusForbidden, "SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided."}
+	errRequestTimeSkewed  = &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large."}
+	errAuthMalformed      = &apiError{http.StatusBadRequest, "AuthorizationHeaderMalformed", "The authorization header is malformed."}
+	errContentSHA256      = &apiError{http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed."}
+	errBadDigest          = &apiError{http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received."}
+	errIncompleteBody     = &apiError{http.StatusBadRequest, "IncompleteBody", "The request body is malformed or incomplete."}
+	errEntityTooLarge     = &apiError{http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size."}
+	errInvalidKey         = &apiError{http.StatusBadRequest, "InvalidArgument", "The key does not map to a path: no empty, '.' or '..' segments."}
+	errInvalidArgument    = &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid argument."}
+	errMalformedXML       = &apiError{http.StatusBadRequest, "MalformedXML", "The XML you provided was not well-formed."}
+	errInvalidPart        = &apiError{http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found or its entity tag did not match."}
+	errInvalidPartOrder   = &apiError{http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order."}
+	errNoSuchKey          = &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	errNoSuchUpload       = &apiError{http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist."}
+	errMethodNotAllowed   = &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource."}
+	errInvalidRange       = &apiError{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable."}
+	errNotImplemented     = &apiError{http.StatusNotImplemented, "NotImplemented", "A header or query you provided implies functionality that is not implemented."}
+	errSlowDown           = &apiError{http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate."}
+	errSignedTrailers     = &apiError{http.StatusNotImplemented, "NotImplemented", "Signed trailers are not supported; use unsigned trailers or a signed payload."}
+)
+
+type errorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// writeError sends err as an S3 error document; errors that are not S3
+// errors are logged and sent as InternalError.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	var e *apiError
+	if !errors.As(err, &e) {
+		zap.L().Named("s3gw").Error("request", zap.Error(err), zap.String("method", r.Method), zap.String("path", r.URL.Path))
+		e = &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	}
+	if r.Method == http.MethodHead {
+		w.WriteHeader(e.Status)
+		return
+	}
+	writeXML(w, e.Status, errorResponse{
+		Code:      e.Code,
+		Message:   e.Message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get("X-Amz-Request-Id"),
+	})
+}
+
+func writeXML(w http.ResponseWriter, status int, v any) error {
+	out, err := xml.Marshal(v)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(out)
+	return nil
+}
+
+type locationConstraint struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ LocationConstraint"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   owner    `xml:"Owner"`
+	Buckets []bucket `xml:"Buckets>Bucket"`
+}
+
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// listBuckets lists the one bucket the credential gives access to.
+func (g *Gateway) listBuckets(w http.ResponseWriter, cred Credential) {
+	writeXML(w, http.StatusOK, listAllMyBucketsResult{
+		Owner:   owner{ID: cred.Owner, DisplayName: cred.Owner},
+		Buckets: []bucket{{Name: cred.Owner, CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339)}},
+	})
+}
+
+// etag quotes an entity tag for a header or document.
+func etag(tag string) string {
+	return fmt.Sprintf("%q", tag)
+}
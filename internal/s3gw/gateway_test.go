@@ -0,0 +1,431 @@
+package s3gw_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/codec"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/ratelimit"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/s3gw"
+)
+
+// memFiles is an in-memory stand-in for the file service: versioned paths
+// per owner, folders implied by paths.
+type memFiles struct {
+	mu       sync.Mutex
+	next     int
+	data     map[string][]byte           // by file ID
+	versions map[string][]db.FileVersion // by owner/path, oldest first
+	quotas   map[string]dsde.OwnerQuota  // by owner; none: unlimited
+}
+
+func newMemFiles() *memFiles {
+	return &memFiles{data: make(map[string][]byte), versions: make(map[string][]db.FileVersion)}
+}
+
+func (m *memFiles) FilePath(_ context.Context, _, p string) (string, error) {
+	return dsde.CleanPath(p)
+}
+
+func (m *memFiles) UploadWithCodec(_ context.Context, owner, name string, _ codec.Codec, r io.Reader) (string, []byte, []byte, []byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, nil, nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.next++
+	id := fmt.Sprintf("file-%d", m.next)
+	m.data[id] = data
+	k := owner + "/" + name
+	m.versions[k] = append(m.versions[k], db.FileVersion{FileID: id, Version: len(m.versions[k]) + 1, CreatedAt: time.Now()})
+	return id, nil, nil, nil, nil
+}
+
+func (m *memFiles) UploadChunks(ctx context.Context, owner, name string, r io.Reader) (string, []byte, []byte, []byte, error) {
+	return m.UploadWithCodec(ctx, owner, name, codec.None, r)
+}
+
+func (m *memFiles) Versions(_ context.Context, owner, p string) ([]db.FileVersion, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	vs := m.versions[owner+"/"+p]
+	if len(vs) == 0 {
+		return nil, dsde.ErrFileNotFound
+	}
+	out := make([]db.FileVersion, len(vs))
+	for i, v := range vs {
+		out[len(vs)-1-i] = v
+	}
+	return out, nil
+}
+
+func (m *memFiles) Download(_ context.Context, _, fileID string) (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return io.NopCloser(bytes.NewReader(m.data[fileID])), nil
+}
+
+func (m *memFiles) Stat(_ context.Context, owner, p string) (bool, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, file := m.versions[owner+"/"+p]
+	for k := range m.versions {
+		if strings.HasPrefix(k, owner+"/"+p+"/") {
+			return file, true, nil
+		}
+	}
+	return file, false, nil
+}
+
+func (m *memFiles) List(_ context.Context, owner, p string, _ bool) ([]db.TreeEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	prefix := owner + "/"
+	if p != "" {
+		prefix += p + "/"
+	}
+	var out []db.TreeEntry
+	for k, vs := range m.versions {
+		if strings.HasPrefix(k, prefix) {
+			v := vs[len(vs)-1]
+			out = append(out, db.TreeEntry{Path: strings.TrimPrefix(k, owner+"/"), FileID: v.FileID, Version: v.Version, CreatedAt: v.CreatedAt})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out, nil
+}
+
+func (m *memFiles) Quota(_ context.Context, owner string) (dsde.OwnerQuota, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := m.quotas[owner]
+	q.Owner = owner
+	return q, nil
+}
+
+func (m *memFiles) Mkdir(context.Context, string, string) error { return nil }
+func (m *memFiles) Rmdir(context.Context, string, string) error { return dsde.ErrFileNotFound }
+
+func (m *memFiles) DeletePath(_ context.Context, owner, p string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.versions[owner+"/"+p]; !ok {
+		return dsde.ErrFileNotFound
+	}
+	delete(m.versions, owner+"/"+p)
+	return nil
+}
+
+type memMeta struct {
+	mu sync.Mutex
+	m  map[string]db.ObjectMeta
+}
+
+func (m *memMeta) PutObjectMeta(o db.ObjectMeta) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.m[o.FileID] = o
+	return nil
+}
+
+func (m *memMeta) ObjectMetas(ids []string) (map[string]db.ObjectMeta, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make(map[string]db.ObjectMeta)
+	for _, id := range ids {
+		if o, ok := m.m[id]; ok {
+			out[id] = o
+		}
+	}
+	return out, nil
+}
+
+type memBlobs struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (b *memBlobs) PutObject(_ context.Context, key string, body io.Reader) error {
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.m[key] = data
+	return nil
+}
+
+func (b *memBlobs) GetObject(_ context.Context, key string) (io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	data, ok := b.m[key]
+	if !ok {
+		return nil, errors.New("no such blob")
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (b *memBlobs) DeleteObject(_ context.Context, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.m, key)
+	return nil
+}
+
+func newClient(t *testing.T, blobs *memBlobs, opts ...s3gw.Option) *s3.Client {
+	t.Helper()
+	return newClientFor(t, newMemFiles(), blobs, opts...)
+}
+
+func newClientFor(t *testing.T, files *memFiles, blobs *memBlobs, opts ...s3gw.Option) *s3.Client {
+	t.Helper()
+	creds, err := s3gw.ParseCredentials("AKALICE:alice-secret:alice")
+	if err != nil {
+		t.Fatalf("ParseCredentials: %v", err)
+	}
+	gw := s3gw.New(files, &memMeta{m: make(map[string]db.ObjectMeta)}, blobs, creds, opts...)
+	srv := httptest.NewServer(gw)
+	t.Cleanup(srv.Close)
+
+	return s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: aws.String(srv.URL),
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKALICE", "alice-secret", ""),
+	})
+}
+
+func TestGateway_PutGetListDelete(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, &memBlobs{m: make(map[string][]byte)})
+	body := []byte("the quick brown fox jumps over the lazy dog")
+
+	for _, key := range []string{"docs/a.txt", "docs/b.txt", "docs/sub/c.txt", "top.txt"} {
+		_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("alice"), Key: aws.String(key), Body: bytes.NewReader(body)})
+		if err != nil {
+			t.Fatalf("PutObject(%s): %v", key, err)
+		}
+	}
+
+	got, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("alice"), Key: aws.String("docs/a.txt")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	data, _ := io.ReadAll(got.Body)
+	if !bytes.Equal(data, body) {
+		t.Errorf("GetObject body = %q", data)
+	}
+
+	rng, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("alice"), Key: aws.String("docs/a.txt"), Range: aws.String("bytes=4-8")})
+	if err != nil {
+		t.Fatalf("GetObject(range): %v", err)
+	}
+	data, _ = io.ReadAll(rng.Body)
+	if string(data) != "quick" {
+		t.Errorf("ranged GetObject body = %q, want %q", data, "quick")
+	}
+
+	head, err := c.HeadObject(ctx, &s3.HeadObjectInput{Bucket: aws.String("alice"), Key: aws.String("top.txt")})
+	if err != nil {
+		t.Fatalf("HeadObject: %v", err)
+	}
+	if aws.ToInt64(head.ContentLength) != int64(len(body)) {
+		t.Errorf("HeadObject length = %d, want %d", aws.ToInt64(head.ContentLength), len(body))
+	}
+
+	list, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("alice"), Prefix: aws.String("docs/"), Delimiter: aws.String("/")})
+	if err != nil {
+		t.Fatalf("ListObjectsV2: %v", err)
+	}
+	var keys, prefixes []string
+	for _, o := range list.Contents {
+		keys = append(keys, aws.ToString(o.Key))
+	}
+	for _, p := range list.CommonPrefixes {
+		prefixes = append(prefixes, aws.ToString(p.Prefix))
+	}
+	if strings.Join(keys, ",") != "docs/a.txt,docs/b.txt" || strings.Join(prefixes, ",") != "docs/sub/" {
+		t.Errorf("listing = %v, prefixes %v", keys, prefixes)
+	}
+
+	// pagination walks every key exactly once
+	var all []string
+	p := s3.NewListObjectsV2Paginator(c, &s3.ListObjectsV2Input{Bucket: aws.String("alice"), MaxKeys: aws.Int32(1)})
+	for p.HasMorePages() {
+		page, err := p.NextPage(ctx)
+		if err != nil {
+			t.Fatalf("ListObjectsV2 page: %v", err)
+		}
+		for _, o := range page.Contents {
+			all = append(all, aws.ToString(o.Key))
+		}
+	}
+	if strings.Join(all, ",") != "docs/a.txt,docs/b.txt,docs/sub/c.txt,top.txt" {
+		t.Errorf("paginated listing = %v", all)
+	}
+
+	if _, err := c.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String("alice"), Key: aws.String("top.txt")}); err != nil {
+		t.Fatalf("DeleteObject: %v", err)
+	}
+	_, err = c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("alice"), Key: aws.String("top.txt")})
+	var nsk *types.NoSuchKey
+	if !errors.As(err, &nsk) {
+		t.Errorf("expected NoSuchKey after delete, got %v", err)
+	}
+}
+
+func TestGateway_Multipart(t *testing.T) {
+	ctx := context.Background()
+	blobs := &memBlobs{m: make(map[string][]byte)}
+	c := newClient(t, blobs)
+
+	up, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("alice"), Key: aws.String("big.bin")})
+	if err != nil {
+		t.Fatalf("CreateMultipartUpload: %v", err)
+	}
+	parts := [][]byte{bytes.Repeat([]byte("a"), 1000), bytes.Repeat([]byte("b"), 500)}
+	var done []types.CompletedPart
+	for i, data := range parts {
+		res, err := c.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket: aws.String("alice"), Key: aws.String("big.bin"), UploadId: up.UploadId,
+			PartNumber: aws.Int32(int32(i + 1)), Body: bytes.NewReader(data),
+		})
+		if err != nil {
+			t.Fatalf("UploadPart(%d): %v", i+1, err)
+		}
+		done = append(done, types.CompletedPart{ETag: res.ETag, PartNumber: aws.Int32(int32(i + 1))})
+	}
+	for k, v := range blobs.m {
+		if bytes.Contains(v, parts[0][:64]) {
+			t.Errorf("part %s is stored in the clear", k)
+		}
+	}
+
+	res, err := c.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket: aws.String("alice"), Key: aws.String("big.bin"), UploadId: up.UploadId,
+		MultipartUpload: &types.CompletedMultipartUpload{Parts: done},
+	})
+	if err != nil {
+		t.Fatalf("CompleteMultipartUpload: %v", err)
+	}
+	if !strings.HasSuffix(strings.Trim(aws.ToString(res.ETag), `"`), "-2") {
+		t.Errorf("multipart ETag = %s, want an MD5 of MD5s ending in -2", aws.ToString(res.ETag))
+	}
+	if len(blobs.m) != 0 {
+		t.Errorf("%d parts left behind after completion", len(blobs.m))
+	}
+
+	got, err := c.GetObject(ctx, &s3.GetObjectInput{Bucket: aws.String("alice"), Key: aws.String("big.bin")})
+	if err != nil {
+		t.Fatalf("GetObject: %v", err)
+	}
+	data, _ := io.ReadAll(got.Body)
+	if !bytes.Equal(data, bytes.Join(parts, nil)) {
+		t.Errorf("assembled object has %d bytes, want %d", len(data), 1500)
+	}
+}
+
+func TestGateway_MultipartLimits(t *testing.T) {
+	ctx := context.Background()
+	files := newMemFiles()
+	files.quotas = map[string]dsde.OwnerQuota{"alice": {LogicalQuota: 1500, LogicalBytes: 100}}
+	c := newClientFor(t, files, &memBlobs{m: make(map[string][]byte)}, s3gw.WithMaxObjectSize(1200))
+
+	create := func() *string {
+		t.Helper()
+		up, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("alice"), Key: aws.String("big.bin")})
+		if err != nil {
+			t.Fatalf("CreateMultipartUpload: %v", err)
+		}
+		return up.UploadId
+	}
+	put := func(id *string, n, size int) error {
+		_, err := c.UploadPart(ctx, &s3.UploadPartInput{
+			Bucket: aws.String("alice"), Key: aws.String("big.bin"), UploadId: id,
+			PartNumber: aws.Int32(int32(n)), Body: bytes.NewReader(make([]byte, size)),
+		})
+		return err
+	}
+
+	first := create()
+	if err := put(first, 1, 1000); err != nil {
+		t.Fatalf("UploadPart within limits: %v", err)
+	}
+	if err := put(first, 2, 300); err == nil || !strings.Contains(err.Error(), "EntityTooLarge") {
+		t.Errorf("part past the largest object: got %v, want EntityTooLarge", err)
+	}
+	if err := put(first, 1, 1100); err != nil {
+		t.Fatalf("replacing a part counts only the new one: %v", err)
+	}
+	// 100 stored + 1100 held in the first upload leave room for 300 more.
+	second := create()
+	if err := put(second, 1, 301); err == nil || !strings.Contains(err.Error(), "QuotaExceeded") {
+		t.Errorf("part past the quota: got %v, want QuotaExceeded", err)
+	}
+	if err := put(second, 1, 300); err != nil {
+		t.Errorf("part within the quota: %v", err)
+	}
+
+	for i := 2; i < 100; i++ {
+		create()
+	}
+	_, err := c.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{Bucket: aws.String("alice"), Key: aws.String("big.bin")})
+	if err == nil || !strings.Contains(err.Error(), "QuotaExceeded") {
+		t.Errorf("upload past the open upload cap: got %v, want QuotaExceeded", err)
+	}
+}
+
+func TestGateway_RejectsOtherOwnersAndBadSecrets(t *testing.T) {
+	ctx := context.Background()
+	c := newClient(t, &memBlobs{m: make(map[string][]byte)})
+
+	_, err := c.PutObject(ctx, &s3.PutObjectInput{Bucket: aws.String("bob"), Key: aws.String("x"), Body: strings.NewReader("x")})
+	if err == nil || !strings.Contains(err.Error(), "AccessDenied") {
+		t.Errorf("expected AccessDenied for another owner's bucket, got %v", err)
+	}
+
+	bad := s3.New(s3.Options{
+		Region:       "us-east-1",
+		BaseEndpoint: c.Options().BaseEndpoint,
+		UsePathStyle: true,
+		Credentials:  credentials.NewStaticCredentialsProvider("AKALICE", "wrong", ""),
+	})
+	_, err = bad.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("alice")})
+	if err == nil || !strings.Contains(err.Error(), "SignatureDoesNotMatch") {
+		t.Errorf("expected SignatureDoesNotMatch for a wrong secret, got %v", err)
+	}
+}
+
+func TestGateway_SlowDown(t *testing.T) {
+	ctx := context.Background()
+	limiter := ratelimit.NewLimiter(ratelimit.Limits{OwnerRequests: 0.001, OwnerBurst: 1})
+	c := newClient(t, &memBlobs{m: make(map[string][]byte)}, s3gw.WithLimiter(limiter))
+
+	if _, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("alice")}); err != nil {
+		t.Fatalf("first request: %v", err)
+	}
+	_, err := c.ListObjectsV2(ctx, &s3.ListObjectsV2Input{Bucket: aws.String("alice")}, func(o *s3.Options) {
+		o.RetryMaxAttempts = 1
+	})
+	if err == nil || !strings.Contains(err.Error(), "SlowDown") {
+		t.Errorf("expected SlowDown over the request rate, got %v", err)
+	}
+}
@@ -0,0 +1,352 @@
+package s3gw
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/encryption"
+)
+
+// Multipart uploads: parts are sealed under a random per-upload key, held
+// only in memory, and kept in the object store under multipart/<uploadID>/
+// until the upload is completed, aborted or expires. Completion assembles
+// the parts and stores the object like a single PUT. Uploads do not survive
+// a restart: parts left behind then are unreadable, and a lifecycle rule on
+// the multipart/ prefix of the bucket can remove them.
+//
+// Parts held for an owner count against their quota as if already stored,
+// and an upload's parts may not add up to more than the largest object, so
+// parts cannot be used to park data past either. An owner may have at most
+// maxOpenUploads uploads in progress.
+
+const (
+	maxParts       = 10000
+	maxOpenUploads = 100
+	multipartTTL   = 24 * time.Hour
+)
+
+var errTooManyUploads = &apiError{http.StatusInsufficientStorage, "QuotaExceeded", "Too many multipart uploads in progress; complete or abort some first."}
+
+type multipartUpload struct {
+	owner, path, contentType string
+	key                      []byte       // seals parts at rest
+	parts                    map[int]part // by part number
+	started                  time.Time
+}
+
+type part struct {
+	etag string // hex MD5 of the part
+	size int64
+}
+
+func partKey(uploadID string, n int) string {
+	return fmt.Sprintf("multipart/%s/%05d", uploadID, n)
+}
+
+func partAAD(uploadID string, n int) []byte {
+	return []byte(fmt.Sprintf("s3gw/part/%s/%d", uploadID, n))
+}
+
+type initiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+func (g *Gateway) createMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	p, folder, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	if folder {
+		return errInvalidKey
+	}
+	if p, err = g.files.FilePath(r.Context(), bucket, p); err != nil {
+		return fileError(err)
+	}
+	var id [16]byte
+	sealKey := make([]byte, 32)
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	if _, err := rand.Read(sealKey); err != nil {
+		return err
+	}
+	u := &multipartUpload{
+		owner:       bucket,
+		path:        p,
+		contentType: r.Header.Get("Content-Type"),
+		key:         sealKey,
+		parts:       make(map[int]part),
+		started:     time.Now(),
+	}
+	uploadID := hex.EncodeToString(id[:])
+
+	g.mu.Lock()
+	expired := make(map[string]*multipartUpload)
+	open := 0
+	for k, old := range g.uploads {
+		if time.Since(old.started) > multipartTTL {
+			expired[k] = old
+			delete(g.uploads, k)
+		} else if old.owner == bucket {
+			open++
+		}
+	}
+	if open < maxOpenUploads {
+		g.uploads[uploadID] = u
+	}
+	g.mu.Unlock()
+
+	for k, old := range expired {
+		g.dropParts(context.WithoutCancel(r.Context()), k, old)
+	}
+	if open >= maxOpenUploads {
+		return errTooManyUploads
+	}
+	return writeXML(w, http.StatusOK, initiateMultipartUploadResult{Bucket: bucket, Key: key, UploadID: uploadID})
+}
+
+// upload returns the in-progress upload uploadID of ownerID's key.
+func (g *Gateway) upload(uploadID, ownerID, key string) (*multipartUpload, error) {
+	p, _, err := keyPath(key)
+	if err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	u, ok := g.uploads[uploadID]
+	if !ok || u.owner != ownerID || u.path != p {
+		return nil, errNoSuchUpload
+	}
+	return u, nil
+}
+
+func (g *Gateway) uploadPart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	q := r.URL.Query()
+	uploadID := q.Get("uploadId")
+	n, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || n < 1 || n > maxParts {
+		return &apiError{http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and 10000, inclusive."}
+	}
+	u, err := g.upload(uploadID, bucket, key)
+	if err != nil {
+		return err
+	}
+	data, err := g.readBody(r)
+	if err != nil {
+		return err
+	}
+	quota, err := g.files.Quota(r.Context(), bucket)
+	if err != nil {
+		return err
+	}
+	if err := g.reservePart(u, n, int64(len(data)), quota); err != nil {
+		return err
+	}
+	// Until its ETag is set the part cannot be completed, only counted.
+	unreserve := func() {
+		g.mu.Lock()
+		delete(u.parts, n)
+		g.mu.Unlock()
+	}
+	enc, err := encryption.NewWithKey(u.key)
+	if err != nil {
+		unreserve()
+		return err
+	}
+	ct, err := enc.EncryptAAD(data, false, partAAD(uploadID, n))
+	if err != nil {
+		unreserve()
+		return err
+	}
+	if err := g.blobs.PutObject(r.Context(), partKey(uploadID, n), bytes.NewReader(ct)); err != nil {
+		unreserve()
+		return err
+	}
+	sum := md5.Sum(data)
+	tag := hex.EncodeToString(sum[:])
+
+	g.mu.Lock()
+	u.parts[n] = part{etag: tag, size: int64(len(data))}
+	g.mu.Unlock()
+
+	w.Header().Set("ETag", etag(tag))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// reservePart records size bytes as part n of u, replacing any earlier part
+// n, unless that takes u past the largest object or its owner past quota q
+// with the parts of all their open uploads counted as stored.
+func (g *Gateway) reservePart(u *multipartUpload, n int, size int64, q dsde.OwnerQuota) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	var upload, pending int64
+	for _, other := range g.uploads {
+		if other.owner != u.owner {
+			continue
+		}
+		for pn, p := range other.parts {
+			if other == u && pn == n {
+				continue
+			}
+			pending += p.size
+			if other == u {
+				upload += p.size
+			}
+		}
+	}
+	if upload+size > g.maxObject {
+		return errEntityTooLarge
+	}
+	pending += size
+	if q.LogicalQuota > 0 && q.LogicalBytes+pending > q.LogicalQuota {
+		return fileError(fmt.Errorf("%w: %d logical bytes stored and %d in multipart uploads exceed the limit of %d",
+			dsde.ErrQuotaExceeded, q.LogicalBytes, pending, q.LogicalQuota))
+	}
+	if q.PhysicalQuota > 0 && q.PhysicalBytes+pending > q.PhysicalQuota {
+		return fileError(fmt.Errorf("%w: %d physical bytes stored and %d in multipart uploads exceed the limit of %d",
+			dsde.ErrQuotaExceeded, q.PhysicalBytes, pending, q.PhysicalQuota))
+	}
+	u.parts[n] = part{size: size}
+	return nil
+}
+
+type completeMultipartUpload struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type completeMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+func (g *Gateway) completeMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	uploadID := r.URL.Query().Get("uploadId")
+	u, err := g.upload(uploadID, bucket, key)
+	if err != nil {
+		return err
+	}
+	body, err := g.readBody(r)
+	if err != nil {
+		return err
+	}
+	var req completeMultipartUpload
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Parts) == 0 {
+		return errMalformedXML
+	}
+
+	g.mu.Lock()
+	parts := make([]part, len(req.Parts))
+	var size int64
+	for i, p := range req.Parts {
+		if i > 0 && p.PartNumber <= req.Parts[i-1].PartNumber {
+			g.mu.Unlock()
+			return errInvalidPartOrder
+		}
+		got, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != got.etag {
+			g.mu.Unlock()
+			return errInvalidPart
+		}
+		parts[i] = got
+		size += got.size
+	}
+	g.mu.Unlock()
+	if size > g.maxObject {
+		return errEntityTooLarge
+	}
+
+	enc, err := encryption.NewWithKey(u.key)
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, size)
+	sums := make([]byte, 0, len(parts)*md5.Size)
+	for i, p := range req.Parts {
+		rc, err := g.blobs.GetObject(r.Context(), partKey(uploadID, p.PartNumber))
+		if err != nil {
+			return fmt.Errorf("GetObject(part %d): %w", p.PartNumber, err)
+		}
+		ct, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		pt, err := enc.DecryptAAD(ct, partAAD(uploadID, p.PartNumber))
+		if err != nil {
+			return fmt.Errorf("open part %d: %w", p.PartNumber, err)
+		}
+		data = append(data, pt...)
+		sum, _ := hex.DecodeString(parts[i].etag)
+		sums = append(sums, sum...)
+	}
+	total := md5.Sum(sums)
+	tag := fmt.Sprintf("%s-%d", hex.EncodeToString(total[:]), len(parts))
+
+	if err := g.store(r.Context(), bucket, u.path, data, tag, u.contentType); err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	delete(g.uploads, uploadID)
+	g.mu.Unlock()
+	g.dropParts(r.Context(), uploadID, u)
+
+	return writeXML(w, http.StatusOK, completeMultipartUploadResult{
+		Location: "/" + bucket + "/" + key,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     etag(tag),
+	})
+}
+
+func (g *Gateway) abortMultipart(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	uploadID := r.URL.Query().Get("uploadId")
+	u, err := g.upload(uploadID, bucket, key)
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	delete(g.uploads, uploadID)
+	g.mu.Unlock()
+	g.dropParts(r.Context(), uploadID, u)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// dropParts deletes an upload's stored parts.
+func (g *Gateway) dropParts(ctx context.Context, uploadID string, u *multipartUpload) {
+	g.mu.Lock()
+	numbers := make([]int, 0, len(u.parts))
+	for n := range u.parts {
+		numbers = append(numbers, n)
+	}
+	g.mu.Unlock()
+	for _, n := range numbers {
+		if err := g.blobs.DeleteObject(ctx, partKey(uploadID, n)); err != nil {
+			zap.L().Named("s3gw").Warn("DeleteObject(part)", zap.Error(err), zap.String("upload", uploadID), zap.Int("part", n))
+		}
+	}
+}
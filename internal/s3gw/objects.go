@@ -0,0 +1,527 @@
+package s3gw
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/db"
+	"github.com/Anish-Chanda/double-layer-dedup/internal/dsde"
+)
+
+// readBody reads a whole request body, bounded by the maximum object size.
+// Errors from the authenticating body reader (a payload hash or chunk
+// signature mismatch) come back as S3 errors.
+func (g *Gateway) readBody(r *http.Request) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, g.maxObject+1))
+	if err != nil {
+		var e *apiError
+		if errors.As(err, &e) {
+			return nil, e
+		}
+		return nil, errIncompleteBody
+	}
+	if int64(len(data)) > g.maxObject {
+		return nil, errEntityTooLarge
+	}
+	if want := r.Header.Get("Content-Md5"); want != "" {
+		sum := md5.Sum(data)
+		if base64.StdEncoding.EncodeToString(sum[:]) != want {
+			return nil, errBadDigest
+		}
+	}
+	return data, nil
+}
+
+// store uploads data as the newest version of ownerID's path and records its
+// S3 attributes.
+func (g *Gateway) store(ctx context.Context, ownerID, p string, data []byte, tag, contentType string) error {
+	var (
+		fileID string
+		err    error
+	)
+	if g.chunks {
+		fileID, _, _, _, err = g.files.UploadChunks(ctx, ownerID, p, bytes.NewReader(data))
+	} else {
+		fileID, _, _, _, err = g.files.UploadWithCodec(ctx, ownerID, p, g.codec, bytes.NewReader(data))
+	}
+	if err != nil {
+		return fileError(err)
+	}
+	return g.meta.PutObjectMeta(db.ObjectMeta{FileID: fileID, Size: int64(len(data)), ETag: tag, ContentType: contentType})
+}
+
+func (g *Gateway) putObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	p, folder, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	data, err := g.readBody(r)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(data)
+	tag := hex.EncodeToString(sum[:])
+
+	if folder {
+		if len(data) > 0 {
+			return &apiError{http.StatusBadRequest, "InvalidArgument", "A folder marker key must have an empty body."}
+		}
+		if err := g.files.Mkdir(r.Context(), bucket, p); err != nil {
+			return fileError(err)
+		}
+	} else {
+		if p, err = g.files.FilePath(r.Context(), bucket, p); err != nil {
+			return fileError(err)
+		}
+		if err := g.store(r.Context(), bucket, p, data, tag, r.Header.Get("Content-Type")); err != nil {
+			return err
+		}
+	}
+	w.Header().Set("ETag", etag(tag))
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// object is the newest version of a key and its S3 attributes.
+type object struct {
+	db.FileVersion
+	db.ObjectMeta
+}
+
+// lookup finds the newest version of ownerID's path p.
+func (g *Gateway) lookup(ctx context.Context, ownerID, p string) (object, error) {
+	versions, err := g.files.Versions(ctx, ownerID, p)
+	if err != nil {
+		return object{}, fileError(err)
+	}
+	o := object{FileVersion: versions[0]}
+	metas, err := g.meta.ObjectMetas([]string{o.FileVersion.FileID})
+	if err != nil {
+		return object{}, err
+	}
+	o.ObjectMeta = metas[o.FileVersion.FileID]
+	return o, nil
+}
+
+// download fetches a version's contents, recording its S3 attributes if it
+// was stored by another API and has none yet.
+func (g *Gateway) download(ctx context.Context, ownerID string, o *object) ([]byte, error) {
+	rc, err := g.files.Download(ctx, ownerID, o.FileVersion.FileID)
+	if err != nil {
+		return nil, fileError(err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if o.ObjectMeta.FileID == "" {
+		sum := md5.Sum(data)
+		o.ObjectMeta = db.ObjectMeta{FileID: o.FileVersion.FileID, Size: int64(len(data)), ETag: hex.EncodeToString(sum[:])}
+		if err := g.meta.PutObjectMeta(o.ObjectMeta); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// getObject serves GetObject, with a single Range if asked, or HeadObject.
+func (g *Gateway) getObject(w http.ResponseWriter, r *http.Request, bucket, key string, withBody bool) error {
+	p, folder, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	if folder {
+		if _, isFolder, err := g.files.Stat(r.Context(), bucket, p); err != nil {
+			return fileError(err)
+		} else if !isFolder {
+			return errNoSuchKey
+		}
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("ETag", etag(hex.EncodeToString(md5.New().Sum(nil))))
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	o, err := g.lookup(r.Context(), bucket, p)
+	if err != nil {
+		return err
+	}
+	// A version stored through another API has no recorded size or ETag
+	// yet: measure it once. Otherwise the body is streamed.
+	var body io.ReadCloser
+	if o.ObjectMeta.FileID == "" {
+		data, err := g.download(r.Context(), bucket, &o)
+		if err != nil {
+			return err
+		}
+		body = io.NopCloser(bytes.NewReader(data))
+	} else if withBody {
+		if body, err = g.files.Download(r.Context(), bucket, o.FileVersion.FileID); err != nil {
+			return fileError(err)
+		}
+	}
+	if body != nil {
+		defer body.Close()
+	}
+
+	h := w.Header()
+	h.Set("ETag", etag(o.ETag))
+	h.Set("Last-Modified", o.CreatedAt.UTC().Format(http.TimeFormat))
+	h.Set("Accept-Ranges", "bytes")
+	h.Set("X-Amz-Meta-Version", strconv.Itoa(o.Version))
+	if o.ContentType != "" {
+		h.Set("Content-Type", o.ContentType)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+	}
+
+	start, end := int64(0), o.Size-1
+	status := http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		if start, end, err = parseRange(rng, o.Size); err != nil {
+			h.Set("Content-Range", fmt.Sprintf("bytes */%d", o.Size))
+			return err
+		}
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, o.Size))
+		status = http.StatusPartialContent
+	}
+	if withBody {
+		if err := skip(body, start); err != nil {
+			return err
+		}
+	}
+	h.Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	w.WriteHeader(status)
+	if withBody {
+		io.CopyN(w, body, end-start+1)
+	}
+	return nil
+}
+
+// skip moves past the first n bytes of r, seeking when it can.
+func skip(r io.Reader, n int64) error {
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(n, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(io.Discard, r, n)
+	return err
+}
+
+// parseRange parses a single byte range, "bytes=a-b", "bytes=a-" or
+// "bytes=-n", against an object of size bytes.
+func parseRange(s string, size int64) (start, end int64, err error) {
+	spec, ok := strings.CutPrefix(s, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, errInvalidRange
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	if !ok {
+		return 0, 0, errInvalidRange
+	}
+	switch {
+	case first == "":
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 || size == 0 {
+			return 0, 0, errInvalidRange
+		}
+		return max(size-n, 0), size - 1, nil
+	default:
+		start, err = strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 || start >= size {
+			return 0, 0, errInvalidRange
+		}
+		end = size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return 0, 0, errInvalidRange
+			}
+			end = min(end, size-1)
+		}
+		return start, end, nil
+	}
+}
+
+// deleteObject deletes every version of a key. Like S3, deleting a missing
+// key succeeds.
+func (g *Gateway) deleteObject(w http.ResponseWriter, r *http.Request, bucket, key string) error {
+	if err := g.delete(r.Context(), bucket, key); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (g *Gateway) delete(ctx context.Context, ownerID, key string) error {
+	p, folder, err := keyPath(key)
+	if err != nil {
+		return err
+	}
+	if folder {
+		err = g.files.Rmdir(ctx, ownerID, p)
+	} else {
+		err = g.files.DeletePath(ctx, ownerID, p)
+	}
+	if err != nil && !errors.Is(err, dsde.ErrFileNotFound) {
+		return fileError(err)
+	}
+	return nil
+}
+
+type deleteRequest struct {
+	Quiet   bool `xml:"Quiet"`
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+type deletedObject struct {
+	Key string `xml:"Key"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// deleteObjects serves DeleteObjects, reporting failures per key.
+func (g *Gateway) deleteObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	body, err := g.readBody(r)
+	if err != nil {
+		return err
+	}
+	var req deleteRequest
+	if err := xml.Unmarshal(body, &req); err != nil || len(req.Objects) > 1000 {
+		return errMalformedXML
+	}
+	var res deleteResult
+	for _, o := range req.Objects {
+		if err := g.delete(r.Context(), bucket, o.Key); err != nil {
+			e := &apiError{Code: "InternalError", Message: err.Error()}
+			errors.As(err, &e)
+			res.Errors = append(res.Errors, deleteError{Key: o.Key, Code: e.Code, Message: e.Message})
+			continue
+		}
+		if !req.Quiet {
+			res.Deleted = append(res.Deleted, deletedObject{Key: o.Key})
+		}
+	}
+	return writeXML(w, http.StatusOK, res)
+}
+
+type listContent struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Marker                *string        `xml:"Marker,omitempty"`
+	NextMarker            string         `xml:"NextMarker,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              *int           `xml:"KeyCount,omitempty"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listContent  `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listItem is a key or a common prefix in a listing.
+type listItem struct {
+	key    string
+	prefix bool
+	entry  db.TreeEntry
+}
+
+// listObjects serves ListObjects and ListObjectsV2 (list-type=2). Keys come
+// from the owner's namespace: the newest version of every file whose path
+// starts with prefix, and with a delimiter, folders as common prefixes.
+func (g *Gateway) listObjects(w http.ResponseWriter, r *http.Request, bucket string) error {
+	q := r.URL.Query()
+	v2 := q.Get("list-type") == "2"
+	prefix, delim := q.Get("prefix"), q.Get("delimiter")
+	maxKeys := 1000
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return errInvalidArgument
+		}
+		maxKeys = min(n, 1000)
+	}
+	urlEncode := q.Get("encoding-type") == "url"
+
+	// everything after marker, which V2 spells continuation-token or start-after
+	marker := q.Get("marker")
+	if v2 {
+		marker = q.Get("start-after")
+		if tok := q.Get("continuation-token"); tok != "" {
+			raw, err := base64.RawURLEncoding.DecodeString(tok)
+			if err != nil {
+				return errInvalidArgument
+			}
+			marker = string(raw)
+		}
+	}
+
+	items, err := g.listItems(r.Context(), bucket, prefix, delim)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(items), func(i int) bool { return items[i].key > marker })
+	items = items[i:]
+	truncated := len(items) > maxKeys
+	if truncated {
+		items = items[:maxKeys]
+	}
+
+	ids := make([]string, 0, len(items))
+	for _, it := range items {
+		if !it.prefix {
+			ids = append(ids, it.entry.FileID)
+		}
+	}
+	metas, err := g.meta.ObjectMetas(ids)
+	if err != nil {
+		return err
+	}
+
+	enc := func(s string) string {
+		if urlEncode {
+			return uriEncode(s, false)
+		}
+		return s
+	}
+	res := listBucketResult{
+		Name:        bucket,
+		Prefix:      enc(prefix),
+		MaxKeys:     maxKeys,
+		Delimiter:   enc(delim),
+		IsTruncated: truncated,
+	}
+	if urlEncode {
+		res.EncodingType = "url"
+	}
+	for _, it := range items {
+		if it.prefix {
+			res.CommonPrefixes = append(res.CommonPrefixes, commonPrefix{Prefix: enc(it.key)})
+			continue
+		}
+		o := object{
+			FileVersion: db.FileVersion{FileID: it.entry.FileID, Version: it.entry.Version, CreatedAt: it.entry.CreatedAt},
+			ObjectMeta:  metas[it.entry.FileID],
+		}
+		if o.ObjectMeta.FileID == "" {
+			if _, err := g.download(r.Context(), bucket, &o); err != nil {
+				return err
+			}
+		}
+		res.Contents = append(res.Contents, listContent{
+			Key:          enc(it.key),
+			LastModified: o.CreatedAt.UTC().Format(time.RFC3339),
+			ETag:         etag(o.ETag),
+			Size:         o.Size,
+			StorageClass: "STANDARD",
+		})
+	}
+
+	var last string
+	if len(items) > 0 {
+		last = items[len(items)-1].key
+	}
+	if v2 {
+		n := len(items)
+		res.KeyCount = &n
+		res.StartAfter = enc(q.Get("start-after"))
+		res.ContinuationToken = q.Get("continuation-token")
+		if truncated {
+			res.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		}
+	} else {
+		res.Marker = &marker
+		if truncated {
+			res.NextMarker = enc(last)
+		}
+	}
+	return writeXML(w, http.StatusOK, res)
+}
+
+// listItems returns, in key order, the keys under prefix rolled up at
+// delim into common prefixes.
+func (g *Gateway) listItems(ctx context.Context, ownerID, prefix, delim string) ([]listItem, error) {
+	// the deepest folder that can hold every key starting with prefix
+	dir := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		dir = path.Clean(prefix[:i])
+		if dir == "." {
+			dir = ""
+		}
+	}
+	entries, err := g.files.List(ctx, ownerID, dir, true)
+	if errors.Is(err, dsde.ErrFileNotFound) || errors.Is(err, dsde.ErrInvalidPath) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fileError(err)
+	}
+
+	seen := make(map[string]bool)
+	var items []listItem
+	for _, e := range entries {
+		key := e.Path
+		if e.Folder {
+			key += "/"
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if delim != "" {
+			if i := strings.Index(key[len(prefix):], delim); i >= 0 {
+				cp := key[:len(prefix)+i+len(delim)]
+				if !seen[cp] {
+					seen[cp] = true
+					items = append(items, listItem{key: cp, prefix: true})
+				}
+				continue
+			}
+		}
+		if e.Folder {
+			continue
+		}
+		items = append(items, listItem{key: key, entry: e})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].key < items[j].key })
+	return items, nil
+}
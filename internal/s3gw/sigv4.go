@@ -0,0 +1,340 @@
+package s3gw
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Credential is an access key bound to the one owner it may act for.
+type Credential struct {
+	AccessKey string
+	Secret    string
+	Owner     string
+}
+
+// ParseCredentials parses a comma-separated list of
+// accesskey:secret:owner triples.
+func ParseCredentials(spec string) ([]Credential, error) {
+	var creds []Credential
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		f := strings.Split(part, ":")
+		if len(f) != 3 || f[0] == "" || f[1] == "" || f[2] == "" {
+			return nil, fmt.Errorf("s3gw: credential %q is not accesskey:secret:owner", part)
+		}
+		creds = append(creds, Credential{AccessKey: f[0], Secret: f[1], Owner: f[2]})
+	}
+	return creds, nil
+}
+
+const (
+	sigAlgorithm      = "AWS4-HMAC-SHA256"
+	amzDateFormat     = "20060102T150405Z"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	streamingSigned   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer  = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+	streamingSignedTr = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	emptySHA256       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	maxChunkSize      = 64 << 20
+)
+
+// authenticate checks the request's Signature V4 Authorization header and
+// returns the credential it was signed with and the request body, decoded
+// from aws-chunked encoding if need be. The body reports a mismatch with the
+// signed payload hash, or a bad chunk signature, as an error when read.
+func (g *Gateway) authenticate(r *http.Request, now time.Time) (Credential, io.Reader, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return Credential{}, nil, errAccessDenied
+	}
+	rest, ok := strings.CutPrefix(auth, sigAlgorithm+" ")
+	if !ok {
+		return Credential{}, nil, errAuthMalformed
+	}
+	var credential, signedHeaders, signature string
+	for _, f := range strings.Split(rest, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(f), "=")
+		switch k {
+		case "Credential":
+			credential = v
+		case "SignedHeaders":
+			signedHeaders = v
+		case "Signature":
+			signature = v
+		}
+	}
+	// access key / date / region / s3 / aws4_request
+	scopeParts := strings.Split(credential, "/")
+	if len(scopeParts) != 5 || scopeParts[3] != "s3" || scopeParts[4] != "aws4_request" || signedHeaders == "" || signature == "" {
+		return Credential{}, nil, errAuthMalformed
+	}
+	cred, ok := g.creds[scopeParts[0]]
+	if !ok {
+		return Credential{}, nil, errInvalidAccessKeyID
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil || t.Format("20060102") != scopeParts[1] {
+		return Credential{}, nil, errAuthMalformed
+	}
+	if d := now.Sub(t); d > g.maxSkew || d < -g.maxSkew {
+		return Credential{}, nil, errRequestTimeSkewed
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return Credential{}, nil, &apiError{http.StatusBadRequest, "InvalidRequest", "Missing required header for this request: x-amz-content-sha256"}
+	}
+	if payloadHash == streamingSignedTr {
+		return Credential{}, nil, errSignedTrailers
+	}
+
+	scope := strings.Join(scopeParts[1:], "/")
+	creq := canonicalRequest(r, strings.Split(signedHeaders, ";"), payloadHash)
+	sts := sigAlgorithm + "\n" + amzDate + "\n" + scope + "\n" + hexSHA256([]byte(creq))
+	key := signingKey(cred.Secret, scopeParts[1], scopeParts[2])
+	want := hex.EncodeToString(hmacSHA256(key, []byte(sts)))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(signature)) != 1 {
+		return Credential{}, nil, errSignatureMismatch
+	}
+
+	var body io.Reader = r.Body
+	if body == nil {
+		body = http.NoBody
+	}
+	switch payloadHash {
+	case unsignedPayload:
+	case streamingSigned:
+		body = &chunkedReader{r: bufio.NewReader(body), key: key, amzDate: amzDate, scope: scope, prevSig: signature, signed: true}
+	case streamingTrailer:
+		body = &chunkedReader{r: bufio.NewReader(body)}
+	default:
+		sum, err := hex.DecodeString(payloadHash)
+		if err != nil || len(sum) != sha256.Size {
+			return Credential{}, nil, errContentSHA256
+		}
+		body = &hashCheckReader{r: body, h: sha256.New(), want: sum, mismatch: errContentSHA256}
+	}
+	return cred, body, nil
+}
+
+// canonicalRequest builds the Signature V4 canonical request for S3, whose
+// paths are encoded once.
+func canonicalRequest(r *http.Request, signed []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(uriEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+
+	q, _ := url.ParseQuery(r.URL.RawQuery)
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		vals := append([]string(nil), q[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	b.WriteString(strings.Join(pairs, "&"))
+	b.WriteByte('\n')
+
+	for _, h := range signed {
+		var v string
+		switch h {
+		case "host":
+			v = r.Host
+		case "content-length":
+			v = r.Header.Get("Content-Length")
+			if v == "" && r.ContentLength >= 0 {
+				v = strconv.FormatInt(r.ContentLength, 10)
+			}
+		case "transfer-encoding":
+			v = strings.Join(r.TransferEncoding, ",")
+		default:
+			vals := r.Header.Values(h)
+			trimmed := make([]string, len(vals))
+			for i, s := range vals {
+				trimmed[i] = strings.Join(strings.Fields(s), " ")
+			}
+			v = strings.Join(trimmed, ",")
+		}
+		b.WriteString(h)
+		b.WriteByte(':')
+		b.WriteString(v)
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signed, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+// uriEncode percent-encodes everything but unreserved characters, and "/"
+// unless encodeSlash is set, as Signature V4 requires.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func signingKey(secret, date, region string) []byte {
+	k := hmacSHA256([]byte("AWS4"+secret), []byte(date))
+	k = hmacSHA256(k, []byte(region))
+	k = hmacSHA256(k, []byte("s3"))
+	return hmacSHA256(k, []byte("aws4_request"))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+func hexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// hashCheckReader fails with mismatch at EOF unless what was read hashes to
+// want.
+type hashCheckReader struct {
+	r        io.Reader
+	h        hash.Hash
+	want     []byte
+	mismatch error
+}
+
+func (c *hashCheckReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.h.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(c.h.Sum(nil), c.want) {
+		return n, c.mismatch
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body: hex-size[;chunk-signature=sig]
+// CRLF data CRLF, ending with a zero-size chunk and optional trailers. When
+// signed, each chunk's signature chains from the previous one, starting with
+// the request's.
+type chunkedReader struct {
+	r      *bufio.Reader
+	signed bool
+
+	key            []byte
+	amzDate, scope string
+	prevSig        string
+
+	chunk []byte
+	done  bool
+	err   error
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		c.err = c.next()
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// next reads and checks one chunk.
+func (c *chunkedReader) next() error {
+	line, err := c.readLine()
+	if err == io.EOF {
+		return errIncompleteBody
+	} else if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeHex), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errIncompleteBody
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errIncompleteBody
+	}
+	if c.signed {
+		sig, ok := strings.CutPrefix(ext, "chunk-signature=")
+		if !ok {
+			return errSignatureMismatch
+		}
+		sts := sigAlgorithm + "-PAYLOAD\n" + c.amzDate + "\n" + c.scope + "\n" + c.prevSig + "\n" + emptySHA256 + "\n" + hexSHA256(data)
+		want := hex.EncodeToString(hmacSHA256(c.key, []byte(sts)))
+		if subtle.ConstantTimeCompare([]byte(want), []byte(sig)) != 1 {
+			return errSignatureMismatch
+		}
+		c.prevSig = sig
+	}
+	if size == 0 {
+		// trailers, if any, up to an empty line
+		for {
+			line, err := c.readLine()
+			if err == io.EOF || (err == nil && line == "") {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		c.done = true
+		return nil
+	}
+	if line, err := c.readLine(); err != nil || line != "" {
+		return errIncompleteBody
+	}
+	c.chunk = data
+	return nil
+}
+
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err == io.EOF && line == "" {
+		return "", io.EOF
+	} else if err != nil && err != io.EOF {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,101 @@
+package signedurl_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/signedurl"
+)
+
+const (
+	oldKey = "k1:000102030405060708090a0b0c0d0e0f"
+	newKey = "k2:101112131415161718191a1b1c1d1e1f"
+)
+
+func mustSigner(t *testing.T, spec string) *signedurl.Signer {
+	t.Helper()
+	keys, err := signedurl.ParseKeys(spec)
+	if err != nil {
+		t.Fatalf("ParseKeys(%q): %v", spec, err)
+	}
+	s, err := signedurl.New(keys)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return s
+}
+
+func TestSignVerify_RoundTrip(t *testing.T) {
+	s := mustSigner(t, oldKey)
+	now := time.Now()
+	want := signedurl.Claims{FileID: "f1", OwnerID: "alice", Expires: now.Add(time.Hour).Truncate(time.Second), Offset: 10, Length: 100}
+	tok, err := s.Sign(want)
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	got, err := s.Verify(tok, now)
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if got != want {
+		t.Errorf("claims = %+v, want %+v", got, want)
+	}
+
+	if _, err := s.Verify(tok, now.Add(2*time.Hour)); !errors.Is(err, signedurl.ErrExpired) {
+		t.Errorf("expected ErrExpired after expiry, got %v", err)
+	}
+}
+
+func TestVerify_RejectsTampering(t *testing.T) {
+	s := mustSigner(t, oldKey)
+	now := time.Now()
+	tok, err := s.Sign(signedurl.Claims{FileID: "f1", OwnerID: "alice", Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	other, _ := s.Sign(signedurl.Claims{FileID: "f2", OwnerID: "alice", Expires: now.Add(time.Hour)})
+
+	body, _, _ := strings.Cut(tok, ".")
+	_, sig, _ := strings.Cut(other, ".")
+	for name, bad := range map[string]string{
+		"swapped signature": body + "." + sig,
+		"no signature":      body,
+		"garbage":           "not-a-token",
+	} {
+		if _, err := s.Verify(bad, now); !errors.Is(err, signedurl.ErrInvalidToken) {
+			t.Errorf("%s: expected ErrInvalidToken, got %v", name, err)
+		}
+	}
+
+	stranger := mustSigner(t, "k1:ffeeddccbbaa99887766554433221100")
+	if _, err := stranger.Verify(tok, now); !errors.Is(err, signedurl.ErrInvalidToken) {
+		t.Errorf("expected a different secret to reject the token, got %v", err)
+	}
+}
+
+func TestVerify_KeyRotation(t *testing.T) {
+	now := time.Now()
+	tok, err := mustSigner(t, oldKey).Sign(signedurl.Claims{FileID: "f1", OwnerID: "alice", Expires: now.Add(time.Hour)})
+	if err != nil {
+		t.Fatalf("Sign: %v", err)
+	}
+	if _, err := mustSigner(t, newKey+","+oldKey).Verify(tok, now); err != nil {
+		t.Errorf("rotated signer rejected a token from the old key: %v", err)
+	}
+	if _, err := mustSigner(t, newKey).Verify(tok, now); !errors.Is(err, signedurl.ErrInvalidToken) {
+		t.Errorf("expected the old key's tokens rejected once it is dropped, got %v", err)
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	if keys, err := signedurl.ParseKeys(""); err != nil || len(keys) != 0 {
+		t.Errorf("ParseKeys(\"\") = %v, %v", keys, err)
+	}
+	for _, bad := range []string{"nohex", "k1:zz", "k1:0011", oldKey + "," + oldKey} {
+		if _, err := signedurl.ParseKeys(bad); err == nil {
+			t.Errorf("ParseKeys(%q): expected an error", bad)
+		}
+	}
+}
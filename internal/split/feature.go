@@ -23,6 +23,12 @@ func NewFG(a, m []uint64) *FG {
 	return &FG{table: table, a: a, m: m, window: 64}
 }
 
+// NewDefaultFG returns the FG configuration the server and client share.
+// Changing it changes every feature, so existing content stops deduplicating.
+func NewDefaultFG() *FG {
+	return NewFG([]uint64{1, 3, 5}, []uint64{0, 0, 0})
+}
+
 // Feature reads the entire file from r, slides a 64-byte Rabin window at each byte,
 // computes Pi = current 64-byte fingerprint, maps to si = aᵢ·Pi + mᵢ mod 2⁶⁴,
 // feeds each si (big-endian) into SHA256, and returns the final 32-byte digest.
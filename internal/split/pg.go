@@ -3,15 +3,15 @@ package split
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"fmt"
 )
 
-// PG implements Section IV-A: given fea = FG(F) and the full data slice,
-// picks B bit-positions via Hᵢ(fea) mod len(data), marks a bit-vector D,
-// then splits into pkg2 (D[j]==1) and pkg1 (the rest).
-func PG(fea, data []byte, B int) (pkg1, pkg2 []byte) {
-	lf := len(data)
+// positions marks the B bit-positions Hᵢ(fea) mod lf, i = 1..B.
+func positions(fea []byte, lf, B int) []bool {
 	D := make([]bool, lf)
-
+	if lf == 0 {
+		return D
+	}
 	for i := 1; i <= B; i++ {
 		h := sha256.New()
 		h.Write(fea)
@@ -22,7 +22,14 @@ func PG(fea, data []byte, B int) (pkg1, pkg2 []byte) {
 		pos := binary.BigEndian.Uint64(sum[:8]) % uint64(lf)
 		D[pos] = true
 	}
+	return D
+}
 
+// PG implements Section IV-A: given fea = FG(F) and the full data slice,
+// picks B bit-positions via Hᵢ(fea) mod len(data), marks a bit-vector D,
+// then splits into pkg2 (D[j]==1) and pkg1 (the rest).
+func PG(fea, data []byte, B int) (pkg1, pkg2 []byte) {
+	D := positions(fea, len(data), B)
 	for j, b := range data {
 		if D[j] {
 			pkg2 = append(pkg2, b)
@@ -32,3 +39,32 @@ func PG(fea, data []byte, B int) (pkg1, pkg2 []byte) {
 	}
 	return
 }
+
+// Merge reverses PG: it interleaves pkg1 and pkg2 back into the original data
+// using the same positions derived from fea.
+func Merge(fea, pkg1, pkg2 []byte, B int) ([]byte, error) {
+	lf := len(pkg1) + len(pkg2)
+	D := positions(fea, lf, B)
+
+	out := make([]byte, lf)
+	i1, i2 := 0, 0
+	for j := 0; j < lf; j++ {
+		if D[j] {
+			if i2 >= len(pkg2) {
+				return nil, fmt.Errorf("merge: pkg2 exhausted at position %d (len %d)", j, len(pkg2))
+			}
+			out[j] = pkg2[i2]
+			i2++
+		} else {
+			if i1 >= len(pkg1) {
+				return nil, fmt.Errorf("merge: pkg1 exhausted at position %d (len %d)", j, len(pkg1))
+			}
+			out[j] = pkg1[i1]
+			i1++
+		}
+	}
+	if i1 != len(pkg1) || i2 != len(pkg2) {
+		return nil, fmt.Errorf("merge: used %d/%d of pkg1 and %d/%d of pkg2", i1, len(pkg1), i2, len(pkg2))
+	}
+	return out, nil
+}
@@ -16,3 +16,25 @@ func TestPG_SumLengths(t *testing.T) {
 		t.Errorf("pkg1+pkg2 total %d, want %d", len(pkg1)+len(pkg2), len(data))
 	}
 }
+
+func TestMerge_InvertsPG(t *testing.T) {
+	fea := bytes.Repeat([]byte{7}, sha256.Size)
+	for _, data := range [][]byte{[]byte("a"), []byte("abcdef"), bytes.Repeat([]byte("xyz"), 100)} {
+		pkg1, pkg2 := split.PG(fea, data, 3)
+		got, err := split.Merge(fea, pkg1, pkg2, 3)
+		if err != nil {
+			t.Fatalf("Merge error: %v", err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("Merge(PG(%q)) = %q", data, got)
+		}
+	}
+}
+
+func TestMerge_RejectsWrongSplit(t *testing.T) {
+	fea := bytes.Repeat([]byte{7}, sha256.Size)
+	pkg1, pkg2 := split.PG(fea, []byte("abcdefgh"), 3)
+	if _, err := split.Merge(fea, append(pkg1, pkg2...), nil, 3); err == nil {
+		t.Error("expected Merge to reject a split with pkg2 missing")
+	}
+}
@@ -2,11 +2,13 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 )
 
 // Client wraps an S3 API client and a bucket name.
@@ -52,6 +54,74 @@ func (c *Client) GetObject(ctx context.Context, key string) (io.ReadCloser, erro
 	return out.Body, nil
 }
 
+// ObjectReaderAt reads byte ranges of one object with ranged GETs, so
+// segmented blobs can be decrypted without downloading them whole.
+type ObjectReaderAt struct {
+	ctx  context.Context
+	c    *Client
+	key  string
+	size int64
+}
+
+// NewReaderAt looks up the object's size and returns a ranged reader over it.
+func (c *Client) NewReaderAt(ctx context.Context, key string) (*ObjectReaderAt, error) {
+	out, err := c.api.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: &c.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectReaderAt{ctx: ctx, c: c, key: key, size: aws.ToInt64(out.ContentLength)}, nil
+}
+
+// Size returns the object's length in bytes.
+func (r *ObjectReaderAt) Size() int64 { return r.size }
+
+// ReadAt fetches len(p) bytes starting at off.
+func (r *ObjectReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), r.size) - 1
+	rng := fmt.Sprintf("bytes=%d-%d", off, end)
+	out, err := r.c.api.GetObject(r.ctx, &s3.GetObjectInput{
+		Bucket: &r.c.bucket,
+		Key:    &r.key,
+		Range:  &rng,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer out.Body.Close()
+	n, err := io.ReadFull(out.Body, p[:end-off+1])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// IsNotFound reports whether err is S3's answer for a missing key.
+func IsNotFound(err error) bool {
+	var nsk *types.NoSuchKey
+	return errors.As(err, &nsk)
+}
+
+// DeleteObject removes the object stored under key.
+func (c *Client) DeleteObject(ctx context.Context, key string) error {
+	_, err := c.api.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: &c.bucket,
+		Key:    &key,
+	})
+	return err
+}
+
+// Ping checks that the bucket exists and is reachable.
+func (c *Client) Ping(ctx context.Context) error {
+	_, err := c.api.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &c.bucket})
+	return err
+}
+
 // ListKeys returns all object keys in the bucket.
 func (c *Client) ListKeys(ctx context.Context) ([]string, error) {
 	out, err := c.api.ListObjectsV2(ctx, &s3.ListObjectsV2Input{
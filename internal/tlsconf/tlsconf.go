@@ -0,0 +1,186 @@
+// Package tlsconf builds the server's TLS configuration: a certificate that
+// is reloaded when its files change, optional client-certificate checking
+// against a CA, and the mapping of verified client certificates to owners.
+package tlsconf
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Reloader serves a certificate and key pair from disk, picking up
+// replacements (e.g. renewals) without a restart.
+type Reloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+	mod  time.Time // newer modification time of the two files when loaded
+}
+
+// NewReloader loads the pair from certFile and keyFile.
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the pair again. On error the previous certificate stays in
+// use.
+func (r *Reloader) Reload() error {
+	mod, err := r.modTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("tlsconf: load key pair: %w", err)
+	}
+	r.mu.Lock()
+	r.cert, r.mod = &cert, mod
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Reloader) modTime() (time.Time, error) {
+	var newest time.Time
+	for _, f := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("tlsconf: %w", err)
+		}
+		if fi.ModTime().After(newest) {
+			newest = fi.ModTime()
+		}
+	}
+	return newest, nil
+}
+
+// Watch checks the files every interval until ctx is done and reloads the
+// pair when either has changed.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	log := zap.L().Named("tlsconf")
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+		mod, err := r.modTime()
+		if err != nil {
+			log.Warn("stat certificate", zap.Error(err))
+			continue
+		}
+		r.mu.RLock()
+		changed := !mod.Equal(r.mod)
+		r.mu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := r.Reload(); err != nil {
+			log.Warn("reload certificate, keeping the old one", zap.Error(err))
+			continue
+		}
+		log.Info("reloaded certificate", zap.String("file", r.certFile))
+	}
+}
+
+// GetCertificate returns the current certificate; it fits
+// tls.Config.GetCertificate.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// LoadCertPool reads the PEM certificates in file into a pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("tlsconf: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("tlsconf: no certificates in %s", file)
+	}
+	return pool, nil
+}
+
+// ParseClientAuth parses "none", "optional" (verify a certificate if the
+// client sends one) or "require".
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "none":
+		return tls.NoClientCert, nil
+	case "optional":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return 0, fmt.Errorf("tlsconf: unknown client auth %q", s)
+}
+
+// ServerConfig returns a TLS 1.2+ configuration serving r's certificate.
+// Client certificates are checked against clientCAs as auth says; clientCAs
+// may be nil when auth is tls.NoClientCert.
+func ServerConfig(r *Reloader, clientCAs *x509.CertPool, auth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: r.GetCertificate,
+		ClientCAs:      clientCAs,
+		ClientAuth:     auth,
+	}
+}
+
+// Owners maps verified client certificates to owner IDs.
+type Owners struct {
+	byCN map[string]string // nil: the common name is the owner
+}
+
+// ParseOwners parses "commonname:owner,..." pairs. An empty spec makes each
+// certificate's common name its owner; otherwise only the listed names map
+// to an owner.
+func ParseOwners(spec string) (*Owners, error) {
+	o := &Owners{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		cn, owner, ok := strings.Cut(part, ":")
+		if !ok || cn == "" || owner == "" {
+			return nil, fmt.Errorf("tlsconf: owner mapping %q is not commonname:owner", part)
+		}
+		if o.byCN == nil {
+			o.byCN = map[string]string{}
+		}
+		o.byCN[cn] = owner
+	}
+	return o, nil
+}
+
+// Owner returns the owner of the connection's verified client certificate,
+// and false if there is none or it maps to no owner.
+func (o *Owners) Owner(cs *tls.ConnectionState) (string, bool) {
+	if cs == nil || len(cs.VerifiedChains) == 0 || len(cs.VerifiedChains[0]) == 0 {
+		return "", false
+	}
+	cn := cs.VerifiedChains[0][0].Subject.CommonName
+	if o.byCN == nil {
+		return cn, cn != ""
+	}
+	owner, ok := o.byCN[cn]
+	return owner, ok
+}
@@ -0,0 +1,223 @@
+package tlsconf_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Anish-Chanda/double-layer-dedup/internal/tlsconf"
+)
+
+// issued is a generated certificate with its key.
+type issued struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func (c issued) certPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+}
+
+func (c issued) keyPEM(t *testing.T) []byte {
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func (c issued) tlsCert(t *testing.T) tls.Certificate {
+	cert, err := tls.X509KeyPair(c.certPEM(), c.keyPEM(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// issue creates a certificate for cn signed by parent, or self-signed as a
+// CA if parent is nil.
+func issue(t *testing.T, cn string, serial int64, parent *issued, usage x509.ExtKeyUsage) issued {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		tmpl.ExtKeyUsage = []x509.ExtKeyUsage{usage}
+		tmpl.DNSNames, tmpl.IPAddresses = []string{"localhost"}, []net.IP{net.IPv4(127, 0, 0, 1)}
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return issued{cert: cert, key: key}
+}
+
+func writePair(t *testing.T, dir string, c issued) (certFile, keyFile string) {
+	t.Helper()
+	certFile, keyFile = filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	if err := os.WriteFile(certFile, c.certPEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, c.keyPEM(t), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "test CA", 1, nil, 0)
+	server := issue(t, "localhost", 2, &ca, x509.ExtKeyUsageServerAuth)
+	alice := issue(t, "alice-laptop", 3, &ca, x509.ExtKeyUsageClientAuth)
+	rogueCA := issue(t, "rogue CA", 4, nil, 0)
+	mallory := issue(t, "alice-laptop", 5, &rogueCA, x509.ExtKeyUsageClientAuth)
+
+	rl, err := tlsconf.NewReloader(writePair(t, dir, server))
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	caFile := filepath.Join(dir, "ca.crt")
+	if err := os.WriteFile(caFile, ca.certPEM(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pool, err := tlsconf.LoadCertPool(caFile)
+	if err != nil {
+		t.Fatalf("LoadCertPool: %v", err)
+	}
+	owners, err := tlsconf.ParseOwners("alice-laptop:alice")
+	if err != nil {
+		t.Fatalf("ParseOwners: %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner, _ := owners.Owner(r.TLS)
+		io.WriteString(w, owner)
+	}))
+	// StartTLS would install its own certificate, so wrap the listener instead
+	srv.Listener = tls.NewListener(srv.Listener, tlsconf.ServerConfig(rl, pool, tls.RequireAndVerifyClientCert))
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.Start()
+	defer srv.Close()
+	url := strings.Replace(srv.URL, "http://", "https://", 1)
+
+	get := func(certs ...tls.Certificate) (string, error) {
+		roots := x509.NewCertPool()
+		roots.AddCert(ca.cert)
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		resp, err := c.Get(url)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	if owner, err := get(alice.tlsCert(t)); err != nil || owner != "alice" {
+		t.Errorf("with alice's certificate: got %q, %v; want alice", owner, err)
+	}
+	if _, err := get(); err == nil {
+		t.Error("without a client certificate: request succeeded")
+	}
+	if _, err := get(mallory.tlsCert(t)); err == nil {
+		t.Error("with a certificate from another CA: request succeeded")
+	}
+}
+
+func TestReloaderWatch(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, "test CA", 1, nil, 0)
+	rl, err := tlsconf.NewReloader(writePair(t, dir, issue(t, "localhost", 10, &ca, x509.ExtKeyUsageServerAuth)))
+	if err != nil {
+		t.Fatalf("NewReloader: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go rl.Watch(ctx, 5*time.Millisecond)
+
+	certFile, keyFile := writePair(t, dir, issue(t, "localhost", 11, &ca, x509.ExtKeyUsageServerAuth))
+	later := time.Now().Add(time.Minute) // coarse file timestamps must still differ
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		cert, _ := rl.GetCertificate(nil)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.SerialNumber.Int64() == 11 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("still serving serial %d after the files changed", leaf.SerialNumber)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestParseOwners(t *testing.T) {
+	chain := func(cn string) *tls.ConnectionState {
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: pkix.Name{CommonName: cn}}}}}
+	}
+
+	byName, err := tlsconf.ParseOwners("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := byName.Owner(chain("bob")); !ok || owner != "bob" {
+		t.Errorf("common name as owner: got %q, %v", owner, ok)
+	}
+	if _, ok := byName.Owner(&tls.ConnectionState{}); ok {
+		t.Error("connection without a verified chain mapped to an owner")
+	}
+
+	mapped, err := tlsconf.ParseOwners("ci-runner:builds, bob-phone:bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner, ok := mapped.Owner(chain("bob-phone")); !ok || owner != "bob" {
+		t.Errorf("mapped name: got %q, %v", owner, ok)
+	}
+	if _, ok := mapped.Owner(chain("bob")); ok {
+		t.Error("unmapped name mapped to an owner")
+	}
+
+	if _, err := tlsconf.ParseOwners("nocolon"); err == nil {
+		t.Error("ParseOwners accepted an entry without an owner")
+	}
+}
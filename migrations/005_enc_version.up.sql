@@ -0,0 +1,4 @@
+-- 0005_enc_version.up.sql
+-- 0 = legacy blobs sealed without associated data
+ALTER TABLE files
+  ADD COLUMN enc_version SMALLINT NOT NULL DEFAULT 0;
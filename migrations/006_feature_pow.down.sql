@@ -0,0 +1,3 @@
+ALTER TABLE features
+  DROP COLUMN pow_root,
+  DROP COLUMN pow_leaves;
@@ -0,0 +1,5 @@
+-- 0006_feature_pow.up.sql
+-- Merkle root of the content, for proof-of-ownership challenges
+ALTER TABLE features
+  ADD COLUMN pow_root   BYTEA,
+  ADD COLUMN pow_leaves INTEGER;
@@ -0,0 +1,3 @@
+ALTER TABLE features
+  DROP COLUMN dedup_threshold,
+  DROP COLUMN upload_count;
@@ -0,0 +1,5 @@
+-- 0007_dedup_threshold.up.sql
+-- Randomized per-feature dedup thresholds (Harnik et al.)
+ALTER TABLE features
+  ADD COLUMN dedup_threshold INTEGER,
+  ADD COLUMN upload_count    INTEGER NOT NULL DEFAULT 0;
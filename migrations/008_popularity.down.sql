@@ -0,0 +1,4 @@
+ALTER TABLE files
+  DROP COLUMN storage_mode;
+
+DROP TABLE IF EXISTS feature_owners;
@@ -0,0 +1,17 @@
+-- 0008_popularity.up.sql
+-- Distinct owners per feature, and how each file is stored
+CREATE TABLE IF NOT EXISTS feature_owners (
+  fea_hash   BYTEA       NOT NULL REFERENCES features(fea_hash) ON DELETE CASCADE,
+  owner_id   TEXT        NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (fea_hash, owner_id)
+);
+
+INSERT INTO feature_owners (fea_hash, owner_id)
+  SELECT DISTINCT f.fea_hash, f.owner_id
+    FROM files f
+    JOIN features ft ON ft.fea_hash = f.fea_hash
+  ON CONFLICT DO NOTHING;
+
+ALTER TABLE files
+  ADD COLUMN storage_mode TEXT NOT NULL DEFAULT 'dsde';
@@ -0,0 +1,4 @@
+-- 0009_codec.up.sql
+-- Compression applied to each file's contents before it was split and sealed
+ALTER TABLE files
+  ADD COLUMN codec TEXT NOT NULL DEFAULT 'none';
@@ -0,0 +1,13 @@
+-- 0010_grants.up.sql
+-- Read access to a file granted by its owner to another user
+CREATE TABLE IF NOT EXISTS file_grants (
+  file_id     UUID        NOT NULL REFERENCES files(file_id) ON DELETE CASCADE,
+  grantee_id  TEXT        NOT NULL,
+  permission  TEXT        NOT NULL DEFAULT 'read',
+  expires_at  TIMESTAMPTZ,                          -- NULL: no expiry
+  revoked_at  TIMESTAMPTZ,                          -- NULL: active
+  created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (file_id, grantee_id)
+);
+
+CREATE INDEX IF NOT EXISTS file_grants_grantee_idx ON file_grants (grantee_id);
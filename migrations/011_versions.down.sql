@@ -0,0 +1,4 @@
+DROP INDEX file_chunks_chunk_hash_idx;
+DROP INDEX files_path_version_idx;
+ALTER TABLE files
+  DROP COLUMN version;
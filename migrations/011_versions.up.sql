@@ -0,0 +1,19 @@
+-- 0011_versions.up.sql
+-- Each upload of an owner's filename (its logical path) is a new version
+ALTER TABLE files
+  ADD COLUMN version INT;
+
+UPDATE files f
+   SET version = v.n
+  FROM (SELECT file_id,
+               row_number() OVER (PARTITION BY owner_id, filename ORDER BY created_at, file_id) AS n
+          FROM files) v
+ WHERE f.file_id = v.file_id;
+
+ALTER TABLE files
+  ALTER COLUMN version SET NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS files_path_version_idx ON files (owner_id, filename, version);
+
+-- Pruning looks chunks up by hash to find those no file references any more
+CREATE INDEX IF NOT EXISTS file_chunks_chunk_hash_idx ON file_chunks (chunk_hash);
@@ -0,0 +1,8 @@
+-- 0012_folders.up.sql
+-- Folders created explicitly; a file's path also implies its parent folders
+CREATE TABLE IF NOT EXISTS folders (
+  owner_id   TEXT        NOT NULL,
+  path       TEXT        NOT NULL,
+  created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+  PRIMARY KEY (owner_id, path)
+);
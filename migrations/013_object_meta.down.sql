@@ -0,0 +1 @@
+DROP TABLE object_meta;
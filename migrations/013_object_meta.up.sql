@@ -0,0 +1,8 @@
+-- 0013_object_meta.up.sql
+-- S3 attributes of files served through the gateway
+CREATE TABLE IF NOT EXISTS object_meta (
+  file_id      UUID   PRIMARY KEY REFERENCES files(file_id) ON DELETE CASCADE,
+  size         BIGINT NOT NULL,
+  etag         TEXT   NOT NULL,
+  content_type TEXT   NOT NULL DEFAULT ''
+);
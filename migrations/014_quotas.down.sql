@@ -0,0 +1,16 @@
+DROP TRIGGER file_chunks_recharge ON file_chunks;
+DROP TRIGGER file_chunks_charge ON file_chunks;
+DROP TRIGGER chunks_usage ON chunks;
+DROP TRIGGER files_usage ON files;
+DROP FUNCTION file_chunks_recharge();
+DROP FUNCTION file_chunks_charge();
+DROP FUNCTION chunks_usage();
+DROP FUNCTION files_usage();
+DROP FUNCTION usage_add(TEXT, BIGINT, BIGINT);
+DROP TABLE owner_usage;
+DROP TABLE quotas;
+ALTER TABLE chunks
+  DROP COLUMN owner_id,
+  DROP COLUMN size;
+ALTER TABLE files
+  DROP COLUMN size;
@@ -0,0 +1,124 @@
+-- 0014_quotas.up.sql
+-- Per-owner usage, kept up to date by triggers, and optional quotas on it.
+--
+-- Logical bytes are the sizes of an owner's files as uploaded. Physical bytes
+-- are the stored blobs charged to the owner: each blob is charged to exactly
+-- one owner of a file that links it (the earliest), so the owners' physical
+-- bytes add up to what the bucket holds. A shared blob passes to the next
+-- owner when its payer stops linking it.
+ALTER TABLE files
+  ADD COLUMN size BIGINT NOT NULL DEFAULT 0;
+
+ALTER TABLE chunks
+  ADD COLUMN size     BIGINT NOT NULL DEFAULT 0,
+  ADD COLUMN owner_id TEXT;
+
+-- Blobs stored before sizes were recorded count as 0 bytes
+UPDATE files f
+   SET size = m.size
+  FROM object_meta m
+ WHERE m.file_id = f.file_id;
+
+UPDATE chunks c
+   SET owner_id = (SELECT f.owner_id
+                     FROM file_chunks fc
+                     JOIN files f ON f.file_id = fc.file_id
+                    WHERE fc.chunk_hash = c.chunk_hash
+                    ORDER BY f.created_at, f.file_id
+                    LIMIT 1);
+
+-- Limits in bytes; 0 is unlimited
+CREATE TABLE IF NOT EXISTS quotas (
+  owner_id       TEXT        PRIMARY KEY,
+  logical_bytes  BIGINT      NOT NULL DEFAULT 0,
+  physical_bytes BIGINT      NOT NULL DEFAULT 0,
+  updated_at     TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+CREATE TABLE IF NOT EXISTS owner_usage (
+  owner_id       TEXT   PRIMARY KEY,
+  logical_bytes  BIGINT NOT NULL DEFAULT 0,
+  physical_bytes BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO owner_usage (owner_id, logical_bytes, physical_bytes)
+SELECT owner_id, sum(logical), sum(physical)
+  FROM (SELECT owner_id, size AS logical, 0 AS physical FROM files
+        UNION ALL
+        SELECT owner_id, 0, size FROM chunks WHERE owner_id IS NOT NULL) u
+ GROUP BY owner_id;
+
+CREATE FUNCTION usage_add(owner TEXT, logical BIGINT, physical BIGINT) RETURNS void AS $$
+  INSERT INTO owner_usage (owner_id, logical_bytes, physical_bytes)
+  VALUES (owner, logical, physical)
+  ON CONFLICT (owner_id) DO UPDATE
+    SET logical_bytes  = owner_usage.logical_bytes + EXCLUDED.logical_bytes,
+        physical_bytes = owner_usage.physical_bytes + EXCLUDED.physical_bytes;
+$$ LANGUAGE sql;
+
+CREATE FUNCTION files_usage() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP IN ('UPDATE', 'DELETE') THEN
+    PERFORM usage_add(OLD.owner_id, -OLD.size, 0);
+  END IF;
+  IF TG_OP IN ('INSERT', 'UPDATE') THEN
+    PERFORM usage_add(NEW.owner_id, NEW.size, 0);
+  END IF;
+  RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER files_usage
+  AFTER INSERT OR DELETE OR UPDATE OF owner_id, size ON files
+  FOR EACH ROW EXECUTE FUNCTION files_usage();
+
+CREATE FUNCTION chunks_usage() RETURNS trigger AS $$
+BEGIN
+  IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.owner_id IS NOT NULL THEN
+    PERFORM usage_add(OLD.owner_id, 0, -OLD.size);
+  END IF;
+  IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.owner_id IS NOT NULL THEN
+    PERFORM usage_add(NEW.owner_id, 0, NEW.size);
+  END IF;
+  RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER chunks_usage
+  AFTER INSERT OR DELETE OR UPDATE OF owner_id, size ON chunks
+  FOR EACH ROW EXECUTE FUNCTION chunks_usage();
+
+-- An unpaid blob is charged to the owner of the first file linking it
+CREATE FUNCTION file_chunks_charge() RETURNS trigger AS $$
+BEGIN
+  UPDATE chunks c
+     SET owner_id = f.owner_id
+    FROM files f
+   WHERE c.chunk_hash = NEW.chunk_hash AND c.owner_id IS NULL AND f.file_id = NEW.file_id;
+  RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER file_chunks_charge
+  AFTER INSERT ON file_chunks
+  FOR EACH ROW EXECUTE FUNCTION file_chunks_charge();
+
+-- When the payer no longer links a blob, the next linking owner pays, or
+-- nobody until it is deleted
+CREATE FUNCTION file_chunks_recharge() RETURNS trigger AS $$
+BEGIN
+  UPDATE chunks c
+     SET owner_id = (SELECT f.owner_id
+                       FROM file_chunks fc
+                       JOIN files f ON f.file_id = fc.file_id
+                      WHERE fc.chunk_hash = c.chunk_hash
+                      ORDER BY f.created_at, f.file_id
+                      LIMIT 1)
+   WHERE c.chunk_hash = OLD.chunk_hash
+     AND NOT EXISTS (SELECT 1
+                       FROM file_chunks fc
+                       JOIN files f ON f.file_id = fc.file_id
+                      WHERE fc.chunk_hash = c.chunk_hash AND f.owner_id = c.owner_id);
+  RETURN NULL;
+END $$ LANGUAGE plpgsql;
+
+CREATE TRIGGER file_chunks_recharge
+  AFTER DELETE ON file_chunks
+  FOR EACH ROW EXECUTE FUNCTION file_chunks_recharge();
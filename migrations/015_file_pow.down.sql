@@ -0,0 +1,6 @@
+ALTER TABLE features
+  ADD COLUMN pow_root   BYTEA,
+  ADD COLUMN pow_leaves INTEGER;
+ALTER TABLE files
+  DROP COLUMN pow_root,
+  DROP COLUMN pow_leaves;
@@ -0,0 +1,14 @@
+-- 0015_file_pow.up.sql
+-- Merkle roots move from features to the files they were computed from.
+-- Distinct contents can share a feature (every file under 64 bytes does), so
+-- a proof must be checked against the very file it lets the prover clone.
+-- A feature's root cannot be traced back to one of its files, so files
+-- stored before this have none and are not eligible for proof-of-ownership
+-- dedup.
+ALTER TABLE files
+  ADD COLUMN pow_root   BYTEA,
+  ADD COLUMN pow_leaves INTEGER;
+
+ALTER TABLE features
+  DROP COLUMN pow_root,
+  DROP COLUMN pow_leaves;
@@ -0,0 +1,3 @@
+ALTER TABLE files
+  DROP COLUMN shared_suite,
+  DROP COLUMN user_suite;
@@ -0,0 +1,8 @@
+-- 0016_file_suites.up.sql
+-- The cipher suites a file's shared and user layers were sealed with. From
+-- enc_version 4 on, blobs are opened only under the suites recorded here, so
+-- a blob's own suite header is no longer trusted. 0 is unrecorded: files
+-- sealed before this name their suite in each blob.
+ALTER TABLE files
+  ADD COLUMN shared_suite SMALLINT NOT NULL DEFAULT 0,
+  ADD COLUMN user_suite   SMALLINT NOT NULL DEFAULT 0;